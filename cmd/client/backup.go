@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"e2e_chat/internal/service/app"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runBackup handles "client backup export [flags] <username> <file>" and
+// "client backup import [flags] <file>". Both work on the local storage
+// only; export with the client stopped, so its sessions are saved.
+func runBackup(a *app.App, command string, rest []string, restoreSessions bool) {
+	ctx := context.Background()
+
+	switch command {
+	case "export":
+		if len(rest) != 2 {
+			log.Fatal("Usage: go run main.go backup export [flags] <username> <file>")
+		}
+
+		// never overwrites an older backup
+		f, err := os.OpenFile(rest[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		code, err := a.ExportBackup(ctx, rest[0], f)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(rest[1])
+			log.Fatalf("export backup: %v", err)
+		}
+
+		fmt.Printf("Backup of %s written to %s.\n", rest[0], rest[1])
+		fmt.Printf("Recovery code: %s\n", code)
+		fmt.Println("Write the code down and keep it apart from the file. The backup cannot be opened without it.")
+	case "import":
+		if len(rest) != 1 {
+			log.Fatal("Usage: go run main.go backup import [flags] <file>")
+		}
+
+		f, err := os.Open(rest[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		fmt.Print("Recovery code: ")
+		code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && code == "" {
+			log.Fatalf("read recovery code: %v", err)
+		}
+
+		report, err := a.ImportBackup(ctx, f, strings.TrimSpace(code), restoreSessions)
+		if err != nil {
+			log.Fatalf("import backup: %v", err)
+		}
+
+		fmt.Printf("Restored %s from a backup of %s.\n", report.User, report.Created.Local().Format("2006-01-02 15:04"))
+		fmt.Printf("Identity: %s\n", report.Identity)
+		fmt.Printf("History: %d messages added\n", report.Messages)
+
+		peers := make([]string, 0, len(report.Sessions))
+		for peer := range report.Sessions {
+			peers = append(peers, peer)
+		}
+		sort.Strings(peers)
+		for _, peer := range peers {
+			fmt.Printf("Session with %s: %s\n", peer, report.Sessions[peer])
+		}
+	}
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"e2e_chat/internal/config"
+	"e2e_chat/internal/protocol/sealed"
 	"e2e_chat/internal/repository/user"
 	"e2e_chat/internal/service/app"
 	redisSvc "e2e_chat/internal/service/redis"
-
+	"e2e_chat/internal/storage/memory"
+	"e2e_chat/internal/utils/tlsutil"
+	"errors"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
@@ -18,46 +23,108 @@ import (
 )
 
 func main() {
-	// os.Args[0] is the program name, os.Args[1:] are arguments
-	if len(os.Args) < 2 {
-		log.Fatal("Usage: go run main.go <username>")
+	// "client config print [flags]" shows the effective config and exits,
+	// "client backup export|import [flags] ..." saves or restores the user
+	args := os.Args[1:]
+	printConfig := len(args) >= 2 && args[0] == "config" && args[1] == "print"
+	if printConfig {
+		args = args[2:]
+	}
+	backupCommand := ""
+	if len(args) >= 2 && args[0] == "backup" && (args[1] == "export" || args[1] == "import") {
+		backupCommand = args[1]
+		args = args[2:]
 	}
 
-	username := os.Args[1]
-
-	mongoDBClient, err := initMongo()
+	cfg, rest, err := config.LoadClient(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
-	db := mongoDBClient.Database("mydb")
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379", // Redis server
-		Password: "",               // no password by default
-		DB:       0,                // use default DB
-	})
+	if backupCommand != "" {
+		runBackup(newApp(cfg), backupCommand, rest, cfg.RestoreSessions)
+		return
+	}
 
-	redis := redisSvc.NewRedis(rdb)
+	if len(rest) < 1 {
+		log.Fatal("Usage: go run main.go [flags] <username>")
+	}
 
-	ctx := context.Background()
+	username := rest[0]
 
-	userRepo := user.NewUserRepo(db)
-	app := app.NewApp(userRepo, redis)
-	app.Run(ctx, username)
+	a := newApp(cfg)
+	a.SetDownloadDir(cfg.DownloadDir)
+	a.SetHistoryRetention(cfg.History.Retention, cfg.History.MaxMessages)
+
+	if cfg.TLS.Enabled {
+		tlsConfig, err := tlsutil.ClientConfig(cfg.TLS.CAFile, cfg.TLS.Pins)
+		if err != nil {
+			log.Fatalf("load TLS config: %v", err)
+		}
+		a.SetTLSConfig(tlsConfig)
+	}
+
+	if cfg.TrustRoot != "" {
+		// validated with the config
+		trustRoot, _ := sealed.ParseTrustRoot(cfg.TrustRoot)
+		a.SetTrustRoot(trustRoot)
+	}
+
+	ctx := context.Background()
+	a.Run(ctx, username)
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
 	<-done
 
-	app.Stop()
+	a.Stop()
+}
+
+// newApp opens the local storage of cfg.
+func newApp(cfg *config.Client) *app.App {
+	var a *app.App
+	switch cfg.Storage {
+	case config.StorageMemory:
+		// keys and sessions are lost when the client exits
+		a = app.NewApp(memory.NewUserStore(), memory.NewStateStore())
+	case config.StorageMongo:
+		mongoDBClient, err := initMongo(cfg.Mongo.URI)
+		if err != nil {
+			panic(err)
+		}
+
+		db := mongoDBClient.Database(cfg.Mongo.Database)
+
+		rdb := redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+
+		redis := redisSvc.NewRedis(rdb)
+
+		userRepo := user.NewLocalUserRepo(db)
+		a = app.NewApp(userRepo, redisSvc.NewStateStore(redis))
+	}
+	a.SetServerAddr(cfg.Server)
+	return a
 }
 
-func initMongo() (*mongo.Client, error) {
+func initMongo(uri string) (*mongo.Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
 		return nil, err
 	}
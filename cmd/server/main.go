@@ -2,9 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"e2e_chat/internal/config"
 	"e2e_chat/internal/repository/user"
 	redisSvc "e2e_chat/internal/service/redis"
 	"e2e_chat/internal/service/server"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/file"
+	"e2e_chat/internal/storage/memory"
+	"e2e_chat/internal/utils/tlsutil"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
 
 	"os"
 	"os/signal"
@@ -17,35 +32,245 @@ import (
 )
 
 func main() {
-	mongoDBClient, err := initMongo()
+	// "server config print [flags]" shows the effective config and exits
+	args := os.Args[1:]
+	printConfig := len(args) >= 2 && args[0] == "config" && args[1] == "print"
+	if printConfig {
+		args = args[2:]
+	}
+
+	cfg, _, err := config.LoadServer(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
-	db := mongoDBClient.Database("mydb")
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// storage connections, closed once the server has drained
+	var closers []func(ctx context.Context) error
+
+	// health of the storage backends, reported by /readyz
+	checks := make(map[string]func(ctx context.Context) error)
+
+	// rate limit buckets, shared between nodes when in Redis
+	var limiter storage.RateLimiter = memory.NewRateLimiter()
+
+	var c *server.HttpServer
+	switch cfg.Storage {
+	case config.StorageMemory:
+		c = server.NewHttpServer(
+			memory.NewUserStore(),
+			memory.NewMessageQueue(cfg.Queue.MaxLen, cfg.Queue.Retention),
+			memory.NewStateStore(),
+			memory.NewBroker(),
+		)
+	case config.StorageFile:
+		db, err := file.Open(filepath.Join(cfg.DataDir, "e2e_chat.log"))
+		if err != nil {
+			log.Fatalf("open data file: %v", err)
+		}
+		closers = append(closers, func(context.Context) error {
+			return db.Close()
+		})
+		checks["file"] = func(context.Context) error {
+			return db.Ping()
+		}
+
+		c = server.NewHttpServer(
+			file.NewUserStore(db),
+			file.NewMessageQueue(db, cfg.Queue.MaxLen, cfg.Queue.Retention),
+			file.NewStateStore(db),
+			memory.NewBroker(),
+		)
+	case config.StorageMongo:
+		mongoDBClient, err := initMongo(cfg.Mongo.URI)
+		if err != nil {
+			panic(err)
+		}
+
+		db := mongoDBClient.Database(cfg.Mongo.Database)
+
+		rdb := redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+
+		redis := redisSvc.NewRedis(rdb)
+		closers = append(closers, mongoDBClient.Disconnect, func(context.Context) error {
+			return rdb.Close()
+		})
+		checks["mongo"] = func(ctx context.Context) error {
+			return mongoDBClient.Ping(ctx, nil)
+		}
+		checks["redis"] = func(ctx context.Context) error {
+			return rdb.Ping(ctx).Err()
+		}
+
+		userRepo := user.NewUserRepo(db)
+		c = server.NewHttpServer(
+			userRepo,
+			redisSvc.NewMessageQueue(redis, int64(cfg.Queue.MaxLen), cfg.Queue.Retention),
+			redisSvc.NewStateStore(redis),
+			redis,
+		)
+		limiter = redis
+	}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379", // Redis server
-		Password: "",               // no password by default
-		DB:       0,                // use default DB
+	c.SetAddr(cfg.Listen)
+	if cfg.NodeID != "" {
+		c.SetNodeID(cfg.NodeID)
+	}
+	c.SetAdmins(cfg.Admins...)
+	c.SetMaxFrameSize(int64(cfg.MaxFrameSize))
+	c.SetRateLimits(limiter, server.RateLimits{
+		Messages:    server.Limit{Rate: cfg.RateLimit.Messages, Burst: cfg.RateLimit.MessagesBurst},
+		KeyFetches:  server.Limit{Rate: cfg.RateLimit.KeyFetches, Burst: cfg.RateLimit.KeyFetchesBurst},
+		Connections: server.Limit{Rate: cfg.RateLimit.Connections, Burst: cfg.RateLimit.ConnectionsBurst},
 	})
+	for name, fn := range checks {
+		c.AddReadinessCheck(name, fn)
+	}
 
-	redis := redisSvc.NewRedis(rdb)
+	var blobs storage.BlobStore = memory.NewBlobStore()
+	if cfg.Storage != config.StorageMemory || cfg.Attachments.Dir != "" {
+		dir := cfg.Attachments.Dir
+		if dir == "" {
+			dir = filepath.Join(cfg.DataDir, "attachments")
+		}
+		if blobs, err = file.NewBlobStore(dir); err != nil {
+			log.Fatalf("open attachment store: %v", err)
+		}
+	}
+	c.SetBlobStore(blobs, int64(cfg.Attachments.MaxSize), cfg.Attachments.Retention)
 
-	userRepo := user.NewUserRepo(db)
-	c := server.NewHttpServer(userRepo, redis)
-	c.Run()
+	certKeyFile := cfg.CertificateKey
+	if certKeyFile == "" && cfg.Storage != config.StorageMemory {
+		certKeyFile = filepath.Join(cfg.DataDir, "certificate_key.pem")
+	}
+	if certKeyFile != "" {
+		certKey, err := tlsutil.LoadOrCreateEd25519(certKeyFile)
+		if err != nil {
+			log.Fatalf("load certificate key: %v", err)
+		}
+		c.SetCertificateKey(certKey)
+	}
+	log.Printf("sender certificate trust root: %s", c.CertificateTrustRoot())
+
+	switch {
+	case cfg.TokenSecret != "":
+		secret, err := base64.StdEncoding.DecodeString(cfg.TokenSecret)
+		if err != nil {
+			log.Fatalf("decode token secret: %v", err)
+		}
+		c.SetTokenSecret(secret)
+	case cfg.Storage == config.StorageFile:
+		secret, err := loadOrCreateTokenSecret(filepath.Join(cfg.DataDir, "token_secret"))
+		if err != nil {
+			log.Fatalf("load token secret: %v", err)
+		}
+		c.SetTokenSecret(secret)
+	}
+
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := serverTLS(&cfg.TLS)
+		if err != nil {
+			log.Fatalf("load TLS certificate: %v", err)
+		}
+		c.SetTLSConfig(tlsConfig)
+	}
+
+	if err := c.Start(context.Background()); err != nil {
+		log.Fatalf("start server: %v", err)
+	}
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
 	<-done
+
+	log.Printf("shutting down, draining connections for up to %s", cfg.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := c.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+
+	// storage gets a fresh deadline even if draining used up the old one
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelClose()
+
+	for _, close := range closers {
+		if err := close(closeCtx); err != nil {
+			log.Printf("close storage: %v", err)
+		}
+	}
+}
+
+func serverTLS(cfg *config.TLS) (*tls.Config, error) {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+	if cfg.SelfSigned {
+		cert, err = tlsutil.LoadOrCreateSelfSigned(cfg.CertFile, cfg.KeyFile, cfg.Hosts)
+	} else {
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pin, err := tlsutil.LeafPin(&cert)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("TLS certificate pin: %s", pin)
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// loadOrCreateTokenSecret reads the base64 token secret at path, writing a
+// random one first if the file is missing.
+func loadOrCreateTokenSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(secret) < config.MinTokenSecretSize {
+			return nil, fmt.Errorf("%s: not base64 of at least %d bytes", path, config.MinTokenSecretSize)
+		}
+		return secret, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	secret := make([]byte, config.MinTokenSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	return secret, os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(secret)+"\n"), 0o600)
 }
 
-func initMongo() (*mongo.Client, error) {
+func initMongo(uri string) (*mongo.Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
 		return nil, err
 	}
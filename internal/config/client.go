@@ -0,0 +1,130 @@
+package config
+
+import (
+	"e2e_chat/internal/protocol/sealed"
+	"e2e_chat/internal/utils/tlsutil"
+	"io"
+	"time"
+)
+
+type (
+	Client struct {
+		Server  string    `yaml:"server" toml:"server" env:"E2E_SERVER" flag:"server" help:"chat server host:port"`
+		Storage string    `yaml:"storage" toml:"storage" env:"E2E_STORAGE" flag:"storage" help:"local storage backend: mongo (with Redis) or memory"`
+		Mongo   Mongo     `yaml:"mongo" toml:"mongo"`
+		Redis   Redis     `yaml:"redis" toml:"redis"`
+		TLS     ClientTLS `yaml:"tls" toml:"tls"`
+		History History   `yaml:"history" toml:"history"`
+
+		DownloadDir string `yaml:"download_dir" toml:"download_dir" env:"E2E_DOWNLOAD_DIR" flag:"download-dir" help:"directory received attachments are saved in"`
+
+		TrustRoot string `yaml:"trust_root" toml:"trust_root" env:"E2E_TRUST_ROOT" flag:"trust-root" help:"ed25519/<base64> key the server signs sender certificates with, as logged at server start; trusted on first use when empty"`
+
+		RestoreSessions bool `yaml:"restore_sessions" toml:"restore_sessions" env:"E2E_RESTORE_SESSIONS" flag:"restore-sessions" help:"backup import: restore ratchet sessions from a backup under 2 hours old instead of starting new ones; repeats message keys if the sessions were used after the export"`
+	}
+
+	// ClientTLS switches the client to https/wss. Pins are checked on top of
+	// normal chain verification, so a certificate from a rogue CA is rejected.
+	ClientTLS struct {
+		Enabled bool     `yaml:"enabled" toml:"enabled" env:"E2E_TLS" flag:"tls" help:"connect with https and wss"`
+		CAFile  string   `yaml:"ca_file" toml:"ca_file" env:"E2E_TLS_CA_FILE" flag:"tls-ca" help:"extra PEM root certificates, e.g. the server's self-signed one"`
+		Pins    []string `yaml:"pins" toml:"pins" env:"E2E_TLS_PINS" flag:"tls-pins" help:"comma separated sha256/<base64> SPKI pins, one must match the server chain"`
+	}
+
+	// History bounds the encrypted local message history. Zero keeps
+	// messages until they are deleted by a disappearing messages timer.
+	History struct {
+		Retention   time.Duration `yaml:"retention" toml:"retention" env:"E2E_HISTORY_RETENTION" flag:"history-retention" help:"how long messages are kept in the local history, 0 for ever"`
+		MaxMessages int           `yaml:"max_messages" toml:"max_messages" env:"E2E_HISTORY_MAX_MESSAGES" flag:"history-max-messages" help:"max messages kept per conversation, 0 for no limit"`
+	}
+)
+
+func DefaultClient() *Client {
+	// the client keeps private keys and sessions, so by default it does not
+	// share a database with a server running on the same Mongo and Redis
+	mongo := defaultMongo()
+	mongo.Database = "e2e_client"
+	redis := defaultRedis()
+	redis.DB = 1
+
+	return &Client{
+		Server:      "localhost:9090",
+		Storage:     StorageMongo,
+		Mongo:       mongo,
+		Redis:       redis,
+		DownloadDir: "downloads",
+	}
+}
+
+// LoadClient returns the effective client config for the given command line
+// arguments (without the program name) and the positional arguments left over.
+func LoadClient(args []string) (*Client, []string, error) {
+	cfg := DefaultClient()
+
+	var errs ValidationError
+	rest, err := load(cfg, "client", args, &errs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg.validate(&errs)
+	if err := errs.err(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, rest, nil
+}
+
+func (c *Client) Validate() error {
+	var errs ValidationError
+	c.validate(&errs)
+	return errs.err()
+}
+
+func (c *Client) validate(errs *ValidationError) {
+	validateHostPort(errs, "server", c.Server)
+
+	switch c.Storage {
+	case StorageMongo:
+		c.Mongo.validate(errs)
+		c.Redis.validate(errs)
+	case StorageMemory:
+	default:
+		errs.add("storage", "must be %s or %s, got %q", StorageMongo, StorageMemory, c.Storage)
+	}
+
+	c.TLS.validate(errs)
+
+	if c.History.Retention < 0 {
+		errs.add("history.retention", "must not be negative, got %s", c.History.Retention)
+	}
+	if c.History.MaxMessages < 0 {
+		errs.add("history.max_messages", "must not be negative, got %d", c.History.MaxMessages)
+	}
+
+	if c.DownloadDir == "" {
+		errs.add("download_dir", "required")
+	}
+
+	if c.TrustRoot != "" {
+		if _, err := sealed.ParseTrustRoot(c.TrustRoot); err != nil {
+			errs.add("trust_root", "%v", err)
+		}
+	}
+}
+
+func (t *ClientTLS) validate(errs *ValidationError) {
+	if !t.Enabled && (t.CAFile != "" || len(t.Pins) > 0) {
+		errs.add("tls.enabled", "must be set to use ca_file or pins")
+	}
+
+	for _, pin := range t.Pins {
+		if _, err := tlsutil.ParsePin(pin); err != nil {
+			errs.add("tls.pins", "%q: %v", pin, err)
+		}
+	}
+}
+
+// Print writes the config as YAML with secrets masked.
+func (c *Client) Print(w io.Writer) error {
+	return write(w, c)
+}
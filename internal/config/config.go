@@ -0,0 +1,272 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ConfigEnv names the config file when --config is not given.
+	ConfigEnv = "E2E_CONFIG"
+
+	redacted = "<redacted>"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+type (
+	// ValidationError lists every bad field of a config, one "path: problem"
+	// entry each.
+	ValidationError []string
+
+	// field is a leaf of a config struct. Its sources are declared with struct
+	// tags: yaml/toml (the yaml name is also the path in errors), env, flag,
+	// help and secret.
+	field struct {
+		path   string
+		env    string
+		flag   string
+		help   string
+		secret bool
+		value  reflect.Value
+	}
+
+	// flagValue records the raw flag text; it is applied after the file and
+	// environment so that flags win.
+	flagValue struct {
+		text   string
+		isBool bool
+	}
+)
+
+func (v *flagValue) String() string {
+	return v.text
+}
+
+func (v *flagValue) Set(s string) error {
+	v.text = s
+	return nil
+}
+
+// IsBoolFlag lets bool fields be given as a bare --flag.
+func (v *flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+func (e ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+func (e *ValidationError) add(path, format string, args ...any) {
+	*e = append(*e, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (e ValidationError) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// load fills cfg, which already holds the defaults, from a config file, then
+// E2E_* environment variables, then command line flags; later sources win.
+// Values that fail to parse are added to errs so they are reported together
+// with the validation errors. It returns the positional arguments left after
+// the flags.
+func load(cfg any, name string, args []string, errs *ValidationError) ([]string, error) {
+	fields := fieldsOf(reflect.ValueOf(cfg).Elem(), "")
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(ConfigEnv), "YAML or TOML config file (env "+ConfigEnv+")")
+
+	flags := make(map[string]*flagValue)
+	for _, f := range fields {
+		if f.flag == "" {
+			continue
+		}
+		v := &flagValue{isBool: f.value.Kind() == reflect.Bool}
+		fs.Var(v, f.flag, fmt.Sprintf("%s (env %s, config %s)", f.help, f.env, f.path))
+		flags[f.flag] = v
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		if err := decodeFile(*configPath, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range fields {
+		if s, ok := os.LookupEnv(f.env); ok && f.env != "" {
+			if err := setValue(f.value, s); err != nil {
+				errs.add(f.path, "%s: %v", f.env, err)
+			}
+		}
+	}
+
+	fs.Visit(func(fl *flag.Flag) {
+		v, ok := flags[fl.Name]
+		if !ok {
+			return
+		}
+		for _, f := range fields {
+			if f.flag != fl.Name {
+				continue
+			}
+			if err := setValue(f.value, v.text); err != nil {
+				errs.add(f.path, "--%s: %v", f.flag, err)
+			}
+		}
+	})
+
+	return fs.Args(), nil
+}
+
+func decodeFile(path string, cfg any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown field %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("%s: unsupported config format, want .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+func fieldsOf(v reflect.Value, prefix string) []field {
+	var fields []field
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		path := prefix + name
+		if sf.Type.Kind() == reflect.Struct && sf.Type != durationType {
+			fields = append(fields, fieldsOf(v.Field(i), path+".")...)
+			continue
+		}
+
+		fields = append(fields, field{
+			path:   path,
+			env:    sf.Tag.Get("env"),
+			flag:   sf.Tag.Get("flag"),
+			help:   sf.Tag.Get("help"),
+			secret: sf.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fields
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("not an integer: %q", s)
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", s)
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("not a boolean: %q", s)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// write prints cfg as YAML with secrets masked.
+func write(w io.Writer, cfg any) error {
+	masked := reflect.New(reflect.TypeOf(cfg).Elem())
+	masked.Elem().Set(reflect.ValueOf(cfg).Elem())
+
+	for _, f := range fieldsOf(masked.Elem(), "") {
+		if f.secret && f.value.Kind() == reflect.String && f.value.String() != "" {
+			f.value.SetString(mask(f.value.String()))
+		}
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(masked.Interface()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// mask hides a secret. URIs keep everything but the password so it is still
+// clear where they point.
+func mask(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" && u.Host != "" {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+		if u.User == nil {
+			return s
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadServerDefaults(t *testing.T) {
+	t.Setenv(ConfigEnv, "")
+
+	// mongo is the default storage, which needs a token secret
+	if _, _, err := LoadServer(nil); err == nil || !strings.Contains(err.Error(), "token_secret") {
+		t.Fatalf("got %v, want a token_secret error", err)
+	}
+
+	t.Setenv("E2E_STORAGE", StorageMemory)
+	cfg, rest, err := LoadServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("rest %q", rest)
+	}
+	if cfg.Listen != "localhost:9090" || cfg.Queue.MaxLen != DefaultServer().Queue.MaxLen {
+		t.Fatalf("defaults not applied: %+v", cfg)
+	}
+}
+
+func TestLoadServerPrecedence(t *testing.T) {
+	path := writeConfig(t, "server.yaml", `
+listen: file:1
+storage: memory
+node_id: from-file
+queue:
+  max_len: 10
+  retention: 1h
+redis:
+  addr: file:6379
+`)
+	t.Setenv(ConfigEnv, path)
+	t.Setenv("E2E_LISTEN", "env:2")
+	t.Setenv("E2E_QUEUE_MAX_LEN", "20")
+
+	cfg, rest, err := LoadServer([]string{"--listen", "flag:3", "--admins", "root, ops", "print"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != "flag:3" {
+		t.Errorf("listen %q, want the flag", cfg.Listen)
+	}
+	if cfg.Queue.MaxLen != 20 {
+		t.Errorf("queue.max_len %d, want the env value", cfg.Queue.MaxLen)
+	}
+	if cfg.NodeID != "from-file" || cfg.Queue.Retention != time.Hour || cfg.Redis.Addr != "file:6379" {
+		t.Errorf("file values not applied: %+v", cfg)
+	}
+	if cfg.Mongo.Database != "mydb" {
+		t.Errorf("default dropped: mongo.database %q", cfg.Mongo.Database)
+	}
+	if !slices.Equal(cfg.Admins, []string{"root", "ops"}) {
+		t.Errorf("admins %q", cfg.Admins)
+	}
+	if !slices.Equal(rest, []string{"print"}) {
+		t.Errorf("rest %q", rest)
+	}
+}
+
+func TestLoadServerTOML(t *testing.T) {
+	path := writeConfig(t, "server.toml", `
+listen = "toml:1"
+storage = "file"
+data_dir = "/var/lib/e2e"
+
+[rate_limit]
+messages = 2.5
+messages_burst = 5
+`)
+	t.Setenv(ConfigEnv, "")
+
+	cfg, _, err := LoadServer([]string{"--config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != "toml:1" || cfg.DataDir != "/var/lib/e2e" || cfg.RateLimit.Messages != 2.5 || cfg.RateLimit.MessagesBurst != 5 {
+		t.Fatalf("got %+v", cfg)
+	}
+}
+
+func TestLoadServerBadFile(t *testing.T) {
+	t.Setenv(ConfigEnv, "")
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{"unknown yaml field", "server.yaml", "listne: x:1\n", "listne"},
+		{"unknown toml field", "server.toml", "listne = \"x:1\"\n", "listne"},
+		{"unsupported format", "server.json", "{}", "unsupported config format"},
+		{"bad yaml", "server.yml", "listen: [\n", "server.yml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.file, tt.content)
+			_, _, err := LoadServer([]string{"--config", path})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error mentioning %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, _, err := LoadServer([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Fatal("missing config file accepted")
+	}
+}
+
+func TestLoadServerListsEveryError(t *testing.T) {
+	t.Setenv(ConfigEnv, "")
+	t.Setenv("E2E_QUEUE_MAX_LEN", "many")
+
+	_, _, err := LoadServer([]string{
+		"--listen", "no port",
+		"--storage", "tape",
+		"--shutdown-timeout", "soon",
+	})
+
+	verr, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("got %T %v, want a ValidationError", err, err)
+	}
+	for _, path := range []string{"listen", "storage", "queue.max_len", "shutdown_timeout"} {
+		found := slices.ContainsFunc(verr, func(e string) bool {
+			return strings.HasPrefix(e, path+":")
+		})
+		if !found {
+			t.Errorf("no error for %s in:\n%v", path, err)
+		}
+	}
+}
+
+func TestLoadClient(t *testing.T) {
+	t.Setenv(ConfigEnv, "")
+	t.Setenv("E2E_SERVER", "env:9090")
+	t.Setenv("E2E_STORAGE", StorageMemory)
+
+	cfg, rest, err := LoadClient([]string{"--history-max-messages", "50", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server != "env:9090" || cfg.History.MaxMessages != 50 || cfg.DownloadDir != "downloads" {
+		t.Fatalf("got %+v", cfg)
+	}
+	if !slices.Equal(rest, []string{"alice"}) {
+		t.Fatalf("rest %q", rest)
+	}
+
+	server := DefaultServer()
+	if cfg.Mongo.Database == server.Mongo.Database || cfg.Redis.DB == server.Redis.DB {
+		t.Fatalf("client shares the server's database: mongo %q, redis %d", cfg.Mongo.Database, cfg.Redis.DB)
+	}
+
+	if _, _, err := LoadClient([]string{"--storage", "file"}); err == nil || !strings.Contains(err.Error(), "storage") {
+		t.Fatalf("file storage on the client: got %v", err)
+	}
+	if _, _, err := LoadClient([]string{"--tls-pins", "sha256/AAAA"}); err == nil || !strings.Contains(err.Error(), "tls.enabled") {
+		t.Fatalf("pins without tls: got %v", err)
+	}
+}
+
+func TestLoadClientTrustRoot(t *testing.T) {
+	t.Setenv(ConfigEnv, "")
+	t.Setenv("E2E_STORAGE", StorageMemory)
+
+	root := "ed25519/" + strings.Repeat("A", 43) + "="
+	cfg, _, err := LoadClient([]string{"--trust-root", root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TrustRoot != root {
+		t.Fatalf("trust root %q", cfg.TrustRoot)
+	}
+
+	for _, bad := range []string{"AAAA", "ed25519/AAAA", "x25519/" + strings.Repeat("A", 43) + "="} {
+		if _, _, err := LoadClient([]string{"--trust-root", bad}); err == nil || !strings.Contains(err.Error(), "trust_root") {
+			t.Errorf("trust root %q: got %v", bad, err)
+		}
+	}
+}
+
+func TestLoadClientHistory(t *testing.T) {
+	t.Setenv(ConfigEnv, "")
+	t.Setenv("E2E_STORAGE", StorageMemory)
+	t.Setenv("E2E_HISTORY_RETENTION", "720h")
+
+	cfg, _, err := LoadClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.History.Retention != 720*time.Hour || cfg.History.MaxMessages != 0 {
+		t.Fatalf("got %+v", cfg.History)
+	}
+
+	for _, args := range [][]string{{"--history-retention", "-1h"}, {"--history-max-messages", "-1"}} {
+		if _, _, err := LoadClient(args); err == nil || !strings.Contains(err.Error(), "history.") {
+			t.Errorf("%q: got %v", args, err)
+		}
+	}
+}
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"mongodb://user:hunter2@db:27017/app", "mongodb://user:xxxxx@db:27017/app"},
+		{"mongodb://db:27017", "mongodb://db:27017"},
+		{"hunter2", redacted},
+	}
+
+	for _, tt := range tests {
+		if got := mask(tt.in); got != tt.want {
+			t.Errorf("mask(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
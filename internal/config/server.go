@@ -0,0 +1,280 @@
+package config
+
+import (
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	StorageMongo  = "mongo"
+	StorageFile   = "file"
+	StorageMemory = "memory"
+
+	MinTokenSecretSize = 32
+)
+
+type (
+	Server struct {
+		Listen  string   `yaml:"listen" toml:"listen" env:"E2E_LISTEN" flag:"listen" help:"address to serve HTTP and websockets on"`
+		NodeID  string   `yaml:"node_id" toml:"node_id" env:"E2E_NODE_ID" flag:"node-id" help:"stable node ID for routing, random when empty"`
+		Admins  []string `yaml:"admins" toml:"admins" env:"E2E_ADMINS" flag:"admins" help:"comma separated users granted the admin scope"`
+		Storage string   `yaml:"storage" toml:"storage" env:"E2E_STORAGE" flag:"storage" help:"storage backend: mongo (with Redis), file or memory"`
+		DataDir string   `yaml:"data_dir" toml:"data_dir" env:"E2E_DATA_DIR" flag:"data-dir" help:"directory for the file storage backend"`
+		Mongo   Mongo    `yaml:"mongo" toml:"mongo"`
+		Redis   Redis    `yaml:"redis" toml:"redis"`
+		Queue   Queue    `yaml:"queue" toml:"queue"`
+		TLS     TLS      `yaml:"tls" toml:"tls"`
+
+		Attachments Attachments `yaml:"attachments" toml:"attachments"`
+
+		CertificateKey string `yaml:"certificate_key" toml:"certificate_key" env:"E2E_CERTIFICATE_KEY" flag:"certificate-key" help:"PEM Ed25519 key signing sender certificates, created if missing; defaults to <data_dir>/certificate_key.pem, or a key kept in memory with memory storage"`
+		TokenSecret    string `yaml:"token_secret" toml:"token_secret" env:"E2E_TOKEN_SECRET" flag:"token-secret" help:"base64 key of at least 32 bytes signing access tokens, the same on every node; required with mongo storage, kept in <data_dir>/token_secret with file storage and in memory with memory storage when empty" secret:"true"`
+
+		RateLimit    RateLimit `yaml:"rate_limit" toml:"rate_limit"`
+		MaxFrameSize int       `yaml:"max_frame_size" toml:"max_frame_size" env:"E2E_MAX_FRAME_SIZE" flag:"max-frame-size" help:"max bytes of a websocket frame from a client"`
+
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"E2E_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" help:"how long to drain connections before exiting"`
+	}
+
+	Mongo struct {
+		URI      string `yaml:"uri" toml:"uri" env:"E2E_MONGO_URI" flag:"mongo-uri" help:"MongoDB connection URI" secret:"true"`
+		Database string `yaml:"database" toml:"database" env:"E2E_MONGO_DATABASE" flag:"mongo-database" help:"MongoDB database name"`
+	}
+
+	Redis struct {
+		Addr     string `yaml:"addr" toml:"addr" env:"E2E_REDIS_ADDR" flag:"redis-addr" help:"Redis host:port"`
+		Password string `yaml:"password" toml:"password" env:"E2E_REDIS_PASSWORD" flag:"redis-password" help:"Redis password" secret:"true"`
+		DB       int    `yaml:"db" toml:"db" env:"E2E_REDIS_DB" flag:"redis-db" help:"Redis database number"`
+	}
+
+	// TLS is enabled when a certificate is configured or self_signed is set.
+	// With self_signed, missing cert/key files are generated and written to
+	// the given paths, or kept in memory when no paths are set.
+	TLS struct {
+		CertFile   string   `yaml:"cert_file" toml:"cert_file" env:"E2E_TLS_CERT_FILE" flag:"tls-cert" help:"PEM certificate file"`
+		KeyFile    string   `yaml:"key_file" toml:"key_file" env:"E2E_TLS_KEY_FILE" flag:"tls-key" help:"PEM private key file"`
+		SelfSigned bool     `yaml:"self_signed" toml:"self_signed" env:"E2E_TLS_SELF_SIGNED" flag:"tls-self-signed" help:"generate a self-signed certificate for development"`
+		Hosts      []string `yaml:"hosts" toml:"hosts" env:"E2E_TLS_HOSTS" flag:"tls-hosts" help:"comma separated names and IPs of the self-signed certificate"`
+	}
+
+	// RateLimit sets token bucket budgets: a steady rate per second and a
+	// burst. A zero rate disables the budget.
+	RateLimit struct {
+		Messages         float64 `yaml:"messages" toml:"messages" env:"E2E_RATE_LIMIT_MESSAGES" flag:"rate-limit-messages" help:"messages per second per user"`
+		MessagesBurst    int     `yaml:"messages_burst" toml:"messages_burst" env:"E2E_RATE_LIMIT_MESSAGES_BURST" flag:"rate-limit-messages-burst" help:"message burst per user"`
+		KeyFetches       float64 `yaml:"key_fetches" toml:"key_fetches" env:"E2E_RATE_LIMIT_KEY_FETCHES" flag:"rate-limit-key-fetches" help:"key fetches per second per user and per IP"`
+		KeyFetchesBurst  int     `yaml:"key_fetches_burst" toml:"key_fetches_burst" env:"E2E_RATE_LIMIT_KEY_FETCHES_BURST" flag:"rate-limit-key-fetches-burst" help:"key fetch burst per user and per IP"`
+		Connections      float64 `yaml:"connections" toml:"connections" env:"E2E_RATE_LIMIT_CONNECTIONS" flag:"rate-limit-connections" help:"connection attempts (challenges, logins, websockets) per second per IP"`
+		ConnectionsBurst int     `yaml:"connections_burst" toml:"connections_burst" env:"E2E_RATE_LIMIT_CONNECTIONS_BURST" flag:"rate-limit-connections-burst" help:"connection attempt burst per IP"`
+	}
+
+	// Attachments configures the encrypted blob store. Blobs are kept on
+	// local disk, or in memory with memory storage and no dir.
+	Attachments struct {
+		Dir       string        `yaml:"dir" toml:"dir" env:"E2E_ATTACHMENTS_DIR" flag:"attachments-dir" help:"directory for attachment blobs; defaults to <data_dir>/attachments, or memory with memory storage"`
+		MaxSize   int           `yaml:"max_size" toml:"max_size" env:"E2E_ATTACHMENTS_MAX_SIZE" flag:"attachments-max-size" help:"max bytes of one encrypted attachment"`
+		Retention time.Duration `yaml:"retention" toml:"retention" env:"E2E_ATTACHMENTS_RETENTION" flag:"attachments-retention" help:"how long attachments are kept after upload"`
+	}
+
+	// Queue bounds each user's offline queue.
+	Queue struct {
+		MaxLen    int           `yaml:"max_len" toml:"max_len" env:"E2E_QUEUE_MAX_LEN" flag:"queue-max-len" help:"max queued messages per user"`
+		Retention time.Duration `yaml:"retention" toml:"retention" env:"E2E_QUEUE_RETENTION" flag:"queue-retention" help:"how long undelivered messages are kept"`
+	}
+)
+
+func DefaultServer() *Server {
+	return &Server{
+		Listen:  "localhost:9090",
+		Storage: StorageMongo,
+		DataDir: "./data",
+		Mongo:   defaultMongo(),
+		Redis:   defaultRedis(),
+		Queue: Queue{
+			MaxLen:    storage.DefaultQueueMaxLen,
+			Retention: storage.DefaultQueueRetention,
+		},
+		TLS: TLS{
+			Hosts: []string{"localhost", "127.0.0.1", "::1"},
+		},
+		Attachments: Attachments{
+			MaxSize:   storage.DefaultAttachmentMaxSize,
+			Retention: storage.DefaultQueueRetention,
+		},
+		RateLimit: RateLimit{
+			Messages:         5,
+			MessagesBurst:    20,
+			KeyFetches:       1,
+			KeyFetchesBurst:  10,
+			Connections:      1,
+			ConnectionsBurst: 20,
+		},
+		MaxFrameSize:    model.DefaultMaxFrameSize,
+		ShutdownTimeout: 15 * time.Second,
+	}
+}
+
+func defaultMongo() Mongo {
+	return Mongo{
+		URI:      "mongodb://localhost:27017",
+		Database: "mydb",
+	}
+}
+
+func defaultRedis() Redis {
+	return Redis{
+		Addr: "localhost:6379",
+	}
+}
+
+// LoadServer returns the effective server config for the given command line
+// arguments (without the program name) and the positional arguments left over.
+func LoadServer(args []string) (*Server, []string, error) {
+	cfg := DefaultServer()
+
+	var errs ValidationError
+	rest, err := load(cfg, "server", args, &errs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg.validate(&errs)
+	if err := errs.err(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, rest, nil
+}
+
+func (c *Server) Validate() error {
+	var errs ValidationError
+	c.validate(&errs)
+	return errs.err()
+}
+
+func (c *Server) validate(errs *ValidationError) {
+	validateHostPort(errs, "listen", c.Listen)
+
+	for _, name := range c.Admins {
+		if name == "" {
+			errs.add("admins", "empty user name")
+		}
+	}
+
+	switch c.Storage {
+	case StorageMongo:
+		c.Mongo.validate(errs)
+		c.Redis.validate(errs)
+	case StorageFile:
+		if c.DataDir == "" {
+			errs.add("data_dir", "required for file storage")
+		}
+	case StorageMemory:
+	default:
+		errs.add("storage", "must be %s, %s or %s, got %q", StorageMongo, StorageFile, StorageMemory, c.Storage)
+	}
+
+	if c.TokenSecret != "" {
+		if secret, err := base64.StdEncoding.DecodeString(c.TokenSecret); err != nil || len(secret) < MinTokenSecretSize {
+			errs.add("token_secret", "must be base64 of at least %d bytes", MinTokenSecretSize)
+		}
+	} else if c.Storage == StorageMongo {
+		errs.add("token_secret", "required with mongo storage, so every node accepts the same tokens")
+	}
+
+	if c.Queue.MaxLen <= 0 {
+		errs.add("queue.max_len", "must be positive, got %d", c.Queue.MaxLen)
+	}
+	if c.Queue.Retention <= 0 {
+		errs.add("queue.retention", "must be positive, got %s", c.Queue.Retention)
+	}
+
+	c.TLS.validate(errs)
+	c.RateLimit.validate(errs)
+
+	if c.Attachments.MaxSize <= 0 {
+		errs.add("attachments.max_size", "must be positive, got %d", c.Attachments.MaxSize)
+	}
+	if c.Attachments.Retention <= 0 {
+		errs.add("attachments.retention", "must be positive, got %s", c.Attachments.Retention)
+	}
+
+	if c.MaxFrameSize <= 0 {
+		errs.add("max_frame_size", "must be positive, got %d", c.MaxFrameSize)
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		errs.add("shutdown_timeout", "must be positive, got %s", c.ShutdownTimeout)
+	}
+}
+
+// Print writes the config as YAML with secrets masked.
+func (c *Server) Print(w io.Writer) error {
+	return write(w, c)
+}
+
+// Enabled reports whether the server serves HTTPS.
+func (t *TLS) Enabled() bool {
+	return t.SelfSigned || t.CertFile != "" || t.KeyFile != ""
+}
+
+func (t *TLS) validate(errs *ValidationError) {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs.add("tls", "cert_file and key_file must be set together")
+	}
+
+	if !t.SelfSigned {
+		return
+	}
+
+	if len(t.Hosts) == 0 {
+		errs.add("tls.hosts", "required for self-signed certificates")
+	}
+	for _, h := range t.Hosts {
+		if h == "" {
+			errs.add("tls.hosts", "empty host name")
+		}
+	}
+}
+
+func (r *RateLimit) validate(errs *ValidationError) {
+	validateBudget(errs, "rate_limit.messages", r.Messages, r.MessagesBurst)
+	validateBudget(errs, "rate_limit.key_fetches", r.KeyFetches, r.KeyFetchesBurst)
+	validateBudget(errs, "rate_limit.connections", r.Connections, r.ConnectionsBurst)
+}
+
+func validateBudget(errs *ValidationError, path string, rate float64, burst int) {
+	if rate < 0 {
+		errs.add(path, "must not be negative, got %g", rate)
+	}
+	if rate > 0 && burst < 1 {
+		errs.add(path+"_burst", "must be at least 1, got %d", burst)
+	}
+}
+
+func (m *Mongo) validate(errs *ValidationError) {
+	u, err := url.Parse(m.URI)
+	if err != nil || (u.Scheme != "mongodb" && u.Scheme != "mongodb+srv") || u.Host == "" {
+		errs.add("mongo.uri", "must be a mongodb:// or mongodb+srv:// URI")
+	}
+	if m.Database == "" {
+		errs.add("mongo.database", "required")
+	}
+}
+
+func (r *Redis) validate(errs *ValidationError) {
+	validateHostPort(errs, "redis.addr", r.Addr)
+	if r.DB < 0 {
+		errs.add("redis.db", "must not be negative, got %d", r.DB)
+	}
+}
+
+func validateHostPort(errs *ValidationError, path, addr string) {
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		errs.add(path, "must be host:port, got %q", addr)
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestServerTokenSecret(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(make([]byte, MinTokenSecretSize))
+	short := base64.StdEncoding.EncodeToString(make([]byte, MinTokenSecretSize-1))
+
+	tests := []struct {
+		name    string
+		storage string
+		secret  string
+		valid   bool
+	}{
+		{"mongo with secret", StorageMongo, secret, true},
+		{"mongo without secret", StorageMongo, "", false},
+		{"file without secret", StorageFile, "", true},
+		{"memory without secret", StorageMemory, "", true},
+		{"too short", StorageMemory, short, false},
+		{"not base64", StorageMemory, "not base64!", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultServer()
+			cfg.Storage = tt.storage
+			cfg.TokenSecret = tt.secret
+
+			err := cfg.Validate()
+			if tt.valid && err != nil {
+				t.Fatalf("got %v", err)
+			}
+			if !tt.valid && (err == nil || !strings.Contains(err.Error(), "token_secret")) {
+				t.Fatalf("got %v, want a token_secret error", err)
+			}
+		})
+	}
+}
+
+func TestServerPrintMasksTokenSecret(t *testing.T) {
+	cfg := DefaultServer()
+	cfg.TokenSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	var b strings.Builder
+	if err := cfg.Print(&b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), cfg.TokenSecret) {
+		t.Fatalf("secret printed:\n%s", b.String())
+	}
+}
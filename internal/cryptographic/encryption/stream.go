@@ -0,0 +1,279 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"e2e_chat/internal/cryptographic/kdf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streaming AEAD for payloads too large to hold in memory, following the
+// STREAM construction (Hoang, Reyhanitabar, Rogaway, Vizár). The output is
+//
+//	salt (16) || segment 0 || segment 1 || ... || final segment
+//
+// Every segment but the last holds StreamSegmentSize bytes of plaintext
+// sealed with AES-256-GCM under a key derived from the caller's key and the
+// random salt. Its nonce is the big-endian segment counter followed by a
+// flag byte that is 1 only on the final segment, so segments cannot be
+// reordered, dropped or moved to another stream, and a stream cut at a
+// segment boundary fails for lack of a final segment.
+const (
+	StreamSegmentSize = 64 << 10
+
+	streamSaltSize = 16
+	streamTagSize  = 16
+	streamSegment  = StreamSegmentSize + streamTagSize
+)
+
+var (
+	streamInfo = []byte("E2EChatStreamV1")
+
+	ErrStreamTruncated = errors.New("stream: truncated")
+	ErrStreamCorrupt   = errors.New("stream: segment failed authentication")
+	ErrStreamClosed    = errors.New("stream: write after close")
+	errStreamOverflow  = errors.New("stream: too many segments")
+)
+
+// StreamSize is the length of the stream for a plaintext of size bytes.
+func StreamSize(size int64) int64 {
+	segments := size/StreamSegmentSize + 1
+	if size > 0 && size%StreamSegmentSize == 0 {
+		segments--
+	}
+	return streamSaltSize + size + segments*streamTagSize
+}
+
+type (
+	streamCipher struct {
+		aead    cipher.AEAD
+		aad     []byte
+		counter uint64
+		nonce   [12]byte
+	}
+
+	// StreamWriter encrypts everything written to it into a stream. Close
+	// must be called to write the final segment.
+	StreamWriter struct {
+		dst    io.Writer
+		c      *streamCipher
+		buf    []byte // plaintext of the segment being filled
+		out    []byte
+		closed bool
+	}
+
+	// StreamReader decrypts a stream, returning plaintext only from
+	// segments that authenticated.
+	StreamReader struct {
+		src     io.Reader
+		c       *streamCipher
+		in      []byte
+		pending int // bytes of in already read ahead
+		out     []byte
+		plain   []byte // part of out not yet read
+		done    bool   // the final segment was read
+		err     error
+	}
+)
+
+func newStreamCipher(key, salt, aad []byte) (*streamCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("stream: key must be 32 bytes, got %d", len(key))
+	}
+
+	streamKey := make([]byte, 32)
+	if _, err := kdf.HKDF(key, salt, streamInfo, streamKey); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(streamKey)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cipher.NewGCM: %w", err)
+	}
+	return &streamCipher{aead: aead, aad: aad}, nil
+}
+
+// next returns the nonce of the next segment and advances the counter.
+func (c *streamCipher) next(final bool) ([]byte, error) {
+	if c.counter == 1<<64-1 {
+		return nil, errStreamOverflow
+	}
+
+	// the top 3 bytes of the 11-byte counter stay zero
+	binary.BigEndian.PutUint64(c.nonce[3:11], c.counter)
+	c.nonce[11] = 0
+	if final {
+		c.nonce[11] = 1
+	}
+	c.counter++
+	return c.nonce[:], nil
+}
+
+// NewStreamWriter starts a stream to dst under the 32-byte key. aad is bound
+// to every segment and must be given again to read the stream.
+func NewStreamWriter(dst io.Writer, key, aad []byte) (*StreamWriter, error) {
+	salt := make([]byte, streamSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("rand.Read salt: %w", err)
+	}
+
+	c, err := newStreamCipher(key, salt, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := dst.Write(salt); err != nil {
+		return nil, err
+	}
+
+	return &StreamWriter{
+		dst: dst,
+		c:   c,
+		buf: make([]byte, 0, StreamSegmentSize),
+		out: make([]byte, 0, streamSegment),
+	}, nil
+}
+
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrStreamClosed
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// a full segment is only sealed once more data follows, since the
+		// last one has to carry the final flag
+		if len(w.buf) == StreamSegmentSize {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+
+		k := copy(w.buf[len(w.buf):StreamSegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Close writes the final segment. It does not close dst.
+func (w *StreamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+func (w *StreamWriter) seal(final bool) error {
+	nonce, err := w.c.next(final)
+	if err != nil {
+		return err
+	}
+
+	w.out = w.c.aead.Seal(w.out[:0], nonce, w.buf, w.c.aad)
+	w.buf = w.buf[:0]
+	_, err = w.dst.Write(w.out)
+	return err
+}
+
+// NewStreamReader opens a stream written by StreamWriter with the same key
+// and aad. Read fails with ErrStreamCorrupt for a tampered or reordered
+// segment and ErrStreamTruncated when the final segment is missing.
+func NewStreamReader(src io.Reader, key, aad []byte) (*StreamReader, error) {
+	salt := make([]byte, streamSaltSize)
+	if _, err := io.ReadFull(src, salt); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrStreamTruncated
+		}
+		return nil, err
+	}
+
+	c, err := newStreamCipher(key, salt, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamReader{
+		src: src,
+		c:   c,
+		in:  make([]byte, streamSegment+1),
+		out: make([]byte, 0, StreamSegmentSize),
+	}, nil
+}
+
+func (r *StreamReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.open()
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next segment. One byte past a full segment is
+// read ahead: a full segment followed by more data cannot be the final one.
+func (r *StreamReader) open() error {
+	n, err := io.ReadFull(r.src, r.in[r.pending:])
+	n += r.pending
+	r.pending = 0
+
+	switch {
+	case err == nil:
+		// a full segment and the first byte of the next
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		// the last segment, possibly full
+	default:
+		return err
+	}
+
+	final := n <= streamSegment
+	segment := r.in[:min(n, streamSegment)]
+	if len(segment) < streamTagSize {
+		return ErrStreamTruncated
+	}
+
+	nonce, err := r.c.next(final)
+	if err != nil {
+		return err
+	}
+
+	plain, err := r.c.aead.Open(r.out[:0], nonce, segment, r.c.aad)
+	if err != nil {
+		if final {
+			// a valid non-final segment here means the rest was cut off
+			nonce[11] = 0
+			if _, err := r.c.aead.Open(r.out[:0], nonce, segment, r.c.aad); err == nil {
+				return ErrStreamTruncated
+			}
+		}
+		return ErrStreamCorrupt
+	}
+	r.plain = plain
+
+	if final {
+		r.done = true
+		return nil
+	}
+
+	// keep the byte read ahead for the next segment
+	r.in[0] = r.in[streamSegment]
+	r.pending = 1
+	return nil
+}
@@ -0,0 +1,361 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+var testAAD = []byte("E2EChatStreamTest")
+
+func testKey(t testing.TB) []byte {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func sealStream(t testing.TB, key, plaintext []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := NewStreamWriter(&buf, key, testAAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// openStream reads the whole stream and returns what was read before the
+// first error.
+func openStream(stream, key, aad []byte) ([]byte, error) {
+	r, err := NewStreamReader(bytes.NewReader(stream), key, aad)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// segments splits a stream after its salt.
+func segments(stream []byte) [][]byte {
+	var segs [][]byte
+	for rest := stream[streamSaltSize:]; len(rest) > 0; {
+		n := min(len(rest), streamSegment)
+		segs = append(segs, rest[:n])
+		rest = rest[n:]
+	}
+	return segs
+}
+
+func join(salt []byte, segs ...[]byte) []byte {
+	return bytes.Join(append([][]byte{salt}, segs...), nil)
+}
+
+func randomPlaintext(t testing.TB, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// checkRejected fails unless reading stream ends in want, having returned
+// at most a prefix of plaintext.
+func checkRejected(t *testing.T, stream, key, plaintext []byte, want error) {
+	t.Helper()
+
+	got, err := openStream(stream, key, testAAD)
+	if !errors.Is(err, want) {
+		t.Fatalf("got %v, want %v", err, want)
+	}
+	if !bytes.HasPrefix(plaintext, got) {
+		t.Fatal("returned plaintext that was never written")
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testKey(t)
+
+	for _, size := range []int{0, 1, StreamSegmentSize - 1, StreamSegmentSize, StreamSegmentSize + 1, 3 * StreamSegmentSize, 3*StreamSegmentSize + 5} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			plaintext := randomPlaintext(t, size)
+			stream := sealStream(t, key, plaintext)
+			if int64(len(stream)) != StreamSize(int64(size)) {
+				t.Fatalf("stream of %d bytes, StreamSize says %d", len(stream), StreamSize(int64(size)))
+			}
+
+			got, err := openStream(stream, key, testAAD)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatal("plaintext differs")
+			}
+
+			// short reads from the source and into the caller
+			r, err := NewStreamReader(iotest.HalfReader(bytes.NewReader(stream)), key, testAAD)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = io.ReadAll(iotest.OneByteReader(r))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatal("plaintext differs after short reads")
+			}
+		})
+	}
+}
+
+func TestStreamSmallWrites(t *testing.T) {
+	key := testKey(t)
+	plaintext := randomPlaintext(t, 2*StreamSegmentSize+100)
+
+	var buf bytes.Buffer
+	w, err := NewStreamWriter(&buf, key, testAAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := plaintext; len(rest) > 0; {
+		n := min(len(rest), 1000)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("x")); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("write after close: got %v", err)
+	}
+
+	got, err := openStream(buf.Bytes(), key, testAAD)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	key := testKey(t)
+	plaintext := randomPlaintext(t, 3*StreamSegmentSize+5)
+	stream := sealStream(t, key, plaintext)
+
+	// cut at a segment boundary, every remaining segment authenticates
+	for k := range 4 {
+		t.Run(fmt.Sprintf("after segment %d", k), func(t *testing.T) {
+			checkRejected(t, stream[:streamSaltSize+k*streamSegment], key, plaintext, ErrStreamTruncated)
+		})
+	}
+
+	t.Run("in the salt", func(t *testing.T) {
+		checkRejected(t, stream[:streamSaltSize-1], key, plaintext, ErrStreamTruncated)
+	})
+
+	t.Run("shorter than a tag", func(t *testing.T) {
+		checkRejected(t, stream[:streamSaltSize+streamSegment+1], key, plaintext, ErrStreamTruncated)
+	})
+
+	for _, n := range []int{streamTagSize, streamSegment / 2, streamSegment - 1} {
+		t.Run(fmt.Sprintf("%d bytes into a segment", n), func(t *testing.T) {
+			checkRejected(t, stream[:streamSaltSize+streamSegment+n], key, plaintext, ErrStreamCorrupt)
+		})
+	}
+
+	t.Run("final segment", func(t *testing.T) {
+		checkRejected(t, stream[:len(stream)-1], key, plaintext, ErrStreamCorrupt)
+	})
+}
+
+func TestStreamReordered(t *testing.T) {
+	key := testKey(t)
+	plaintext := randomPlaintext(t, 3*StreamSegmentSize+5)
+	stream := sealStream(t, key, plaintext)
+	salt, segs := stream[:streamSaltSize], segments(stream)
+
+	tests := map[string][]byte{
+		"swapped":        join(salt, segs[1], segs[0], segs[2], segs[3]),
+		"dropped":        join(salt, segs[0], segs[2], segs[3]),
+		"repeated":       join(salt, segs[0], segs[0], segs[1], segs[2], segs[3]),
+		"final moved up": join(salt, segs[0], segs[1], segs[3]),
+		"final first":    join(salt, segs[3]),
+	}
+	for name, stream := range tests {
+		t.Run(name, func(t *testing.T) {
+			checkRejected(t, stream, key, plaintext, ErrStreamCorrupt)
+		})
+	}
+
+	// same key, other salt
+	other := sealStream(t, key, plaintext)
+	t.Run("from another stream", func(t *testing.T) {
+		checkRejected(t, join(salt, segs[0], segments(other)[1], segs[2], segs[3]), key, plaintext, ErrStreamCorrupt)
+	})
+}
+
+func TestStreamExtended(t *testing.T) {
+	key := testKey(t)
+
+	for _, size := range []int{5, StreamSegmentSize, 2*StreamSegmentSize + 5} {
+		plaintext := randomPlaintext(t, size)
+		stream := sealStream(t, key, plaintext)
+		salt, segs := stream[:streamSaltSize], segments(stream)
+		final := segs[len(segs)-1]
+
+		tests := map[string][]byte{
+			"one byte":      append(bytes.Clone(stream), 0),
+			"final again":   join(stream, final),
+			"whole segment": join(stream, randomPlaintext(t, streamSegment)),
+			"other stream":  join(stream, segments(sealStream(t, key, plaintext))...),
+			"own segments":  join(salt, append(segs, segs...)...),
+		}
+		for name, stream := range tests {
+			t.Run(fmt.Sprintf("%d/%s", size, name), func(t *testing.T) {
+				checkRejected(t, stream, key, plaintext, ErrStreamCorrupt)
+			})
+		}
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	key := testKey(t)
+	plaintext := randomPlaintext(t, 2*StreamSegmentSize+5)
+	stream := sealStream(t, key, plaintext)
+
+	for _, i := range []int{0, streamSaltSize, streamSaltSize + streamSegment - 1, len(stream) - streamTagSize, len(stream) - 1} {
+		t.Run(fmt.Sprintf("byte %d", i), func(t *testing.T) {
+			tampered := bytes.Clone(stream)
+			tampered[i] ^= 1
+			checkRejected(t, tampered, key, plaintext, ErrStreamCorrupt)
+		})
+	}
+
+	t.Run("key", func(t *testing.T) {
+		checkRejected(t, stream, testKey(t), plaintext, ErrStreamCorrupt)
+	})
+
+	t.Run("aad", func(t *testing.T) {
+		if _, err := openStream(stream, key, []byte("other")); !errors.Is(err, ErrStreamCorrupt) {
+			t.Fatalf("got %v, want %v", err, ErrStreamCorrupt)
+		}
+	})
+}
+
+func TestStreamKeySize(t *testing.T) {
+	if _, err := NewStreamWriter(io.Discard, make([]byte, 16), nil); err == nil {
+		t.Fatal("accepted a 16-byte key")
+	}
+}
+
+const (
+	MiB = 1 << 20
+	GiB = 1 << 30
+)
+
+var benchmarkSizes = []int64{MiB, 64 * MiB, GiB, 4 * GiB}
+
+// zeroReader yields n zero bytes, standing in for a large file.
+type zeroReader struct {
+	n int64
+}
+
+func (r *zeroReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), r.n))
+	clear(p[:n])
+	r.n -= int64(n)
+	return n, nil
+}
+
+func benchmarkSize(b *testing.B, size int64) {
+	if size >= GiB && testing.Short() {
+		b.Skip("multi-GB input in short mode")
+	}
+	b.SetBytes(size)
+}
+
+func BenchmarkStreamWriter(b *testing.B) {
+	key := testKey(b)
+
+	for _, size := range benchmarkSizes {
+		b.Run(formatBytes(size), func(b *testing.B) {
+			benchmarkSize(b, size)
+
+			for b.Loop() {
+				w, err := NewStreamWriter(io.Discard, key, testAAD)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(w, &zeroReader{n: size}); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkStreamRoundTrip decrypts a stream while it is written, so that
+// multi-GB streams never have to be held.
+func BenchmarkStreamRoundTrip(b *testing.B) {
+	key := testKey(b)
+
+	for _, size := range benchmarkSizes {
+		b.Run(formatBytes(size), func(b *testing.B) {
+			benchmarkSize(b, size)
+
+			for b.Loop() {
+				pr, pw := io.Pipe()
+				go func() {
+					w, err := NewStreamWriter(pw, key, testAAD)
+					if err == nil {
+						_, err = io.Copy(w, &zeroReader{n: size})
+					}
+					if err == nil {
+						err = w.Close()
+					}
+					pw.CloseWithError(err)
+				}()
+
+				r, err := NewStreamReader(pr, key, testAAD)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, r)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != size {
+					b.Fatalf("decrypted %d bytes of %d", n, size)
+				}
+			}
+		})
+	}
+}
+
+func formatBytes(n int64) string {
+	if n >= GiB {
+		return fmt.Sprintf("%dGiB", n/GiB)
+	}
+	return fmt.Sprintf("%dMiB", n/MiB)
+}
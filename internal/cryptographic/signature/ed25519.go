@@ -19,6 +19,9 @@ func ED25519Sign(privKeyBytes []byte, message []byte) []byte {
 }
 
 func ED25519Verify(pubKeyBytes []byte, message []byte, signature []byte) bool {
+	if len(pubKeyBytes) != ed25519.PublicKeySize {
+		return false
+	}
 	pubKey := ed25519.PublicKey(pubKeyBytes)
 	return ed25519.Verify(pubKey, message, signature)
 }
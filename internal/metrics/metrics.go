@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	contentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// LatencyBuckets suits request handling, in seconds.
+	LatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+)
+
+type (
+	// Registry holds metrics and renders them in the Prometheus text
+	// exposition format.
+	Registry struct {
+		mu      sync.Mutex
+		metrics []metric
+	}
+
+	metric interface {
+		write(w *bufio.Writer)
+	}
+
+	desc struct {
+		name string
+		help string
+		kind string
+	}
+
+	Counter struct {
+		desc
+		v atomic.Uint64
+	}
+
+	// CounterVec is a family of counters told apart by the value of one label.
+	CounterVec struct {
+		desc
+		label string
+
+		mu     sync.Mutex
+		values map[string]*atomic.Uint64
+	}
+
+	GaugeFunc struct {
+		desc
+		fn func() float64
+	}
+
+	Histogram struct {
+		desc
+		bounds []float64
+
+		mu     sync.Mutex
+		counts []uint64 // per bucket, not cumulative
+		sum    float64
+		count  uint64
+	}
+)
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter"}}
+	r.register(c)
+	return c
+}
+
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name, help, "counter"},
+		label:  label,
+		values: make(map[string]*atomic.Uint64),
+	}
+	r.register(c)
+	return c
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name, help, "gauge"}, fn: fn}
+	r.register(g)
+	return g
+}
+
+// NewHistogram registers a histogram with the given ascending upper bounds;
+// the +Inf bucket is implied.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		desc:   desc{name, help, "histogram"},
+		bounds: append([]float64(nil), buckets...),
+		counts: make([]uint64, len(buckets)+1),
+	}
+	sort.Float64s(h.bounds)
+	r.register(h)
+	return h
+}
+
+// WriteText writes every metric in the text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		r.WriteText(w)
+	})
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	fmt.Fprintf(w, "%s %d\n", c.name, c.v.Load())
+}
+
+func (c *CounterVec) get(value string) *atomic.Uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.values[value]
+	if !ok {
+		v = new(atomic.Uint64)
+		c.values[value] = v
+	}
+	return v
+}
+
+func (c *CounterVec) Inc(value string) {
+	c.get(value).Add(1)
+}
+
+func (c *CounterVec) Add(value string, n uint64) {
+	c.get(value).Add(n)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	values := make([]string, 0, len(c.values))
+	for v := range c.values {
+		values = append(values, v)
+	}
+	c.mu.Unlock()
+	sort.Strings(values)
+
+	c.writeHeader(w)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", c.name, c.label, escapeLabel(v), c.get(v).Load())
+	}
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v) // first bound >= v
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	h.writeHeader(w)
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
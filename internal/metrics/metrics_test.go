@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.NewCounter("requests_total", "Requests.\nAll of them.")
+	c.Inc()
+	c.Add(2)
+
+	v := r.NewCounterVec("routed_total", "Routed.", "route")
+	v.Inc("remote")
+	v.Add("local", 3)
+	v.Inc(`a "quoted" \ value`)
+
+	r.NewGaugeFunc("connections", "Open connections.", func() float64 { return 7 })
+
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.1) // bounds are inclusive
+	h.Observe(0.5)
+	h.Observe(math.Inf(1))
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP requests_total Requests.\nAll of them.
+# TYPE requests_total counter
+requests_total 3
+# HELP routed_total Routed.
+# TYPE routed_total counter
+routed_total{route="a \"quoted\" \\ value"} 1
+routed_total{route="local"} 3
+routed_total{route="remote"} 1
+# HELP connections Open connections.
+# TYPE connections gauge
+connections 7
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum +Inf
+latency_seconds_count 4
+`
+	if got := b.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("up", "Up.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "\nup 1\n") {
+		t.Fatalf("body:\n%s", rec.Body)
+	}
+}
+
+// TestConcurrentUpdates is meant for -race.
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("c", "C.")
+	v := r.NewCounterVec("v", "V.", "k")
+	h := r.NewHistogram("h", "H.", LatencyBuckets)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 1000 {
+				c.Inc()
+				v.Inc(string(rune('a' + (i+j)%4)))
+				h.Observe(float64(j) / 1000)
+				if j%100 == 0 {
+					r.WriteText(&strings.Builder{})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var b strings.Builder
+	r.WriteText(&b)
+	if !strings.Contains(b.String(), "\nc 8000\n") || !strings.Contains(b.String(), "\nh_count 8000\n") {
+		t.Fatalf("lost updates:\n%s", b.String())
+	}
+}
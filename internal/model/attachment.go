@@ -0,0 +1,22 @@
+package model
+
+type (
+	// Attachment points to an encrypted blob on the server. It travels inside
+	// the ratchet-encrypted Content, so only the recipient learns the key.
+	Attachment struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		ContentType string `json:"content_type,omitempty"`
+		Size        int64  `json:"size"`      // of the plaintext
+		BlobSize    int64  `json:"blob_size"` // of the encrypted blob
+		Key         []byte `json:"key"`
+		Digest      []byte `json:"digest"` // SHA-256 of the encrypted blob
+	}
+
+	// Upload is the state of a chunked attachment upload.
+	Upload struct {
+		ID     string `json:"id"`
+		Size   int64  `json:"size"`
+		Offset int64  `json:"offset"`
+	}
+)
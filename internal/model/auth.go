@@ -0,0 +1,32 @@
+package model
+
+type (
+	// AuthChallenge is the single-use nonce the server hands out before login.
+	AuthChallenge struct {
+		Nonce []byte `json:"nonce"`
+	}
+
+	// AuthResponse proves possession of the user's identity signing key.
+	AuthResponse struct {
+		UserID    string `json:"user_id"`
+		DeviceID  string `json:"device_id"`
+		Nonce     []byte `json:"nonce"`
+		Timestamp int64  `json:"timestamp"`
+		Signature []byte `json:"signature"`
+	}
+
+	TokenPair struct {
+		AccessToken  string   `json:"access_token"`
+		RefreshToken string   `json:"refresh_token"`
+		ExpiresAt    int64    `json:"expires_at"`
+		Scopes       []string `json:"scopes"`
+	}
+
+	RefreshRequest struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	RevokeRequest struct {
+		RefreshToken string `json:"refresh_token,omitempty"`
+	}
+)
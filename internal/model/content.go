@@ -0,0 +1,44 @@
+package model
+
+type (
+	ContentType string
+
+	ReceiptStatus string
+
+	// Content is the plaintext carried inside a ratchet-encrypted message.
+	Content struct {
+		Type       ContentType `json:"type"`
+		Text       string      `json:"text,omitempty"`
+		Receipt    *Receipt    `json:"receipt,omitempty"`
+		Attachment *Attachment `json:"attachment,omitempty"`
+
+		// ExpireTimer is the disappearing messages timer in seconds, 0 when
+		// off. Text and attachments carry the timer they disappear after; a
+		// timer message changes the conversation's setting.
+		ExpireTimer int64 `json:"expire_timer,omitempty"`
+
+		// ProfileKey is the sender's, so the recipient can send it sealed messages.
+		ProfileKey []byte `json:"profile_key,omitempty"`
+
+		// SessionStarted is set on the message carrying a handshake: when
+		// the sender started its session, in unix millis. The recipient
+		// only replaces its session with a newer one.
+		SessionStarted int64 `json:"session_started,omitempty"`
+	}
+
+	// Receipt acknowledges messages by their server-assigned IDs.
+	Receipt struct {
+		Status     ReceiptStatus `json:"status"`
+		MessageIDs []string      `json:"message_ids"`
+	}
+)
+
+const (
+	ContentText       ContentType = "text"
+	ContentReceipt    ContentType = "receipt"
+	ContentTimer      ContentType = "timer"
+	ContentAttachment ContentType = "attachment"
+
+	ReceiptDelivered ReceiptStatus = "delivered"
+	ReceiptRead      ReceiptStatus = "read"
+)
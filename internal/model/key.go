@@ -5,5 +5,30 @@ type (
 		IKPub     []byte `json:"ik_pub"`
 		SPKPub    []byte `json:"spk_pub"`
 		Signature []byte `json:"signature"`
+		SigPub    []byte `json:"sig_pub"`
+	}
+
+	// Registration publishes a user's public keys to the server. The server
+	// never needs the private halves.
+	Registration struct {
+		Name   string `json:"name"`
+		IKPub  []byte `json:"ik_pub"`
+		SPKPub []byte `json:"spk_pub"`
+		SPKSig []byte `json:"spk_sig"`
+		SigPub []byte `json:"sig_pub"`
+
+		// DeliveryToken is required from senders of sealed messages.
+		DeliveryToken []byte `json:"delivery_token"`
+
+		// Timestamp, in unix millis, and Signature by SigPriv over all of the
+		// above prove the registration comes from the key owner, and recently.
+		Timestamp int64  `json:"timestamp"`
+		Signature []byte `json:"signature"`
+	}
+
+	// PrekeyUpload carries the owner's signature over its signed prekey.
+	PrekeyUpload struct {
+		SPKPub    []byte `json:"spk_pub"`
+		Signature []byte `json:"signature"`
 	}
 )
@@ -1,5 +1,12 @@
 package model
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type (
 	// Header is the message header carried along with each ciphertext.
 	Header struct {
@@ -9,10 +16,100 @@ type (
 	}
 
 	Message struct {
-		From          string         `json:"from" validate:"required"`
-		To            string         `json:"to" validate:"required"`
-		Header        *Header        `json:"header" validate:"required"`
-		Ciphertext    []byte         `json:"ciphertext" validate:"required"`
+		ID            string         `json:"id,omitempty"`                          // assigned by the server
+		ClientID      string         `json:"client_id,omitempty" validate:"max=64"` // assigned by the sender
+		Timestamp     int64          `json:"timestamp,omitempty"`                   // server receive time, unix millis
+		From          string         `json:"from,omitempty" validate:"required,max=64"`
+		To            string         `json:"to" validate:"required,max=64"`
+		Header        *Header        `json:"header,omitempty" validate:"required"`
+		Ciphertext    []byte         `json:"ciphertext,omitempty" validate:"required"`
 		X3DHHandShake *X3DHHandshake `json:"x3dh_handshake,omitempty"`
+		Sealed        *Sealed        `json:"sealed,omitempty"`               // replaces From, Header, Ciphertext and X3DHHandShake
+		TTL           int64          `json:"ttl,omitempty" validate:"min=0"` // seconds the server may keep it queued, 0 for no limit
+	}
+
+	FrameType string
+
+	// Frame is the unit exchanged over the websocket in both directions.
+	Frame struct {
+		Type    FrameType `json:"type"`
+		Message *Message  `json:"message,omitempty"`
+		Ack     *Ack      `json:"ack,omitempty"`
+		Error   *Error    `json:"error,omitempty"`
+	}
+
+	// Ack is sent by a recipient once it has processed a message, and by the
+	// server to tell a sender which ID its message was stored under.
+	Ack struct {
+		ID       string `json:"id" validate:"required"`
+		ClientID string `json:"client_id,omitempty"`
+	}
+
+	ErrorCode string
+
+	// Error is sent by the server when it rejects a frame. ClientID names the
+	// rejected message when there is one.
+	Error struct {
+		Code     ErrorCode `json:"code"`
+		Message  string    `json:"message"`
+		ClientID string    `json:"client_id,omitempty"`
 	}
 )
+
+const (
+	FrameMessage  FrameType = "message"
+	FrameAck      FrameType = "ack"
+	FrameAccepted FrameType = "accepted"
+	FrameError    FrameType = "error"
+)
+
+const (
+	ErrorMalformed ErrorCode = "malformed" // not a frame, or an unknown type
+	ErrorInvalid   ErrorCode = "invalid"   // a required field is missing or too long
+	ErrorForbidden ErrorCode = "forbidden" // the sender is not the authenticated user
+	ErrorInternal  ErrorCode = "internal"  // the server failed, sending again may work
+)
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Retryable reports whether sending the same frame again may succeed.
+func (e *Error) Retryable() bool {
+	return e.Code == ErrorInternal
+}
+
+// Expired reports whether a message with a TTL has outlived it at now. The
+// TTL runs from the server receive time.
+func (m *Message) Expired(now time.Time) bool {
+	if m.TTL <= 0 || m.Timestamp == 0 {
+		return false
+	}
+	return now.UnixMilli() >= m.Timestamp+m.TTL*1000
+}
+
+// DefaultMaxFrameSize bounds a websocket frame the server reads from a
+// client; a text message is far smaller.
+const DefaultMaxFrameSize = 64 << 10
+
+// CloseRateLimited is the websocket close code sent to a client that exceeded
+// its message budget. The reason holds the seconds to wait before
+// reconnecting, see RetryAfterReason.
+const CloseRateLimited = 4429
+
+func RetryAfterReason(seconds int) string {
+	return fmt.Sprintf("retry-after=%d", seconds)
+}
+
+// ParseRetryAfterReason reads the wait from a CloseRateLimited reason.
+func ParseRetryAfterReason(reason string) (time.Duration, bool) {
+	v, ok := strings.CutPrefix(reason, "retry-after=")
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,46 @@
+package model
+
+type (
+	// Sealed is a message whose sender is only known to the recipient. Its
+	// ciphertext holds a SealedContent, encrypted to the recipient's identity
+	// key with EphemeralPub.
+	Sealed struct {
+		EphemeralPub []byte `json:"ephemeral_pub" validate:"len=32"`
+		Ciphertext   []byte `json:"ciphertext" validate:"required"`
+	}
+
+	// SealedContent is the inside of a Sealed message: the ratchet message
+	// with its sender, who proves its identity key with a certificate.
+	SealedContent struct {
+		From          string             `json:"from"`
+		Certificate   *SenderCertificate `json:"certificate"`
+		Header        *Header            `json:"header"`
+		Ciphertext    []byte             `json:"ciphertext"`
+		X3DHHandShake *X3DHHandshake     `json:"x3dh_handshake,omitempty"`
+	}
+
+	// SealedEnvelope submits a sealed message without logging in. The
+	// delivery token shows the sender was given the recipient's profile key.
+	SealedEnvelope struct {
+		To            string  `json:"to" validate:"required,max=64"`
+		ClientID      string  `json:"client_id,omitempty" validate:"max=64"`
+		DeliveryToken []byte  `json:"delivery_token" validate:"len=16"`
+		Sealed        *Sealed `json:"sealed" validate:"required"`
+		TTL           int64   `json:"ttl,omitempty" validate:"min=0"`
+	}
+
+	// SenderCertificate is the server vouching that Sender owns the X25519
+	// IdentityKey on device DeviceID until Expires (unix seconds).
+	SenderCertificate struct {
+		Sender      string `json:"sender"`
+		DeviceID    string `json:"device_id"`
+		IdentityKey []byte `json:"identity_key"`
+		Expires     int64  `json:"expires"`
+		Signature   []byte `json:"signature"`
+	}
+
+	// CertificateKey is the server's Ed25519 key for sender certificates.
+	CertificateKey struct {
+		PublicKey []byte `json:"public_key"`
+	}
+)
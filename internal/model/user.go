@@ -7,6 +7,15 @@ type (
 		ID      primitive.ObjectID `bson:"_id,omitempty"`
 		Name    string             `bson:"name"`
 		IKPriv  []byte             `bson:"ikPriv"`
+		IKPub   []byte             `bson:"ikPub"`
 		SPKPriv []byte             `bson:"spkPriv"`
+		SPKPub  []byte             `bson:"spkPub"`
+		SPKSig  []byte             `bson:"spkSig"`
+		SigPriv []byte             `bson:"sigPriv"`
+		SigPub  []byte             `bson:"sigPub"`
+
+		ProfileKey    []byte `bson:"profileKey,omitempty"`    // client side only
+		DeliveryToken []byte `bson:"deliveryToken,omitempty"` // server side only
+		RegisteredAt  int64  `bson:"registeredAt,omitempty"`  // server side only, timestamp of the last registration
 	}
 )
@@ -2,7 +2,7 @@ package model
 
 type (
 	X3DHHandshake struct {
-		EKPub []byte
+		EKPub []byte `validate:"len=32"`
 	}
 
 	SenderKeyBundle struct {
@@ -0,0 +1,88 @@
+// Package attachment encrypts files for upload as opaque blobs. A blob is an
+// encryption stream (segmented AES-256-GCM) under a random 32-byte key. The
+// key and the SHA-256 digest of the blob travel inside the ratchet message,
+// so the server stores a blob it can neither read nor swap undetected.
+package attachment
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"e2e_chat/internal/cryptographic/encryption"
+	"errors"
+	"io"
+)
+
+const (
+	KeySize    = 32
+	DigestSize = sha256.Size
+)
+
+var (
+	// bound to every segment, so a blob cannot pass as another kind of stream
+	blobAAD = []byte("E2EChatAttachmentV1")
+
+	ErrInvalidKey     = errors.New("attachment: invalid key")
+	ErrDigestMismatch = errors.New("attachment: digest does not match")
+)
+
+// NewKey returns a random attachment key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// BlobSize is the size of the blob for a plaintext of size bytes.
+func BlobSize(size int64) int64 {
+	return encryption.StreamSize(size)
+}
+
+// Encrypt reads plaintext from src until EOF and writes the blob to dst. It
+// returns the digest of the blob and the plaintext size.
+func Encrypt(dst io.Writer, src io.Reader, key []byte) (digest []byte, size int64, err error) {
+	if len(key) != KeySize {
+		return nil, 0, ErrInvalidKey
+	}
+
+	sum := sha256.New()
+	w, err := encryption.NewStreamWriter(io.MultiWriter(dst, sum), key, blobAAD)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err = io.Copy(w, src)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, err
+	}
+	return sum.Sum(nil), size, nil
+}
+
+// Decrypt checks the digest of the blob of size bytes and then writes its
+// plaintext to dst. Nothing is written for a blob that was swapped or
+// altered, so a tampered download never reaches disk as plaintext.
+func Decrypt(dst io.Writer, blob io.ReaderAt, size int64, key, digest []byte) error {
+	if len(key) != KeySize {
+		return ErrInvalidKey
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, io.NewSectionReader(blob, 0, size)); err != nil {
+		return err
+	}
+	if !hmac.Equal(sum.Sum(nil), digest) {
+		return ErrDigestMismatch
+	}
+
+	r, err := encryption.NewStreamReader(io.NewSectionReader(blob, 0, size), key, blobAAD)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
@@ -0,0 +1,74 @@
+package attachment
+
+import (
+	"bytes"
+	"crypto/rand"
+	"e2e_chat/internal/cryptographic/encryption"
+	"errors"
+	"testing"
+)
+
+func encryptTest(t *testing.T, plaintext []byte) (blob, key, digest []byte) {
+	t.Helper()
+
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	digest, size, err := Encrypt(&buf, bytes.NewReader(plaintext), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(plaintext)) || int64(buf.Len()) != BlobSize(size) {
+		t.Fatalf("size %d, blob %d bytes, want %d and %d", size, buf.Len(), len(plaintext), BlobSize(size))
+	}
+	return buf.Bytes(), key, digest
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	plaintext := make([]byte, 3*encryption.StreamSegmentSize+7)
+	rand.Read(plaintext)
+	blob, key, digest := encryptTest(t, plaintext)
+
+	var out bytes.Buffer
+	if err := Decrypt(&out, bytes.NewReader(blob), int64(len(blob)), key, digest); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), plaintext) {
+		t.Fatal("plaintext differs")
+	}
+}
+
+func TestDecryptRejected(t *testing.T) {
+	blob, key, digest := encryptTest(t, []byte("holiday photos"))
+	otherKey, _ := NewKey()
+
+	tampered := bytes.Clone(blob)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := map[string]struct {
+		blob, key, digest []byte
+		want              error
+	}{
+		"tampered":  {tampered, key, digest, ErrDigestMismatch},
+		"digest":    {blob, key, make([]byte, DigestSize), ErrDigestMismatch},
+		"truncated": {blob[:len(blob)-1], key, digest, ErrDigestMismatch},
+		"short key": {blob, key[:16], digest, ErrInvalidKey},
+		// the digest matches, so only the stream can tell
+		"key": {blob, otherKey, digest, encryption.ErrStreamCorrupt},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Decrypt(&out, bytes.NewReader(tt.blob), int64(len(tt.blob)), tt.key, tt.digest)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if out.Len() != 0 {
+				t.Fatalf("wrote %d bytes of plaintext", out.Len())
+			}
+		})
+	}
+}
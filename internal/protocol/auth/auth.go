@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"e2e_chat/internal/cryptographic/signature"
+	"e2e_chat/internal/model"
+	"encoding/binary"
+)
+
+var (
+	domain             = []byte("E2EChatAuthV1")
+	registrationDomain = []byte("E2EChatRegisterV1")
+)
+
+// ChallengePayload builds the byte string signed during login. Every field is
+// length-prefixed so that no two different responses share a payload.
+func ChallengePayload(userID, deviceID string, nonce []byte, timestamp int64) []byte {
+	payload := make([]byte, 0, len(domain)+len(userID)+len(deviceID)+len(nonce)+20)
+	payload = append(payload, domain...)
+	payload = appendField(payload, []byte(userID))
+	payload = appendField(payload, []byte(deviceID))
+	payload = appendField(payload, nonce)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(timestamp))
+	return payload
+}
+
+// SignChallenge answers a challenge with the given Ed25519 private key.
+func SignChallenge(sigPriv []byte, userID, deviceID string, nonce []byte, timestamp int64) *model.AuthResponse {
+	return &model.AuthResponse{
+		UserID:    userID,
+		DeviceID:  deviceID,
+		Nonce:     nonce,
+		Timestamp: timestamp,
+		Signature: signature.ED25519Sign(sigPriv, ChallengePayload(userID, deviceID, nonce, timestamp)),
+	}
+}
+
+// VerifyChallenge checks the response signature against the registered key.
+func VerifyChallenge(sigPub []byte, resp *model.AuthResponse) bool {
+	payload := ChallengePayload(resp.UserID, resp.DeviceID, resp.Nonce, resp.Timestamp)
+	return signature.ED25519Verify(sigPub, payload, resp.Signature)
+}
+
+// RegistrationPayload builds the byte string signed to register: every field
+// of the registration but the signature itself.
+func RegistrationPayload(reg *model.Registration) []byte {
+	payload := append([]byte(nil), registrationDomain...)
+	payload = appendField(payload, []byte(reg.Name))
+	payload = appendField(payload, reg.IKPub)
+	payload = appendField(payload, reg.SPKPub)
+	payload = appendField(payload, reg.SPKSig)
+	payload = appendField(payload, reg.SigPub)
+	payload = appendField(payload, reg.DeliveryToken)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(reg.Timestamp))
+	return payload
+}
+
+// SignRegistration signs reg with the private half of reg.SigPub.
+func SignRegistration(sigPriv []byte, reg *model.Registration) {
+	reg.Signature = signature.ED25519Sign(sigPriv, RegistrationPayload(reg))
+}
+
+// VerifyRegistration checks the registration signature against sigPub.
+func VerifyRegistration(sigPub []byte, reg *model.Registration) bool {
+	return signature.ED25519Verify(sigPub, RegistrationPayload(reg), reg.Signature)
+}
+
+func appendField(b, field []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(field)))
+	return append(b, field...)
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"bytes"
+	"e2e_chat/internal/cryptographic/signature"
+	"e2e_chat/internal/model"
+	"testing"
+	"time"
+)
+
+func newRegistration(t *testing.T) (*model.Registration, []byte) {
+	t.Helper()
+
+	sigPub, sigPriv, err := signature.NewEd25519Keypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &model.Registration{
+		Name:          "alice",
+		IKPub:         bytes.Repeat([]byte{1}, 32),
+		SPKPub:        bytes.Repeat([]byte{2}, 32),
+		SPKSig:        bytes.Repeat([]byte{3}, 64),
+		SigPub:        sigPub,
+		DeliveryToken: bytes.Repeat([]byte{4}, 16),
+		Timestamp:     time.Now().UnixMilli(),
+	}
+	SignRegistration(sigPriv, reg)
+	return reg, sigPriv
+}
+
+func TestRegistrationSignature(t *testing.T) {
+	reg, _ := newRegistration(t)
+	if !VerifyRegistration(reg.SigPub, reg) {
+		t.Fatal("valid registration refused")
+	}
+
+	other, _ := newRegistration(t)
+	if VerifyRegistration(other.SigPub, reg) {
+		t.Fatal("verified against another key")
+	}
+
+	// every field is covered
+	tamper := map[string]func(r *model.Registration){
+		"name":           func(r *model.Registration) { r.Name = "mallory" },
+		"identity key":   func(r *model.Registration) { r.IKPub[0] ^= 1 },
+		"signed prekey":  func(r *model.Registration) { r.SPKPub[0] ^= 1 },
+		"prekey sig":     func(r *model.Registration) { r.SPKSig[0] ^= 1 },
+		"delivery token": func(r *model.Registration) { r.DeliveryToken = nil },
+		"timestamp":      func(r *model.Registration) { r.Timestamp++ },
+	}
+	for name, fn := range tamper {
+		t.Run(name, func(t *testing.T) {
+			reg, _ := newRegistration(t)
+			fn(reg)
+			if VerifyRegistration(reg.SigPub, reg) {
+				t.Fatal("tampered registration verified")
+			}
+		})
+	}
+}
+
+// TestPayloadsDistinct checks that fields cannot be shifted between each
+// other, and that a login signature is no registration signature.
+func TestPayloadsDistinct(t *testing.T) {
+	a := &model.Registration{Name: "ab", IKPub: []byte("c")}
+	b := &model.Registration{Name: "a", IKPub: []byte("bc")}
+	if bytes.Equal(RegistrationPayload(a), RegistrationPayload(b)) {
+		t.Fatal("shifted fields share a payload")
+	}
+
+	reg, sigPriv := newRegistration(t)
+	resp := SignChallenge(sigPriv, reg.Name, "device", []byte("nonce"), reg.Timestamp)
+	if VerifyRegistration(reg.SigPub, &model.Registration{Name: reg.Name, Timestamp: reg.Timestamp, Signature: resp.Signature}) {
+		t.Fatal("login signature accepted as a registration")
+	}
+}
+
+func TestChallengeSignature(t *testing.T) {
+	sigPub, sigPriv, err := signature.NewEd25519Keypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := SignChallenge(sigPriv, "alice", "device", []byte("nonce"), 1)
+	if !VerifyChallenge(sigPub, resp) {
+		t.Fatal("valid response refused")
+	}
+	resp.DeviceID = "other"
+	if VerifyChallenge(sigPub, resp) {
+		t.Fatal("tampered response verified")
+	}
+}
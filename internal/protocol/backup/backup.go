@@ -0,0 +1,234 @@
+// Package backup seals client backups under a recovery code. A backup file
+// is a magic line, a JSON header line and an encryption stream:
+//
+//	E2E Chat backup\n
+//	{"version":1,"created":...,"kdf":{...,"salt":...}}\n
+//	stream (encryption.StreamWriter output)
+//
+// The stream key is derived from the 30-digit recovery code with Argon2id
+// using the parameters and salt in the header, and both lines are bound to
+// every segment, so a backup cannot be altered, cut short or given another
+// header without the check failing.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"e2e_chat/internal/cryptographic/encryption"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// Version is the format written by Encrypt. Decrypt reads it and older
+	// ones.
+	Version = 1
+
+	CodeDigits = 30
+
+	codeGroup  = 5
+	saltSize   = 16
+	maxLineLen = 4 << 10
+
+	kdfArgon2id = "argon2id"
+)
+
+var (
+	magic = []byte("E2E Chat backup\n")
+
+	// RFC 9106, second recommended option
+	defaultKDF = KDF{
+		Name:    kdfArgon2id,
+		Time:    3,
+		Memory:  64 << 10,
+		Threads: 4,
+	}
+
+	ErrNotBackup          = errors.New("backup: not a backup file")
+	ErrUnsupportedVersion = errors.New("backup: unsupported version")
+	ErrInvalidCode        = fmt.Errorf("backup: recovery code must be %d digits", CodeDigits)
+	ErrDecrypt            = errors.New("backup: wrong recovery code or damaged file")
+)
+
+type (
+	Header struct {
+		Version int       `json:"version"`
+		Created time.Time `json:"created"`
+		KDF     KDF       `json:"kdf"`
+	}
+
+	// KDF holds the Argon2id parameters the key was derived with. Memory is
+	// in KiB.
+	KDF struct {
+		Name    string `json:"name"`
+		Time    uint32 `json:"time"`
+		Memory  uint32 `json:"memory"`
+		Threads uint8  `json:"threads"`
+		Salt    []byte `json:"salt"`
+	}
+)
+
+// NewRecoveryCode returns a random code of CodeDigits digits, in dash
+// separated groups of five.
+func NewRecoveryCode() (string, error) {
+	var b strings.Builder
+	for i := 0; i < CodeDigits; i++ {
+		if i > 0 && i%codeGroup == 0 {
+			b.WriteByte('-')
+		}
+
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte('0' + byte(d.Int64()))
+	}
+	return b.String(), nil
+}
+
+// ParseRecoveryCode returns the digits of code, ignoring the spaces and
+// dashes it may have been written down with.
+func ParseRecoveryCode(code string) (string, error) {
+	var digits strings.Builder
+	for _, r := range code {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == ' ' || r == '-':
+		default:
+			return "", ErrInvalidCode
+		}
+	}
+
+	if digits.Len() != CodeDigits {
+		return "", ErrInvalidCode
+	}
+	return digits.String(), nil
+}
+
+func (k *KDF) check() error {
+	// bounded, so a crafted header cannot make the import exhaust memory
+	if k.Name != kdfArgon2id || k.Time < 1 || k.Time > 16 || k.Memory < 8<<10 || k.Memory > 1<<20 ||
+		k.Threads < 1 || len(k.Salt) != saltSize {
+		return fmt.Errorf("%w: kdf parameters", ErrNotBackup)
+	}
+	return nil
+}
+
+func (k *KDF) key(code string) ([]byte, error) {
+	digits, err := ParseRecoveryCode(code)
+	if err != nil {
+		return nil, err
+	}
+	return argon2.IDKey([]byte(digits), k.Salt, k.Time, k.Memory, k.Threads, 32), nil
+}
+
+// Encrypt writes a backup of payload to dst under the recovery code.
+func Encrypt(dst io.Writer, code string, payload []byte) error {
+	header := Header{
+		Version: Version,
+		Created: time.Now().UTC(),
+		KDF:     defaultKDF,
+	}
+	header.KDF.Salt = make([]byte, saltSize)
+	if _, err := rand.Read(header.KDF.Salt); err != nil {
+		return fmt.Errorf("rand.Read salt: %w", err)
+	}
+
+	key, err := header.KDF.key(code)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(&header)
+	if err != nil {
+		return err
+	}
+	preamble := append(append(bytes.Clone(magic), line...), '\n')
+
+	if _, err := dst.Write(preamble); err != nil {
+		return err
+	}
+
+	w, err := encryption.NewStreamWriter(dst, key, preamble)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Decrypt reads a backup from src and returns its header and payload. The
+// whole file is authenticated before anything is returned.
+func Decrypt(src io.Reader, code string) (*Header, []byte, error) {
+	r := bufio.NewReader(src)
+
+	preamble := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, preamble); err != nil || !bytes.Equal(preamble, magic) {
+		return nil, nil, ErrNotBackup
+	}
+
+	line, err := readLine(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	preamble = append(preamble, line...)
+
+	var header Header
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, nil, fmt.Errorf("%w: header: %v", ErrNotBackup, err)
+	}
+	if header.Version < 1 || header.Version > Version {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header.Version)
+	}
+	if err := header.KDF.check(); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := header.KDF.key(code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream, err := encryption.NewStreamReader(r, key, preamble)
+	if err != nil {
+		return nil, nil, ErrDecrypt
+	}
+	payload, err := io.ReadAll(stream)
+	if errors.Is(err, encryption.ErrStreamCorrupt) || errors.Is(err, encryption.ErrStreamTruncated) {
+		return nil, nil, ErrDecrypt
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &header, payload, nil
+}
+
+// readLine reads the header line including its newline.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLineLen {
+			return nil, fmt.Errorf("%w: header too long", ErrNotBackup)
+		}
+		if err == nil {
+			return line, nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, ErrNotBackup
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func encryptTest(t *testing.T, payload []byte) ([]byte, string) {
+	t.Helper()
+
+	code, err := NewRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Encrypt(&buf, code, payload); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), code
+}
+
+// withHeader returns the backup with its header line changed by modify.
+func withHeader(t *testing.T, file []byte, modify func(h map[string]any)) []byte {
+	t.Helper()
+
+	rest := file[len(magic):]
+	end := bytes.IndexByte(rest, '\n')
+
+	var header map[string]any
+	if err := json.Unmarshal(rest[:end], &header); err != nil {
+		t.Fatal(err)
+	}
+	modify(header)
+	line, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Join([][]byte{magic, line, []byte("\n"), rest[end+1:]}, nil)
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code, err := NewRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^\d{5}(-\d{5}){5}$`).MatchString(code) {
+		t.Fatalf("code %q", code)
+	}
+
+	digits, err := ParseRecoveryCode(" " + strings.ReplaceAll(code, "-", " ") + " ")
+	if err != nil || digits != strings.ReplaceAll(code, "-", "") {
+		t.Fatalf("parsed %q, %v", digits, err)
+	}
+
+	for _, bad := range []string{"", code[:len(code)-1], code + "1", "x" + code, "12345-67890-12345-67890-12345-6789O"} {
+		if _, err := ParseRecoveryCode(bad); !errors.Is(err, ErrInvalidCode) {
+			t.Errorf("%q: got %v", bad, err)
+		}
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"user":"alice"}`), 10000)
+	file, code := encryptTest(t, payload)
+
+	if !bytes.HasPrefix(file, magic) {
+		t.Fatal("no magic line")
+	}
+	if bytes.Contains(file, []byte("alice")) {
+		t.Fatal("payload stored in the clear")
+	}
+
+	// written down with spaces
+	header, got, err := Decrypt(bytes.NewReader(file), strings.ReplaceAll(code, "-", " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload differs")
+	}
+	if header.Version != Version || header.Created.IsZero() || len(header.KDF.Salt) != saltSize {
+		t.Fatalf("header %+v", header)
+	}
+}
+
+func TestDecryptRejected(t *testing.T) {
+	file, code := encryptTest(t, []byte("payload"))
+	other, err := NewRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := bytes.Clone(file)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := map[string]struct {
+		file []byte
+		code string
+		want error
+	}{
+		"wrong code": {file, other, ErrDecrypt},
+		"bad code":   {file, "1234", ErrInvalidCode},
+		"tampered":   {tampered, code, ErrDecrypt},
+		"truncated":  {file[:len(file)-1], code, ErrDecrypt},
+		"cut after header": {
+			file[:len(magic)+bytes.IndexByte(file[len(magic):], '\n')+1], code, ErrDecrypt,
+		},
+		"extended": {append(bytes.Clone(file), 0), code, ErrDecrypt},
+		"no magic": {file[1:], code, ErrNotBackup},
+		"empty":    {nil, code, ErrNotBackup},
+		"no header end": {
+			append(bytes.Clone(magic), bytes.Repeat([]byte("x"), 2*maxLineLen)...), code, ErrNotBackup,
+		},
+		// the header is bound to every segment
+		"created changed": {
+			withHeader(t, file, func(h map[string]any) { h["created"] = "2001-01-01T00:00:00Z" }), code, ErrDecrypt,
+		},
+		"newer version": {
+			withHeader(t, file, func(h map[string]any) { h["version"] = Version + 1 }), code, ErrUnsupportedVersion,
+		},
+		"huge memory": {
+			withHeader(t, file, func(h map[string]any) { h["kdf"].(map[string]any)["memory"] = 1 << 30 }), code, ErrNotBackup,
+		},
+		"other kdf": {
+			withHeader(t, file, func(h map[string]any) { h["kdf"].(map[string]any)["name"] = "scrypt" }), code, ErrNotBackup,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := Decrypt(bytes.NewReader(tt.file), tt.code); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+// Package sealed hides who sent a message from the relay. The sender's name
+// and certificate travel inside a box encrypted to the recipient's identity
+// key with a one-time ephemeral key, so the envelope only names the
+// recipient. Delivery tokens, derived from a profile key the recipient shares
+// with its contacts, let the relay refuse strangers without learning who
+// the sender is.
+package sealed
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"e2e_chat/internal/cryptographic/dh"
+	"e2e_chat/internal/cryptographic/encryption"
+	"e2e_chat/internal/cryptographic/kdf"
+	"e2e_chat/internal/cryptographic/signature"
+	"e2e_chat/internal/model"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	ProfileKeySize    = 32
+	DeliveryTokenSize = 16
+
+	trustRootPrefix = "ed25519/"
+)
+
+var (
+	sealInfo          = []byte("E2EChatSealedSenderV1")
+	deliveryTokenInfo = []byte("E2EChatDeliveryTokenV1")
+	certificateDomain = []byte("E2EChatSenderCertV1")
+
+	ErrInvalidKey         = errors.New("sealed: invalid key")
+	ErrInvalidCertificate = errors.New("sealed: invalid sender certificate")
+	ErrExpiredCertificate = errors.New("sealed: sender certificate expired")
+	ErrTrustRootMismatch  = errors.New("sealed: server certificate key does not match the trusted root")
+)
+
+// NewProfileKey returns a random profile key.
+func NewProfileKey() ([]byte, error) {
+	key := make([]byte, ProfileKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DeliveryToken derives the token that senders present to deliver to the
+// owner of profileKey. The server stores it but cannot recover the key.
+func DeliveryToken(profileKey []byte) ([]byte, error) {
+	if len(profileKey) != ProfileKeySize {
+		return nil, ErrInvalidKey
+	}
+
+	token := make([]byte, DeliveryTokenSize)
+	if _, err := kdf.HKDF(profileKey, nil, deliveryTokenInfo, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Seal encrypts plaintext to the recipient's X25519 identity key. It returns
+// the ephemeral public key the recipient needs to open it.
+func Seal(recipientIK []byte, plaintext []byte) (ephPub []byte, ciphertext []byte, err error) {
+	if len(recipientIK) != 32 {
+		return nil, nil, ErrInvalidKey
+	}
+
+	ephPriv, eph, err := dh.NewX25519KeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := sealKey(ephPriv, [32]byte(recipientIK), eph[:], recipientIK)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ciphertext, err = encryption.AEADEncrypt(key, plaintext, append(eph[:], recipientIK...))
+	if err != nil {
+		return nil, nil, err
+	}
+	return eph[:], ciphertext, nil
+}
+
+// Open decrypts a box sealed to the identity key ikPriv.
+func Open(ikPriv []byte, ephPub []byte, ciphertext []byte) ([]byte, error) {
+	if len(ikPriv) != 32 || len(ephPub) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	priv, err := dh.ConvertToECDHFormat(ikPriv)
+	if err != nil {
+		return nil, err
+	}
+	ikPub := priv.PublicKey().Bytes()
+
+	key, err := sealKey([32]byte(ikPriv), [32]byte(ephPub), ephPub, ikPub)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.AEADDecrypt(key, ciphertext, append(bytes.Clone(ephPub), ikPub...))
+}
+
+func sealKey(priv, pub [32]byte, ephPub, recipientIK []byte) ([]byte, error) {
+	shared, err := dh.X25519SharedSecret(priv, pub)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := kdf.HKDF(shared, append(bytes.Clone(ephPub), recipientIK...), sealInfo, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// CertificatePayload is what the server signs to vouch that sender owns
+// identityKey on deviceID until expires (unix seconds). Every field is
+// length-prefixed.
+func CertificatePayload(sender, deviceID string, identityKey []byte, expires int64) []byte {
+	payload := make([]byte, 0, len(certificateDomain)+len(sender)+len(deviceID)+len(identityKey)+20)
+	payload = append(payload, certificateDomain...)
+	payload = appendField(payload, []byte(sender))
+	payload = appendField(payload, []byte(deviceID))
+	payload = appendField(payload, identityKey)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(expires))
+	return payload
+}
+
+// SignCertificate issues a certificate with the server's Ed25519 key.
+func SignCertificate(serverPriv []byte, sender, deviceID string, identityKey []byte, expires time.Time) *model.SenderCertificate {
+	return &model.SenderCertificate{
+		Sender:      sender,
+		DeviceID:    deviceID,
+		IdentityKey: identityKey,
+		Expires:     expires.Unix(),
+		Signature:   signature.ED25519Sign(serverPriv, CertificatePayload(sender, deviceID, identityKey, expires.Unix())),
+	}
+}
+
+// VerifyCertificate checks the signature by the trust root serverPub and that
+// cert is valid at now.
+func VerifyCertificate(serverPub []byte, cert *model.SenderCertificate, now time.Time) error {
+	if cert == nil {
+		return ErrInvalidCertificate
+	}
+
+	payload := CertificatePayload(cert.Sender, cert.DeviceID, cert.IdentityKey, cert.Expires)
+	if !signature.ED25519Verify(serverPub, payload, cert.Signature) {
+		return ErrInvalidCertificate
+	}
+	if now.Unix() >= cert.Expires {
+		return ErrExpiredCertificate
+	}
+	return nil
+}
+
+// FormatTrustRoot encodes the server's certificate key for configuration:
+// "ed25519/" followed by the base64 public key.
+func FormatTrustRoot(serverPub []byte) string {
+	return trustRootPrefix + base64.StdEncoding.EncodeToString(serverPub)
+}
+
+// ParseTrustRoot reads a key in the form produced by FormatTrustRoot.
+func ParseTrustRoot(s string) ([]byte, error) {
+	b64, ok := strings.CutPrefix(s, trustRootPrefix)
+	if !ok {
+		return nil, fmt.Errorf("trust root must start with %q", trustRootPrefix)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("trust root must be a base64 Ed25519 public key")
+	}
+	return key, nil
+}
+
+func appendField(b, field []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(field)))
+	return append(b, field...)
+}
@@ -0,0 +1,138 @@
+package sealed
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"e2e_chat/internal/cryptographic/dh"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newIdentity(t *testing.T) (priv, pub []byte) {
+	t.Helper()
+
+	ikPriv, _, err := dh.NewX25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ik, err := dh.ConvertToECDHFormat(ikPriv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ikPriv[:], ik.PublicKey().Bytes()
+}
+
+func TestSealOpen(t *testing.T) {
+	priv, pub := newIdentity(t)
+	otherPriv, _ := newIdentity(t)
+	plaintext := []byte("from alice")
+
+	ephPub, ciphertext, err := Seal(pub, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Fatal("plaintext visible in the sealed box")
+	}
+
+	got, err := Open(priv, ephPub, ciphertext)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("open: %q, %v", got, err)
+	}
+
+	if _, err := Open(otherPriv, ephPub, ciphertext); err == nil {
+		t.Fatal("opened with another identity key")
+	}
+	tampered := bytes.Clone(ciphertext)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := Open(priv, ephPub, tampered); err == nil {
+		t.Fatal("opened a tampered box")
+	}
+
+	// a fresh ephemeral key every time
+	ephPub2, _, err := Seal(pub, plaintext)
+	if err != nil || bytes.Equal(ephPub, ephPub2) {
+		t.Fatalf("ephemeral key reused: %v", err)
+	}
+
+	if _, _, err := Seal(pub[:31], plaintext); err == nil {
+		t.Fatal("sealed to a short key")
+	}
+}
+
+func TestDeliveryToken(t *testing.T) {
+	key, err := NewProfileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewProfileKey()
+
+	a, err := DeliveryToken(key)
+	if err != nil || len(a) != DeliveryTokenSize {
+		t.Fatalf("token %x, %v", a, err)
+	}
+	b, _ := DeliveryToken(key)
+	c, _ := DeliveryToken(other)
+	if !bytes.Equal(a, b) || bytes.Equal(a, c) {
+		t.Fatal("token not derived from the profile key alone")
+	}
+
+	if _, err := DeliveryToken(key[:16]); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("short profile key: %v", err)
+	}
+}
+
+func TestCertificate(t *testing.T) {
+	serverPub, serverPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, ik := newIdentity(t)
+	now := time.Now()
+
+	cert := SignCertificate(serverPriv, "alice", "laptop", ik, now.Add(time.Hour))
+	if err := VerifyCertificate(serverPub, cert, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyCertificate(serverPub, cert, now.Add(time.Hour)); !errors.Is(err, ErrExpiredCertificate) {
+		t.Fatalf("expired: %v", err)
+	}
+	if err := VerifyCertificate(otherPub, cert, now); !errors.Is(err, ErrInvalidCertificate) {
+		t.Fatalf("other trust root: %v", err)
+	}
+	if err := VerifyCertificate(serverPub, nil, now); !errors.Is(err, ErrInvalidCertificate) {
+		t.Fatalf("no certificate: %v", err)
+	}
+
+	forged := *cert
+	forged.Sender = "mallory"
+	if err := VerifyCertificate(serverPub, &forged, now); !errors.Is(err, ErrInvalidCertificate) {
+		t.Fatalf("other sender: %v", err)
+	}
+	forged = *cert
+	forged.Expires += 3600
+	if err := VerifyCertificate(serverPub, &forged, now); !errors.Is(err, ErrInvalidCertificate) {
+		t.Fatalf("extended: %v", err)
+	}
+}
+
+func TestTrustRoot(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ParseTrustRoot(FormatTrustRoot(pub))
+	if err != nil || !bytes.Equal(got, pub) {
+		t.Fatalf("round trip: %x, %v", got, err)
+	}
+
+	for _, s := range []string{"", "AAAA", "ed25519/not base64!", "ed25519/AAAA", "x25519/" + FormatTrustRoot(pub)[len(trustRootPrefix):]} {
+		if _, err := ParseTrustRoot(s); err == nil {
+			t.Errorf("ParseTrustRoot(%q) accepted", s)
+		}
+	}
+}
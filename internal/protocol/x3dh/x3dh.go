@@ -116,3 +116,13 @@ func (s *X3DHReceiver) GenerateShareKey(rkb *model.ReceiverKeyBundle) ([]byte, e
 	}
 	return sk, nil
 }
+
+// SignedPrekeyPayload is what the owner signs to bind its signed prekey to
+// its identity key.
+func SignedPrekeyPayload(ikPub, spkPub []byte) []byte {
+	payload := make([]byte, 0, len("SignedPrekey")+len(ikPub)+len(spkPub))
+	payload = append(payload, "SignedPrekey"...)
+	payload = append(payload, ikPub...)
+	payload = append(payload, spkPub...)
+	return payload
+}
@@ -21,6 +21,14 @@ func NewUserRepo(db *mongo.Database) *UserRepo {
 	}
 }
 
+// NewLocalUserRepo keeps the client's own users, private keys included,
+// apart from the users a server registers.
+func NewLocalUserRepo(db *mongo.Database) *UserRepo {
+	return &UserRepo{
+		collection: db.Collection("local_users"),
+	}
+}
+
 func (r *UserRepo) GetByName(ctx context.Context, name string) (*model.User, error) {
 	filter := bson.M{
 		"name": name,
@@ -39,13 +47,21 @@ func (r *UserRepo) GetByName(ctx context.Context, name string) (*model.User, err
 	return &user, nil
 }
 
-func (r *UserRepo) Create(ctx context.Context, user *model.User) (primitive.ObjectID, error) {
+func (r *UserRepo) Create(ctx context.Context, user *model.User) error {
 	res, err := r.collection.InsertOne(ctx, user)
 	if err != nil {
-		return primitive.NilObjectID, err
+		return err
+	}
+
+	user.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (r *UserRepo) Update(ctx context.Context, user *model.User) error {
+	filter := bson.M{
+		"_id": user.ID,
 	}
 
-	id := res.InsertedID.(primitive.ObjectID)
-	user.ID = id
-	return id, nil
+	_, err := r.collection.ReplaceOne(ctx, filter, user)
+	return err
 }
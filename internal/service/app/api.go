@@ -1,28 +1,76 @@
 package app
 
 import (
+	"bytes"
+	"e2e_chat/internal/cryptographic/dh"
+	"e2e_chat/internal/cryptographic/signature"
 	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/auth"
+	"e2e_chat/internal/protocol/sealed"
+	"e2e_chat/internal/protocol/x3dh"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 var (
-	host string = "localhost:9090"
+	errLoginRejected   = errors.New("login rejected by server")
+	errDeliveryRefused = errors.New("sealed delivery refused by server")
+
+	errAttachmentTooLarge = errors.New("attachment too large for the server")
+	errAttachmentGone     = errors.New("attachment no longer on the server")
+	errOffsetMismatch     = errors.New("upload offset out of sync with the server")
+)
+
+type (
+	// rateLimitedError is a 429 from the server, which asks to wait
+	// retryAfter before trying again.
+	rateLimitedError struct {
+		retryAfter time.Duration
+	}
 )
 
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited by server, retry in %s", e.retryAfter)
+}
+
+func rateLimited(resp *http.Response) error {
+	seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	return &rateLimitedError{retryAfter: time.Duration(max(seconds, 0)) * time.Second}
+}
+
+func (c *App) httpScheme() string {
+	if c.tls {
+		return "https"
+	}
+	return "http"
+}
+
+func (c *App) wsScheme() string {
+	if c.tls {
+		return "wss"
+	}
+	return "ws"
+}
+
 func (c *App) getSharedKeysOfUser(name string) (*model.SharedKey, error) {
 	u := url.URL{
-		Scheme: "http",
-		Host:   host,
+		Scheme: c.httpScheme(),
+		Host:   c.host,
 		Path:   fmt.Sprintf("/keys/%s", name),
 	}
 
-	resp, err := http.Get(u.String())
+	resp, err := c.doAuthorized(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, u.String(), nil)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -30,6 +78,13 @@ func (c *App) getSharedKeysOfUser(name string) (*model.SharedKey, error) {
 	defer resp.Body.Close()
 	defer io.Copy(io.Discard, resp.Body)
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, rateLimited(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get shared keys failed: %s", resp.Status)
+	}
+
 	var sk model.SharedKey
 	err = json.NewDecoder(resp.Body).Decode(&sk)
 	if err != nil {
@@ -39,22 +94,538 @@ func (c *App) getSharedKeysOfUser(name string) (*model.SharedKey, error) {
 	return &sk, nil
 }
 
-func (c *App) initWebhook(name string) (*websocket.Conn, error) {
+func (c *App) getChallenge(name string) (*model.AuthChallenge, error) {
 	params := url.Values{
 		"userID": []string{name},
 	}
 
 	u := url.URL{
-		Scheme:   "ws",
-		Host:     host,
+		Scheme:   c.httpScheme(),
+		Host:     c.host,
+		Path:     "/challenge",
+		RawQuery: params.Encode(),
+	}
+
+	resp, err := c.httpClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, rateLimited(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get challenge failed: %s", resp.Status)
+	}
+
+	var challenge model.AuthChallenge
+	err = json.NewDecoder(resp.Body).Decode(&challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return &challenge, nil
+}
+
+// signChallenge fetches a fresh nonce and signs it with the identity signing key.
+func (c *App) signChallenge() (*model.AuthResponse, error) {
+	challenge, err := c.getChallenge(c.user.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.SignChallenge(c.user.SigPriv, c.user.Name, c.deviceID, challenge.Nonce, time.Now().Unix()), nil
+}
+
+func (c *App) initWebhook() (*websocket.Conn, error) {
+	authResp, err := c.signChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{
+		"userID":    []string{authResp.UserID},
+		"deviceID":  []string{authResp.DeviceID},
+		"nonce":     []string{base64.RawURLEncoding.EncodeToString(authResp.Nonce)},
+		"timestamp": []string{strconv.FormatInt(authResp.Timestamp, 10)},
+		"signature": []string{base64.RawURLEncoding.EncodeToString(authResp.Signature)},
+	}
+
+	u := url.URL{
+		Scheme:   c.wsScheme(),
+		Host:     c.host,
 		Path:     "/init",
 		RawQuery: params.Encode(),
 	}
 
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	conn, resp, err := c.dialer.Dial(u.String(), nil)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("%w: %v", errLoginRejected, err)
+		}
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			return nil, rateLimited(resp)
+		}
 		return nil, err
 	}
 
 	return conn, nil
 }
+
+// dialServer opens an authenticated websocket. A rejected login is retried
+// once after registering again, since the server may have lost our keys, e.g.
+// an in-memory server that restarted.
+func (c *App) dialServer() (*websocket.Conn, error) {
+	conn, err := c.initWebhook()
+	if !errors.Is(err, errLoginRejected) {
+		return conn, err
+	}
+
+	if err := c.register(); err != nil {
+		return nil, err
+	}
+	return c.initWebhook()
+}
+
+// register publishes our public keys. It is safe to repeat on every start.
+func (c *App) register() error {
+	u := url.URL{
+		Scheme: c.httpScheme(),
+		Host:   c.host,
+		Path:   "/register",
+	}
+
+	ikPriv, err := dh.ConvertToECDHFormat(c.user.IKPriv)
+	if err != nil {
+		return err
+	}
+
+	spkPriv, err := dh.ConvertToECDHFormat(c.user.SPKPriv)
+	if err != nil {
+		return err
+	}
+
+	deliveryToken, err := sealed.DeliveryToken(c.user.ProfileKey)
+	if err != nil {
+		return err
+	}
+
+	ikPub := ikPriv.PublicKey().Bytes()
+	spkPub := spkPriv.PublicKey().Bytes()
+	reg := &model.Registration{
+		Name:   c.user.Name,
+		IKPub:  ikPub,
+		SPKPub: spkPub,
+		SPKSig: signature.ED25519Sign(c.user.SigPriv, x3dh.SignedPrekeyPayload(ikPub, spkPub)),
+		SigPub: c.user.SigPub,
+
+		DeliveryToken: deliveryToken,
+		Timestamp:     time.Now().UnixMilli(),
+	}
+	auth.SignRegistration(c.user.SigPriv, reg)
+
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Post(u.String(), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("register failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// getCertificateKey fetches the key that signs sender certificates.
+func (c *App) getCertificateKey() ([]byte, error) {
+	u := url.URL{
+		Scheme: c.httpScheme(),
+		Host:   c.host,
+		Path:   "/certificate/key",
+	}
+
+	resp, err := c.httpClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get certificate key failed: %s", resp.Status)
+	}
+
+	var key model.CertificateKey
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		return nil, err
+	}
+	return key.PublicKey, nil
+}
+
+// getSenderCertificate asks the server to vouch for our identity key.
+func (c *App) getSenderCertificate() (*model.SenderCertificate, error) {
+	u := url.URL{
+		Scheme: c.httpScheme(),
+		Host:   c.host,
+		Path:   "/certificate",
+	}
+
+	resp, err := c.doAuthorized(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, u.String(), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get sender certificate failed: %s", resp.Status)
+	}
+
+	var cert model.SenderCertificate
+	if err := json.NewDecoder(resp.Body).Decode(&cert); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// postSealed submits a sealed message. It deliberately goes without our
+// access token, so the server cannot tell who sent it.
+func (c *App) postSealed(envelope *model.SealedEnvelope) (*model.Ack, error) {
+	u := url.URL{
+		Scheme: c.httpScheme(),
+		Host:   c.host,
+		Path:   "/sealed",
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Post(u.String(), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, errDeliveryRefused
+	case http.StatusTooManyRequests:
+		return nil, rateLimited(resp)
+	default:
+		return nil, fmt.Errorf("send sealed message failed: %s", resp.Status)
+	}
+
+	var ack model.Ack
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+// createUpload reserves an attachment blob of size bytes on the server.
+func (c *App) createUpload(size int64) (*model.Upload, error) {
+	u := url.URL{
+		Scheme: c.httpScheme(),
+		Host:   c.host,
+		Path:   "/attachments",
+	}
+
+	resp, err := c.doAuthorized(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+	case http.StatusTooManyRequests:
+		return nil, rateLimited(resp)
+	case http.StatusRequestEntityTooLarge:
+		return nil, errAttachmentTooLarge
+	default:
+		return nil, fmt.Errorf("create upload failed: %s", resp.Status)
+	}
+
+	var upload model.Upload
+	if err := json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// uploadOffset asks how many bytes of an upload the server has, to resume
+// it from there.
+func (c *App) uploadOffset(id string) (int64, error) {
+	u := url.URL{
+		Scheme: c.httpScheme(),
+		Host:   c.host,
+		Path:   "/attachments/" + id,
+	}
+
+	resp, err := c.doAuthorized(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, u.String(), nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, fmt.Errorf("get upload offset failed: %s", resp.Status)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// uploadChunk sends chunk to be stored at offset and returns the offset the
+// server has now. On a conflict the server's offset is returned with
+// errOffsetMismatch, so the caller can continue from there.
+func (c *App) uploadChunk(id string, offset int64, chunk []byte) (int64, error) {
+	u := url.URL{
+		Scheme: c.httpScheme(),
+		Host:   c.host,
+		Path:   "/attachments/" + id,
+	}
+
+	resp, err := c.doAuthorized(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPatch, u.String(), bytes.NewReader(chunk))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		return req, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+	case http.StatusConflict:
+		next, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("upload chunk failed: %s", resp.Status)
+		}
+		return next, errOffsetMismatch
+	default:
+		return 0, fmt.Errorf("upload chunk failed: %s", resp.Status)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// downloadAttachment appends at most limit bytes of the blob id to dst,
+// which already holds its first offset bytes, so an interrupted download
+// picks up where it stopped.
+func (c *App) downloadAttachment(id string, dst io.Writer, offset, limit int64) error {
+	u := url.URL{
+		Scheme: c.httpScheme(),
+		Host:   c.host,
+		Path:   "/attachments/" + id,
+	}
+
+	resp, err := c.doAuthorized(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+	case offset == 0 && resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusNotFound:
+		return errAttachmentGone
+	default:
+		return fmt.Errorf("download attachment failed: %s", resp.Status)
+	}
+
+	_, err = io.Copy(dst, io.LimitReader(resp.Body, limit))
+	return err
+}
+
+// login exchanges a signed challenge for a pair of session tokens.
+func (c *App) login() error {
+	authResp, err := c.signChallenge()
+	if err != nil {
+		return err
+	}
+
+	tokens, err := c.postTokens("/auth/login", authResp)
+	if err != nil {
+		return err
+	}
+
+	c.tokenMu.Lock()
+	c.tokens = tokens
+	c.tokenMu.Unlock()
+	return nil
+}
+
+func (c *App) refreshTokens() error {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if c.tokens == nil {
+		return fmt.Errorf("not logged in")
+	}
+
+	tokens, err := c.postTokens("/auth/refresh", &model.RefreshRequest{
+		RefreshToken: c.tokens.RefreshToken,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.tokens = tokens
+	return nil
+}
+
+func (c *App) revokeTokens() error {
+	c.tokenMu.Lock()
+	tokens := c.tokens
+	c.tokenMu.Unlock()
+
+	if tokens == nil {
+		return nil
+	}
+
+	u := url.URL{
+		Scheme: c.httpScheme(),
+		Host:   c.host,
+		Path:   "/auth/revoke",
+	}
+
+	data, err := json.Marshal(&model.RevokeRequest{
+		RefreshToken: tokens.RefreshToken,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("revoke failed: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *App) postTokens(path string, body any) (*model.TokenPair, error) {
+	u := url.URL{
+		Scheme: c.httpScheme(),
+		Host:   c.host,
+		Path:   path,
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Post(u.String(), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s failed: %s", path, resp.Status)
+	}
+
+	var tokens model.TokenPair
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokens, nil
+}
+
+// doAuthorized sends the request with the current access token. On a 401 it
+// refreshes the session (falling back to a fresh login) and retries once.
+func (c *App) doAuthorized(newReq func() (*http.Request, error)) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		c.tokenMu.Lock()
+		if c.tokens != nil {
+			req.Header.Set("Authorization", "Bearer "+c.tokens.AccessToken)
+		}
+		c.tokenMu.Unlock()
+
+		return c.httpClient.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if err := c.refreshTokens(); err != nil {
+		if err := c.login(); err != nil {
+			return nil, err
+		}
+	}
+
+	return send()
+}
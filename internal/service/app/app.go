@@ -2,14 +2,21 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
 	"e2e_chat/internal/cryptographic/dh"
+	"e2e_chat/internal/cryptographic/signature"
 	"e2e_chat/internal/model"
 	"e2e_chat/internal/protocol/doubleratchet"
-	userRepo "e2e_chat/internal/repository/user"
-	"e2e_chat/internal/service/redis"
+	"e2e_chat/internal/protocol/x3dh"
+	"e2e_chat/internal/storage"
 	"e2e_chat/internal/utils/log"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/gorilla/websocket"
@@ -20,13 +27,27 @@ import (
 type (
 	App struct {
 		app     *tview.Application
+		pages   *tview.Pages
 		chatbox *tview.TextView
 		input   *tview.InputField
 
-		redisService *redis.RedisService
+		stateStore storage.StateStore
 
-		userRepo *userRepo.UserRepo
+		// server host:port
+		host       string
+		tls        bool
+		httpClient *http.Client
+		dialer     *websocket.Dialer
+
+		users    storage.UserStore
 		user     *model.User
+		deviceID string
+
+		// where received attachments are saved
+		downloadDir string
+
+		tokenMu sync.Mutex
+		tokens  *model.TokenPair
 
 		state *doubleratchet.RatchetState
 
@@ -36,69 +57,276 @@ type (
 		// Only needed before ratchet state is initialized
 		ekPriv []byte
 
-		conn *websocket.Conn
+		// the current session with the peer and the handshakes used so
+		// far, loaded with the state
+		session *sessionRecord
+
+		ws *connManager
+
+		// sealed sender: the key that signs sender certificates, our own
+		// certificate and the recipient's profile key, once it shared it
+		sealMu         sync.Mutex
+		trustRoot      []byte // pinned certificate key, if configured
+		serverKey      []byte
+		senderCert     *model.SenderCertificate
+		peerProfileKey []byte
+
+		// encrypted frames not yet accepted by the server
+		outbox   []*model.Frame
+		outboxMu sync.Mutex
+
+		// received attachments not saved yet, or saved and removed when
+		// their message disappears
+		downloads   []*download
+		downloadsMu sync.Mutex
+
+		// IDs of messages already processed, to drop redeliveries, and the
+		// order they were processed in
+		seen      map[string]bool
+		seenOrder []string
+		seenMu    sync.Mutex
+
+		// guards state, ekPriv and session
+		ratchetMu sync.Mutex
+
+		// chatbox contents and delivery status of our own messages
+		chatMu  sync.Mutex
+		lines   []*chatLine
+		pending map[string]*chatLine // by client ID, until accepted
+		sent    map[string]*chatLine // by server ID
+		unread  []string
+
+		// shown in the chatbox title, guarded by chatMu
+		connState connState
+		retryIn   time.Duration
+
+		// disappearing messages timer of the conversation, zero when off,
+		// guarded by chatMu
+		expireTimer time.Duration
+
+		// encrypted local history of the conversation and the oldest page
+		// shown in the chatbox. Taken before chatMu when both are held.
+		historyMu          sync.Mutex
+		historyKey         []byte
+		history            *historyIndex
+		historyShown       int
+		historyRetention   time.Duration
+		historyMaxMessages int
+
+		// search index of each history page read so far, guarded by
+		// historyMu
+		searchShards map[int]*searchShard
 	}
 )
 
-func NewApp(userRepo *userRepo.UserRepo, redis *redis.RedisService) *App {
+func NewApp(users storage.UserStore, stateStore storage.StateStore) *App {
+	deviceID, err := os.Hostname()
+	if err != nil || deviceID == "" {
+		deviceID = "default"
+	}
+
 	return &App{
-		app:          tview.NewApplication(),
-		userRepo:     userRepo,
-		redisService: redis,
+		app:         tview.NewApplication(),
+		host:        "localhost:9090",
+		httpClient:  http.DefaultClient,
+		dialer:      websocket.DefaultDialer,
+		users:       users,
+		stateStore:  stateStore,
+		deviceID:    deviceID,
+		downloadDir: "downloads",
+		seen:        make(map[string]bool),
+		pending:     make(map[string]*chatLine),
+		sent:        make(map[string]*chatLine),
+
+		searchShards: make(map[int]*searchShard),
 	}
 }
 
+// SetServerAddr sets the host:port of the chat server.
+func (c *App) SetServerAddr(host string) {
+	c.host = host
+}
+
+// SetTLSConfig switches the client to https and wss using cfg, which carries
+// the trusted roots and pinning checks.
+func (c *App) SetTLSConfig(cfg *tls.Config) {
+	c.tls = true
+	c.httpClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: cfg,
+		},
+	}
+	c.dialer = &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		TLSClientConfig:  cfg,
+	}
+}
+
+// SetTrustRoot pins the Ed25519 key sender certificates must be signed with.
+// Without it the key the server presents first is remembered and trusted.
+func (c *App) SetTrustRoot(serverPub []byte) {
+	c.trustRoot = serverPub
+}
+
 func (c *App) Run(ctx context.Context, name string) {
-	user, err := c.getUserAndCreateIfNotExist(ctx, name)
-	if err != nil {
-		log.Fatal("get user info failed", zap.Error(err))
+	if err := c.signIn(ctx, name); err != nil {
+		log.Fatal("sign in failed", zap.Error(err))
 	}
-	c.user = user
 
 	var toName string
 	fmt.Print("Enter recipient's name: ")
-	_, err = fmt.Scan(&toName) // reads until whitespace
+	_, err := fmt.Scan(&toName) // reads until whitespace
 	if err != nil {
 		fmt.Println("error:", err)
 		return
 	}
+
+	if err := c.openConversation(ctx, toName); err != nil {
+		log.Fatal("open conversation failed", zap.Error(err))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go c.expireMessages(ctx)
+
+	c.buildUI()
+	c.connect()
+	if err := c.app.Run(); err != nil {
+		log.Fatal("cannot init app", zap.Error(err))
+	}
+}
+
+// signIn loads or creates user name, publishes its keys and logs in.
+func (c *App) signIn(ctx context.Context, name string) error {
+	user, err := c.getUserAndCreateIfNotExist(ctx, name)
+	if err != nil {
+		return fmt.Errorf("get user info: %w", err)
+	}
+	c.user = user
+
+	if err := c.register(); err != nil {
+		return fmt.Errorf("register with server: %w", err)
+	}
+
+	if err := c.login(); err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	return nil
+}
+
+// openConversation fetches the keys of toName and loads what is kept
+// locally about the conversation.
+func (c *App) openConversation(ctx context.Context, toName string) error {
 	c.toName = toName
 
+	if err := c.addConversation(ctx, toName); err != nil {
+		return fmt.Errorf("save conversation: %w", err)
+	}
+
 	toSharedKeys, err := c.getSharedKeysOfUser(c.toName)
 	if err != nil {
-		log.Fatal("cannot init share_secret", zap.Error(err))
+		return fmt.Errorf("cannot init share_secret: %w", err)
 	}
 
-	// if !signature.ED25519Verify(toSharedKeys.IKPub, toSharedKeys.SPKPub, toSharedKeys.Signature) {
-	// 	log.Fatal("verify spkPub failed")
-	// }
+	if toSharedKeys.Signature == nil {
+		log.Warn("recipient has not signed its prekey yet", zap.String("name", c.toName))
+	} else if !signature.ED25519Verify(toSharedKeys.SigPub, x3dh.SignedPrekeyPayload(toSharedKeys.IKPub, toSharedKeys.SPKPub), toSharedKeys.Signature) {
+		return errors.New("verify spkPub failed")
+	}
 	c.toSharedKeys = toSharedKeys
 
-	c.conn, err = c.initWebhook(c.user.Name)
-	if err != nil {
-		log.Fatal("init webhook to server failed", zap.Error(err))
+	if err := c.loadSeen(ctx); err != nil {
+		return fmt.Errorf("load delivered message IDs: %w", err)
+	}
+
+	if err := c.loadOutbox(ctx); err != nil {
+		return fmt.Errorf("load outbox: %w", err)
+	}
+
+	if err := c.loadSealed(ctx); err != nil {
+		return fmt.Errorf("load sealed sender keys: %w", err)
+	}
+
+	if err := c.loadExpireTimer(ctx); err != nil {
+		return fmt.Errorf("load expire timer: %w", err)
+	}
+
+	if err := c.loadHistory(ctx); err != nil {
+		return fmt.Errorf("load history: %w", err)
+	}
+
+	// encrypted under the history key
+	if err := c.loadDownloads(ctx); err != nil {
+		return fmt.Errorf("load downloads: %w", err)
 	}
+	return nil
+}
+
+// connect keeps the websocket to the server up in the background.
+func (c *App) connect() {
+	c.ws = newConnManager(c.dialServer, c.handleFrame, c.onConnected, c.setConnState)
+	go c.ws.run()
+}
 
-	go c.listenOnWebhook()
-	c.renderUI()
+// onConnected runs after every connect: unsent frames go out first, then
+// attachments that could not be downloaded are retried.
+func (c *App) onConnected() {
+	c.flushOutbox()
+	go c.resumeDownloads()
 }
 
 func (c *App) Stop() {
+	if c.ws != nil {
+		c.ws.close()
+	}
+
+	c.ratchetMu.Lock()
 	c.SaveState(context.TODO(), c.user.Name, c.toName, c.state)
+	c.ratchetMu.Unlock()
+	c.saveSeen(context.TODO())
+
+	if err := c.revokeTokens(); err != nil {
+		log.Warn("revoke session failed", zap.Error(err))
+	}
 }
 
-// blocking function
-func (c *App) renderUI() {
+// buildUI lays out the chatbox and the message field. It must run before
+// anything is drawn, and c.app.Run shows it.
+func (c *App) buildUI() {
 	c.chatbox = tview.NewTextView().
 		SetDynamicColors(true).
-		SetScrollable(true)
-	c.chatbox.SetBorder(true).SetTitle(fmt.Sprintf(" Chat with %s ", c.toName))
+		SetRegions(true).
+		SetScrollable(true).
+		ScrollToEnd()
+	c.chatbox.SetBorder(true).SetTitle(c.chatTitle())
+	c.chatbox.SetText(c.renderChat()) // the history loaded at start, the app is not running yet
 
 	c.input = tview.NewInputField().
 		SetLabel("Message: ").
 		SetFieldWidth(0)
 	c.input.SetBorder(true).SetTitle(" New Message ")
 
+	// typing in the conversation means everything shown so far has been read
+	c.input.SetChangedFunc(func(text string) {
+		go func() {
+			if err := c.sendReceipt(model.ReceiptRead, c.takeUnread()); err != nil {
+				log.Error("send read receipt failed", zap.Error(err))
+			}
+		}()
+	})
+
+	// the chatbox never has focus, so the page keys scroll it from here
+	c.input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyPgUp, tcell.KeyPgDn:
+			c.scrollChat(event)
+			return nil
+		}
+		return event
+	})
+
 	// This is the key change: We set the input capture on the input field itself.
 	c.input.SetDoneFunc(func(key tcell.Key) {
 		if key == tcell.KeyEnter {
@@ -106,6 +334,12 @@ func (c *App) renderUI() {
 			if text == "" {
 				return
 			}
+			c.chatbox.Highlight().ScrollToEnd()
+
+			if c.runCommand(text) {
+				c.input.SetText("")
+				return
+			}
 
 			go func(msg string) {
 				err := c.SendMessage(msg)
@@ -123,37 +357,81 @@ func (c *App) renderUI() {
 		AddItem(c.chatbox, 0, 1, false).
 		AddItem(c.input, 3, 0, true)
 
-	if err := c.app.SetRoot(layout, true).SetFocus(c.input).Run(); err != nil {
-		log.Fatal("cannot init app", zap.Error(err))
-	}
+	// search results open on top of the chat
+	c.pages = tview.NewPages().
+		AddPage("chat", layout, true, true)
+
+	c.app.SetRoot(c.pages, true).SetFocus(c.input)
 }
 
-func (c *App) listenOnWebhook() {
-	for {
-		_, data, err := c.conn.ReadMessage()
-		if err != nil {
-			log.Debug("worker web socket closed", zap.Error(err))
-			c.conn.Close()
-			break
-		}
+func (c *App) setConnState(state connState, retryIn time.Duration) {
+	c.chatMu.Lock()
+	c.connState = state
+	c.retryIn = retryIn
+	c.chatMu.Unlock()
 
-		var message model.Message
-		err = json.Unmarshal(data, &message)
-		if err != nil {
-			log.Error("Unmarshal message failed", zap.Error(err))
-			continue
+	c.app.QueueUpdateDraw(func() {
+		if c.chatbox != nil {
+			c.chatbox.SetTitle(c.chatTitle())
 		}
+	})
+}
 
-		if err := c.ReceiveMessage(&message); err != nil {
-			c.app.Suspend(func() {
-				log.Info("root key receiver: ", zap.String("RK", fmt.Sprintf("%x\n", c.state.RootKey)))
-				log.Error("receive message failed: ", zap.Error(err))
-			})
-		}
+func (c *App) chatTitle() string {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	state := c.connState.String()
+	if c.connState == connOffline && c.retryIn > 0 {
+		state = fmt.Sprintf("offline, retrying in %s", c.retryIn.Round(time.Second))
 	}
+	if c.expireTimer > 0 {
+		state += fmt.Sprintf(" · ⏱ %s", formatTimer(c.expireTimer))
+	}
+	return fmt.Sprintf(" Chat with %s · %s ", c.toName, state)
 }
 
 func (c *App) SendMessage(msg string) error {
+	clientID := newClientID()
+	timer := c.getExpireTimer()
+	c.addOutgoingLine(clientID, msg, timer)
+	c.app.QueueUpdate(func() {
+		c.input.SetText("")
+	})
+
+	return c.sendContent(clientID, &model.Content{
+		Type:        model.ContentText,
+		Text:        msg,
+		ExpireTimer: int64(timer / time.Second),
+	})
+}
+
+// sendReceipt reports the given incoming messages as delivered or read.
+func (c *App) sendReceipt(status model.ReceiptStatus, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return c.sendContent(newClientID(), &model.Content{
+		Type: model.ContentReceipt,
+		Receipt: &model.Receipt{
+			Status:     status,
+			MessageIDs: ids,
+		},
+	})
+}
+
+// sendContent encrypts content with the ratchet, stores it in the outbox and
+// sends it to the server if connected. The ratchet lock is held until the
+// frame is written so that messages leave in the same order as their ratchet
+// message numbers.
+func (c *App) sendContent(clientID string, content *model.Content) error {
+	// lets the recipient answer with sealed messages
+	content.ProfileKey = c.user.ProfileKey
+
+	c.ratchetMu.Lock()
+	defer c.ratchetMu.Unlock()
+
 	var x3dhHandshake *model.X3DHHandshake = nil
 
 	// try to retrieve state from cache first
@@ -164,6 +442,9 @@ func (c *App) SendMessage(msg string) error {
 		}
 		c.state = state
 	}
+	if err := c.loadSession(context.TODO()); err != nil {
+		return err
+	}
 
 	if c.state == nil {
 		ekPriv, ekPub, err := dh.NewX25519KeyPair()
@@ -173,7 +454,7 @@ func (c *App) SendMessage(msg string) error {
 
 		c.ekPriv = ekPriv[:]
 
-		err = c.initSendingState()
+		err = c.initSendingState(ekPub[:])
 		if err != nil {
 			return err
 		}
@@ -183,51 +464,86 @@ func (c *App) SendMessage(msg string) error {
 		}
 	}
 
-	hdr, ciphertext, err := c.state.Send([]byte(msg))
+	// the handshake message tells how new its session is, authenticated
+	// by the session itself
+	if x3dhHandshake != nil {
+		content.SessionStarted = c.session.Started
+	}
+	plaintext, err := json.Marshal(content)
 	if err != nil {
 		return err
 	}
 
-	c.conn.WriteJSON(&model.Message{
-		From:          c.user.Name,
-		To:            c.toName,
-		Header:        hdr,
-		Ciphertext:    ciphertext,
-		X3DHHandShake: x3dhHandshake,
-	})
+	hdr, ciphertext, err := c.state.Send(plaintext)
+	if err != nil {
+		return err
+	}
 
-	c.app.QueueUpdateDraw(func() {
-		fmt.Fprintf(c.chatbox, "[yellow]You:[-] %s\n", msg)
-		c.input.SetText("")
-		c.chatbox.ScrollToEnd()
-	})
+	// saved before the message is queued or sent, so that a crash can lose
+	// this message but never hand out its key again
+	if err := c.SaveState(context.TODO(), c.user.Name, c.toName, c.state); err != nil {
+		return err
+	}
+	if x3dhHandshake != nil {
+		if err := c.SaveSession(context.TODO(), c.user.Name, c.toName, c.session); err != nil {
+			return err
+		}
+	}
+
+	frame := &model.Frame{
+		Type: model.FrameMessage,
+		Message: &model.Message{
+			ClientID:      clientID,
+			From:          c.user.Name,
+			To:            c.toName,
+			Header:        hdr,
+			Ciphertext:    ciphertext,
+			X3DHHandShake: x3dhHandshake,
+		},
+	}
+
+	// a disappearing message is not kept queued for longer than it is shown
+	if content.Type == model.ContentText || content.Type == model.ContentAttachment {
+		frame.Message.TTL = content.ExpireTimer
+	}
+
+	if err := c.addToOutbox(frame); err != nil {
+		return err
+	}
+
+	if err := c.transmit(frame); err != nil {
+		// the outbox sends it once we are back online
+		log.Debug("message kept in outbox", zap.String("clientID", clientID), zap.Error(err))
+	}
 	return nil
 }
 
-func (c *App) ReceiveMessage(message *model.Message) error {
+func (c *App) ReceiveMessage(message *model.Message) (*model.Content, error) {
+	c.ratchetMu.Lock()
+	defer c.ratchetMu.Unlock()
+
 	if c.state == nil {
 		state, err := c.GetState(context.TODO(), c.user.Name, c.toName)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("%w: %w", errLoadSession, err)
 		}
 		c.state = state
 	}
 
-	if c.state == nil || (message.X3DHHandShake != nil && message.X3DHHandShake.EKPub != nil) {
-		err := c.initReceiverState(message)
-		if err != nil {
-			return err
-		}
+	if err := c.loadSession(context.TODO()); err != nil {
+		return nil, fmt.Errorf("%w: %w", errLoadSession, err)
+	}
+
+	if message.X3DHHandShake != nil && message.X3DHHandShake.EKPub != nil {
+		return c.receiveHandshake(message)
+	}
+	if c.state == nil {
+		return nil, errNoSession
 	}
 
 	msgBytes, err := c.state.Receive(*message.Header, message.Ciphertext)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	c.app.QueueUpdateDraw(func() {
-		fmt.Fprintf(c.chatbox, ("[green]%s:[-] %s\n"), message.From, string(msgBytes))
-		c.chatbox.ScrollToEnd()
-	})
-	return nil
+	return parseContent(msgBytes), nil
 }
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"e2e_chat/internal/service/server"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/memory"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+const testTimeout = 10 * time.Second
+
+type (
+	// testServer is an in-memory relay on a local port. Clients created for
+	// it connect with clientTLS when set.
+	testServer struct {
+		*server.HttpServer
+		addr      string
+		users     storage.UserStore
+		queue     storage.MessageQueue
+		blobs     storage.BlobStore
+		clientTLS *tls.Config
+	}
+)
+
+// newTestServer starts a relay after applying configure to it.
+func newTestServer(t testing.TB, configure ...func(*server.HttpServer)) *testServer {
+	t.Helper()
+
+	users := memory.NewUserStore()
+	queue := memory.NewMessageQueue(storage.DefaultQueueMaxLen, storage.DefaultQueueRetention)
+	s := server.NewHttpServer(
+		users,
+		queue,
+		memory.NewStateStore(),
+		memory.NewBroker(),
+	)
+	blobs := memory.NewBlobStore()
+	s.SetBlobStore(blobs, storage.DefaultAttachmentMaxSize, storage.DefaultQueueRetention)
+	for _, f := range configure {
+		f(s)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s.SetAddr(addr)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start server: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return &testServer{HttpServer: s, addr: addr, users: users, queue: queue, blobs: blobs}
+}
+
+// newTestClient signs name in on s with fresh local storage.
+func newTestClient(t testing.TB, s *testServer, name string) *App {
+	t.Helper()
+	return newTestClientOn(t, s, name, memory.NewUserStore(), memory.NewStateStore())
+}
+
+// newTestClientOn signs name in with the given local storage, as a restarted
+// client would.
+func newTestClientOn(t testing.TB, s *testServer, name string, users storage.UserStore, state storage.StateStore) *App {
+	t.Helper()
+
+	c := NewApp(users, state)
+	c.SetServerAddr(s.addr)
+	c.SetDownloadDir(t.TempDir())
+	if s.clientTLS != nil {
+		c.SetTLSConfig(s.clientTLS)
+	}
+
+	if err := c.signIn(t.Context(), name); err != nil {
+		t.Fatalf("sign in %s: %v", name, err)
+	}
+	return c
+}
+
+// open starts the conversation with peer, headless, and waits until the
+// client is online. The peer must have signed in.
+func (c *App) open(t testing.TB, peer string) {
+	t.Helper()
+
+	if err := c.openConversation(t.Context(), peer); err != nil {
+		t.Fatalf("open conversation with %s: %v", peer, err)
+	}
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	c.app.SetScreen(screen)
+	c.buildUI()
+
+	ran := make(chan struct{})
+	go func() {
+		defer close(ran)
+		c.app.Run()
+	}()
+
+	// as Run does
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.expireMessages(ctx)
+
+	c.connect()
+	t.Cleanup(func() {
+		cancel()
+		c.ws.close()
+		c.app.Stop()
+		<-ran
+
+		// a spare connection the transport dialed but never used holds
+		// up the server shutdown for seconds
+		c.httpClient.CloseIdleConnections()
+	})
+
+	waitFor(t, func() bool { return c.connStateIs(connOnline) }, c.user.Name+" online")
+}
+
+func (c *App) connStateIs(state connState) bool {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	return c.connState == state
+}
+
+// line returns a copy of the message line with text, if shown.
+func (c *App) line(text string) (chatLine, bool) {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	for _, line := range c.lines {
+		if !line.notice && line.text == text {
+			return *line, true
+		}
+	}
+	return chatLine{}, false
+}
+
+func (c *App) hasNotice(substr string) bool {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	for _, line := range c.lines {
+		if line.notice && strings.Contains(line.text, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitLine waits until the message line with text matches cond.
+func (c *App) waitLine(t testing.TB, text string, cond func(chatLine) bool, what string) chatLine {
+	t.Helper()
+
+	var line chatLine
+	waitFor(t, func() bool {
+		var ok bool
+		line, ok = c.line(text)
+		return ok && cond(line)
+	}, what)
+	return line
+}
+
+func (c *App) send(t testing.TB, text string) {
+	t.Helper()
+
+	if err := c.SendMessage(text); err != nil {
+		t.Fatalf("send %q: %v", text, err)
+	}
+}
+
+func waitFor(t testing.TB, cond func() bool, what string) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
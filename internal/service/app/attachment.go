@@ -0,0 +1,478 @@
+package app
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/attachment"
+	"e2e_chat/internal/utils/log"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// uploadChunkSize is what is lost at most when a connection drops mid
+	// upload; the rest resumes from the server's offset.
+	uploadChunkSize = 256 << 10
+
+	// transferAttempts bounds consecutive failed requests of one upload or
+	// download.
+	transferAttempts = 5
+)
+
+var (
+	errInvalidAttachment   = errors.New("invalid attachment")
+	errDownloadInterrupted = errors.New("download interrupted")
+)
+
+type (
+	// download is a received attachment, kept until it is saved or, for a
+	// disappearing message, until the message expires and the saved file
+	// goes with it.
+	download struct {
+		MessageID  string            `json:"message_id"`
+		From       string            `json:"from"`
+		Attachment *model.Attachment `json:"attachment"`
+		Path       string            `json:"path,omitempty"`    // once saved
+		Expires    int64             `json:"expires,omitempty"` // unix millis, 0 if never
+
+		running bool
+	}
+)
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func attachmentLine(a *model.Attachment) string {
+	return fmt.Sprintf("📎 %s (%s)", a.Name, formatSize(a.Size))
+}
+
+// SetDownloadDir sets where received attachments are saved.
+func (c *App) SetDownloadDir(dir string) {
+	c.downloadDir = dir
+}
+
+func (c *App) runAttachCommand(arg string) {
+	path := strings.TrimSpace(arg)
+	if path == "" {
+		c.addNotice(fmt.Sprintf("%s: usage: %s <path>", attachCommand, attachCommand))
+		return
+	}
+
+	if err := c.SendAttachment(path); err != nil {
+		c.addNotice(fmt.Sprintf("%s: %v", attachCommand, err))
+	}
+}
+
+// SendAttachment encrypts the file at path with a fresh key, uploads the
+// blob and sends the recipient a message with its ID, key and digest. The
+// chat line shows as pending until the message is accepted, and as failed
+// when the upload gives up.
+func (c *App) SendAttachment(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	key, err := attachment.NewKey()
+	if err != nil {
+		return err
+	}
+
+	// the blob is resent from here whenever a chunk has to be repeated
+	blob, err := os.CreateTemp("", "e2e-attachment-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(blob.Name())
+	defer blob.Close()
+
+	digest, size, err := attachment.Encrypt(blob, f, key)
+	if err != nil {
+		return err
+	}
+
+	a := &model.Attachment{
+		Name:        fi.Name(),
+		ContentType: mime.TypeByExtension(filepath.Ext(fi.Name())),
+		Size:        size,
+		BlobSize:    attachment.BlobSize(size),
+		Key:         key,
+		Digest:      digest,
+	}
+
+	clientID := newClientID()
+	timer := c.getExpireTimer()
+	c.addOutgoingLine(clientID, attachmentLine(a), timer)
+
+	upload, err := c.createUpload(a.BlobSize)
+	if err == nil {
+		a.ID = upload.ID
+		err = c.uploadBlob(upload.ID, blob, a.BlobSize)
+	}
+	if err != nil {
+		c.markFailed(clientID, err.Error())
+		return nil
+	}
+
+	return c.sendContent(clientID, &model.Content{
+		Type:        model.ContentAttachment,
+		Attachment:  a,
+		ExpireTimer: int64(timer / time.Second),
+	})
+}
+
+// uploadBlob sends the blob in chunks. After a failed chunk it asks the
+// server how much arrived and resumes from there.
+func (c *App) uploadBlob(id string, blob io.ReaderAt, size int64) error {
+	buf := make([]byte, uploadChunkSize)
+	offset, failures := int64(0), 0
+
+	for offset < size {
+		n, err := blob.ReadAt(buf[:min(int64(len(buf)), size-offset)], offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		next, err := c.uploadChunk(id, offset, buf[:n])
+		if err == nil || errors.Is(err, errOffsetMismatch) {
+			offset = next
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		if failures >= transferAttempts {
+			return err
+		}
+		log.Debug("upload chunk failed, resuming", zap.String("id", id), zap.Int64("offset", offset), zap.Error(err))
+		time.Sleep(max(backoff(failures), retryAfter(err)))
+
+		if !errors.Is(err, errOffsetMismatch) {
+			if next, err := c.uploadOffset(id); err == nil {
+				offset = next
+			}
+		}
+	}
+	return nil
+}
+
+// checkAttachment rejects a pointer that could not have come from
+// SendAttachment, before anything is fetched for it.
+func checkAttachment(a *model.Attachment) error {
+	if id, err := hex.DecodeString(a.ID); err != nil || len(id) != 16 {
+		return fmt.Errorf("%w: id %q", errInvalidAttachment, a.ID)
+	}
+	if len(a.Key) != attachment.KeySize || len(a.Digest) != attachment.DigestSize {
+		return fmt.Errorf("%w: key or digest", errInvalidAttachment)
+	}
+	if a.Size < 0 || a.BlobSize != attachment.BlobSize(a.Size) {
+		return fmt.Errorf("%w: size", errInvalidAttachment)
+	}
+	return nil
+}
+
+// addDownload records an attachment before its message is acked, so that a
+// download cut off by a lost connection or a restart is resumed. It returns
+// nil when the message was already handled.
+func (c *App) addDownload(message *model.Message, a *model.Attachment, timer time.Duration) *download {
+	c.downloadsMu.Lock()
+	defer c.downloadsMu.Unlock()
+
+	if slices.ContainsFunc(c.downloads, func(d *download) bool { return d.MessageID == message.ID }) {
+		return nil
+	}
+
+	d := &download{
+		MessageID:  message.ID,
+		From:       message.From,
+		Attachment: a,
+		running:    true,
+	}
+	if expires := expiry(timer); !expires.IsZero() {
+		d.Expires = expires.UnixMilli()
+	}
+	c.downloads = append(c.downloads, d)
+
+	if err := c.saveDownloads(context.TODO()); err != nil {
+		log.Error("save downloads failed", zap.Error(err))
+	}
+	return d
+}
+
+// resumeDownloads retries the attachments that are not saved yet, one at a
+// time.
+func (c *App) resumeDownloads() {
+	c.downloadsMu.Lock()
+	var resume []*download
+	for _, d := range c.downloads {
+		if d.Path == "" && !d.running {
+			d.running = true
+			resume = append(resume, d)
+		}
+	}
+	c.downloadsMu.Unlock()
+
+	for _, d := range resume {
+		c.receiveAttachment(d)
+	}
+}
+
+// receiveAttachment downloads, verifies and saves an attachment in the
+// download directory, and reports the outcome in the chatbox.
+func (c *App) receiveAttachment(d *download) {
+	a := d.Attachment
+	path, err := c.saveAttachment(a)
+	c.finishDownload(d, path, err)
+
+	switch {
+	case errors.Is(err, errDownloadInterrupted):
+		log.Warn("download attachment failed, resuming later", zap.String("id", a.ID), zap.Error(err))
+		c.addNotice(fmt.Sprintf("could not save %s from %s yet, retrying after reconnecting: %v", a.Name, d.From, err))
+	case err != nil:
+		log.Warn("save attachment failed", zap.String("id", a.ID), zap.Error(err))
+		c.addNotice(fmt.Sprintf("could not save %s from %s: %v", a.Name, d.From, err))
+	default:
+		c.addNotice(fmt.Sprintf("saved %s from %s to %s", a.Name, d.From, path))
+	}
+}
+
+// finishDownload updates the record of d after an attempt. Only an
+// interrupted download is retried; a saved file is remembered while its
+// message can still expire.
+func (c *App) finishDownload(d *download, path string, err error) {
+	c.downloadsMu.Lock()
+	defer c.downloadsMu.Unlock()
+
+	d.running = false
+	i := slices.Index(c.downloads, d)
+	if i < 0 {
+		// the message expired while the attachment was downloading
+		c.removeDownload(d, path)
+		return
+	}
+
+	switch {
+	case errors.Is(err, errDownloadInterrupted):
+		return
+	case err == nil && d.Expires != 0:
+		d.Path = path
+	default:
+		c.downloads = slices.Delete(c.downloads, i, i+1)
+	}
+
+	if err := c.saveDownloads(context.TODO()); err != nil {
+		log.Error("save downloads failed", zap.Error(err))
+	}
+}
+
+// expireDownloads removes the files of attachments whose message
+// disappeared, saved or still downloading.
+func (c *App) expireDownloads(now time.Time) {
+	c.downloadsMu.Lock()
+	defer c.downloadsMu.Unlock()
+
+	n := len(c.downloads)
+	c.downloads = slices.DeleteFunc(c.downloads, func(d *download) bool {
+		if d.Expires == 0 || now.UnixMilli() < d.Expires {
+			return false
+		}
+		// a running download is cleaned up when it finishes
+		if !d.running {
+			c.removeDownload(d, d.Path)
+		}
+		return true
+	})
+	if len(c.downloads) == n {
+		return
+	}
+
+	if err := c.saveDownloads(context.TODO()); err != nil {
+		log.Error("save downloads failed", zap.Error(err))
+	}
+}
+
+// removeDownload deletes what was written for d: the file saved at path, if
+// any, and the partial blob.
+func (c *App) removeDownload(d *download, path string) {
+	for _, p := range []string{path, c.partPath(d.Attachment)} {
+		if p == "" {
+			continue
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn("remove attachment failed", zap.String("path", p), zap.Error(err))
+		}
+	}
+}
+
+// saveDownloads persists the download records. The caller holds
+// downloadsMu.
+func (c *App) saveDownloads(ctx context.Context) error {
+	return c.SaveDownloads(ctx, c.user.Name, c.toName, c.historyKey, c.downloads)
+}
+
+func (c *App) loadDownloads(ctx context.Context) error {
+	downloads, err := c.GetDownloads(ctx, c.user.Name, c.toName, c.historyKey)
+	if err != nil {
+		return err
+	}
+
+	c.downloadsMu.Lock()
+	defer c.downloadsMu.Unlock()
+
+	c.downloads = downloads
+	return nil
+}
+
+// partPath is where the blob of a is downloaded to until it is verified.
+func (c *App) partPath(a *model.Attachment) string {
+	return filepath.Join(c.downloadDir, "."+a.ID+".part")
+}
+
+// saveAttachment downloads the blob of a and writes its plaintext to a new
+// file in the download directory. A download that was cut off keeps the
+// blob received so far and fails with errDownloadInterrupted; any other
+// failure is final and removes it.
+func (c *App) saveAttachment(a *model.Attachment) (string, error) {
+	if err := checkAttachment(a); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(c.downloadDir, 0o700); err != nil {
+		return "", err
+	}
+
+	// the blob stays apart until verified
+	blobPath := c.partPath(a)
+	blob, err := os.OpenFile(blobPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+
+	path, err := c.decryptBlob(a, blob)
+	if errors.Is(err, errDownloadInterrupted) {
+		return "", err
+	}
+	if err := os.Remove(blobPath); err != nil {
+		log.Warn("remove downloaded blob failed", zap.String("path", blobPath), zap.Error(err))
+	}
+	return path, err
+}
+
+func (c *App) decryptBlob(a *model.Attachment, blob *os.File) (string, error) {
+	if err := c.downloadBlob(a, blob); err != nil {
+		if errors.Is(err, errAttachmentGone) || errors.Is(err, errInvalidAttachment) {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: %w", errDownloadInterrupted, err)
+	}
+
+	out, path, err := createUnique(c.downloadDir, a.Name)
+	if err != nil {
+		return "", err
+	}
+	if err := attachment.Decrypt(out, blob, a.BlobSize, a.Key, a.Digest); err != nil {
+		out.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// downloadBlob fetches the blob into f, resuming after failed requests from
+// what f already holds.
+func (c *App) downloadBlob(a *model.Attachment, f *os.File) error {
+	failures := 0
+	for {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() == a.BlobSize {
+			return nil
+		}
+		if fi.Size() > a.BlobSize {
+			return fmt.Errorf("%w: blob larger than announced", errInvalidAttachment)
+		}
+
+		// one byte past the announced size tells an oversized blob apart
+		err = c.downloadAttachment(a.ID, f, fi.Size(), a.BlobSize-fi.Size()+1)
+		if errors.Is(err, errAttachmentGone) {
+			return err
+		}
+		if err == nil {
+			continue
+		}
+
+		failures++
+		if failures >= transferAttempts {
+			return err
+		}
+		log.Debug("download interrupted, resuming", zap.String("id", a.ID), zap.Error(err))
+		time.Sleep(max(backoff(failures), retryAfter(err)))
+	}
+}
+
+// createUnique creates a new file for name in dir, numbering it when the
+// name is taken. Only the last element of name is used, so a sender cannot
+// place files outside dir.
+func createUnique(dir, name string) (*os.File, string, error) {
+	name = filepath.Base(filepath.Clean("/" + strings.ReplaceAll(name, `\`, "/")))
+	if name == "/" {
+		name = "attachment"
+	} else if strings.HasPrefix(name, ".") {
+		// never hidden, nor a clash with blobs being downloaded
+		name = "attachment" + name
+	}
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+
+		path := filepath.Join(dir, candidate)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return f, path, err
+	}
+}
@@ -0,0 +1,320 @@
+package app
+
+import (
+	"bytes"
+	"crypto/rand"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/attachment"
+	"e2e_chat/internal/storage/memory"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uploadTestBlob encrypts plaintext and uploads it as c, as SendAttachment
+// does, and returns the pointer a recipient would get and the blob.
+func uploadTestBlob(t *testing.T, c *App, name string, plaintext []byte) (*model.Attachment, []byte) {
+	t.Helper()
+
+	key, err := attachment.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blob bytes.Buffer
+	digest, size, err := attachment.Encrypt(&blob, bytes.NewReader(plaintext), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := c.createUpload(int64(blob.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.uploadBlob(upload.ID, bytes.NewReader(blob.Bytes()), int64(blob.Len())); err != nil {
+		t.Fatal(err)
+	}
+
+	return &model.Attachment{
+		ID:       upload.ID,
+		Name:     name,
+		Size:     size,
+		BlobSize: attachment.BlobSize(size),
+		Key:      key,
+		Digest:   digest,
+	}, blob.Bytes()
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func checkSaved(t *testing.T, path string, want []byte) {
+	t.Helper()
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s holds %d bytes, not the %d sent", path, len(got), len(want))
+	}
+}
+
+func TestSendAttachment(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	// several upload chunks
+	content := randomBytes(t, 2*uploadChunkSize+100)
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.SendAttachment(path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return bob.hasNotice("saved photo.jpg from alice") }, "bob to save the attachment")
+
+	checkSaved(t, filepath.Join(bob.downloadDir, "photo.jpg"), content)
+	if parts, _ := filepath.Glob(filepath.Join(bob.downloadDir, ".*.part")); len(parts) != 0 {
+		t.Fatalf("partial downloads left behind: %q", parts)
+	}
+}
+
+func TestSaveAttachmentResumes(t *testing.T) {
+	srv := newTestServer(t)
+	bob := newTestClient(t, srv, "bob")
+
+	content := randomBytes(t, 100000)
+	a, blob := uploadTestBlob(t, bob, "notes.txt", content)
+
+	// an earlier attempt got half of it
+	if err := os.MkdirAll(bob.downloadDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bob.partPath(a), blob[:len(blob)/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := bob.saveAttachment(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSaved(t, path, content)
+	if _, err := os.Stat(bob.partPath(a)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("partial download not removed after success: %v", err)
+	}
+}
+
+// TestSaveAttachmentDropsPart checks that a blob that failed verification is
+// removed rather than kept forever, and nothing is written in its place.
+func TestSaveAttachmentDropsPart(t *testing.T) {
+	srv := newTestServer(t)
+	bob := newTestClient(t, srv, "bob")
+
+	content := randomBytes(t, 1000)
+	a, _ := uploadTestBlob(t, bob, "notes.txt", content)
+
+	wrong := *a
+	wrong.Digest = bytes.Repeat([]byte{1}, attachment.DigestSize)
+	if _, err := bob.saveAttachment(&wrong); !errors.Is(err, attachment.ErrDigestMismatch) {
+		t.Fatalf("got %v, want %v", err, attachment.ErrDigestMismatch)
+	}
+	if _, err := os.Stat(bob.partPath(a)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unverified blob kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bob.downloadDir, "notes.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("unverified plaintext written")
+	}
+
+	path, err := bob.saveAttachment(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSaved(t, path, content)
+}
+
+func TestSaveAttachmentGone(t *testing.T) {
+	srv := newTestServer(t)
+	bob := newTestClient(t, srv, "bob")
+
+	a, blob := uploadTestBlob(t, bob, "notes.txt", randomBytes(t, 1000))
+	if _, err := srv.blobs.Purge(t.Context(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// an earlier attempt got part of it, which can no longer be completed
+	if err := os.MkdirAll(bob.downloadDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bob.partPath(a), blob[:10], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bob.saveAttachment(a); !errors.Is(err, errAttachmentGone) {
+		t.Fatalf("got %v, want %v", err, errAttachmentGone)
+	}
+	if _, err := os.Stat(bob.partPath(a)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("partial download kept: %v", err)
+	}
+}
+
+// TestDownloadResumedAfterRestart checks that an attachment whose download
+// was cut off by a restart is fetched once the client is back, although its
+// message was acked.
+func TestDownloadResumedAfterRestart(t *testing.T) {
+	srv := newTestServer(t)
+	newTestClient(t, srv, "alice")
+	bobUsers, bobState := memory.NewUserStore(), memory.NewStateStore()
+	bob := newTestClientOn(t, srv, "bob", bobUsers, bobState)
+	bob.open(t, "alice")
+
+	content := randomBytes(t, 1000)
+	a, _ := uploadTestBlob(t, bob, "notes.txt", content)
+	d := bob.addDownload(&model.Message{ID: "1", From: "alice"}, a, 0)
+	if d == nil {
+		t.Fatal("download not recorded")
+	}
+	if bob.addDownload(&model.Message{ID: "1", From: "alice"}, a, 0) != nil {
+		t.Fatal("redelivered attachment recorded twice")
+	}
+
+	bob.ws.close()
+	restarted := newTestClientOn(t, srv, "bob", bobUsers, bobState)
+	restarted.SetDownloadDir(bob.downloadDir)
+	restarted.open(t, "alice")
+	waitFor(t, func() bool { return restarted.hasNotice("saved notes.txt from alice") }, "the download to resume")
+
+	checkSaved(t, filepath.Join(bob.downloadDir, "notes.txt"), content)
+	waitFor(t, func() bool {
+		downloads, err := restarted.GetDownloads(t.Context(), "bob", "alice", restarted.historyKey)
+		return err == nil && len(downloads) == 0
+	}, "the saved download to be forgotten")
+}
+
+func TestExpiredAttachmentRemoved(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	if err := alice.SetExpireTimer(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(path, randomBytes(t, 1000), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SendAttachment(path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return bob.hasNotice("saved photo.jpg from alice") }, "bob to save the attachment")
+
+	saved := filepath.Join(bob.downloadDir, "photo.jpg")
+	if _, err := os.Stat(saved); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, err := os.Stat(saved)
+		return errors.Is(err, os.ErrNotExist)
+	}, "the saved file to be removed with its message")
+
+	downloads, err := bob.GetDownloads(t.Context(), "bob", "alice", bob.historyKey)
+	if err != nil || len(downloads) != 0 {
+		t.Fatalf("got %d downloads, %v; want none", len(downloads), err)
+	}
+}
+
+// TestExpiredWhileDownloading checks that a file finished after its message
+// expired is removed.
+func TestExpiredWhileDownloading(t *testing.T) {
+	c := NewApp(memory.NewUserStore(), memory.NewStateStore())
+	c.user = &model.User{Name: "bob"}
+	c.toName = "alice"
+	c.historyKey = make([]byte, 32)
+	c.SetDownloadDir(t.TempDir())
+
+	a := &model.Attachment{ID: strings.Repeat("ab", 16), Name: "notes.txt"}
+	d := c.addDownload(&model.Message{ID: "1", From: "alice"}, a, time.Second)
+	c.expireDownloads(time.Now().Add(time.Minute))
+
+	path := filepath.Join(c.downloadDir, "notes.txt")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c.finishDownload(d, path, nil)
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("file of an expired message kept: %v", err)
+	}
+}
+
+func TestCheckAttachment(t *testing.T) {
+	valid := model.Attachment{
+		ID:       strings.Repeat("ab", 16),
+		Size:     10,
+		BlobSize: attachment.BlobSize(10),
+		Key:      make([]byte, attachment.KeySize),
+		Digest:   make([]byte, attachment.DigestSize),
+	}
+
+	tests := map[string]func(a *model.Attachment){
+		"path in ID":    func(a *model.Attachment) { a.ID = "../" + a.ID[3:] },
+		"short ID":      func(a *model.Attachment) { a.ID = a.ID[:30] },
+		"short key":     func(a *model.Attachment) { a.Key = a.Key[:16] },
+		"no digest":     func(a *model.Attachment) { a.Digest = nil },
+		"negative size": func(a *model.Attachment) { a.Size = -1 },
+		"blob size":     func(a *model.Attachment) { a.BlobSize++ },
+	}
+
+	if err := checkAttachment(&valid); err != nil {
+		t.Fatal(err)
+	}
+	for name, modify := range tests {
+		a := valid
+		modify(&a)
+		if err := checkAttachment(&a); !errors.Is(err, errInvalidAttachment) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestCreateUnique(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name, want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"report.pdf", "report (1).pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`..\..\boot.ini`, "boot.ini"},
+		{"/", "attachment"},
+		{"", "attachment (1)"},
+		{".bashrc", "attachment.bashrc"},
+	}
+
+	for _, tt := range tests {
+		f, path, err := createUnique(dir, tt.name)
+		if err != nil {
+			t.Fatalf("createUnique(%q): %v", tt.name, err)
+		}
+		f.Close()
+		if path != filepath.Join(dir, tt.want) {
+			t.Errorf("createUnique(%q) = %q, want %q", tt.name, path, filepath.Join(dir, tt.want))
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/backup"
+	"e2e_chat/internal/protocol/doubleratchet"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	errIdentityMismatch = errors.New("another identity with this name exists locally")
+)
+
+const (
+	sessionRestored = "restored"
+	sessionKept     = "kept the local session"
+	sessionNew      = "not restored, a new session starts with the next message"
+	sessionStale    = "stale, a new session starts with the next message"
+	sessionNone     = "none"
+)
+
+type (
+	// backupPayload is everything a client needs to carry on as the same
+	// user on another machine.
+	backupPayload struct {
+		User          *model.User           `json:"user"`
+		Seen          []string              `json:"seen,omitempty"`
+		Outbox        []*model.Frame        `json:"outbox,omitempty"`
+		TrustRoots    map[string][]byte     `json:"trust_roots,omitempty"` // by server host:port
+		Conversations []*backupConversation `json:"conversations"`
+	}
+
+	backupConversation struct {
+		Peer        string                      `json:"peer"`
+		Ratchet     *doubleratchet.RatchetState `json:"ratchet,omitempty"`
+		Session     *sessionRecord              `json:"session,omitempty"`
+		ProfileKey  []byte                      `json:"profile_key,omitempty"`
+		ExpireTimer int64                       `json:"expire_timer,omitempty"` // seconds
+		History     []*historyEntry             `json:"history,omitempty"`
+	}
+
+	// RestoreReport tells what ImportBackup restored.
+	RestoreReport struct {
+		User     string
+		Created  time.Time
+		Identity string            // created, or kept when already present
+		Sessions map[string]string // outcome by peer
+		Messages int               // history entries added
+	}
+)
+
+// addConversation records that the user talks to peer.
+func (c *App) addConversation(ctx context.Context, peer string) error {
+	peers, err := c.GetConversations(ctx, c.user.Name)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(peers, peer) {
+		return nil
+	}
+	return c.SaveConversations(ctx, c.user.Name, append(peers, peer))
+}
+
+// ExportBackup writes an encrypted backup of the identity, sessions, trust
+// roots and history of user name to w. It returns the recovery code the
+// backup opens with, which is not stored anywhere.
+func (c *App) ExportBackup(ctx context.Context, name string, w io.Writer) (string, error) {
+	user, err := c.users.GetByName(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if user == nil {
+		return "", fmt.Errorf("no local user %q", name)
+	}
+
+	key, err := historyKey(user)
+	if err != nil {
+		return "", err
+	}
+
+	// the ID belongs to the local store
+	exported := *user
+	exported.ID = primitive.NilObjectID
+	payload := &backupPayload{
+		User:       &exported,
+		TrustRoots: make(map[string][]byte),
+	}
+
+	if payload.Seen, err = c.GetSeen(ctx, name); err != nil {
+		return "", err
+	}
+	if payload.Outbox, err = c.GetOutbox(ctx, name); err != nil {
+		return "", err
+	}
+
+	trustRoot, err := c.GetTrustRoot(ctx, name, c.host)
+	if err != nil {
+		return "", err
+	}
+	if trustRoot != nil {
+		payload.TrustRoots[c.host] = trustRoot
+	}
+
+	peers, err := c.GetConversations(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	for _, peer := range peers {
+		conv, err := c.exportConversation(ctx, name, peer, key)
+		if err != nil {
+			return "", fmt.Errorf("conversation with %s: %w", peer, err)
+		}
+		payload.Conversations = append(payload.Conversations, conv)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	code, err := backup.NewRecoveryCode()
+	if err != nil {
+		return "", err
+	}
+	return code, backup.Encrypt(w, code, data)
+}
+
+func (c *App) exportConversation(ctx context.Context, user, peer string, key []byte) (*backupConversation, error) {
+	conv := &backupConversation{Peer: peer}
+
+	var err error
+	if conv.Ratchet, err = c.GetState(ctx, user, peer); err != nil {
+		return nil, err
+	}
+	if conv.Session, err = c.GetSession(ctx, user, peer); err != nil {
+		return nil, err
+	}
+	if conv.ProfileKey, err = c.GetProfileKey(ctx, user, peer); err != nil {
+		return nil, err
+	}
+
+	timer, err := c.GetExpireTimer(ctx, user, peer)
+	if err != nil {
+		return nil, err
+	}
+	conv.ExpireTimer = int64(timer / time.Second)
+
+	index, err := c.GetHistoryIndex(ctx, user, peer, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, page := range index.Pages {
+		entries, err := c.GetHistoryPage(ctx, user, peer, key, page.N)
+		if err != nil {
+			return nil, err
+		}
+		conv.History = append(conv.History, entries...)
+	}
+	return conv, nil
+}
+
+// ImportBackup restores a backup from r, which must open with code. The
+// file is fully authenticated before anything is written, and nothing local
+// is overwritten: an existing identity must be the one in the backup, and
+// local settings, trust roots and sessions win over the backed up ones.
+//
+// Ratchet states are not restored: the exported copy may have been used
+// since, and sending with it again would repeat message keys. Each
+// conversation starts a new session with its next message instead. With
+// restoreSessions, a state is restored when there is no local one and the
+// backup is younger than ratchetStateTTL. Messages in the outbox are
+// restored only with their session.
+func (c *App) ImportBackup(ctx context.Context, r io.Reader, code string, restoreSessions bool) (*RestoreReport, error) {
+	header, data, err := backup.Decrypt(r, code)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload backupPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("decode backup: %w", err)
+	}
+	if payload.User == nil || payload.User.Name == "" || len(payload.User.IKPriv) == 0 || len(payload.User.SigPub) == 0 {
+		return nil, fmt.Errorf("decode backup: no identity")
+	}
+	name := payload.User.Name
+
+	report := &RestoreReport{
+		User:     name,
+		Created:  header.Created,
+		Sessions: make(map[string]string),
+	}
+
+	local, err := c.users.GetByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case local == nil:
+		if err := c.users.Create(ctx, payload.User); err != nil {
+			return nil, err
+		}
+		local = payload.User
+		report.Identity = "created"
+	case !sameIdentity(local, payload.User):
+		return nil, fmt.Errorf("%w: %s", errIdentityMismatch, name)
+	default:
+		report.Identity = "kept"
+	}
+	c.user = local
+
+	for host, serverPub := range payload.TrustRoots {
+		trusted, err := c.GetTrustRoot(ctx, name, host)
+		if err != nil {
+			return nil, err
+		}
+		if trusted == nil {
+			if err := c.SaveTrustRoot(ctx, name, host, serverPub); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := c.loadSeen(ctx); err != nil {
+		return nil, err
+	}
+	for _, id := range payload.Seen {
+		c.markSeen(id)
+	}
+	if err := c.saveSeen(ctx); err != nil {
+		return nil, err
+	}
+
+	fresh := time.Since(header.Created) < ratchetStateTTL
+	restored := make(map[string]bool)
+	for _, conv := range payload.Conversations {
+		outcome, added, err := c.importConversation(ctx, conv, restoreSessions, fresh)
+		if err != nil {
+			return nil, fmt.Errorf("conversation with %s: %w", conv.Peer, err)
+		}
+		report.Sessions[conv.Peer] = outcome
+		report.Messages += added
+		restored[conv.Peer] = outcome == sessionRestored
+	}
+
+	if err := c.importOutbox(ctx, payload.Outbox, restored); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// sameIdentity reports whether a and b hold the same identity: the signing
+// key the server knows the user by and the identity key peers know it by.
+func sameIdentity(a, b *model.User) bool {
+	return len(a.SigPub) > 0 && bytes.Equal(a.SigPub, b.SigPub) &&
+		len(a.IKPriv) > 0 && bytes.Equal(a.IKPriv, b.IKPriv)
+}
+
+func (c *App) importConversation(ctx context.Context, conv *backupConversation, restore, fresh bool) (string, int, error) {
+	c.toName = conv.Peer
+	if err := c.addConversation(ctx, conv.Peer); err != nil {
+		return "", 0, err
+	}
+
+	profileKey, err := c.GetProfileKey(ctx, c.user.Name, conv.Peer)
+	if err != nil {
+		return "", 0, err
+	}
+	if profileKey == nil && conv.ProfileKey != nil {
+		if err := c.SaveProfileKey(ctx, c.user.Name, conv.Peer, conv.ProfileKey); err != nil {
+			return "", 0, err
+		}
+	}
+
+	timer, err := c.GetExpireTimer(ctx, c.user.Name, conv.Peer)
+	if err != nil {
+		return "", 0, err
+	}
+	if timer == 0 && conv.ExpireTimer > 0 {
+		if err := c.SaveExpireTimer(ctx, c.user.Name, conv.Peer, time.Duration(conv.ExpireTimer)*time.Second); err != nil {
+			return "", 0, err
+		}
+	}
+
+	added, err := c.importHistory(ctx, conv.History)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := c.importSession(ctx, conv.Session); err != nil {
+		return "", 0, err
+	}
+
+	state, err := c.GetState(ctx, c.user.Name, conv.Peer)
+	if err != nil {
+		return "", 0, err
+	}
+	switch {
+	case conv.Ratchet == nil:
+		return sessionNone, added, nil
+	case state != nil:
+		return sessionKept, added, nil
+	case !restore:
+		return sessionNew, added, nil
+	case !fresh:
+		return sessionStale, added, nil
+	}
+
+	if err := c.SaveState(ctx, c.user.Name, conv.Peer, conv.Ratchet); err != nil {
+		return "", 0, err
+	}
+	return sessionRestored, added, nil
+}
+
+// importSession merges the backed up session record into the local one:
+// handshakes used on either machine stay refused, and new sessions are
+// dated after the newest one known.
+func (c *App) importSession(ctx context.Context, backedUp *sessionRecord) error {
+	if backedUp == nil {
+		return nil
+	}
+
+	record, err := c.GetSession(ctx, c.user.Name, c.toName)
+	if err != nil {
+		return err
+	}
+	for _, ekPub := range backedUp.Used {
+		record.addUsed(ekPub)
+	}
+	if record.newer(backedUp.Started, backedUp.EKPub) {
+		record.Started, record.EKPub = backedUp.Started, backedUp.EKPub
+	}
+	return c.SaveSession(ctx, c.user.Name, c.toName, record)
+}
+
+// importHistory merges entries into the history of the conversation with
+// c.toName and returns how many were new. The merged history is written to
+// new pages before the old ones are deleted, so nothing is lost midway.
+func (c *App) importHistory(ctx context.Context, entries []*historyEntry) (int, error) {
+	key, err := historyKey(c.user)
+	if err != nil {
+		return 0, err
+	}
+
+	index, err := c.GetHistoryIndex(ctx, c.user.Name, c.toName, key)
+	if err != nil {
+		return 0, err
+	}
+
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	c.historyKey = key
+	c.history = index
+	clear(c.searchShards)
+
+	var merged []*historyEntry
+	for _, page := range index.Pages {
+		local, err := c.GetHistoryPage(ctx, c.user.Name, c.toName, key, page.N)
+		if err != nil {
+			return 0, err
+		}
+		merged = append(merged, local...)
+	}
+
+	added := 0
+	for _, e := range entries {
+		if !slices.ContainsFunc(merged, e.same) {
+			merged = append(merged, e)
+			added++
+		}
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Timestamp < merged[j].Timestamp
+	})
+
+	old := slices.Clone(index.Pages)
+	for page := range slices.Chunk(merged, historyPageSize) {
+		n := index.Next
+		index.Next++
+		if err := c.writeHistoryPageLocked(ctx, n, page); err != nil {
+			return 0, err
+		}
+	}
+	for _, page := range old {
+		if err := c.writeHistoryPageLocked(ctx, page.N, nil); err != nil {
+			return 0, err
+		}
+	}
+	return added, nil
+}
+
+// importOutbox adds the frames of restored sessions that are not queued
+// already. The rest were encrypted with a session that is gone.
+func (c *App) importOutbox(ctx context.Context, frames []*model.Frame, restored map[string]bool) error {
+	if err := c.loadOutbox(ctx); err != nil {
+		return err
+	}
+
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+
+	changed := false
+	for _, frame := range frames {
+		if frame.Message == nil || !restored[frame.Message.To] {
+			continue
+		}
+
+		queued := slices.ContainsFunc(c.outbox, func(f *model.Frame) bool {
+			return f.Message != nil && f.Message.ClientID == frame.Message.ClientID
+		})
+		if !queued {
+			c.outbox = append(c.outbox, frame)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return c.SaveOutbox(ctx, c.user.Name, c.outbox)
+}
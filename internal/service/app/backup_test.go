@@ -0,0 +1,188 @@
+package app
+
+import (
+	"bytes"
+	"crypto/rand"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/backup"
+	"e2e_chat/internal/storage/memory"
+	"errors"
+	"testing"
+)
+
+func exportBackup(t *testing.T, c *App, name string) ([]byte, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	code, err := c.ExportBackup(t.Context(), name, &buf)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	return buf.Bytes(), code
+}
+
+// chatAndExport has alice and bob exchange a message each and returns
+// alice's backup, as exported with her client stopped.
+func chatAndExport(t *testing.T, srv *testServer) (*App, []byte, string) {
+	t.Helper()
+
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	alice.send(t, "hello bob")
+	bob.waitLine(t, "hello bob", func(chatLine) bool { return true }, "alice's message")
+	bob.send(t, "hello alice")
+	alice.waitLine(t, "hello alice", func(chatLine) bool { return true }, "bob's message")
+	alice.waitLine(t, "hello bob", func(l chatLine) bool { return l.status == statusDelivered }, "bob's delivery receipt")
+
+	alice.ws.close()
+	data, code := exportBackup(t, alice, "alice")
+	return bob, data, code
+}
+
+func TestBackupNewDevice(t *testing.T) {
+	srv := newTestServer(t)
+	bob, data, code := chatAndExport(t, srv)
+
+	users, state := memory.NewUserStore(), memory.NewStateStore()
+	report, err := NewApp(users, state).ImportBackup(t.Context(), bytes.NewReader(data), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.User != "alice" || report.Identity != "created" || report.Messages != 2 || report.Sessions["bob"] != sessionNew {
+		t.Fatalf("got %+v", report)
+	}
+	if ratchet, err := NewApp(users, state).GetState(t.Context(), "alice", "bob"); err != nil || ratchet != nil {
+		t.Fatalf("ratchet state restored: %v", err)
+	}
+	// so that handshakes from before the backup stay refused
+	if record, err := NewApp(users, state).GetSession(t.Context(), "alice", "bob"); err != nil || record.Started == 0 || len(record.Used) == 0 {
+		t.Fatalf("session record not restored: %+v, %v", record, err)
+	}
+
+	// the history is back, and a new session starts with the next message
+	alice := newTestClientOn(t, srv, "alice", users, state)
+	alice.open(t, "bob")
+	if _, ok := alice.line("hello alice"); !ok {
+		t.Fatal("history not restored")
+	}
+	line := alice.waitLine(t, "hello bob", func(chatLine) bool { return true }, "the restored message")
+	if line.status != statusDelivered {
+		t.Fatalf("status %v after restore", line.status)
+	}
+
+	alice.send(t, "new device")
+	bob.waitLine(t, "new device", func(chatLine) bool { return true }, "the message from the new device")
+	bob.send(t, "welcome back")
+	alice.waitLine(t, "welcome back", func(chatLine) bool { return true }, "bob's answer on the new session")
+}
+
+func TestBackupRestoreSessions(t *testing.T) {
+	srv := newTestServer(t)
+	_, data, code := chatAndExport(t, srv)
+
+	users, state := memory.NewUserStore(), memory.NewStateStore()
+	c := NewApp(users, state)
+	report, err := c.ImportBackup(t.Context(), bytes.NewReader(data), code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sessions["bob"] != sessionRestored {
+		t.Fatalf("got %+v", report)
+	}
+	if ratchet, err := c.GetState(t.Context(), "alice", "bob"); err != nil || ratchet == nil {
+		t.Fatalf("ratchet state not restored: %v", err)
+	}
+}
+
+func TestBackupKeepsLocal(t *testing.T) {
+	users, state := memory.NewUserStore(), memory.NewStateStore()
+	c := NewApp(users, state)
+	if _, err := c.getUserAndCreateIfNotExist(t.Context(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	data, code := exportBackup(t, c, "alice")
+
+	// restoring over the same client changes nothing
+	report, err := NewApp(users, state).ImportBackup(t.Context(), bytes.NewReader(data), code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Identity != "kept" || report.Messages != 0 {
+		t.Fatalf("got %+v", report)
+	}
+}
+
+func TestBackupIdentityMismatch(t *testing.T) {
+	newKey := func() []byte {
+		key := make([]byte, 32)
+		rand.Read(key)
+		return key
+	}
+
+	tests := map[string]struct {
+		backedUp, local *model.User
+	}{
+		"generated": {
+			backedUp: nil,
+			local:    nil,
+		},
+		// identities without an IKPub once matched each other
+		"no IKPub": {
+			backedUp: &model.User{Name: "alice", IKPriv: newKey(), SigPub: newKey()},
+			local:    &model.User{Name: "alice", IKPriv: newKey(), SigPub: newKey()},
+		},
+		"same signing key": {
+			backedUp: &model.User{Name: "alice", IKPriv: newKey(), SigPub: []byte("sig")},
+			local:    &model.User{Name: "alice", IKPriv: newKey(), SigPub: []byte("sig")},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := NewApp(memory.NewUserStore(), memory.NewStateStore())
+			dst := NewApp(memory.NewUserStore(), memory.NewStateStore())
+			for _, c := range []struct {
+				app  *App
+				user *model.User
+			}{{src, tt.backedUp}, {dst, tt.local}} {
+				var err error
+				if c.user == nil {
+					_, err = c.app.getUserAndCreateIfNotExist(t.Context(), "alice")
+				} else {
+					err = c.app.users.Create(t.Context(), c.user)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			data, code := exportBackup(t, src, "alice")
+			if _, err := dst.ImportBackup(t.Context(), bytes.NewReader(data), code, false); !errors.Is(err, errIdentityMismatch) {
+				t.Fatalf("got %v, want %v", err, errIdentityMismatch)
+			}
+		})
+	}
+}
+
+func TestBackupWrongCode(t *testing.T) {
+	src := NewApp(memory.NewUserStore(), memory.NewStateStore())
+	if _, err := src.getUserAndCreateIfNotExist(t.Context(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := exportBackup(t, src, "alice")
+
+	code, err := backup.NewRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := memory.NewUserStore()
+	if _, err := NewApp(users, memory.NewStateStore()).ImportBackup(t.Context(), bytes.NewReader(data), code, false); !errors.Is(err, backup.ErrDecrypt) {
+		t.Fatalf("got %v, want %v", err, backup.ErrDecrypt)
+	}
+	if user, _ := users.GetByName(t.Context(), "alice"); user != nil {
+		t.Fatal("identity written from a backup that did not open")
+	}
+}
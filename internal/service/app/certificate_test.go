@@ -0,0 +1,141 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"e2e_chat/internal/cryptographic/dh"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/sealed"
+	"e2e_chat/internal/service/server"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newCertificateKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func TestTrustRootPinned(t *testing.T) {
+	certKey := newCertificateKey(t)
+	srv := newTestServer(t, func(s *server.HttpServer) { s.SetCertificateKey(certKey) })
+	newTestClient(t, srv, "bob")
+
+	pinned := newTestClient(t, srv, "alice")
+	pinned.SetTrustRoot(certKey.Public().(ed25519.PublicKey))
+	if err := pinned.openConversation(t.Context(), "bob"); err != nil {
+		t.Fatalf("pinned to the server key: %v", err)
+	}
+
+	other := newTestClient(t, srv, "carol")
+	other.SetTrustRoot(newCertificateKey(t).Public().(ed25519.PublicKey))
+	if err := other.openConversation(t.Context(), "bob"); !errors.Is(err, sealed.ErrTrustRootMismatch) {
+		t.Fatalf("pinned to another key: got %v, want %v", err, sealed.ErrTrustRootMismatch)
+	}
+}
+
+func TestTrustRootFirstUse(t *testing.T) {
+	srv := newTestServer(t)
+	newTestClient(t, srv, "bob")
+	alice := newTestClient(t, srv, "alice")
+
+	if err := alice.openConversation(t.Context(), "bob"); err != nil {
+		t.Fatal(err)
+	}
+	remembered, err := alice.GetTrustRoot(t.Context(), "alice", alice.host)
+	if err != nil || remembered == nil {
+		t.Fatalf("trust root not remembered: %v", err)
+	}
+
+	// as if the server came back with another key
+	other := newCertificateKey(t).Public().(ed25519.PublicKey)
+	if err := alice.SaveTrustRoot(t.Context(), "alice", alice.host, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.openConversation(t.Context(), "bob"); !errors.Is(err, sealed.ErrTrustRootMismatch) {
+		t.Fatalf("changed server key: got %v, want %v", err, sealed.ErrTrustRootMismatch)
+	}
+}
+
+func TestVerifySenderCertificate(t *testing.T) {
+	certKey := newCertificateKey(t)
+	rogue := newCertificateKey(t)
+
+	c := &App{serverKey: certKey.Public().(ed25519.PublicKey)}
+	ik := testIdentityKey(t)
+	otherIK := testIdentityKey(t)
+	now := time.Now()
+	expires := now.Add(time.Hour)
+
+	tests := []struct {
+		name string
+		cert *model.SenderCertificate
+		want error
+	}{
+		{"valid", sealed.SignCertificate(certKey, "alice", "laptop", ik, expires), nil},
+		{"other signer", sealed.SignCertificate(rogue, "alice", "laptop", ik, expires), sealed.ErrInvalidCertificate},
+		{"expired", sealed.SignCertificate(certKey, "alice", "laptop", ik, now.Add(-time.Second)), sealed.ErrExpiredCertificate},
+		{"other sender", sealed.SignCertificate(certKey, "mallory", "laptop", ik, expires), sealed.ErrInvalidCertificate},
+		{"other identity key", sealed.SignCertificate(certKey, "alice", "laptop", otherIK, expires), sealed.ErrInvalidCertificate},
+		{"no device", sealed.SignCertificate(certKey, "alice", "", ik, expires), sealed.ErrInvalidCertificate},
+		{"missing", nil, sealed.ErrInvalidCertificate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.verifySenderCertificate(tt.cert, "alice", ik, now)
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestSenderCertificateDevice checks that the client only uses a certificate
+// issued for its own identity key and device.
+func TestSenderCertificateDevice(t *testing.T) {
+	srv := newTestServer(t)
+	newTestClient(t, srv, "bob")
+	alice := newTestClient(t, srv, "alice")
+	if err := alice.openConversation(t.Context(), "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := alice.senderCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Sender != "alice" || cert.DeviceID != alice.deviceID {
+		t.Fatalf("certificate %+v", cert)
+	}
+	if again, _ := alice.senderCertificate(); again != cert {
+		t.Fatal("certificate fetched again while still valid")
+	}
+
+	// logged in from another device, the server vouches for that one
+	alice.deviceID = "other-" + alice.deviceID
+	alice.senderCert = nil
+	if _, err := alice.senderCertificate(); !errors.Is(err, sealed.ErrInvalidCertificate) {
+		t.Fatalf("certificate for another device: got %v", err)
+	}
+}
+
+func testIdentityKey(t *testing.T) []byte {
+	t.Helper()
+
+	priv, _, err := dh.NewX25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ik, err := dh.ConvertToECDHFormat(priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ik.PublicKey().Bytes()
+}
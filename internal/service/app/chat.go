@@ -0,0 +1,300 @@
+package app
+
+import (
+	"e2e_chat/internal/model"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const (
+	statusPending deliveryStatus = iota
+	statusSent
+	statusDelivered
+	statusRead
+)
+
+type (
+	deliveryStatus int
+
+	// chatLine is one rendered entry in the chatbox.
+	chatLine struct {
+		id       string // server-assigned, empty until accepted
+		clientID string
+		from     string
+		text     string
+		outgoing bool
+		status   deliveryStatus
+		failed   string    // why the server rejected it
+		notice   bool      // a conversation event rather than a message
+		expires  time.Time // when a disappearing message is removed, zero if never
+
+		timestamp time.Time
+		page      int // history page storing it, 0 if not stored
+	}
+)
+
+func (s deliveryStatus) tick() string {
+	switch s {
+	case statusSent:
+		return "[gray]✓[-]"
+	case statusDelivered:
+		return "[gray]✓✓[-]"
+	case statusRead:
+		return "[blue]✓✓[-]"
+	default:
+		return "[gray]…[-]"
+	}
+}
+
+func receiptStatus(status model.ReceiptStatus) (deliveryStatus, bool) {
+	switch status {
+	case model.ReceiptDelivered:
+		return statusDelivered, true
+	case model.ReceiptRead:
+		return statusRead, true
+	default:
+		return statusPending, false
+	}
+}
+
+// region names the line in the chatbox, so search can jump to it.
+func (l *chatLine) region() string {
+	switch {
+	case l.notice:
+		return ""
+	case l.outgoing:
+		return "c" + l.clientID
+	default:
+		return "s" + l.id
+	}
+}
+
+func (l *chatLine) render(now time.Time) string {
+	if l.notice {
+		return fmt.Sprintf("[gray]%s[-]", tview.Escape(l.text))
+	}
+
+	var text string
+	switch {
+	case l.outgoing && l.failed != "":
+		text = fmt.Sprintf("[yellow]You:[-] %s [red]✗ %s[-]", tview.Escape(l.text), tview.Escape(l.failed))
+	case l.outgoing:
+		text = fmt.Sprintf("[yellow]You:[-] %s %s", tview.Escape(l.text), l.status.tick())
+	default:
+		text = fmt.Sprintf("[green]%s:[-] %s", tview.Escape(l.from), tview.Escape(l.text))
+	}
+
+	if !l.expires.IsZero() {
+		text += fmt.Sprintf(" [gray]⏱ %s[-]", formatTimer(l.expires.Sub(now)))
+	}
+	return fmt.Sprintf(`["%s"]%s[""]`, l.region(), text)
+}
+
+// expiry is when a message shown now with the given timer disappears.
+func expiry(timer time.Duration) time.Time {
+	if timer <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timer)
+}
+
+func (c *App) addOutgoingLine(clientID, text string, timer time.Duration) {
+	line := &chatLine{
+		clientID:  clientID,
+		text:      text,
+		outgoing:  true,
+		expires:   expiry(timer),
+		timestamp: time.Now(),
+	}
+	c.recordHistory(line)
+
+	c.chatMu.Lock()
+	c.lines = append(c.lines, line)
+	c.pending[clientID] = line
+	c.chatMu.Unlock()
+
+	c.redrawChat()
+}
+
+func (c *App) addIncomingLine(message *model.Message, text string, timer time.Duration) {
+	line := &chatLine{
+		id:        message.ID,
+		from:      message.From,
+		text:      text,
+		expires:   expiry(timer),
+		timestamp: time.UnixMilli(message.Timestamp),
+	}
+	if message.Timestamp == 0 {
+		line.timestamp = time.Now()
+	}
+	c.recordHistory(line)
+
+	c.chatMu.Lock()
+	c.lines = append(c.lines, line)
+	c.unread = append(c.unread, message.ID)
+	c.chatMu.Unlock()
+
+	c.redrawChat()
+}
+
+// addNotice shows a conversation event, such as a timer change. Notices are
+// not kept in the history.
+func (c *App) addNotice(text string) {
+	c.chatMu.Lock()
+	c.lines = append(c.lines, &chatLine{
+		text:   text,
+		notice: true,
+	})
+	c.chatMu.Unlock()
+
+	c.redrawChat()
+}
+
+// dropExpired removes disappearing messages whose timer ran out from the
+// chatbox; pruneHistory deletes them from the history. It reports
+// whether it removed any and whether others are still counting down.
+func (c *App) dropExpired(now time.Time) (dropped, counting bool) {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	kept := c.lines[:0]
+	for _, line := range c.lines {
+		if line.expires.IsZero() || now.Before(line.expires) {
+			kept = append(kept, line)
+			counting = counting || !line.expires.IsZero()
+			continue
+		}
+
+		dropped = true
+		delete(c.pending, line.clientID)
+		delete(c.sent, line.id)
+	}
+	clear(c.lines[len(kept):])
+	c.lines = kept
+	return dropped, counting
+}
+
+// markAccepted records the server ID of an outgoing message.
+func (c *App) markAccepted(clientID, id string) {
+	c.chatMu.Lock()
+	line, ok := c.pending[clientID]
+	var updated chatLine
+	if ok {
+		delete(c.pending, clientID)
+		line.id = id
+		c.sent[id] = line
+		if line.status < statusSent {
+			line.status = statusSent
+		}
+		updated = *line
+	}
+	c.chatMu.Unlock()
+
+	if ok {
+		c.updateHistory(updated)
+		c.redrawChat()
+	}
+}
+
+// markFailed flags an outgoing message the server rejected for good.
+func (c *App) markFailed(clientID, reason string) {
+	c.chatMu.Lock()
+	line, ok := c.pending[clientID]
+	var updated chatLine
+	if ok {
+		delete(c.pending, clientID)
+		line.failed = reason
+		updated = *line
+	}
+	c.chatMu.Unlock()
+
+	if ok {
+		c.updateHistory(updated)
+		c.redrawChat()
+	}
+}
+
+// applyReceipt upgrades the status of the referenced outgoing messages.
+// Receipts may arrive out of order, so a status never moves backwards.
+func (c *App) applyReceipt(receipt *model.Receipt) {
+	status, ok := receiptStatus(receipt.Status)
+	if !ok {
+		return
+	}
+
+	var updated []chatLine
+	c.chatMu.Lock()
+	for _, id := range receipt.MessageIDs {
+		line, ok := c.sent[id]
+		if !ok || line.status >= status {
+			continue
+		}
+		line.status = status
+		updated = append(updated, *line)
+	}
+	c.chatMu.Unlock()
+
+	if len(updated) > 0 {
+		c.updateHistory(updated...)
+		c.redrawChat()
+	}
+}
+
+// takeUnread returns the incoming message IDs not yet reported as read.
+func (c *App) takeUnread() []string {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	ids := c.unread
+	c.unread = nil
+	return ids
+}
+
+func (c *App) redrawChat() {
+	c.drawChat(false)
+}
+
+// drawChat renders the lines into the chatbox. The view stays where the
+// user scrolled it; when older lines were prepended it moves down by as
+// many rows, so it still shows the same messages.
+func (c *App) drawChat(prepended bool) {
+	c.app.QueueUpdateDraw(func() {
+		rows := c.chatbox.GetWrappedLineCount()
+		c.chatbox.SetText(c.renderChat())
+		if prepended {
+			row, _ := c.chatbox.GetScrollOffset()
+			c.chatbox.ScrollTo(max(row, 0)+c.chatbox.GetWrappedLineCount()-rows, 0)
+		}
+	})
+}
+
+func (c *App) renderChat() string {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	now := time.Now()
+	rendered := make([]string, 0, len(c.lines))
+	for _, line := range c.lines {
+		rendered = append(rendered, line.render(now))
+	}
+	return strings.Join(rendered, "\n") + "\n"
+}
+
+// scrollChat pages the chatbox up or down. Scrolling up past the top loads
+// older history; scrolling down to the bottom follows new messages again.
+func (c *App) scrollChat(event *tcell.EventKey) {
+	c.chatbox.InputHandler()(event, func(tview.Primitive) {})
+
+	row, _ := c.chatbox.GetScrollOffset()
+	_, _, _, height := c.chatbox.GetInnerRect()
+	switch {
+	case event.Key() == tcell.KeyPgUp && row <= 0:
+		go c.showOlderHistory()
+	case event.Key() == tcell.KeyPgDn && row+height >= c.chatbox.GetWrappedLineCount():
+		c.chatbox.ScrollToEnd()
+	}
+}
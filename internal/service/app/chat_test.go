@@ -0,0 +1,52 @@
+package app
+
+import (
+	"e2e_chat/internal/model"
+	"testing"
+)
+
+func TestReceipts(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	alice.send(t, "hi bob")
+	alice.waitLine(t, "hi bob", func(l chatLine) bool { return l.status == statusDelivered }, "delivered tick")
+
+	got := bob.waitLine(t, "hi bob", func(chatLine) bool { return true }, "message at bob")
+	if got.outgoing || got.from != "alice" || got.id == "" {
+		t.Fatalf("bob got %+v", got)
+	}
+
+	// what typing in the message field does
+	if err := bob.sendReceipt(model.ReceiptRead, bob.takeUnread()); err != nil {
+		t.Fatal(err)
+	}
+	alice.waitLine(t, "hi bob", func(l chatLine) bool { return l.status == statusRead }, "read tick")
+
+	if unread := bob.takeUnread(); len(unread) != 0 {
+		t.Fatalf("still unread after the read receipt: %v", unread)
+	}
+}
+
+func TestReceiptNeverDowngrades(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+
+	alice.addOutgoingLine("c1", "hello", 0)
+	alice.markAccepted("c1", "s1")
+
+	alice.applyReceipt(&model.Receipt{Status: model.ReceiptRead, MessageIDs: []string{"s1"}})
+	alice.applyReceipt(&model.Receipt{Status: model.ReceiptDelivered, MessageIDs: []string{"s1"}})
+
+	if line, _ := alice.line("hello"); line.status != statusRead {
+		t.Fatalf("status %d after a late delivery receipt, want read", line.status)
+	}
+
+	// receipts for unknown messages are ignored
+	alice.applyReceipt(&model.Receipt{Status: model.ReceiptRead, MessageIDs: []string{"unknown"}})
+}
@@ -0,0 +1,29 @@
+package app
+
+import (
+	"strings"
+)
+
+// commands typed in the message field instead of a message
+const (
+	timerCommand  = "/timer"  // "/timer 30s", "/timer 1h" or "/timer off"
+	attachCommand = "/attach" // "/attach <path>"
+	searchCommand = "/search" // "/search <words>", each word matching as a prefix
+)
+
+// runCommand starts the command in text, if it is one. It reports whether it
+// was, otherwise text is sent as a message.
+func (c *App) runCommand(text string) bool {
+	name, arg, _ := strings.Cut(text, " ")
+	switch name {
+	case timerCommand:
+		go c.runTimerCommand(arg)
+	case attachCommand:
+		go c.runAttachCommand(arg)
+	case searchCommand:
+		go c.runSearchCommand(arg)
+	default:
+		return false
+	}
+	return true
+}
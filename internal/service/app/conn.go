@@ -0,0 +1,254 @@
+package app
+
+import (
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/utils/log"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	connOffline connState = iota
+	connReconnecting
+	connOnline
+)
+
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var (
+	errOffline = errors.New("not connected to server")
+)
+
+type (
+	connState int
+
+	// connManager owns the websocket to the server. Whenever the connection
+	// drops it redials, re-authenticating with a fresh challenge, and backs off
+	// exponentially with jitter between failed attempts, or for as long as the
+	// server asks when it rate limits us.
+	connManager struct {
+		dial        func() (*websocket.Conn, error)
+		onFrame     func(*model.Frame)
+		onConnected func()
+		onState     func(connState, time.Duration)
+
+		// guards conn; gorilla/websocket allows a single writer
+		mu   sync.Mutex
+		conn *websocket.Conn
+
+		// held while a frame is handled, so close can wait for it
+		handling sync.Mutex
+
+		stop     chan struct{}
+		stopOnce sync.Once
+	}
+)
+
+func (s connState) String() string {
+	switch s {
+	case connOnline:
+		return "online"
+	case connReconnecting:
+		return "reconnecting"
+	default:
+		return "offline"
+	}
+}
+
+func newConnManager(dial func() (*websocket.Conn, error), onFrame func(*model.Frame), onConnected func(), onState func(connState, time.Duration)) *connManager {
+	return &connManager{
+		dial:        dial,
+		onFrame:     onFrame,
+		onConnected: onConnected,
+		onState:     onState,
+		stop:        make(chan struct{}),
+	}
+}
+
+// run keeps a connection up until close is called. It blocks.
+func (m *connManager) run() {
+	attempt := 0
+	for {
+		m.onState(connReconnecting, 0)
+
+		conn, err := m.dial()
+		if err != nil {
+			wait := max(backoff(attempt), retryAfter(err))
+			attempt++
+			log.Debug("connect to server failed", zap.Duration("retryIn", wait), zap.Error(err))
+
+			if !m.sleep(wait) {
+				return
+			}
+			continue
+		}
+
+		attempt = 0
+		if !m.setConn(conn) {
+			conn.Close()
+			return
+		}
+
+		m.onState(connOnline, 0)
+		m.onConnected()
+		err = m.readLoop(conn)
+
+		m.mu.Lock()
+		m.conn = nil
+		m.mu.Unlock()
+
+		select {
+		case <-m.stop:
+			m.onState(connOffline, 0)
+			return
+		default:
+		}
+
+		if wait := retryAfter(err); wait > 0 {
+			log.Debug("disconnected by rate limit", zap.Duration("retryIn", wait))
+			if !m.sleep(wait) {
+				return
+			}
+		}
+	}
+}
+
+// sleep reports offline for wait. It returns false if closed meanwhile.
+func (m *connManager) sleep(wait time.Duration) bool {
+	m.onState(connOffline, wait)
+	select {
+	case <-m.stop:
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+// retryAfter is the wait the server asked for when err is a rate limit,
+// either a 429 or a websocket closed with model.CloseRateLimited.
+func retryAfter(err error) time.Duration {
+	var limited *rateLimitedError
+	if errors.As(err, &limited) {
+		return limited.retryAfter
+	}
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code == model.CloseRateLimited {
+		if wait, ok := model.ParseRetryAfterReason(closeErr.Text); ok {
+			return wait
+		}
+		return maxBackoff
+	}
+	return 0
+}
+
+func (m *connManager) setConn(conn *websocket.Conn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.stop:
+		return false
+	default:
+	}
+
+	m.conn = conn
+	return true
+}
+
+// readLoop hands frames to onFrame until the connection fails, and returns
+// why it did.
+func (m *connManager) readLoop(conn *websocket.Conn) error {
+	defer conn.Close()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Debug("worker web socket closed", zap.Error(err))
+			return err
+		}
+
+		var frame model.Frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			log.Error("Unmarshal frame failed", zap.Error(err))
+			continue
+		}
+
+		if !m.handle(&frame) {
+			return errOffline
+		}
+	}
+}
+
+// handle passes frame to onFrame unless the manager was closed meanwhile.
+func (m *connManager) handle(frame *model.Frame) bool {
+	m.handling.Lock()
+	defer m.handling.Unlock()
+
+	select {
+	case <-m.stop:
+		return false
+	default:
+	}
+
+	m.onFrame(frame)
+	return true
+}
+
+// write sends frame on the current connection. A failed write closes the
+// connection, which makes run reconnect.
+func (m *connManager) write(frame *model.Frame) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		return errOffline
+	}
+
+	if err := m.conn.WriteJSON(frame); err != nil {
+		m.conn.Close()
+		m.conn = nil
+		return err
+	}
+	return nil
+}
+
+// close stops reconnecting and closes the current connection. It returns
+// once no frame is being handled, and none is handled after it.
+func (m *connManager) close() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+
+	m.mu.Lock()
+	if m.conn != nil {
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		m.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		m.conn.Close()
+		m.conn = nil
+	}
+	m.mu.Unlock()
+
+	m.handling.Lock()
+	m.handling.Unlock()
+}
+
+// backoff returns the wait before the given retry: exponential, capped at
+// maxBackoff, with the upper half randomised so clients that lost the same
+// server do not all come back at once.
+func backoff(attempt int) time.Duration {
+	d := maxBackoff
+	if attempt < 16 {
+		d = min(minBackoff<<attempt, maxBackoff)
+	}
+	return d/2 + rand.N(d/2+1)
+}
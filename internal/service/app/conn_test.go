@@ -0,0 +1,44 @@
+package app
+
+import (
+	"e2e_chat/internal/model"
+	"testing"
+	"time"
+)
+
+// TestCloseWaitsForFrame checks that close returns only once the frame being
+// handled is done, and that no frame is handled after it, so a client that
+// is closed never touches its state again.
+func TestCloseWaitsForFrame(t *testing.T) {
+	handling, release := make(chan struct{}), make(chan struct{})
+	handled := 0
+	m := newConnManager(nil, func(*model.Frame) {
+		handled++
+		close(handling)
+		<-release
+	}, nil, nil)
+
+	go m.handle(&model.Frame{})
+	<-handling
+
+	closed := make(chan struct{})
+	go func() {
+		m.close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("close returned while a frame was handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-closed
+
+	if m.handle(&model.Frame{}) {
+		t.Fatal("frame handled after close")
+	}
+	if handled != 1 {
+		t.Fatalf("%d frames handled, want 1", handled)
+	}
+}
@@ -0,0 +1,431 @@
+package app
+
+import (
+	"context"
+	"e2e_chat/internal/cryptographic/kdf"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/utils/log"
+	"slices"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// historyPageSize is how many messages one history page holds. A page is
+// what is encrypted, loaded and scrolled back at a time.
+const historyPageSize = 100
+
+var historyInfo = []byte("E2EChatHistoryV1")
+
+type (
+	// historyEntry is a message as kept in the local history.
+	historyEntry struct {
+		ID        string         `json:"id,omitempty"`
+		ClientID  string         `json:"client_id,omitempty"`
+		Timestamp int64          `json:"timestamp"` // unix millis
+		From      string         `json:"from,omitempty"`
+		Text      string         `json:"text"`
+		Outgoing  bool           `json:"outgoing,omitempty"`
+		Status    deliveryStatus `json:"status,omitempty"`
+		Failed    string         `json:"failed,omitempty"`
+		Expires   int64          `json:"expires,omitempty"` // unix millis, 0 if never
+	}
+
+	// historyPage sums up a stored page, so pruning only opens the pages it
+	// changes.
+	historyPage struct {
+		N       int   `json:"n"`
+		Count   int   `json:"count"`
+		Oldest  int64 `json:"oldest"`
+		Newest  int64 `json:"newest"`
+		Expires int64 `json:"expires,omitempty"` // first expiry in the page, 0 if none
+	}
+
+	// historyIndex lists the pages of a conversation, oldest first. Messages
+	// go to the last page until it is full.
+	historyIndex struct {
+		Next  int            `json:"next"` // number of the next new page
+		Pages []*historyPage `json:"pages"`
+	}
+)
+
+// historyKey derives the key a user's history is encrypted with from the
+// identity key, so the store alone reveals nothing and a restored identity
+// opens a restored history.
+func historyKey(user *model.User) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := kdf.HKDF(user.IKPriv, nil, historyInfo, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (e *historyEntry) expired(now int64) bool {
+	return e.Expires != 0 && e.Expires <= now
+}
+
+// is reports whether e stores line: our messages are known by client ID,
+// the peer's by server ID.
+func (e *historyEntry) is(line *chatLine) bool {
+	if line.outgoing {
+		return e.Outgoing && e.ClientID == line.clientID
+	}
+	return !e.Outgoing && e.ID == line.id
+}
+
+// same reports whether e and other store the same message.
+func (e *historyEntry) same(other *historyEntry) bool {
+	if e.Outgoing {
+		return other.Outgoing && e.ClientID == other.ClientID
+	}
+	return !other.Outgoing && e.ID == other.ID
+}
+
+func (e *historyEntry) line(page int) *chatLine {
+	line := &chatLine{
+		id:        e.ID,
+		clientID:  e.ClientID,
+		from:      e.From,
+		text:      e.Text,
+		outgoing:  e.Outgoing,
+		status:    e.Status,
+		failed:    e.Failed,
+		timestamp: time.UnixMilli(e.Timestamp),
+		page:      page,
+	}
+	if e.Expires != 0 {
+		line.expires = time.UnixMilli(e.Expires)
+	}
+	return line
+}
+
+func (l *chatLine) entry() *historyEntry {
+	e := &historyEntry{
+		ID:        l.id,
+		ClientID:  l.clientID,
+		Timestamp: l.timestamp.UnixMilli(),
+		From:      l.from,
+		Text:      l.text,
+		Outgoing:  l.outgoing,
+		Status:    l.status,
+		Failed:    l.failed,
+	}
+	if !l.expires.IsZero() {
+		e.Expires = l.expires.UnixMilli()
+	}
+	return e
+}
+
+// summarize describes page n holding entries, which are sorted by time.
+func summarize(n int, entries []*historyEntry) *historyPage {
+	page := &historyPage{
+		N:      n,
+		Count:  len(entries),
+		Oldest: entries[0].Timestamp,
+		Newest: entries[len(entries)-1].Timestamp,
+	}
+	for _, e := range entries {
+		if e.Expires != 0 && (page.Expires == 0 || e.Expires < page.Expires) {
+			page.Expires = e.Expires
+		}
+	}
+	return page
+}
+
+// SetHistoryRetention bounds the local history: messages older than
+// retention, or beyond the newest maxMessages of a conversation, are
+// deleted. Zero means no bound.
+func (c *App) SetHistoryRetention(retention time.Duration, maxMessages int) {
+	c.historyRetention = retention
+	c.historyMaxMessages = maxMessages
+}
+
+// loadHistory opens the encrypted history of the conversation, prunes it
+// and puts its newest messages in the chatbox.
+func (c *App) loadHistory(ctx context.Context) error {
+	key, err := historyKey(c.user)
+	if err != nil {
+		return err
+	}
+
+	index, err := c.GetHistoryIndex(ctx, c.user.Name, c.toName, key)
+	if err != nil {
+		return err
+	}
+
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	c.historyKey = key
+	c.history = index
+	c.historyShown = index.Next
+	clear(c.searchShards)
+
+	if err := c.pruneHistoryLocked(ctx, time.Now()); err != nil {
+		return err
+	}
+
+	// a full page at least, even right after a new one was started
+	var lines []*chatLine
+	for len(lines) < historyPageSize {
+		older, ok, err := c.olderHistoryLocked(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		lines = append(older, lines...)
+	}
+
+	c.chatMu.Lock()
+	c.prependLines(lines)
+	c.chatMu.Unlock()
+	return nil
+}
+
+// showOlderHistory puts the page before the oldest one shown at the top of
+// the chatbox, once the user scrolled up to it.
+func (c *App) showOlderHistory() {
+	c.historyMu.Lock()
+	var (
+		lines []*chatLine
+		ok    = true
+		err   error
+	)
+	// pages whose messages all expired show nothing
+	for ok && err == nil && len(lines) == 0 {
+		lines, ok, err = c.olderHistoryLocked(context.TODO())
+	}
+	if len(lines) > 0 {
+		c.chatMu.Lock()
+		c.prependLines(lines)
+		c.chatMu.Unlock()
+	}
+	c.historyMu.Unlock()
+
+	if err != nil {
+		log.Error("load history failed", zap.Error(err))
+	}
+	if len(lines) > 0 {
+		c.drawChat(true)
+	}
+}
+
+// olderHistoryLocked reads the newest page older than those shown. It
+// reports false when there is none.
+func (c *App) olderHistoryLocked(ctx context.Context) ([]*chatLine, bool, error) {
+	var page *historyPage
+	for _, p := range c.history.Pages {
+		if p.N < c.historyShown {
+			page = p
+		}
+	}
+	if page == nil {
+		return nil, false, nil
+	}
+
+	entries, err := c.GetHistoryPage(ctx, c.user.Name, c.toName, c.historyKey, page.N)
+	if err != nil {
+		return nil, false, err
+	}
+	c.historyShown = page.N
+
+	// expired ones are deleted on the next prune
+	now := time.Now().UnixMilli()
+	lines := make([]*chatLine, 0, len(entries))
+	for _, e := range entries {
+		if !e.expired(now) {
+			lines = append(lines, e.line(page.N))
+		}
+	}
+	return lines, true, nil
+}
+
+// prependLines puts lines from the history before those shown. Our own
+// messages among them take receipts and acks like new ones. chatMu must be
+// held.
+func (c *App) prependLines(lines []*chatLine) {
+	for _, line := range lines {
+		switch {
+		case !line.outgoing || line.failed != "":
+		case line.id == "":
+			c.pending[line.clientID] = line
+		default:
+			c.sent[line.id] = line
+		}
+	}
+	c.lines = append(lines, c.lines...)
+}
+
+// recordHistory stores a new message line and notes its page in line.page.
+func (c *App) recordHistory(line *chatLine) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	if err := c.recordHistoryLocked(context.TODO(), line); err != nil {
+		log.Error("save history failed", zap.Error(err))
+	}
+}
+
+func (c *App) recordHistoryLocked(ctx context.Context, line *chatLine) error {
+	n := c.history.Next
+	var entries []*historyEntry
+	if last := len(c.history.Pages) - 1; last >= 0 && c.history.Pages[last].Count < historyPageSize {
+		n = c.history.Pages[last].N
+
+		var err error
+		entries, err = c.GetHistoryPage(ctx, c.user.Name, c.toName, c.historyKey, n)
+		if err != nil {
+			return err
+		}
+	} else {
+		c.history.Next++
+	}
+
+	// messages may arrive slightly out of order
+	e := line.entry()
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Timestamp > e.Timestamp
+	})
+	entries = slices.Insert(entries, i, e)
+
+	line.page = n
+	return c.writeHistoryPageLocked(ctx, n, entries)
+}
+
+// updateHistory rewrites the stored copies of lines, whose status changed.
+// The lines are copies taken under chatMu.
+func (c *App) updateHistory(lines ...chatLine) {
+	byPage := make(map[int][]*chatLine)
+	for i := range lines {
+		if n := lines[i].page; n != 0 {
+			byPage[n] = append(byPage[n], &lines[i])
+		}
+	}
+	if len(byPage) == 0 {
+		return
+	}
+
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	ctx := context.TODO()
+	for n, lines := range byPage {
+		entries, err := c.GetHistoryPage(ctx, c.user.Name, c.toName, c.historyKey, n)
+		if err != nil {
+			log.Error("load history failed", zap.Error(err))
+			continue
+		}
+
+		changed := false
+		for _, line := range lines {
+			// pruned meanwhile if not found
+			if i := slices.IndexFunc(entries, func(e *historyEntry) bool { return e.is(line) }); i >= 0 {
+				entries[i] = line.entry()
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		if err := c.writeHistoryPageLocked(ctx, n, entries); err != nil {
+			log.Error("save history failed", zap.Error(err))
+		}
+	}
+}
+
+// pruneHistory deletes expired and retained-too-long messages from the
+// history.
+func (c *App) pruneHistory(now time.Time) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	if err := c.pruneHistoryLocked(context.TODO(), now); err != nil {
+		log.Error("prune history failed", zap.Error(err))
+	}
+}
+
+// pruneHistoryLocked deletes disappearing messages whose timer ran out and
+// those past the retention limits. Only pages holding such messages are
+// opened.
+func (c *App) pruneHistoryLocked(ctx context.Context, now time.Time) error {
+	var cutoff int64
+	if c.historyRetention > 0 {
+		cutoff = now.Add(-c.historyRetention).UnixMilli()
+	}
+
+	excess := 0
+	if c.historyMaxMessages > 0 {
+		total := 0
+		for _, page := range c.history.Pages {
+			total += page.Count
+		}
+		excess = max(total-c.historyMaxMessages, 0)
+	}
+
+	nowMilli := now.UnixMilli()
+	for _, page := range slices.Clone(c.history.Pages) {
+		// the oldest messages go first
+		drop := min(excess, page.Count)
+		excess -= drop
+
+		expired := page.Expires != 0 && page.Expires <= nowMilli
+		if drop == 0 && page.Oldest >= cutoff && !expired {
+			continue
+		}
+
+		entries, err := c.GetHistoryPage(ctx, c.user.Name, c.toName, c.historyKey, page.N)
+		if err != nil {
+			return err
+		}
+
+		kept := make([]*historyEntry, 0, len(entries))
+		for i, e := range entries {
+			if i >= drop && e.Timestamp >= cutoff && !e.expired(nowMilli) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == len(entries) {
+			continue
+		}
+
+		if err := c.writeHistoryPageLocked(ctx, page.N, kept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHistoryPageLocked stores page n, or deletes it once empty, and
+// updates its search index and the page list to match.
+func (c *App) writeHistoryPageLocked(ctx context.Context, n int, entries []*historyEntry) error {
+	i := slices.IndexFunc(c.history.Pages, func(p *historyPage) bool { return p.N == n })
+
+	if err := c.indexPageLocked(ctx, n, entries); err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		if err := c.DeleteHistoryPage(ctx, c.user.Name, c.toName, n); err != nil {
+			return err
+		}
+		if i >= 0 {
+			c.history.Pages = slices.Delete(c.history.Pages, i, i+1)
+		}
+	} else {
+		if err := c.SaveHistoryPage(ctx, c.user.Name, c.toName, c.historyKey, n, entries); err != nil {
+			return err
+		}
+		if i >= 0 {
+			c.history.Pages[i] = summarize(n, entries)
+		} else {
+			// a new page, numbered after all others
+			c.history.Pages = append(c.history.Pages, summarize(n, entries))
+		}
+	}
+
+	return c.SaveHistoryIndex(ctx, c.user.Name, c.toName, c.historyKey, c.history)
+}
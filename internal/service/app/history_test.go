@@ -0,0 +1,264 @@
+package app
+
+import (
+	"bytes"
+	"crypto/rand"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/memory"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newHistoryClient opens alice's history of the conversation with bob in
+// state, without a server.
+func newHistoryClient(t *testing.T, state storage.StateStore, ikPriv []byte) *App {
+	t.Helper()
+
+	c := NewApp(memory.NewUserStore(), state)
+	c.user = &model.User{Name: "alice", IKPriv: ikPriv}
+	c.toName = "bob"
+	if err := c.loadHistory(t.Context()); err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	return c
+}
+
+func testIKPriv(t *testing.T) []byte {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// receivedLine is the i-th message from bob, sent at base plus i seconds.
+func receivedLine(i int, base time.Time) *chatLine {
+	return &chatLine{
+		id:        fmt.Sprintf("m%03d", i),
+		from:      "bob",
+		text:      fmt.Sprintf("message %d", i),
+		status:    statusRead,
+		timestamp: base.Add(time.Duration(i) * time.Second),
+	}
+}
+
+func recordReceived(c *App, from, to int, base time.Time) {
+	for i := from; i < to; i++ {
+		c.recordHistory(receivedLine(i, base))
+	}
+}
+
+// scrollBack shows the next older page, as scrolling up past the top does.
+func (c *App) scrollBack(t *testing.T) bool {
+	t.Helper()
+
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	lines, ok, err := c.olderHistoryLocked(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.chatMu.Lock()
+	c.prependLines(lines)
+	c.chatMu.Unlock()
+	return ok
+}
+
+func (c *App) texts() []string {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	var texts []string
+	for _, line := range c.lines {
+		if !line.notice {
+			texts = append(texts, line.text)
+		}
+	}
+	return texts
+}
+
+func (c *App) pageCounts() []int {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	var counts []int
+	for _, page := range c.history.Pages {
+		counts = append(counts, page.Count)
+	}
+	return counts
+}
+
+func messageTexts(from, to int) []string {
+	var texts []string
+	for i := from; i < to; i++ {
+		texts = append(texts, fmt.Sprintf("message %d", i))
+	}
+	return texts
+}
+
+func checkTexts(t *testing.T, got, want []string) {
+	t.Helper()
+
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %d messages %q...\nwant %d messages %q...", len(got), got[:min(len(got), 3)], len(want), want[:min(len(want), 3)])
+	}
+}
+
+func TestHistoryPages(t *testing.T) {
+	state, ikPriv, base := memory.NewStateStore(), testIKPriv(t), time.Now().Add(-time.Hour)
+
+	c := newHistoryClient(t, state, ikPriv)
+	recordReceived(c, 0, 250, base)
+	if counts := c.pageCounts(); !slices.Equal(counts, []int{100, 100, 50}) {
+		t.Fatalf("page counts %v", counts)
+	}
+
+	// a full page at least is shown on start
+	c = newHistoryClient(t, state, ikPriv)
+	checkTexts(t, c.texts(), messageTexts(100, 250))
+
+	if !c.scrollBack(t) {
+		t.Fatal("no older page")
+	}
+	checkTexts(t, c.texts(), messageTexts(0, 250))
+	if c.scrollBack(t) {
+		t.Fatal("older page past the first")
+	}
+}
+
+func TestHistoryOutOfOrder(t *testing.T) {
+	state, ikPriv, base := memory.NewStateStore(), testIKPriv(t), time.Now().Add(-time.Hour)
+
+	c := newHistoryClient(t, state, ikPriv)
+	for _, i := range []int{2, 0, 1} {
+		c.recordHistory(receivedLine(i, base))
+	}
+
+	c = newHistoryClient(t, state, ikPriv)
+	checkTexts(t, c.texts(), messageTexts(0, 3))
+}
+
+func TestHistoryEncrypted(t *testing.T) {
+	state, ikPriv := memory.NewStateStore(), testIKPriv(t)
+
+	c := newHistoryClient(t, state, ikPriv)
+	c.recordHistory(&chatLine{id: "m1", from: "bob", text: "attack at dawn", timestamp: time.Now()})
+
+	for _, key := range []string{"history: alice, peer: bob", "history: alice, peer: bob, page: 1"} {
+		data, err := state.Get(t.Context(), key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if bytes.Contains(data, []byte("attack")) || bytes.Contains(data, []byte("m1")) {
+			t.Fatalf("%s stored in the clear: %q", key, data)
+		}
+	}
+
+	other := NewApp(memory.NewUserStore(), state)
+	other.user = &model.User{Name: "alice", IKPriv: testIKPriv(t)}
+	other.toName = "bob"
+	if err := other.loadHistory(t.Context()); err == nil {
+		t.Fatal("history opened with another identity key")
+	}
+}
+
+func TestHistoryStatus(t *testing.T) {
+	state, ikPriv := memory.NewStateStore(), testIKPriv(t)
+	now := time.Now()
+
+	c := newHistoryClient(t, state, ikPriv)
+	accepted := &chatLine{clientID: "c1", text: "accepted", outgoing: true, timestamp: now}
+	unsent := &chatLine{clientID: "c2", text: "unsent", outgoing: true, timestamp: now.Add(time.Second)}
+	c.recordHistory(accepted)
+	c.recordHistory(unsent)
+
+	accepted.id = "s1"
+	accepted.status = statusRead
+	c.updateHistory(*accepted)
+
+	c = newHistoryClient(t, state, ikPriv)
+	line, ok := c.line("accepted")
+	if !ok || line.id != "s1" || line.status != statusRead || line.page != 1 {
+		t.Fatalf("got %+v", line)
+	}
+
+	// our reloaded messages take acks and receipts again
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+	if c.sent["s1"] == nil || c.pending["c2"] == nil {
+		t.Fatalf("sent %v, pending %v", c.sent, c.pending)
+	}
+}
+
+func TestHistoryMaxMessages(t *testing.T) {
+	state, ikPriv, base := memory.NewStateStore(), testIKPriv(t), time.Now().Add(-time.Hour)
+
+	c := newHistoryClient(t, state, ikPriv)
+	recordReceived(c, 0, 250, base)
+
+	c = NewApp(memory.NewUserStore(), state)
+	c.user = &model.User{Name: "alice", IKPriv: ikPriv}
+	c.toName = "bob"
+	c.SetHistoryRetention(0, 120)
+	if err := c.loadHistory(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if counts := c.pageCounts(); !slices.Equal(counts, []int{70, 50}) {
+		t.Fatalf("page counts %v", counts)
+	}
+	checkTexts(t, c.texts(), messageTexts(130, 250))
+
+	// the emptied first page is gone from the store too
+	if _, err := state.Get(t.Context(), "history: alice, peer: bob, page: 1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("page 1: %v", err)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	state, ikPriv := memory.NewStateStore(), testIKPriv(t)
+	now := time.Now()
+
+	c := newHistoryClient(t, state, ikPriv)
+	c.SetHistoryRetention(time.Hour, 0)
+	recordReceived(c, 0, 10, now.Add(-time.Hour-5*time.Second))
+
+	c.pruneHistory(now)
+	if counts := c.pageCounts(); !slices.Equal(counts, []int{5}) {
+		t.Fatalf("page counts %v", counts)
+	}
+
+	c = newHistoryClient(t, state, ikPriv)
+	checkTexts(t, c.texts(), messageTexts(5, 10))
+}
+
+func TestHistoryExpired(t *testing.T) {
+	state, ikPriv := memory.NewStateStore(), testIKPriv(t)
+	now := time.Now()
+
+	c := newHistoryClient(t, state, ikPriv)
+	for i, expires := range []time.Duration{0, time.Minute, 2 * time.Minute, 0} {
+		line := receivedLine(i, now)
+		if expires != 0 {
+			line.expires = now.Add(expires)
+		}
+		c.recordHistory(line)
+	}
+
+	c.pruneHistory(now.Add(90 * time.Second))
+	c.historyMu.Lock()
+	page := *c.history.Pages[0]
+	c.historyMu.Unlock()
+	if page.Count != 3 || page.Expires != now.Add(2*time.Minute).UnixMilli() {
+		t.Fatalf("got %+v", page)
+	}
+
+	c = newHistoryClient(t, state, ikPriv)
+	checkTexts(t, c.texts(), []string{"message 0", "message 2", "message 3"})
+}
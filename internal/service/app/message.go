@@ -1 +1,249 @@
 package app
+
+import (
+	"context"
+	"crypto/rand"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/utils/log"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxSeenMessages bounds how many delivered message IDs are remembered for
+// de-duplicating redeliveries.
+const maxSeenMessages = 1000
+
+var (
+	errUnknownSender = errors.New("message from another conversation")
+	errLoadSession   = errors.New("load session failed")
+	errSaveSession   = errors.New("save session failed")
+)
+
+func newClientID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (c *App) writeFrame(frame *model.Frame) error {
+	return c.ws.write(frame)
+}
+
+// transmit sends an outgoing message. It goes sealed when the recipient
+// allows it, so the server only learns who receives it; otherwise, or when
+// the server refuses our delivery token, it goes over the websocket.
+func (c *App) transmit(frame *model.Frame) error {
+	if envelope := c.sealEnvelope(frame.Message); envelope != nil {
+		ack, err := c.postSealed(envelope)
+		if err == nil {
+			c.handleFrame(&model.Frame{Type: model.FrameAccepted, Ack: ack})
+			return nil
+		}
+		if !errors.Is(err, errDeliveryRefused) {
+			return err
+		}
+
+		log.Warn("sealed delivery refused, sending unsealed", zap.String("to", frame.Message.To))
+		c.forgetProfileKey()
+	}
+	return c.writeFrame(frame)
+}
+
+func (c *App) handleFrame(frame *model.Frame) {
+	switch frame.Type {
+	case model.FrameMessage:
+		if frame.Message == nil {
+			return
+		}
+		c.handleIncoming(frame.Message)
+	case model.FrameAccepted:
+		if frame.Ack == nil {
+			return
+		}
+		c.removeFromOutbox(frame.Ack.ClientID)
+		c.markAccepted(frame.Ack.ClientID, frame.Ack.ID)
+	case model.FrameError:
+		if frame.Error == nil {
+			return
+		}
+		c.handleRejected(frame.Error)
+	default:
+		log.Warn("unknown frame type", zap.String("type", string(frame.Type)))
+	}
+}
+
+// handleRejected deals with a frame the server refused. A message that can
+// never be accepted leaves the outbox, since resending it would only be
+// refused again; one that failed on the server side stays for the next flush.
+func (c *App) handleRejected(rejected *model.Error) {
+	log.Warn("server rejected frame", zap.String("clientID", rejected.ClientID), zap.Error(rejected))
+
+	if rejected.ClientID == "" || rejected.Retryable() {
+		return
+	}
+	c.removeFromOutbox(rejected.ClientID)
+	c.markFailed(rejected.ClientID, rejected.Message)
+}
+
+// handleIncoming decrypts a message at most once and acks it. The server
+// redelivers until it sees the ack, so duplicates are acked again but never
+// fed to the ratchet a second time. The ratchet state and the seen set are
+// saved before the ack, so that a message acked before a crash is never fed
+// to the ratchet again after it.
+//
+// Messages for another conversation, and those we could not load or save
+// the session for, are not acked: they stay queued and come again on the next
+// connection. One that fails to decrypt is acked, it would only fail again.
+func (c *App) handleIncoming(message *model.Message) {
+	if !c.isSeen(message.ID) {
+		opened, err := c.unseal(message)
+		if err == nil && opened.From != c.toName {
+			err = fmt.Errorf("%w: %q", errUnknownSender, opened.From)
+		}
+		if errors.Is(err, errUnknownSender) {
+			log.Debug("message left queued", zap.String("id", message.ID), zap.Error(err))
+			return
+		}
+
+		var content *model.Content
+		if err == nil {
+			content, err = c.ReceiveMessage(opened)
+		}
+		if errors.Is(err, errLoadSession) || errors.Is(err, errSaveSession) {
+			log.Error("receive message failed", zap.Error(err))
+			return
+		}
+		if err != nil {
+			c.app.Suspend(func() {
+				log.Error("receive message failed: ", zap.Error(err))
+			})
+		}
+		c.markSeen(message.ID)
+
+		if content != nil {
+			c.handleContent(opened, content)
+		}
+
+		if err := c.saveReceived(context.TODO()); err != nil {
+			// unacked, the server redelivers it after a restart
+			log.Error("save ratchet state failed", zap.Error(err))
+			return
+		}
+	}
+
+	err := c.writeFrame(&model.Frame{
+		Type: model.FrameAck,
+		Ack:  &model.Ack{ID: message.ID},
+	})
+	if err != nil {
+		log.Error("ack message failed", zap.Error(err))
+	}
+}
+
+func (c *App) handleContent(message *model.Message, content *model.Content) {
+	if content.ProfileKey != nil {
+		c.learnProfileKey(message.From, content.ProfileKey)
+	}
+
+	switch content.Type {
+	case model.ContentText:
+		c.addIncomingLine(message, content.Text, time.Duration(content.ExpireTimer)*time.Second)
+		if err := c.sendReceipt(model.ReceiptDelivered, []string{message.ID}); err != nil {
+			log.Error("send delivery receipt failed", zap.Error(err))
+		}
+	case model.ContentReceipt:
+		if content.Receipt != nil {
+			c.applyReceipt(content.Receipt)
+		}
+	case model.ContentAttachment:
+		if content.Attachment == nil {
+			return
+		}
+		timer := time.Duration(content.ExpireTimer) * time.Second
+		c.addIncomingLine(message, attachmentLine(content.Attachment), timer)
+		if err := c.sendReceipt(model.ReceiptDelivered, []string{message.ID}); err != nil {
+			log.Error("send delivery receipt failed", zap.Error(err))
+		}
+		if d := c.addDownload(message, content.Attachment, timer); d != nil {
+			go c.receiveAttachment(d)
+		}
+	case model.ContentTimer:
+		c.applyExpireTimer(message.From, content.ExpireTimer)
+	default:
+		log.Warn("unknown content type", zap.String("type", string(content.Type)))
+	}
+}
+
+func (c *App) isSeen(id string) bool {
+	c.seenMu.Lock()
+	defer c.seenMu.Unlock()
+
+	return c.seen[id]
+}
+
+func (c *App) markSeen(id string) {
+	c.seenMu.Lock()
+	defer c.seenMu.Unlock()
+
+	c.addSeen(id)
+}
+
+// addSeen records id and forgets the IDs processed longest ago. The order
+// is kept apart, server IDs need not sort by time. The caller holds seenMu.
+func (c *App) addSeen(id string) {
+	if c.seen[id] {
+		return
+	}
+	c.seen[id] = true
+	c.seenOrder = append(c.seenOrder, id)
+
+	if n := len(c.seenOrder) - maxSeenMessages; n > 0 {
+		for _, old := range c.seenOrder[:n] {
+			delete(c.seen, old)
+		}
+		c.seenOrder = slices.Clone(c.seenOrder[n:])
+	}
+}
+
+func (c *App) loadSeen(ctx context.Context) error {
+	ids, err := c.GetSeen(ctx, c.user.Name)
+	if err != nil {
+		return err
+	}
+
+	c.seenMu.Lock()
+	defer c.seenMu.Unlock()
+
+	for _, id := range ids {
+		c.addSeen(id)
+	}
+	return nil
+}
+
+// saveReceived persists what receiving a message changed.
+func (c *App) saveReceived(ctx context.Context) error {
+	c.ratchetMu.Lock()
+	var err error
+	// none yet when the message was from a session we do not have
+	if c.state != nil {
+		err = c.SaveState(ctx, c.user.Name, c.toName, c.state)
+	}
+	c.ratchetMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.saveSeen(ctx)
+}
+
+func (c *App) saveSeen(ctx context.Context) error {
+	c.seenMu.Lock()
+	ids := slices.Clone(c.seenOrder)
+	c.seenMu.Unlock()
+
+	return c.SaveSeen(ctx, c.user.Name, ids)
+}
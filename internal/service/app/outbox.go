@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/utils/log"
+
+	"go.uber.org/zap"
+)
+
+// addToOutbox persists an encrypted frame until the server confirms it. Once
+// a message is encrypted the ratchet has moved on, so losing it would leave
+// a permanent gap for the recipient. The ratchet state must be saved first.
+func (c *App) addToOutbox(frame *model.Frame) error {
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+
+	c.outbox = append(c.outbox, frame)
+	return c.SaveOutbox(context.TODO(), c.user.Name, c.outbox)
+}
+
+// removeFromOutbox drops the frame with clientID, once the server accepted
+// it or rejected it for good.
+func (c *App) removeFromOutbox(clientID string) {
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+
+	for i, frame := range c.outbox {
+		if frame.Message == nil || frame.Message.ClientID != clientID {
+			continue
+		}
+
+		c.outbox = append(c.outbox[:i], c.outbox[i+1:]...)
+		if err := c.SaveOutbox(context.TODO(), c.user.Name, c.outbox); err != nil {
+			log.Error("save outbox failed", zap.Error(err))
+		}
+		return
+	}
+}
+
+// flushOutbox resends every unconfirmed frame in the order it was encrypted.
+// The server remembers client IDs, so frames that did arrive before the
+// connection dropped are confirmed again rather than queued twice.
+func (c *App) flushOutbox() {
+	// new messages must not overtake the ones already waiting
+	c.ratchetMu.Lock()
+	defer c.ratchetMu.Unlock()
+
+	c.outboxMu.Lock()
+	frames := append([]*model.Frame(nil), c.outbox...)
+	c.outboxMu.Unlock()
+
+	for _, frame := range frames {
+		if err := c.transmit(frame); err != nil {
+			log.Debug("flush outbox interrupted", zap.Error(err))
+			return
+		}
+	}
+}
+
+func (c *App) loadOutbox(ctx context.Context) error {
+	frames, err := c.GetOutbox(ctx, c.user.Name)
+	if err != nil {
+		return err
+	}
+
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+
+	c.outbox = frames
+	return nil
+}
@@ -0,0 +1,253 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"e2e_chat/internal/cryptographic/dh"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/sealed"
+	"e2e_chat/internal/utils/log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// certificateRenewal is how long before expiry the sender certificate is
+// replaced, so a sealed message is never sent with one about to lapse.
+const certificateRenewal = 5 * time.Minute
+
+// sealEnvelope wraps message for sealed delivery. It returns nil when the
+// message has to go unsealed: the recipient has not shared its profile key
+// with us yet, or we hold no valid sender certificate.
+func (c *App) sealEnvelope(message *model.Message) *model.SealedEnvelope {
+	if message.To != c.toName {
+		return nil
+	}
+
+	c.sealMu.Lock()
+	profileKey := c.peerProfileKey
+	c.sealMu.Unlock()
+	if profileKey == nil {
+		return nil
+	}
+
+	token, err := sealed.DeliveryToken(profileKey)
+	if err != nil {
+		log.Warn("invalid profile key of recipient", zap.String("name", message.To), zap.Error(err))
+		return nil
+	}
+
+	cert, err := c.senderCertificate()
+	if err != nil {
+		log.Warn("no sender certificate, sending unsealed", zap.Error(err))
+		return nil
+	}
+
+	inner, err := json.Marshal(&model.SealedContent{
+		From:          message.From,
+		Certificate:   cert,
+		Header:        message.Header,
+		Ciphertext:    message.Ciphertext,
+		X3DHHandShake: message.X3DHHandShake,
+	})
+	if err != nil {
+		log.Error("marshal sealed content failed", zap.Error(err))
+		return nil
+	}
+
+	ephPub, ciphertext, err := sealed.Seal(c.toSharedKeys.IKPub, inner)
+	if err != nil {
+		log.Error("seal message failed", zap.Error(err))
+		return nil
+	}
+
+	return &model.SealedEnvelope{
+		To:            message.To,
+		ClientID:      message.ClientID,
+		DeliveryToken: token,
+		Sealed: &model.Sealed{
+			EphemeralPub: ephPub,
+			Ciphertext:   ciphertext,
+		},
+		TTL: message.TTL,
+	}
+}
+
+// unseal opens a sealed message and checks that its certificate vouches for
+// the identity key we know for the claimed sender. Unsealed messages are
+// returned as they are.
+func (c *App) unseal(message *model.Message) (*model.Message, error) {
+	if message.Sealed == nil {
+		return message, nil
+	}
+
+	plaintext, err := sealed.Open(c.user.IKPriv, message.Sealed.EphemeralPub, message.Sealed.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	var inner model.SealedContent
+	if err := json.Unmarshal(plaintext, &inner); err != nil {
+		return nil, err
+	}
+
+	if inner.From != c.toName {
+		return nil, fmt.Errorf("%w: %q", errUnknownSender, inner.From)
+	}
+
+	// the certificate had to be valid when the server took the message
+	at := time.UnixMilli(message.Timestamp)
+	if err := c.verifySenderCertificate(inner.Certificate, inner.From, c.toSharedKeys.IKPub, at); err != nil {
+		return nil, err
+	}
+
+	if inner.Header == nil {
+		return nil, errors.New("sealed message without header")
+	}
+
+	return &model.Message{
+		ID:            message.ID,
+		ClientID:      message.ClientID,
+		Timestamp:     message.Timestamp,
+		From:          inner.From,
+		To:            message.To,
+		Header:        inner.Header,
+		Ciphertext:    inner.Ciphertext,
+		X3DHHandShake: inner.X3DHHandShake,
+		TTL:           message.TTL,
+	}, nil
+}
+
+// senderCertificate returns our certificate, fetching a new one when it is
+// missing or close to expiry.
+func (c *App) senderCertificate() (*model.SenderCertificate, error) {
+	c.sealMu.Lock()
+	cert := c.senderCert
+	c.sealMu.Unlock()
+
+	if cert != nil && time.Until(time.Unix(cert.Expires, 0)) > certificateRenewal {
+		return cert, nil
+	}
+
+	cert, err := c.getSenderCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	ikPriv, err := dh.ConvertToECDHFormat(c.user.IKPriv)
+	if err != nil {
+		return nil, err
+	}
+
+	// recipients would drop our messages if the server vouched for the
+	// wrong key or signed with one they do not trust
+	if err := c.verifySenderCertificate(cert, c.user.Name, ikPriv.PublicKey().Bytes(), time.Now()); err != nil {
+		return nil, err
+	}
+	if cert.DeviceID != c.deviceID {
+		return nil, fmt.Errorf("%w: issued for device %q", sealed.ErrInvalidCertificate, cert.DeviceID)
+	}
+
+	c.sealMu.Lock()
+	c.senderCert = cert
+	c.sealMu.Unlock()
+	return cert, nil
+}
+
+// verifySenderCertificate checks that cert was signed with the trusted
+// server key, was valid at at and vouches for identityKey as sender's.
+func (c *App) verifySenderCertificate(cert *model.SenderCertificate, sender string, identityKey []byte, at time.Time) error {
+	c.sealMu.Lock()
+	serverKey := c.serverKey
+	c.sealMu.Unlock()
+
+	if err := sealed.VerifyCertificate(serverKey, cert, at); err != nil {
+		return err
+	}
+
+	if cert.Sender != sender || cert.DeviceID == "" {
+		return fmt.Errorf("%w: issued to %q on %q", sealed.ErrInvalidCertificate, cert.Sender, cert.DeviceID)
+	}
+	if !bytes.Equal(cert.IdentityKey, identityKey) {
+		return fmt.Errorf("%w: identity key of %q does not match", sealed.ErrInvalidCertificate, sender)
+	}
+	return nil
+}
+
+// learnProfileKey stores the profile key a peer sent us, which lets us send
+// it sealed messages from now on.
+func (c *App) learnProfileKey(from string, profileKey []byte) {
+	if from != c.toName || len(profileKey) != sealed.ProfileKeySize {
+		return
+	}
+
+	c.sealMu.Lock()
+	known := bytes.Equal(c.peerProfileKey, profileKey)
+	c.peerProfileKey = profileKey
+	c.sealMu.Unlock()
+
+	if known {
+		return
+	}
+	if err := c.SaveProfileKey(context.TODO(), c.user.Name, from, profileKey); err != nil {
+		log.Error("save profile key failed", zap.Error(err))
+	}
+}
+
+// forgetProfileKey stops sealed delivery to the peer until it shares its
+// profile key again, e.g. after the server refused the derived token.
+func (c *App) forgetProfileKey() {
+	c.sealMu.Lock()
+	c.peerProfileKey = nil
+	c.sealMu.Unlock()
+
+	if err := c.DeleteProfileKey(context.TODO(), c.user.Name, c.toName); err != nil {
+		log.Error("delete profile key failed", zap.Error(err))
+	}
+}
+
+// loadSealed settles which server key certificates must be signed with: the
+// pinned trust root, else the one remembered from the first connection. A
+// server presenting another key is refused rather than silently trusted.
+func (c *App) loadSealed(ctx context.Context) error {
+	serverKey, err := c.getCertificateKey()
+	if err != nil {
+		return err
+	}
+
+	trusted := c.trustRoot
+	if trusted == nil {
+		trusted, err = c.GetTrustRoot(ctx, c.user.Name, c.host)
+		if err != nil {
+			return err
+		}
+	}
+
+	if trusted == nil {
+		log.Info("trusting server certificate key on first use", zap.String("trustRoot", sealed.FormatTrustRoot(serverKey)))
+		if err := c.SaveTrustRoot(ctx, c.user.Name, c.host, serverKey); err != nil {
+			return err
+		}
+		trusted = serverKey
+	}
+
+	if !bytes.Equal(trusted, serverKey) {
+		return fmt.Errorf("%w: server presented %s, trusted %s", sealed.ErrTrustRootMismatch,
+			sealed.FormatTrustRoot(serverKey), sealed.FormatTrustRoot(trusted))
+	}
+
+	profileKey, err := c.GetProfileKey(ctx, c.user.Name, c.toName)
+	if err != nil {
+		return err
+	}
+
+	c.sealMu.Lock()
+	defer c.sealMu.Unlock()
+
+	c.serverKey = trusted
+	c.peerProfileKey = profileKey
+	return nil
+}
@@ -0,0 +1,46 @@
+package app
+
+import "testing"
+
+// TestSealedSender checks that once profile keys were exchanged, messages
+// reach the server without naming their sender, and still arrive.
+func TestSealedSender(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	// the first messages carry the profile keys
+	alice.send(t, "hello")
+	bob.waitLine(t, "hello", func(chatLine) bool { return true }, "alice's first message")
+	bob.send(t, "hi")
+	alice.waitLine(t, "hi", func(chatLine) bool { return true }, "bob's reply")
+	alice.waitLine(t, "hello", func(l chatLine) bool { return l.status >= statusDelivered }, "delivered tick")
+
+	waitFor(t, func() bool {
+		alice.sealMu.Lock()
+		defer alice.sealMu.Unlock()
+		return alice.peerProfileKey != nil
+	}, "alice to learn bob's profile key")
+
+	// bob goes away and never acks, so the next message stays queued
+	bob.ws.close()
+
+	alice.send(t, "sealed")
+	alice.waitLine(t, "sealed", func(l chatLine) bool { return l.status >= statusSent }, "the server to accept it")
+
+	pending, err := srv.queue.Pending(t.Context(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the message and alice's read receipt for "hi"
+	if len(pending) == 0 {
+		t.Fatal("nothing queued for bob")
+	}
+	for _, m := range pending {
+		if m.Sealed == nil || m.From != "" || m.Header != nil || m.Ciphertext != nil {
+			t.Fatalf("queued message reveals its sender: %+v", m)
+		}
+	}
+}
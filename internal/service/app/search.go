@@ -0,0 +1,291 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/rivo/tview"
+)
+
+const (
+	// maxSearchHits bounds the results of one search, newest first.
+	maxSearchHits = 50
+
+	searchPage = "search"
+)
+
+type (
+	// searchShard indexes the words of one history page. Tokens is sorted
+	// and Postings[i] lists the positions in the page of the entries that
+	// contain Tokens[i]. It is rewritten whenever its page is.
+	searchShard struct {
+		Tokens   []string `json:"tokens"`
+		Postings [][]int  `json:"postings"`
+	}
+
+	searchHit struct {
+		page  int
+		entry *historyEntry
+	}
+)
+
+// tokenize splits text into lower case words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func newSearchShard(entries []*historyEntry) *searchShard {
+	postings := make(map[string][]int)
+	for i, e := range entries {
+		for _, token := range tokenize(e.Text) {
+			// a word repeated in a message is indexed once
+			if p := postings[token]; len(p) == 0 || p[len(p)-1] != i {
+				postings[token] = append(p, i)
+			}
+		}
+	}
+
+	shard := &searchShard{Tokens: make([]string, 0, len(postings))}
+	for token := range postings {
+		shard.Tokens = append(shard.Tokens, token)
+	}
+	sort.Strings(shard.Tokens)
+	for _, token := range shard.Tokens {
+		shard.Postings = append(shard.Postings, postings[token])
+	}
+	return shard
+}
+
+// match returns the positions of the entries with a word starting with
+// prefix, in order.
+func (s *searchShard) match(prefix string) []int {
+	var positions []int
+	for i := sort.SearchStrings(s.Tokens, prefix); i < len(s.Tokens) && strings.HasPrefix(s.Tokens[i], prefix); i++ {
+		positions = append(positions, s.Postings[i]...)
+	}
+	slices.Sort(positions)
+	return slices.Compact(positions)
+}
+
+// matches reports whether every query word starts a word of text. Hits are
+// checked against their entry, in case a shard is older than its page.
+func matches(text string, query []string) bool {
+	tokens := tokenize(text)
+	for _, prefix := range query {
+		if !slices.ContainsFunc(tokens, func(token string) bool { return strings.HasPrefix(token, prefix) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// intersect returns the positions in both sorted lists.
+func intersect(a, b []int) []int {
+	var both []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			both = append(both, a[i])
+			i++
+			j++
+		}
+	}
+	return both
+}
+
+// searchHistory returns the newest messages of the conversation that have,
+// for every word of query, a word starting with it. Only the pages the
+// index points to are opened.
+func (c *App) searchHistory(ctx context.Context, query string) ([]*searchHit, error) {
+	words := tokenize(query)
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	now := time.Now().UnixMilli()
+	var hits []*searchHit
+	for i := len(c.history.Pages) - 1; i >= 0 && len(hits) < maxSearchHits; i-- {
+		n := c.history.Pages[i].N
+
+		shard, err := c.searchShardLocked(ctx, n)
+		if err != nil {
+			return nil, err
+		}
+
+		positions := shard.match(words[0])
+		for _, word := range words[1:] {
+			positions = intersect(positions, shard.match(word))
+		}
+		if len(positions) == 0 {
+			continue
+		}
+
+		entries, err := c.GetHistoryPage(ctx, c.user.Name, c.toName, c.historyKey, n)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pos := range slices.Backward(positions) {
+			if pos < len(entries) && !entries[pos].expired(now) && matches(entries[pos].Text, words) {
+				hits = append(hits, &searchHit{page: n, entry: entries[pos]})
+			}
+			if len(hits) == maxSearchHits {
+				break
+			}
+		}
+	}
+	return hits, nil
+}
+
+// searchShardLocked returns the index of page n. Pages stored before the
+// index existed are indexed on first use.
+func (c *App) searchShardLocked(ctx context.Context, n int) (*searchShard, error) {
+	if shard, ok := c.searchShards[n]; ok {
+		return shard, nil
+	}
+
+	shard, err := c.GetSearchShard(ctx, c.user.Name, c.toName, c.historyKey, n)
+	if err != nil {
+		return nil, err
+	}
+
+	if shard == nil {
+		entries, err := c.GetHistoryPage(ctx, c.user.Name, c.toName, c.historyKey, n)
+		if err != nil {
+			return nil, err
+		}
+
+		shard = newSearchShard(entries)
+		if err := c.SaveSearchShard(ctx, c.user.Name, c.toName, c.historyKey, n, shard); err != nil {
+			return nil, err
+		}
+	}
+
+	c.searchShards[n] = shard
+	return shard, nil
+}
+
+// indexPageLocked updates the index of page n after the page was written,
+// deleting it with the page.
+func (c *App) indexPageLocked(ctx context.Context, n int, entries []*historyEntry) error {
+	if len(entries) == 0 {
+		delete(c.searchShards, n)
+		return c.DeleteSearchShard(ctx, c.user.Name, c.toName, n)
+	}
+
+	shard := newSearchShard(entries)
+	c.searchShards[n] = shard
+	return c.SaveSearchShard(ctx, c.user.Name, c.toName, c.historyKey, n, shard)
+}
+
+func (c *App) runSearchCommand(arg string) {
+	query := strings.TrimSpace(arg)
+	if len(tokenize(query)) == 0 {
+		c.addNotice(fmt.Sprintf("%s: usage: %s <words>", searchCommand, searchCommand))
+		return
+	}
+
+	hits, err := c.searchHistory(context.TODO(), query)
+	if err != nil {
+		c.addNotice(fmt.Sprintf("%s: %v", searchCommand, err))
+		return
+	}
+	if len(hits) == 0 {
+		c.addNotice(fmt.Sprintf("%s: no messages match %q", searchCommand, query))
+		return
+	}
+
+	c.app.QueueUpdateDraw(func() {
+		c.showSearchResults(query, hits)
+	})
+}
+
+// showSearchResults lists hits over the chat. Selecting one closes the list
+// and shows the message in the chatbox among those around it.
+func (c *App) showSearchResults(query string, hits []*searchHit) {
+	closeResults := func() {
+		c.pages.RemovePage(searchPage)
+		c.app.SetFocus(c.input)
+	}
+
+	list := tview.NewList().
+		ShowSecondaryText(false).
+		SetDoneFunc(closeResults)
+	list.SetBorder(true).SetTitle(fmt.Sprintf(" %d results for %q · Enter to show, Esc to close ", len(hits), query))
+
+	for _, hit := range hits {
+		line := hit.entry.line(hit.page)
+		from := line.from
+		if line.outgoing {
+			from = "You"
+		}
+
+		list.AddItem(fmt.Sprintf("[gray]%s[-] %s: %s", line.timestamp.Format("2006-01-02 15:04"), tview.Escape(from), tview.Escape(line.text)), "", 0, func() {
+			closeResults()
+			go c.jumpTo(line)
+		})
+	}
+
+	// centered over the chat
+	modal := tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(list, min(len(hits), 20)+2, 0, true).
+			AddItem(nil, 0, 1, false), 0, 4, true).
+		AddItem(nil, 0, 1, false)
+
+	c.pages.AddPage(searchPage, modal, true, true)
+	c.app.SetFocus(list)
+}
+
+// jumpTo scrolls the chatbox to line and highlights it, loading the history
+// back to its page first.
+func (c *App) jumpTo(line *chatLine) {
+	c.historyMu.Lock()
+	var (
+		older []*chatLine
+		err   error
+	)
+	for c.historyShown > line.page {
+		var (
+			lines []*chatLine
+			ok    bool
+		)
+		lines, ok, err = c.olderHistoryLocked(context.TODO())
+		if err != nil || !ok {
+			break
+		}
+		older = append(lines, older...)
+	}
+	if len(older) > 0 {
+		c.chatMu.Lock()
+		c.prependLines(older)
+		c.chatMu.Unlock()
+	}
+	c.historyMu.Unlock()
+
+	if err != nil {
+		c.addNotice(fmt.Sprintf("%s: %v", searchCommand, err))
+		return
+	}
+
+	c.drawChat(len(older) > 0)
+	c.app.QueueUpdateDraw(func() {
+		c.chatbox.Highlight(line.region()).ScrollToHighlight()
+	})
+}
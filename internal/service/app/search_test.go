@@ -0,0 +1,204 @@
+package app
+
+import (
+	"e2e_chat/internal/storage/memory"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := map[string][]string{
+		"Meeting at Café!":       {"meeting", "at", "café"},
+		"  re: 2nd-floor, 10:30": {"re", "2nd", "floor", "10", "30"},
+		"ÜBER straße":            {"über", "straße"},
+		"👍 ...":                  nil,
+	}
+	for text, want := range tests {
+		if got := tokenize(text); !slices.Equal(got, want) {
+			t.Errorf("tokenize(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestSearchShard(t *testing.T) {
+	shard := newSearchShard([]*historyEntry{
+		{Text: "meet me at the cafe"},
+		{Text: "Meeting at Café, meeting at noon"},
+		{Text: "no"},
+	})
+
+	if !slices.IsSorted(shard.Tokens) || len(shard.Tokens) != len(shard.Postings) {
+		t.Fatalf("tokens %q, %d postings", shard.Tokens, len(shard.Postings))
+	}
+	if i := slices.Index(shard.Tokens, "meeting"); i < 0 || !slices.Equal(shard.Postings[i], []int{1}) {
+		t.Fatalf("meeting indexed as %v", shard.Postings[i])
+	}
+
+	tests := map[string][]int{
+		"meet": {0, 1},
+		"caf":  {0, 1},
+		"café": {1},
+		"no":   {1, 2},
+		"x":    nil,
+	}
+	for prefix, want := range tests {
+		if got := shard.match(prefix); !slices.Equal(got, want) {
+			t.Errorf("match(%q) = %v, want %v", prefix, got, want)
+		}
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	if got := intersect([]int{1, 3, 5, 7}, []int{0, 3, 4, 7, 9}); !slices.Equal(got, []int{3, 7}) {
+		t.Fatalf("got %v", got)
+	}
+	if got := intersect(nil, []int{1}); got != nil {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func hitTexts(hits []*searchHit) []string {
+	var texts []string
+	for _, hit := range hits {
+		texts = append(texts, hit.entry.Text)
+	}
+	return texts
+}
+
+func search(t *testing.T, c *App, query string) []string {
+	t.Helper()
+
+	hits, err := c.searchHistory(t.Context(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hitTexts(hits)
+}
+
+func TestSearchHistory(t *testing.T) {
+	state, ikPriv, base := memory.NewStateStore(), testIKPriv(t), time.Now().Add(-time.Hour)
+
+	c := newHistoryClient(t, state, ikPriv)
+	recordReceived(c, 0, 250, base)
+	c.recordHistory(&chatLine{id: "x1", from: "bob", text: "Meeting at Café", timestamp: base.Add(10 * time.Minute)})
+
+	// every word must start a word of the message
+	if got := search(t, c, "meet caf"); !slices.Equal(got, []string{"Meeting at Café"}) {
+		t.Fatalf("got %q", got)
+	}
+	if got := search(t, c, "meet noon"); got != nil {
+		t.Fatalf("got %q", got)
+	}
+	if got := search(t, c, "  ... "); got != nil {
+		t.Fatalf("got %q", got)
+	}
+
+	// newest first, across pages, at most maxSearchHits
+	got := search(t, c, "message")
+	if len(got) != maxSearchHits || got[0] != "message 249" || got[maxSearchHits-1] != "message 200" {
+		t.Fatalf("got %d hits %q...", len(got), got[:min(len(got), 3)])
+	}
+	want := []string{"message 79", "message 78", "message 77", "message 76", "message 75", "message 74", "message 73", "message 72", "message 71", "message 70", "message 7"}
+	if got := search(t, c, "message 7"); !slices.Equal(got, want) {
+		t.Fatalf("got %q", got)
+	}
+
+	// a restarted client reads the stored index
+	c = newHistoryClient(t, state, ikPriv)
+	if got := search(t, c, "message 99"); !slices.Equal(got, []string{"message 99"}) {
+		t.Fatalf("after reload got %q", got)
+	}
+}
+
+func TestSearchPruned(t *testing.T) {
+	state, ikPriv := memory.NewStateStore(), testIKPriv(t)
+	now := time.Now()
+
+	c := newHistoryClient(t, state, ikPriv)
+	expiring := receivedLine(0, now)
+	expiring.text = "secret plan"
+	expiring.expires = now.Add(time.Minute)
+	c.recordHistory(expiring)
+	c.recordHistory(&chatLine{id: "m1", from: "bob", text: "public plan", timestamp: now.Add(time.Second)})
+
+	if got := search(t, c, "plan"); len(got) != 2 {
+		t.Fatalf("got %q", got)
+	}
+
+	c.pruneHistory(now.Add(2 * time.Minute))
+	if got := search(t, c, "plan"); !slices.Equal(got, []string{"public plan"}) {
+		t.Fatalf("after the timer got %q", got)
+	}
+
+	c = newHistoryClient(t, state, ikPriv)
+	if got := search(t, c, "secret"); got != nil {
+		t.Fatalf("after reload got %q", got)
+	}
+}
+
+func TestSearchIndexStored(t *testing.T) {
+	state, ikPriv, base := memory.NewStateStore(), testIKPriv(t), time.Now().Add(-time.Hour)
+
+	c := newHistoryClient(t, state, ikPriv)
+	c.recordHistory(&chatLine{id: "m1", from: "bob", text: "attack at dawn", timestamp: base})
+
+	key := "history search: alice, peer: bob, page: 1"
+	data, err := state.Get(t.Context(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(tokenize(string(data)), "attack") {
+		t.Fatal("index stored in the clear")
+	}
+
+	// pages written before the index existed are indexed on first search
+	if err := state.Del(t.Context(), key); err != nil {
+		t.Fatal(err)
+	}
+	c = newHistoryClient(t, state, ikPriv)
+	if got := search(t, c, "dawn"); !slices.Equal(got, []string{"attack at dawn"}) {
+		t.Fatalf("got %q", got)
+	}
+	if _, err := state.Get(t.Context(), key); err != nil {
+		t.Fatalf("index not rebuilt: %v", err)
+	}
+}
+
+func TestSearchJump(t *testing.T) {
+	srv := newTestServer(t)
+	users, state := memory.NewUserStore(), memory.NewStateStore()
+	alice := newTestClientOn(t, srv, "alice", users, state)
+	newTestClient(t, srv, "bob")
+
+	// history from before this run
+	h := newHistoryClient(t, state, alice.user.IKPriv)
+	recordReceived(h, 0, 250, time.Now().Add(-time.Hour))
+
+	alice.open(t, "bob")
+	if _, ok := alice.line("message 5"); ok {
+		t.Fatal("oldest page shown on start")
+	}
+
+	// 59 to 50, then 5
+	hits, err := alice.searchHistory(t.Context(), "message 5")
+	if err != nil || len(hits) != 11 {
+		t.Fatalf("got %d hits, %v", len(hits), err)
+	}
+	hit := hits[len(hits)-1]
+	line := hit.entry.line(hit.page)
+	alice.jumpTo(line)
+
+	if _, ok := alice.line("message 5"); !ok {
+		t.Fatal("page of the hit not loaded")
+	}
+	checkTexts(t, alice.texts(), messageTexts(0, 250))
+
+	waitFor(t, func() bool {
+		// returns once run by the app
+		var highlights []string
+		alice.app.QueueUpdate(func() { highlights = alice.chatbox.GetHighlights() })
+		return slices.Equal(highlights, []string{line.region()})
+	}, fmt.Sprintf("%s highlighted", line.region()))
+}
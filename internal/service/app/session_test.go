@@ -0,0 +1,316 @@
+package app
+
+import (
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage/memory"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestStateSavedBeforeSend(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	for _, text := range []string{"one", "two", "three"} {
+		alice.send(t, text)
+
+		// no Stop: what a crash right after sending would leave behind
+		saved, err := alice.GetState(t.Context(), "alice", "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice.ratchetMu.Lock()
+		ns := alice.state.Ns
+		alice.ratchetMu.Unlock()
+		if saved == nil || saved.Ns != ns {
+			t.Fatalf("after %q: saved state %+v, in memory Ns %d", text, saved, ns)
+		}
+	}
+}
+
+// TestReceiverRestart crashes the receiver after it acked a message and
+// checks that the restarted client continues the same session.
+func TestReceiverRestart(t *testing.T) {
+	srv := newTestServer(t)
+	bobUsers, bobState := memory.NewUserStore(), memory.NewStateStore()
+
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClientOn(t, srv, "bob", bobUsers, bobState)
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	alice.send(t, "before")
+	bob.waitLine(t, "before", func(chatLine) bool { return true }, "message before the crash")
+	alice.waitLine(t, "before", func(l chatLine) bool { return l.status >= statusDelivered }, "delivered tick")
+
+	// saved before the ack, which follows the line being shown
+	line, _ := bob.line("before")
+	waitFor(t, func() bool {
+		seen, err := bob.GetSeen(t.Context(), "bob")
+		return err == nil && slices.Contains(seen, line.id)
+	}, "the seen set to be saved")
+
+	// no Stop, the connection just goes away
+	bob.ws.close()
+
+	restarted := newTestClientOn(t, srv, "bob", bobUsers, bobState)
+	restarted.open(t, "alice")
+
+	alice.send(t, "after")
+	restarted.waitLine(t, "after", func(chatLine) bool { return true }, "message after the restart")
+	if restarted.hasNotice("failed") {
+		t.Fatal("the restarted client failed to decrypt")
+	}
+}
+
+// TestOtherConversationLeftQueued checks that a message from someone other
+// than the open conversation's peer is not acked, and arrives once the
+// conversation with its sender is opened.
+func TestOtherConversationLeftQueued(t *testing.T) {
+	srv := newTestServer(t)
+	bobUsers, bobState := memory.NewUserStore(), memory.NewStateStore()
+
+	alice := newTestClient(t, srv, "alice")
+	carol := newTestClient(t, srv, "carol")
+	bob := newTestClientOn(t, srv, "bob", bobUsers, bobState)
+	alice.open(t, "bob")
+	carol.open(t, "bob")
+	bob.open(t, "alice")
+
+	carol.send(t, "from carol")
+	alice.send(t, "from alice")
+	bob.waitLine(t, "from alice", func(chatLine) bool { return true }, "alice's message")
+
+	waitFor(t, func() bool {
+		pending, err := srv.queue.Pending(t.Context(), "bob")
+		return err == nil && len(pending) == 1 && pending[0].From == "carol"
+	}, "only carol's message to stay queued")
+	if _, ok := bob.line("from carol"); ok {
+		t.Fatal("carol's message shown in the conversation with alice")
+	}
+
+	bob.ws.close()
+
+	restarted := newTestClientOn(t, srv, "bob", bobUsers, bobState)
+	restarted.open(t, "carol")
+	restarted.waitLine(t, "from carol", func(chatLine) bool { return true }, "carol's message")
+	waitFor(t, func() bool {
+		pending, err := srv.queue.Pending(t.Context(), "bob")
+		return err == nil && len(pending) == 0
+	}, "carol's message to be acked")
+}
+
+// TestForgedHandshake checks that a handshake which does not open its
+// message leaves the session alone.
+func TestForgedHandshake(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	alice.send(t, "hi")
+	bob.waitLine(t, "hi", func(chatLine) bool { return true }, "the first message")
+
+	bob.ratchetMu.Lock()
+	state := bob.state
+	bob.ratchetMu.Unlock()
+
+	forged := &model.Message{
+		From:          "alice",
+		To:            "bob",
+		Header:        &model.Header{},
+		Ciphertext:    make([]byte, 64),
+		X3DHHandShake: &model.X3DHHandshake{EKPub: make([]byte, 32)},
+	}
+	forged.X3DHHandShake.EKPub[0] = 9
+	if _, err := bob.ReceiveMessage(forged); err == nil {
+		t.Fatal("forged message opened")
+	}
+	bob.ratchetMu.Lock()
+	kept := bob.state == state
+	bob.ratchetMu.Unlock()
+	if !kept {
+		t.Fatal("forged handshake replaced the session")
+	}
+
+	alice.send(t, "still here")
+	bob.waitLine(t, "still here", func(chatLine) bool { return true }, "a message on the kept session")
+}
+
+// queued returns the messages waiting for to, oldest first.
+func queued(t *testing.T, srv *testServer, to string, n int) []*model.Message {
+	t.Helper()
+
+	var pending []*model.Message
+	waitFor(t, func() bool {
+		var err error
+		pending, err = srv.queue.Pending(t.Context(), to)
+		return err == nil && len(pending) == n
+	}, fmt.Sprintf("%d messages queued for %s", n, to))
+	return pending
+}
+
+// restartSession makes c forget its session with the peer, as restoring a
+// backup without sessions does.
+func (c *App) restartSession(t *testing.T) {
+	t.Helper()
+
+	c.ratchetMu.Lock()
+	defer c.ratchetMu.Unlock()
+
+	c.state = nil
+	if err := c.stateStore.Del(t.Context(), fmt.Sprintf("from: %s, to: %s", c.user.Name, c.toName)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receiveText(t *testing.T, c *App, message *model.Message) string {
+	t.Helper()
+
+	content, err := c.ReceiveMessage(message)
+	if err != nil {
+		t.Fatalf("receive %s: %v", message.ID, err)
+	}
+	return content.Text
+}
+
+// TestHandshakeReplay checks that a handshake opens one session only once,
+// also after a restart.
+func TestHandshakeReplay(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	bobUsers, bobState := memory.NewUserStore(), memory.NewStateStore()
+	bob := newTestClientOn(t, srv, "bob", bobUsers, bobState)
+	alice.open(t, "bob")
+	if err := bob.openConversation(t.Context(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.send(t, "hi")
+	handshake := queued(t, srv, "bob", 1)[0]
+	if got := receiveText(t, bob, handshake); got != "hi" {
+		t.Fatalf("got %q", got)
+	}
+	alice.send(t, "second")
+	if got := receiveText(t, bob, queued(t, srv, "bob", 2)[1]); got != "second" {
+		t.Fatalf("got %q", got)
+	}
+
+	if _, err := bob.ReceiveMessage(handshake); !errors.Is(err, errHandshakeReplayed) {
+		t.Fatalf("got %v, want %v", err, errHandshakeReplayed)
+	}
+
+	restarted := newTestClientOn(t, srv, "bob", bobUsers, bobState)
+	if err := restarted.openConversation(t.Context(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.ReceiveMessage(handshake); !errors.Is(err, errHandshakeReplayed) {
+		t.Fatalf("after restart: got %v, want %v", err, errHandshakeReplayed)
+	}
+	alice.send(t, "third")
+	if got := receiveText(t, restarted, queued(t, srv, "bob", 3)[2]); got != "third" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// TestOlderHandshake checks that a handshake older than the current session
+// is read but does not replace it.
+func TestOlderHandshake(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	if err := bob.openConversation(t.Context(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.send(t, "old")
+	alice.restartSession(t)
+	alice.send(t, "new")
+	alice.send(t, "after")
+	pending := queued(t, srv, "bob", 3)
+
+	// the newer session arrives first
+	if got := receiveText(t, bob, pending[1]); got != "new" {
+		t.Fatalf("got %q", got)
+	}
+	if got := receiveText(t, bob, pending[0]); got != "old" {
+		t.Fatalf("older handshake not read: %q", got)
+	}
+	if got := receiveText(t, bob, pending[2]); got != "after" {
+		t.Fatalf("older handshake replaced the session: %q", got)
+	}
+}
+
+func TestSessionRecordOrder(t *testing.T) {
+	r := &sessionRecord{}
+	if !r.newer(0, []byte{1}) {
+		t.Fatal("a session is not newer than none")
+	}
+
+	r.start(100, []byte{5})
+	tests := []struct {
+		started int64
+		ekPub   byte
+		want    bool
+	}{
+		{101, 0, true},
+		{99, 9, false},
+		{100, 6, true},
+		{100, 4, false},
+		{100, 5, false},
+	}
+	for _, tt := range tests {
+		if got := r.newer(tt.started, []byte{tt.ekPub}); got != tt.want {
+			t.Errorf("newer(%d, %d) = %v, want %v", tt.started, tt.ekPub, got, tt.want)
+		}
+	}
+
+	for i := range maxUsedHandshakes + 1 {
+		r.addUsed([]byte(fmt.Sprint(i)))
+	}
+	if len(r.Used) != maxUsedHandshakes || r.used([]byte{5}) || !r.used([]byte(fmt.Sprint(maxUsedHandshakes))) {
+		t.Fatalf("%d handshakes remembered, want the last %d", len(r.Used), maxUsedHandshakes)
+	}
+}
+
+func TestNoSession(t *testing.T) {
+	srv := newTestServer(t)
+	newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	bob.open(t, "alice")
+
+	// sent on a session bob no longer has
+	message := &model.Message{ID: "m1", From: "alice", To: "bob", Header: &model.Header{}, Ciphertext: make([]byte, 64)}
+	if _, err := bob.ReceiveMessage(message); !errors.Is(err, errNoSession) {
+		t.Fatalf("got %v, want %v", err, errNoSession)
+	}
+
+	bob.handleIncoming(message)
+	if state, err := bob.GetState(t.Context(), "bob", "alice"); err != nil || state != nil {
+		t.Fatalf("state saved for a message without a session: %+v, %v", state, err)
+	}
+}
+
+func TestSeenForgetsOldest(t *testing.T) {
+	c := NewApp(memory.NewUserStore(), memory.NewStateStore())
+
+	// stream IDs whose sequence is not padded, so they do not sort as strings
+	ids := make([]string, maxSeenMessages+2)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("1700000000000-%d", i)
+		c.markSeen(ids[i])
+	}
+
+	for i, id := range ids {
+		if want := i >= 2; c.isSeen(id) != want {
+			t.Fatalf("%s seen %v, want %v", id, !want, want)
+		}
+	}
+}
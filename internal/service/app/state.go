@@ -0,0 +1,367 @@
+package app
+
+import (
+	"context"
+	"e2e_chat/internal/cryptographic/encryption"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/doubleratchet"
+	"e2e_chat/internal/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// outboxTTL bounds how long unsent messages are kept. It matches how long
+	// the server remembers client IDs, so a resend within it is never queued
+	// twice.
+	outboxTTL = 24 * time.Hour
+
+	// ratchetStateTTL is how long a saved ratchet state is kept.
+	ratchetStateTTL = 2 * time.Hour
+)
+
+func (c *App) SaveState(ctx context.Context, from string, to string, state *doubleratchet.RatchetState) error {
+	key := fmt.Sprintf("from: %s, to: %s", from, to)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return c.stateStore.Set(ctx, key, data, ratchetStateTTL)
+}
+
+func (c *App) GetState(ctx context.Context, from string, to string) (*doubleratchet.RatchetState, error) {
+	key := fmt.Sprintf("from: %s, to: %s", from, to)
+	v, err := c.stateStore.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var state doubleratchet.RatchetState
+	err = json.Unmarshal(v, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// SaveSession keeps which session with peer is current and the handshakes
+// user already received from peer. Unlike the ratchet state it does not
+// expire, so that an old handshake is refused however late it comes.
+func (c *App) SaveSession(ctx context.Context, user string, peer string, record *sessionRecord) error {
+	key := fmt.Sprintf("session: %s, peer: %s", user, peer)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return c.stateStore.Set(ctx, key, data, 0)
+}
+
+// GetSession returns an empty record when there is none.
+func (c *App) GetSession(ctx context.Context, user string, peer string) (*sessionRecord, error) {
+	key := fmt.Sprintf("session: %s, peer: %s", user, peer)
+	v, err := c.stateStore.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return &sessionRecord{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var record sessionRecord
+	err = json.Unmarshal(v, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func (c *App) SaveSeen(ctx context.Context, user string, ids []string) error {
+	key := fmt.Sprintf("seen: %s", user)
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return c.stateStore.Set(ctx, key, data, 2*time.Hour)
+}
+
+func (c *App) GetSeen(ctx context.Context, user string) ([]string, error) {
+	key := fmt.Sprintf("seen: %s", user)
+	v, err := c.stateStore.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	err = json.Unmarshal(v, &ids)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (c *App) SaveOutbox(ctx context.Context, user string, frames []*model.Frame) error {
+	key := fmt.Sprintf("outbox: %s", user)
+	if len(frames) == 0 {
+		return c.stateStore.Del(ctx, key)
+	}
+
+	data, err := json.Marshal(frames)
+	if err != nil {
+		return err
+	}
+	return c.stateStore.Set(ctx, key, data, outboxTTL)
+}
+
+func (c *App) GetOutbox(ctx context.Context, user string) ([]*model.Frame, error) {
+	key := fmt.Sprintf("outbox: %s", user)
+	v, err := c.stateStore.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []*model.Frame
+	err = json.Unmarshal(v, &frames)
+	if err != nil {
+		return nil, err
+	}
+
+	return frames, nil
+}
+
+// SaveProfileKey keeps the profile key peer shared with user until it is
+// replaced or refused by the server.
+func (c *App) SaveProfileKey(ctx context.Context, user string, peer string, profileKey []byte) error {
+	key := fmt.Sprintf("profile key: %s, peer: %s", user, peer)
+	return c.stateStore.Set(ctx, key, profileKey, 0)
+}
+
+func (c *App) GetProfileKey(ctx context.Context, user string, peer string) ([]byte, error) {
+	key := fmt.Sprintf("profile key: %s, peer: %s", user, peer)
+	v, err := c.stateStore.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (c *App) DeleteProfileKey(ctx context.Context, user string, peer string) error {
+	key := fmt.Sprintf("profile key: %s, peer: %s", user, peer)
+	return c.stateStore.Del(ctx, key)
+}
+
+// SaveTrustRoot remembers the certificate key the server at host presented
+// the first time user connected.
+func (c *App) SaveTrustRoot(ctx context.Context, user string, host string, serverPub []byte) error {
+	key := fmt.Sprintf("trust root: %s, server: %s", user, host)
+	return c.stateStore.Set(ctx, key, serverPub, 0)
+}
+
+func (c *App) GetTrustRoot(ctx context.Context, user string, host string) ([]byte, error) {
+	key := fmt.Sprintf("trust root: %s, server: %s", user, host)
+	v, err := c.stateStore.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	return v, err
+}
+
+// SaveExpireTimer keeps the disappearing messages timer of the conversation
+// between user and peer. A zero timer turns them off.
+func (c *App) SaveExpireTimer(ctx context.Context, user string, peer string, timer time.Duration) error {
+	key := fmt.Sprintf("expire timer: %s, peer: %s", user, peer)
+	if timer <= 0 {
+		return c.stateStore.Del(ctx, key)
+	}
+	return c.stateStore.Set(ctx, key, []byte(strconv.FormatInt(int64(timer/time.Second), 10)), 0)
+}
+
+func (c *App) GetExpireTimer(ctx context.Context, user string, peer string) (time.Duration, error) {
+	key := fmt.Sprintf("expire timer: %s, peer: %s", user, peer)
+	v, err := c.stateStore.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	seconds, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// SaveConversations keeps the peers user has talked to, which a backup
+// covers.
+func (c *App) SaveConversations(ctx context.Context, user string, peers []string) error {
+	key := fmt.Sprintf("conversations: %s", user)
+	data, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+	return c.stateStore.Set(ctx, key, data, 0)
+}
+
+func (c *App) GetConversations(ctx context.Context, user string) ([]string, error) {
+	key := fmt.Sprintf("conversations: %s", user)
+	v, err := c.stateStore.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []string
+	err = json.Unmarshal(v, &peers)
+	if err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+// SaveHistoryIndex keeps the page list of the history between user and
+// peer, encrypted under key like the pages themselves.
+func (c *App) SaveHistoryIndex(ctx context.Context, user string, peer string, key []byte, index *historyIndex) error {
+	return c.saveEncrypted(ctx, fmt.Sprintf("history: %s, peer: %s", user, peer), key, index)
+}
+
+// GetHistoryIndex returns an empty index for a conversation without history.
+func (c *App) GetHistoryIndex(ctx context.Context, user string, peer string, key []byte) (*historyIndex, error) {
+	index := &historyIndex{Next: 1}
+	err := c.getEncrypted(ctx, fmt.Sprintf("history: %s, peer: %s", user, peer), key, index)
+	if errors.Is(err, storage.ErrNotFound) {
+		return index, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+func (c *App) SaveHistoryPage(ctx context.Context, user string, peer string, key []byte, n int, entries []*historyEntry) error {
+	return c.saveEncrypted(ctx, fmt.Sprintf("history: %s, peer: %s, page: %d", user, peer, n), key, entries)
+}
+
+// GetHistoryPage returns no entries for a missing page.
+func (c *App) GetHistoryPage(ctx context.Context, user string, peer string, key []byte, n int) ([]*historyEntry, error) {
+	var entries []*historyEntry
+	err := c.getEncrypted(ctx, fmt.Sprintf("history: %s, peer: %s, page: %d", user, peer, n), key, &entries)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (c *App) DeleteHistoryPage(ctx context.Context, user string, peer string, n int) error {
+	return c.stateStore.Del(ctx, fmt.Sprintf("history: %s, peer: %s, page: %d", user, peer, n))
+}
+
+// SaveDownloads keeps the attachments received from peer that are not
+// saved yet or disappear with their message, encrypted under the history
+// key since they hold the attachment keys.
+func (c *App) SaveDownloads(ctx context.Context, user string, peer string, key []byte, downloads []*download) error {
+	storeKey := fmt.Sprintf("downloads: %s, peer: %s", user, peer)
+	if len(downloads) == 0 {
+		return c.stateStore.Del(ctx, storeKey)
+	}
+	return c.saveEncrypted(ctx, storeKey, key, downloads)
+}
+
+func (c *App) GetDownloads(ctx context.Context, user string, peer string, key []byte) ([]*download, error) {
+	var downloads []*download
+	err := c.getEncrypted(ctx, fmt.Sprintf("downloads: %s, peer: %s", user, peer), key, &downloads)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return downloads, nil
+}
+
+// saveEncrypted stores v as JSON encrypted under key. The store key is bound as
+// associated data, so values cannot be swapped between keys.
+func (c *App) saveEncrypted(ctx context.Context, key string, encKey []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := encryption.AEADEncrypt(encKey, data, []byte(key))
+	if err != nil {
+		return err
+	}
+	return c.stateStore.Set(ctx, key, ciphertext, 0)
+}
+
+func (c *App) getEncrypted(ctx context.Context, key string, encKey []byte, v any) error {
+	ciphertext, err := c.stateStore.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	data, err := encryption.AEADDecrypt(encKey, ciphertext, []byte(key))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// SaveSearchShard keeps the search index of history page n, encrypted under
+// the history key.
+func (c *App) SaveSearchShard(ctx context.Context, user string, peer string, key []byte, n int, shard *searchShard) error {
+	return c.saveEncrypted(ctx, fmt.Sprintf("history search: %s, peer: %s, page: %d", user, peer, n), key, shard)
+}
+
+// GetSearchShard returns nil, nil when page n has no index yet.
+func (c *App) GetSearchShard(ctx context.Context, user string, peer string, key []byte, n int) (*searchShard, error) {
+	var shard searchShard
+	err := c.getEncrypted(ctx, fmt.Sprintf("history search: %s, peer: %s, page: %d", user, peer, n), key, &shard)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &shard, nil
+}
+
+func (c *App) DeleteSearchShard(ctx context.Context, user string, peer string, n int) error {
+	return c.stateStore.Del(ctx, fmt.Sprintf("history search: %s, peer: %s, page: %d", user, peer, n))
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/utils/log"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	errInvalidTimer = errors.New("timer must be a whole number of seconds, at least 1s, or off")
+)
+
+// parseTimer reads the argument of timerCommand. Off is a zero timer.
+func parseTimer(arg string) (time.Duration, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "off" || arg == "0" {
+		return 0, nil
+	}
+
+	timer, err := time.ParseDuration(arg)
+	if err != nil || timer < time.Second || timer%time.Second != 0 {
+		return 0, errInvalidTimer
+	}
+	return timer, nil
+}
+
+// formatTimer prints a timer the way it is typed, rounded up to seconds.
+func formatTimer(d time.Duration) string {
+	d = d.Round(time.Second)
+	switch {
+	case d <= 0:
+		return "0s"
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return d.String()
+	}
+}
+
+func timerNotice(who string, timer time.Duration) string {
+	if timer <= 0 {
+		return fmt.Sprintf("%s turned off disappearing messages", who)
+	}
+	return fmt.Sprintf("%s set disappearing messages to %s", who, formatTimer(timer))
+}
+
+func (c *App) getExpireTimer() time.Duration {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	return c.expireTimer
+}
+
+// setExpireTimer records the conversation's timer and reports whether it
+// changed.
+func (c *App) setExpireTimer(timer time.Duration) bool {
+	c.chatMu.Lock()
+	changed := c.expireTimer != timer
+	c.expireTimer = timer
+	c.chatMu.Unlock()
+
+	if !changed {
+		return false
+	}
+
+	if err := c.SaveExpireTimer(context.TODO(), c.user.Name, c.toName, timer); err != nil {
+		log.Error("save expire timer failed", zap.Error(err))
+	}
+
+	c.app.QueueUpdateDraw(func() {
+		if c.chatbox != nil {
+			c.chatbox.SetTitle(c.chatTitle())
+		}
+	})
+	return true
+}
+
+// SetExpireTimer changes the disappearing messages timer of the conversation
+// and tells the peer in an encrypted timer message, so both sides delete
+// messages after the same time. Messages already shown keep their timer.
+func (c *App) SetExpireTimer(timer time.Duration) error {
+	if !c.setExpireTimer(timer) {
+		return nil
+	}
+	c.addNotice(timerNotice("You", timer))
+
+	// not itself subject to the timer: a peer that is offline for longer
+	// must still learn the new setting
+	return c.sendContent(newClientID(), &model.Content{
+		Type:        model.ContentTimer,
+		ExpireTimer: int64(timer / time.Second),
+	})
+}
+
+func (c *App) runTimerCommand(arg string) {
+	timer, err := parseTimer(arg)
+	if err != nil {
+		c.addNotice(fmt.Sprintf("%s: %v", timerCommand, err))
+		return
+	}
+
+	if err := c.SetExpireTimer(timer); err != nil {
+		c.app.Suspend(func() {
+			log.Error("Set expire timer failed", zap.Error(err))
+		})
+	}
+}
+
+// applyExpireTimer takes over a timer the peer set.
+func (c *App) applyExpireTimer(from string, seconds int64) {
+	if seconds < 0 {
+		return
+	}
+
+	timer := time.Duration(seconds) * time.Second
+	if c.setExpireTimer(timer) {
+		c.addNotice(timerNotice(from, timer))
+	}
+}
+
+// expireMessages removes disappearing messages from the chatbox and the
+// history once their timer runs out, and redraws their countdowns every
+// second until then. The history retention is applied on the same tick, and
+// attachments saved from expired messages are deleted.
+func (c *App) expireMessages(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.pruneHistory(now)
+			c.expireDownloads(now)
+			dropped, counting := c.dropExpired(now)
+			if dropped || counting {
+				c.redrawChat()
+			}
+		}
+	}
+}
+
+func (c *App) loadExpireTimer(ctx context.Context) error {
+	timer, err := c.GetExpireTimer(ctx, c.user.Name, c.toName)
+	if err != nil {
+		return err
+	}
+
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	c.expireTimer = timer
+	return nil
+}
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"e2e_chat/internal/storage/memory"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimer(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want time.Duration
+		err  error
+	}{
+		{"off", 0, nil},
+		{"0", 0, nil},
+		{" 30s ", 30 * time.Second, nil},
+		{"5m", 5 * time.Minute, nil},
+		{"1h30m", 90 * time.Minute, nil},
+		{"500ms", 0, errInvalidTimer},
+		{"1.5s", 0, errInvalidTimer},
+		{"-1m", 0, errInvalidTimer},
+		{"soon", 0, errInvalidTimer},
+		{"", 0, errInvalidTimer},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTimer(tt.arg)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("parseTimer(%q) = %v, %v, want %v, %v", tt.arg, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestFormatTimer(t *testing.T) {
+	tests := []struct {
+		in   time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{-time.Second, "0s"},
+		{1400 * time.Millisecond, "1s"},
+		{30 * time.Second, "30s"},
+		{5 * time.Minute, "5m"},
+		{2 * time.Hour, "2h"},
+		{90 * time.Second, "1m30s"},
+	}
+
+	for _, tt := range tests {
+		if got := formatTimer(tt.in); got != tt.want {
+			t.Errorf("formatTimer(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExpireTimerSync(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	if err := alice.SetExpireTimer(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// the notice follows the new setting
+	waitFor(t, func() bool { return bob.hasNotice("alice set disappearing messages to 1m") }, "a notice of the new timer")
+	if bob.getExpireTimer() != time.Minute {
+		t.Fatalf("bob's timer %v, want 1m", bob.getExpireTimer())
+	}
+
+	alice.send(t, "ephemeral")
+	line := bob.waitLine(t, "ephemeral", func(chatLine) bool { return true }, "the disappearing message")
+	if line.expires.IsZero() || time.Until(line.expires) > time.Minute {
+		t.Fatalf("received line expires at %v", line.expires)
+	}
+	if !strings.Contains(bob.renderChat(), "⏱") {
+		t.Fatal("no countdown shown")
+	}
+
+	// either side can turn it off again
+	if err := bob.SetExpireTimer(0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return alice.getExpireTimer() == 0 }, "alice to turn the timer off")
+	alice.send(t, "lasting")
+	if line := bob.waitLine(t, "lasting", func(chatLine) bool { return true }, "a lasting message"); !line.expires.IsZero() {
+		t.Fatal("message sent after the timer was turned off expires")
+	}
+}
+
+// TestExpireTimerQueueTTL checks that the server does not keep a disappearing
+// message queued for longer than its timer, but keeps the timer change itself.
+func TestExpireTimerQueueTTL(t *testing.T) {
+	srv := newTestServer(t)
+	alice := newTestClient(t, srv, "alice")
+	newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+
+	if err := alice.SetExpireTimer(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	alice.send(t, "ephemeral")
+	alice.waitLine(t, "ephemeral", func(l chatLine) bool { return l.status >= statusSent }, "the server to accept it")
+
+	pending, err := srv.queue.Pending(t.Context(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("%d messages queued, want the timer change and the message", len(pending))
+	}
+	if pending[0].TTL != 0 || pending[1].TTL != 30 {
+		t.Fatalf("TTLs %d and %d, want 0 for the timer change and 30", pending[0].TTL, pending[1].TTL)
+	}
+}
+
+func TestExpiredMessagesDeleted(t *testing.T) {
+	srv := newTestServer(t)
+	aliceUsers, aliceState := memory.NewUserStore(), memory.NewStateStore()
+	alice := newTestClientOn(t, srv, "alice", aliceUsers, aliceState)
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	if err := alice.SetExpireTimer(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	alice.send(t, "gone")
+	bob.waitLine(t, "gone", func(chatLine) bool { return true }, "the message")
+
+	for _, c := range []*App{alice, bob} {
+		waitFor(t, func() bool {
+			_, shown := c.line("gone")
+			return !shown
+		}, c.user.Name+" to drop the expired message")
+	}
+	if strings.Contains(alice.renderChat(), "gone") {
+		t.Fatal("expired message still drawn")
+	}
+
+	// nor is it in the history a restarted client loads
+	alice.ws.close()
+	restarted := newTestClientOn(t, srv, "alice", aliceUsers, aliceState)
+	restarted.open(t, "bob")
+	if _, shown := restarted.line("gone"); shown {
+		t.Fatal("expired message loaded from the history")
+	}
+	if restarted.getExpireTimer() != time.Second {
+		t.Fatalf("timer %v after restart", restarted.getExpireTimer())
+	}
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"crypto/tls"
+	"e2e_chat/internal/service/server"
+	"e2e_chat/internal/storage/memory"
+	"e2e_chat/internal/utils/tlsutil"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTLSTestServer serves a fresh self-signed certificate and returns its
+// pin and a CA file trusting it.
+func newTLSTestServer(t *testing.T) (*testServer, string, string) {
+	t.Helper()
+
+	certPEM, keyPEM, err := tlsutil.SelfSigned([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin, err := tlsutil.LeafPin(&cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t, func(s *server.HttpServer) {
+		s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	})
+	return s, pin, caFile
+}
+
+func TestTLSPinned(t *testing.T) {
+	srv, pin, caFile := newTLSTestServer(t)
+
+	cfg, err := tlsutil.ClientConfig(caFile, []string{pin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.clientTLS = cfg
+
+	alice := newTestClient(t, srv, "alice")
+	bob := newTestClient(t, srv, "bob")
+	alice.open(t, "bob")
+	bob.open(t, "alice")
+
+	alice.send(t, "over wss")
+	bob.waitLine(t, "over wss", func(chatLine) bool { return true }, "message over wss")
+}
+
+func TestTLSPinMismatch(t *testing.T) {
+	srv, _, caFile := newTLSTestServer(t)
+
+	// the certificate chains to a trusted root but is not the pinned one
+	_, otherPin, _ := newTLSTestServer(t)
+	cfg, err := tlsutil.ClientConfig(caFile, []string{otherPin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewApp(memory.NewUserStore(), memory.NewStateStore())
+	c.SetServerAddr(srv.addr)
+	c.SetTLSConfig(cfg)
+
+	err = c.signIn(t.Context(), "alice")
+	if !errors.Is(err, tlsutil.ErrPinMismatch) {
+		t.Fatalf("sign in: got %v, want %v", err, tlsutil.ErrPinMismatch)
+	}
+	if user, _ := srv.users.GetByName(t.Context(), "alice"); user != nil {
+		t.Fatal("registered through a connection failing the pin")
+	}
+}
@@ -3,25 +3,62 @@ package app
 import (
 	"context"
 	"e2e_chat/internal/cryptographic/dh"
+	"e2e_chat/internal/cryptographic/signature"
 	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/sealed"
+	"e2e_chat/internal/protocol/x3dh"
 )
 
 func (c *App) getUserAndCreateIfNotExist(ctx context.Context, username string) (*model.User, error) {
-	user, err := c.userRepo.GetByName(ctx, username)
+	user, err := c.users.GetByName(ctx, username)
 	if err != nil {
 		return nil, err
 	}
 
 	if user != nil {
+		changed := false
+		if user.SigPriv == nil {
+			// users created before login was authenticated have no signing key
+			user.SigPub, user.SigPriv, err = signature.NewEd25519Keypair()
+			if err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+
+		if user.ProfileKey == nil {
+			// nor do users created before sealed sender have a profile key
+			user.ProfileKey, err = sealed.NewProfileKey()
+			if err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+
+		if changed {
+			if err := c.users.Update(ctx, user); err != nil {
+				return nil, err
+			}
+		}
 		return user, nil
 	}
 
-	ikPriv, _, err := dh.NewX25519KeyPair()
+	ikPriv, ikPub, err := dh.NewX25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	spkPriv, spkPub, err := dh.NewX25519KeyPair()
 	if err != nil {
 		return nil, err
 	}
 
-	spkPriv, _, err := dh.NewX25519KeyPair()
+	sigPub, sigPriv, err := signature.NewEd25519Keypair()
+	if err != nil {
+		return nil, err
+	}
+
+	profileKey, err := sealed.NewProfileKey()
 	if err != nil {
 		return nil, err
 	}
@@ -29,11 +66,17 @@ func (c *App) getUserAndCreateIfNotExist(ctx context.Context, username string) (
 	user = &model.User{
 		Name:    username,
 		IKPriv:  ikPriv[:],
+		IKPub:   ikPub[:],
 		SPKPriv: spkPriv[:],
+		SPKPub:  spkPub[:],
+		SPKSig:  signature.ED25519Sign(sigPriv, x3dh.SignedPrekeyPayload(ikPub[:], spkPub[:])),
+		SigPriv: sigPriv,
+		SigPub:  sigPub,
+
+		ProfileKey: profileKey,
 	}
 
-	_, err = c.userRepo.Create(ctx, user)
-	if err != nil {
+	if err := c.users.Create(ctx, user); err != nil {
 		return nil, err
 	}
 
@@ -1,17 +1,140 @@
 package app
 
 import (
+	"bytes"
+	"context"
 	"e2e_chat/internal/cryptographic/dh"
 	"e2e_chat/internal/model"
 	"e2e_chat/internal/protocol/doubleratchet"
 	"e2e_chat/internal/protocol/x3dh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
 )
 
-func (c *App) initReceiverState(message *model.Message) error {
-	if c.state != nil {
+// maxUsedHandshakes bounds how many handshakes per peer are remembered to
+// refuse replays. A session starts with each one, so they are few.
+const maxUsedHandshakes = 1000
+
+var (
+	errNoSession         = errors.New("message from a session this client does not have")
+	errHandshakeReplayed = errors.New("handshake already used")
+)
+
+type (
+	// sessionRecord tells which session with a peer is current and which
+	// handshakes were already used, so that neither a replayed handshake nor
+	// an older one replaces it.
+	sessionRecord struct {
+		Started int64    `json:"started,omitempty"` // unix millis, by the clock of the side that started it
+		EKPub   []byte   `json:"ek_pub,omitempty"`
+		Used    [][]byte `json:"used,omitempty"` // oldest first
+	}
+)
+
+func (r *sessionRecord) used(ekPub []byte) bool {
+	return slices.ContainsFunc(r.Used, func(used []byte) bool { return bytes.Equal(used, ekPub) })
+}
+
+func (r *sessionRecord) addUsed(ekPub []byte) {
+	if r.used(ekPub) {
+		return
+	}
+	r.Used = append(r.Used, ekPub)
+	if n := len(r.Used) - maxUsedHandshakes; n > 0 {
+		r.Used = slices.Clone(r.Used[n:])
+	}
+}
+
+// newer reports whether the session started at started with ekPub is newer
+// than the current one. The handshake key breaks ties, so two clients that
+// start sessions at the same time agree on one.
+func (r *sessionRecord) newer(started int64, ekPub []byte) bool {
+	if r.Started != started {
+		return started > r.Started
+	}
+	return bytes.Compare(ekPub, r.EKPub) > 0
+}
+
+// start makes the session with ekPub current.
+func (r *sessionRecord) start(started int64, ekPub []byte) {
+	r.Started = started
+	r.EKPub = ekPub
+	r.addUsed(ekPub)
+}
+
+// loadSession reads the session record of the conversation. The caller
+// holds ratchetMu.
+func (c *App) loadSession(ctx context.Context) error {
+	if c.session != nil {
 		return nil
 	}
 
+	record, err := c.GetSession(ctx, c.user.Name, c.toName)
+	if err != nil {
+		return err
+	}
+	c.session = record
+	return nil
+}
+
+// receiveHandshake opens a message that starts a session. A handshake is
+// only ever used once, and its session replaces ours only when it is newer,
+// as when the peer lost its state and restored a backup without sessions.
+// An older one is still read. The caller holds ratchetMu.
+func (c *App) receiveHandshake(message *model.Message) (*model.Content, error) {
+	ekPub := message.X3DHHandShake.EKPub
+	if c.session.used(ekPub) {
+		return nil, errHandshakeReplayed
+	}
+
+	state, err := c.newReceiverState(message)
+	if err != nil {
+		return nil, err
+	}
+	msgBytes, err := state.Receive(*message.Header, message.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	content := parseContent(msgBytes)
+
+	// the new state is saved first: should the record not follow, the
+	// message comes again and opens the same way
+	record := *c.session
+	record.addUsed(ekPub)
+	newer := record.newer(content.SessionStarted, ekPub)
+	if newer {
+		record.start(content.SessionStarted, ekPub)
+		if err := c.SaveState(context.TODO(), c.user.Name, c.toName, state); err != nil {
+			return nil, fmt.Errorf("%w: %w", errSaveSession, err)
+		}
+	}
+	if err := c.SaveSession(context.TODO(), c.user.Name, c.toName, &record); err != nil {
+		return nil, fmt.Errorf("%w: %w", errSaveSession, err)
+	}
+
+	c.session = &record
+	if newer {
+		c.state = state
+	}
+	return content, nil
+}
+
+// parseContent decodes a decrypted message.
+func parseContent(msgBytes []byte) *model.Content {
+	var content model.Content
+	if err := json.Unmarshal(msgBytes, &content); err != nil || content.Type == "" {
+		// peers that predate structured content send bare text
+		return &model.Content{Type: model.ContentText, Text: string(msgBytes)}
+	}
+	return &content
+}
+
+// newReceiverState starts the session of a message carrying an X3DH
+// handshake.
+func (c *App) newReceiverState(message *model.Message) (*doubleratchet.RatchetState, error) {
 	recv := &x3dh.X3DHReceiver{}
 	sk, err := recv.GenerateShareKey(&model.ReceiverKeyBundle{
 		IKPubA:   c.toSharedKeys.IKPub,
@@ -21,20 +144,23 @@ func (c *App) initReceiverState(message *model.Message) error {
 		OTKPrivB: nil,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	spkPrivB, err := dh.ConvertToECDHFormat(c.user.SPKPriv)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	spkPubB := spkPrivB.PublicKey().Bytes()
 
-	c.state = doubleratchet.NewState(sk, [32]byte(c.user.SPKPriv), [32]byte(spkPubB), [32]byte{})
-	return nil
+	return doubleratchet.NewState(sk, [32]byte(c.user.SPKPriv), [32]byte(spkPubB), [32]byte{}), nil
 }
 
-func (c *App) initSendingState() error {
+// initSendingState starts a session with a new handshake and makes it
+// current. It is dated after every session already seen with the peer, so
+// the peer takes it over theirs even when its clock is behind ours. The
+// caller holds ratchetMu.
+func (c *App) initSendingState(ekPub []byte) error {
 	if c.state != nil {
 		return nil
 	}
@@ -52,5 +178,6 @@ func (c *App) initSendingState() error {
 	}
 
 	c.state = doubleratchet.NewState(sk, [32]byte{}, [32]byte{}, [32]byte(c.toSharedKeys.SPKPub))
+	c.session.start(max(time.Now().UnixMilli(), c.session.Started+1), ekPub)
 	return nil
 }
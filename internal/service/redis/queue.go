@@ -0,0 +1,126 @@
+package redis
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	deliveryGroup = "delivery"
+	readBatchSize = 100
+)
+
+type (
+	// MessageQueue keeps one stream per recipient. Entries are read through a
+	// consumer group so that handed-out but unacked messages can be found
+	// again, and are removed once the recipient acks them.
+	MessageQueue struct {
+		svc       *RedisService
+		maxLen    int64
+		retention time.Duration
+	}
+)
+
+func NewMessageQueue(svc *RedisService, maxLen int64, retention time.Duration) *MessageQueue {
+	return &MessageQueue{
+		svc:       svc,
+		maxLen:    maxLen,
+		retention: retention,
+	}
+}
+
+func streamKey(to string) string {
+	return fmt.Sprintf("stream: %s", to)
+}
+
+// Enqueue appends a message to the recipient's stream and assigns it the
+// stream entry ID.
+func (q *MessageQueue) Enqueue(ctx context.Context, to string, message *model.Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	key := streamKey(to)
+	id, err := q.svc.XAdd(ctx, key, q.maxLen, data)
+	if err != nil {
+		return err
+	}
+	message.ID = id
+
+	return q.svc.Expire(ctx, key, q.retention)
+}
+
+// Pending returns every unacknowledged message for a user, oldest first:
+// first those already handed out but never acked, then those never read by
+// the delivery group. Messages past their TTL are removed instead.
+func (q *MessageQueue) Pending(ctx context.Context, to string) ([]*model.Message, error) {
+	key := streamKey(to)
+	if err := q.svc.XGroupCreate(ctx, key, deliveryGroup); err != nil {
+		return nil, err
+	}
+
+	minID := fmt.Sprintf("%d-0", time.Now().Add(-q.retention).UnixMilli())
+	if err := q.svc.XTrimMinID(ctx, key, minID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var res []*model.Message
+	var stale []string
+
+	for _, start := range []string{"0", ">"} {
+		cursor := start
+		for {
+			entries, err := q.svc.XReadGroup(ctx, key, deliveryGroup, to, cursor, readBatchSize)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, e := range entries {
+				if e.Data == "" {
+					// trimmed away while pending
+					stale = append(stale, e.ID)
+					continue
+				}
+
+				var m model.Message
+				err := json.Unmarshal([]byte(e.Data), &m)
+				if err != nil {
+					return nil, err
+				}
+				m.ID = e.ID
+
+				if m.Expired(now) {
+					// a disappearing message past its timer
+					stale = append(stale, e.ID)
+					continue
+				}
+				res = append(res, &m)
+			}
+
+			if len(entries) < readBatchSize {
+				break
+			}
+
+			if start != ">" {
+				cursor = entries[len(entries)-1].ID
+			}
+		}
+	}
+
+	if len(stale) > 0 {
+		if err := q.svc.XAckDel(ctx, key, deliveryGroup, stale...); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+func (q *MessageQueue) Ack(ctx context.Context, to string, id string) error {
+	return q.svc.XAckDel(ctx, streamKey(to), deliveryGroup, id)
+}
@@ -0,0 +1,40 @@
+package redis
+
+import (
+	"context"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/storagetest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testRedis connects to the server at E2E_TEST_REDIS_ADDR, or skips the
+// test when it is not set.
+func testRedis(t *testing.T) *RedisService {
+	t.Helper()
+
+	addr := os.Getenv("E2E_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("E2E_TEST_REDIS_ADDR not set")
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { rdb.Close() })
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		t.Fatalf("redis at %s: %v", addr, err)
+	}
+	return NewRedis(rdb)
+}
+
+func TestMessageQueue(t *testing.T) {
+	svc := testRedis(t)
+	storagetest.TestMessageQueue(t, func(t *testing.T, maxLen int, retention time.Duration) storage.MessageQueue {
+		return NewMessageQueue(svc, int64(maxLen), retention)
+	}, true)
+}
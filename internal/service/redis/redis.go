@@ -2,31 +2,66 @@ package redis
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// delIfEqual deletes KEYS[1] only while it still holds ARGV[1].
+var delIfEqual = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// takeToken is a token bucket kept in a hash. It uses the server clock so
+// that every node refills the bucket at the same pace.
+var takeToken = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
 type (
 	RedisService struct {
 		rdb *redis.Client
 	}
+
+	// StreamEntry is a stream record holding a single opaque payload.
+	StreamEntry struct {
+		ID   string
+		Data string
+	}
 )
 
+const streamDataField = "data"
+
 func NewRedis(rdb *redis.Client) *RedisService {
 	return &RedisService{
 		rdb: rdb,
 	}
 }
 
-func (r *RedisService) RPush(ctx context.Context, key string, value ...any) error {
-	return r.rdb.RPush(ctx, key, value...).Err()
-}
-
-func (r *RedisService) LRange(ctx context.Context, key string) ([]string, error) {
-	return r.rdb.LRange(ctx, key, 0, -1).Result()
-}
-
 func (r *RedisService) Del(ctx context.Context, key string) error {
 	return r.rdb.Del(ctx, key).Err()
 }
@@ -38,3 +73,131 @@ func (r *RedisService) Set(ctx context.Context, key string, value any, ttl time.
 func (r *RedisService) Get(ctx context.Context, key string) (string, error) {
 	return r.rdb.Get(ctx, key).Result()
 }
+
+func (r *RedisService) GetDel(ctx context.Context, key string) (string, error) {
+	return r.rdb.GetDel(ctx, key).Result()
+}
+
+func (r *RedisService) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return r.rdb.Expire(ctx, key, ttl).Err()
+}
+
+// XAdd appends data to stream, trimming it to roughly maxLen entries, and
+// returns the entry ID assigned by Redis.
+func (r *RedisService) XAdd(ctx context.Context, stream string, maxLen int64, data any) (string, error) {
+	return r.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: maxLen,
+		Approx: true,
+		Values: []any{streamDataField, data},
+	}).Result()
+}
+
+// XTrimMinID drops entries older than minID. The trim is exact: trimming
+// with ~ only drops whole nodes and would keep a short stream forever.
+func (r *RedisService) XTrimMinID(ctx context.Context, stream string, minID string) error {
+	return r.rdb.XTrimMinID(ctx, stream, minID).Err()
+}
+
+// XGroupCreate creates a consumer group reading from the start of stream,
+// creating the stream if needed. An existing group is not an error.
+func (r *RedisService) XGroupCreate(ctx context.Context, stream string, group string) error {
+	err := r.rdb.XGroupCreateMkStream(ctx, stream, group, "0").Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// XReadGroup reads up to count entries without blocking. start is ">" for
+// entries never handed to the group, or an ID to re-read the consumer's
+// pending entries after it.
+func (r *RedisService) XReadGroup(ctx context.Context, stream, group, consumer, start string, count int64) ([]StreamEntry, error) {
+	res, err := r.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  []string{stream, start},
+		Count:    count,
+		Block:    -1,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []StreamEntry
+	for _, s := range res {
+		for _, m := range s.Messages {
+			data, _ := m.Values[streamDataField].(string)
+			entries = append(entries, StreamEntry{
+				ID:   m.ID,
+				Data: data,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// XAckDel acknowledges ids for group and removes them from stream.
+func (r *RedisService) XAckDel(ctx context.Context, stream string, group string, ids ...string) error {
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, stream, group, ids...)
+		pipe.XDel(ctx, stream, ids...)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisService) DelIfEqual(ctx context.Context, key string, value string) error {
+	return delIfEqual.Run(ctx, r.rdb, []string{key}, value).Err()
+}
+
+// Take implements storage.RateLimiter.
+func (r *RedisService) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	res, err := takeToken.Run(ctx, r.rdb, []string{key}, rate, burst).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+func (r *RedisService) Publish(ctx context.Context, channel string, data []byte) error {
+	return r.rdb.Publish(ctx, channel, data).Err()
+}
+
+// Subscribe delivers payloads published on channel until ctx is done.
+func (r *RedisService) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	sub := r.rdb.Subscribe(ctx, channel)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		defer sub.Close()
+
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				select {
+				case out <- []byte(msg.Payload):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
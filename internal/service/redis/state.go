@@ -0,0 +1,58 @@
+package redis
+
+import (
+	"context"
+	"e2e_chat/internal/storage"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type (
+	// StateStore adapts RedisService to storage.StateStore.
+	StateStore struct {
+		svc *RedisService
+	}
+)
+
+func NewStateStore(svc *RedisService) *StateStore {
+	return &StateStore{
+		svc: svc,
+	}
+}
+
+func (s *StateStore) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.svc.Get(ctx, key)
+	if err == redis.Nil {
+		return nil, storage.ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return []byte(v), nil
+}
+
+func (s *StateStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.svc.Set(ctx, key, value, ttl)
+}
+
+func (s *StateStore) GetDel(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.svc.GetDel(ctx, key)
+	if err == redis.Nil {
+		return nil, storage.ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return []byte(v), nil
+}
+
+func (s *StateStore) Del(ctx context.Context, key string) error {
+	return s.svc.Del(ctx, key)
+}
+
+func (s *StateStore) DelIfEqual(ctx context.Context, key string, value []byte) error {
+	return s.svc.DelIfEqual(ctx, key, string(value))
+}
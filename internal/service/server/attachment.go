@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/utils/log"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxAttachmentChunk bounds the body of one upload request; clients send
+	// far smaller chunks so that little is lost when a connection drops.
+	maxAttachmentChunk = 4 << 20
+
+	attachmentPurgeInterval = time.Hour
+
+	headerUploadLength = "Upload-Length"
+	headerUploadOffset = "Upload-Offset"
+)
+
+func newAttachmentID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SetBlobStore enables attachments: blobs of up to maxSize bytes are kept in
+// blobs for retention. Without a store the /attachments routes are absent.
+func (s *HttpServer) SetBlobStore(blobs storage.BlobStore, maxSize int64, retention time.Duration) {
+	s.blobs = blobs
+	s.maxAttachmentSize = maxSize
+	s.attachmentRetention = retention
+}
+
+// purgeAttachments removes blobs older than the retention, whether or not
+// the recipient ever fetched them.
+func (s *HttpServer) purgeAttachments(ctx context.Context) {
+	ticker := time.NewTicker(attachmentPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := s.blobs.Purge(ctx, time.Now().Add(-s.attachmentRetention))
+		if err != nil {
+			log.Error("purge attachments failed", zap.Error(err))
+		} else if n > 0 {
+			log.Info("purged attachments", zap.Int("count", n))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// HandleCreateUpload reserves an attachment of Upload-Length bytes. The
+// caller then sends it in chunks with HandleUploadChunk.
+func (s *HttpServer) HandleCreateUpload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		claims := claimsFromContext(ctx)
+
+		if ok, wait := s.allow(ctx, budgetMessages, s.limits.Messages, "user: "+claims.Subject); !ok {
+			writeRateLimited(w, wait)
+			return
+		}
+
+		size, err := strconv.ParseInt(r.Header.Get(headerUploadLength), 10, 64)
+		if err != nil || size <= 0 {
+			http.Error(w, "Upload-Length: must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if size > s.maxAttachmentSize {
+			http.Error(w, "attachment too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		id := newAttachmentID()
+		if err := s.blobs.Create(ctx, id, claims.Subject, size); err != nil {
+			log.Error("Create upload failed", zap.Error(err))
+			http.Error(w, "Create upload failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", "/attachments/"+id)
+		writeJSON(w, http.StatusCreated, &model.Upload{ID: id, Size: size})
+	}
+}
+
+// HandleUploadOffset tells the uploader how many bytes arrived, so it can
+// resume an interrupted upload from there.
+func (s *HttpServer) HandleUploadOffset() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, ok := s.ownBlob(w, r)
+		if !ok {
+			return
+		}
+
+		w.Header().Set(headerUploadLength, strconv.FormatInt(info.Size, 10))
+		w.Header().Set(headerUploadOffset, strconv.FormatInt(info.Offset, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleUploadChunk appends the body at Upload-Offset, which must be the
+// number of bytes received so far. The new offset is returned in the same
+// header; a mismatch answers 409 with the offset to resume from.
+func (s *HttpServer) HandleUploadChunk() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		info, ok := s.ownBlob(w, r)
+		if !ok {
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.Header.Get(headerUploadOffset), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "Upload-Offset: must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentChunk)
+		next, err := s.blobs.Append(ctx, mux.Vars(r)["id"], offset, r.Body)
+		w.Header().Set(headerUploadOffset, strconv.FormatInt(next, 10))
+
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.Is(err, storage.ErrOffsetMismatch):
+			http.Error(w, "Upload-Offset: does not match the bytes received", http.StatusConflict)
+			return
+		case errors.Is(err, storage.ErrBlobTooLarge):
+			http.Error(w, "chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		case errors.As(err, &tooLarge):
+			http.Error(w, "chunk too large", http.StatusRequestEntityTooLarge)
+			return
+		case err != nil:
+			log.Debug("upload chunk interrupted", zap.Int64("offset", next), zap.Error(err))
+			http.Error(w, "upload interrupted", http.StatusBadRequest)
+			return
+		}
+
+		s.metrics.attachmentBytes.Add(uint64(next - offset))
+		if next == info.Size {
+			s.metrics.attachmentsUploaded.Inc()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleDownload serves a complete blob. Any logged-in user holding the ID
+// may fetch it: the ID is unguessable and only travels inside encrypted
+// messages, and the blob is useless without the key next to it. Ranges are
+// supported, so a download can resume too.
+func (s *HttpServer) HandleDownload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		blob, err := s.blobs.Open(ctx, mux.Vars(r)["id"])
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrBlobIncomplete) {
+			http.Error(w, "attachment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Error("Download attachment failed", zap.Error(err))
+			http.Error(w, "Download attachment failed", http.StatusInternalServerError)
+			return
+		}
+		defer blob.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "private, immutable")
+		http.ServeContent(w, r, "", time.Time{}, blob)
+	}
+}
+
+// ownBlob looks up the blob in the request path, which only its uploader
+// may write to. Others are told it does not exist.
+func (s *HttpServer) ownBlob(w http.ResponseWriter, r *http.Request) (*storage.BlobInfo, bool) {
+	ctx := r.Context()
+	claims := claimsFromContext(ctx)
+
+	info, err := s.blobs.Stat(ctx, mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && info.Owner != claims.Subject) {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Error("Look up upload failed", zap.Error(err))
+		http.Error(w, "Look up upload failed", http.StatusInternalServerError)
+		return nil, false
+	}
+	return info, true
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage/memory"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func withBlobStore(maxSize int64) func(*HttpServer) {
+	return func(s *HttpServer) {
+		s.SetBlobStore(memory.NewBlobStore(), maxSize, time.Hour)
+	}
+}
+
+// doUpload sends an attachment request with the upload headers that are set.
+func (n *testNode) doUpload(t testing.TB, method, path string, headers map[string]string, body []byte, token string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, n.url+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func (n *testNode) createUpload(t testing.TB, size int64, token string) string {
+	t.Helper()
+
+	resp := n.doUpload(t, http.MethodPost, "/attachments", map[string]string{headerUploadLength: strconv.FormatInt(size, 10)}, nil, token)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create upload: %s", resp.Status)
+	}
+
+	var upload model.Upload
+	if err := json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		t.Fatal(err)
+	}
+	if upload.Size != size || resp.Header.Get("Location") != "/attachments/"+upload.ID {
+		t.Fatalf("got %+v at %q", upload, resp.Header.Get("Location"))
+	}
+	return upload.ID
+}
+
+func (n *testNode) uploadChunk(t testing.TB, id string, offset int64, chunk []byte, token string) *http.Response {
+	t.Helper()
+	return n.doUpload(t, http.MethodPatch, "/attachments/"+id, map[string]string{headerUploadOffset: strconv.FormatInt(offset, 10)}, chunk, token)
+}
+
+func checkUploadOffset(t testing.TB, resp *http.Response, status int, offset int64) {
+	t.Helper()
+
+	if resp.StatusCode != status {
+		t.Fatalf("got %s, want %d", resp.Status, status)
+	}
+	if got := resp.Header.Get(headerUploadOffset); got != strconv.FormatInt(offset, 10) {
+		t.Fatalf("Upload-Offset %q, want %d", got, offset)
+	}
+}
+
+func TestAttachmentUpload(t *testing.T) {
+	node := newTestNode(t, newTestStores(), withBlobStore(1<<20))
+	alice, bob := newTestUser(t, "alice"), newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+	aliceToken := node.login(t, alice).AccessToken
+	bobToken := node.login(t, bob).AccessToken
+
+	blob := bytes.Repeat([]byte("0123456789"), 100)
+	id := node.createUpload(t, int64(len(blob)), aliceToken)
+
+	// incomplete blobs are not served
+	if resp := node.doUpload(t, http.MethodGet, "/attachments/"+id, nil, nil, bobToken); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("download incomplete: %s", resp.Status)
+	}
+
+	checkUploadOffset(t, node.uploadChunk(t, id, 0, blob[:400], aliceToken), http.StatusNoContent, 400)
+
+	// a repeated chunk is told where to resume
+	checkUploadOffset(t, node.uploadChunk(t, id, 0, blob[:400], aliceToken), http.StatusConflict, 400)
+	resp := node.doUpload(t, http.MethodHead, "/attachments/"+id, nil, nil, aliceToken)
+	checkUploadOffset(t, resp, http.StatusNoContent, 400)
+	if got := resp.Header.Get(headerUploadLength); got != "1000" {
+		t.Fatalf("Upload-Length %q", got)
+	}
+
+	// past the declared size
+	checkUploadOffset(t, node.uploadChunk(t, id, 400, append(blob[400:], 'X'), aliceToken), http.StatusRequestEntityTooLarge, 400)
+
+	checkUploadOffset(t, node.uploadChunk(t, id, 400, blob[400:], aliceToken), http.StatusNoContent, 1000)
+
+	resp = node.doUpload(t, http.MethodGet, "/attachments/"+id, nil, nil, bobToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("download: %s", resp.Status)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(got, blob) {
+		t.Fatalf("downloaded %d bytes, uploaded %d", len(got), len(blob))
+	}
+
+	// a download resumes with a range
+	resp = node.doUpload(t, http.MethodGet, "/attachments/"+id, map[string]string{"Range": "bytes=990-"}, nil, bobToken)
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("range download: %s", resp.Status)
+	}
+	got, _ = io.ReadAll(resp.Body)
+	if !bytes.Equal(got, blob[990:]) {
+		t.Fatalf("range download got %q", got)
+	}
+
+	metrics := node.scrape(t)
+	if metrics["e2e_attachments_uploaded_total"] != 1 || metrics["e2e_attachment_bytes_received_total"] != 1000 {
+		t.Fatalf("uploaded %v, bytes %v", metrics["e2e_attachments_uploaded_total"], metrics["e2e_attachment_bytes_received_total"])
+	}
+}
+
+func TestAttachmentOwner(t *testing.T) {
+	node := newTestNode(t, newTestStores(), withBlobStore(1<<20))
+	alice, bob := newTestUser(t, "alice"), newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+	aliceToken := node.login(t, alice).AccessToken
+	bobToken := node.login(t, bob).AccessToken
+
+	id := node.createUpload(t, 10, aliceToken)
+
+	if resp := node.doUpload(t, http.MethodHead, "/attachments/"+id, nil, nil, bobToken); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("offset of another's upload: %s", resp.Status)
+	}
+	if resp := node.uploadChunk(t, id, 0, []byte("0123456789"), bobToken); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("append to another's upload: %s", resp.Status)
+	}
+	resp := node.doUpload(t, http.MethodHead, "/attachments/"+id, nil, nil, aliceToken)
+	checkUploadOffset(t, resp, http.StatusNoContent, 0)
+}
+
+func TestAttachmentRejected(t *testing.T) {
+	node := newTestNode(t, newTestStores(), withBlobStore(100))
+	alice := newTestUser(t, "alice")
+	node.register(t, alice)
+	token := node.login(t, alice).AccessToken
+
+	for length, want := range map[string]int{
+		"":    http.StatusBadRequest,
+		"0":   http.StatusBadRequest,
+		"-1":  http.StatusBadRequest,
+		"x":   http.StatusBadRequest,
+		"101": http.StatusRequestEntityTooLarge,
+	} {
+		resp := node.doUpload(t, http.MethodPost, "/attachments", map[string]string{headerUploadLength: length}, nil, token)
+		if resp.StatusCode != want {
+			t.Errorf("Upload-Length %q: got %s, want %d", length, resp.Status, want)
+		}
+	}
+
+	id := node.createUpload(t, 100, token)
+	resp := node.doUpload(t, http.MethodPatch, "/attachments/"+id, map[string]string{headerUploadOffset: "-1"}, []byte("x"), token)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("negative offset: %s", resp.Status)
+	}
+
+	if resp := node.doUpload(t, http.MethodGet, "/attachments/"+id, nil, nil, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("download without a token: %s", resp.Status)
+	}
+	if resp := node.doUpload(t, http.MethodGet, "/attachments/0123456789abcdef0123456789abcdef", nil, nil, token); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download unknown: %s", resp.Status)
+	}
+}
+
+func TestAttachmentsOff(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	node.register(t, alice)
+	token := node.login(t, alice).AccessToken
+
+	resp := node.doUpload(t, http.MethodPost, "/attachments", map[string]string{headerUploadLength: "10"}, nil, token)
+	if resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("got %s without a blob store", resp.Status)
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"crypto/rand"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/auth"
+	"e2e_chat/internal/utils/log"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	nonceSize     = 32
+	nonceTTL      = 30 * time.Second
+	maxClockSkew  = 2 * time.Minute
+	maxNonceCache = 100000
+
+	// bounds on outstanding challenges, so that one client cannot use up
+	// the cache for everyone
+	maxChallengesPerUser = 8
+	maxChallengesPerIP   = 64
+)
+
+var (
+	errUnauthorized      = errors.New("unauthorized")
+	errTooManyChallenges = errors.New("too many pending challenges")
+)
+
+type (
+	nonceEntry struct {
+		key       string
+		userID    string
+		ip        string
+		expiresAt time.Time
+		index     int // position in the expiry heap
+	}
+
+	// nonceHeap orders entries by expiry, soonest first.
+	nonceHeap []*nonceEntry
+
+	// nonceCache keeps outstanding login challenges. A nonce can be consumed
+	// exactly once, which stops a captured response from being replayed.
+	nonceCache struct {
+		mu      sync.Mutex
+		nonces  map[string]*nonceEntry
+		expiry  nonceHeap
+		perUser map[string]int
+		perIP   map[string]int
+	}
+)
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+
+func (h nonceHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *nonceHeap) Push(x any) {
+	e := x.(*nonceEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *nonceHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{
+		nonces:  make(map[string]*nonceEntry),
+		perUser: make(map[string]int),
+		perIP:   make(map[string]int),
+	}
+}
+
+// issue hands out a nonce for userID, asked for from ip. It fails with
+// errTooManyChallenges while the user, the address or the whole cache has
+// too many challenges outstanding.
+func (n *nonceCache) issue(userID, ip string) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for len(n.expiry) > 0 && now.After(n.expiry[0].expiresAt) {
+		n.remove(n.expiry[0])
+	}
+
+	if len(n.nonces) >= maxNonceCache || n.perUser[userID] >= maxChallengesPerUser || n.perIP[ip] >= maxChallengesPerIP {
+		return nil, errTooManyChallenges
+	}
+
+	e := &nonceEntry{
+		key:       hex.EncodeToString(nonce),
+		userID:    userID,
+		ip:        ip,
+		expiresAt: now.Add(nonceTTL),
+	}
+	n.nonces[e.key] = e
+	heap.Push(&n.expiry, e)
+	n.perUser[userID]++
+	n.perIP[ip]++
+
+	return nonce, nil
+}
+
+func (n *nonceCache) consume(userID string, nonce []byte) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	e, ok := n.nonces[hex.EncodeToString(nonce)]
+	if !ok {
+		return false
+	}
+	n.remove(e)
+
+	return e.userID == userID && time.Now().Before(e.expiresAt)
+}
+
+// remove drops e from the cache. The caller holds n.mu.
+func (n *nonceCache) remove(e *nonceEntry) {
+	delete(n.nonces, e.key)
+	heap.Remove(&n.expiry, e.index)
+
+	if n.perUser[e.userID]--; n.perUser[e.userID] <= 0 {
+		delete(n.perUser, e.userID)
+	}
+	if n.perIP[e.ip]--; n.perIP[e.ip] <= 0 {
+		delete(n.perIP, e.ip)
+	}
+}
+
+func (s *HttpServer) HandleChallenge() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.URL.Query().Get("userID")
+		if userID == "" {
+			http.Error(w, "userID cannot be empty", http.StatusBadRequest)
+			return
+		}
+
+		nonce, err := s.nonces.issue(userID, clientIP(r))
+		if errors.Is(err, errTooManyChallenges) {
+			log.Warn("too many pending challenges", zap.String("userID", userID))
+			http.Error(w, "too many pending challenges", http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			log.Error("issue challenge failed", zap.Error(err))
+			http.Error(w, "issue challenge failed", http.StatusServiceUnavailable)
+			return
+		}
+
+		data, err := json.Marshal(&model.AuthChallenge{Nonce: nonce})
+		if err != nil {
+			log.Error("issue challenge failed", zap.Error(err))
+			http.Error(w, "issue challenge failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	}
+}
+
+// authenticate verifies a signed challenge against the user's registered
+// identity signing key. The nonce is consumed even when verification fails.
+func (s *HttpServer) authenticate(ctx context.Context, resp *model.AuthResponse) error {
+	if resp.UserID == "" || resp.DeviceID == "" || len(resp.Nonce) == 0 || len(resp.Signature) == 0 {
+		return errUnauthorized
+	}
+
+	if !s.nonces.consume(resp.UserID, resp.Nonce) {
+		return errUnauthorized
+	}
+
+	skew := time.Since(time.Unix(resp.Timestamp, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return errUnauthorized
+	}
+
+	user, err := s.users.GetByName(ctx, resp.UserID)
+	if err != nil {
+		return err
+	}
+
+	if user == nil || !auth.VerifyChallenge(user.SigPub, resp) {
+		return errUnauthorized
+	}
+
+	return nil
+}
+
+func parseAuthResponse(q url.Values) (*model.AuthResponse, error) {
+	nonce, err := base64.RawURLEncoding.DecodeString(q.Get("nonce"))
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(q.Get("signature"))
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := strconv.ParseInt(q.Get("timestamp"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.AuthResponse{
+		UserID:    q.Get("userID"),
+		DeviceID:  q.Get("deviceID"),
+		Nonce:     nonce,
+		Timestamp: ts,
+		Signature: sig,
+	}, nil
+}
+
+// clientIP is the address the request came from. Proxy headers are ignored:
+// they are set by the client unless a trusted proxy overwrites them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
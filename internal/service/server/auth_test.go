@@ -0,0 +1,276 @@
+package server
+
+import (
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/auth"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNonceCacheConsumesOnce(t *testing.T) {
+	n := newNonceCache()
+
+	nonce, err := n.issue("alice", testIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n.consume("bob", nonce) {
+		t.Fatal("nonce issued to alice accepted for bob")
+	}
+	// a failed attempt burns the nonce too
+	if n.consume("alice", nonce) {
+		t.Fatal("nonce accepted after a failed attempt")
+	}
+
+	nonce, err = n.issue("alice", testIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.consume("alice", nonce) {
+		t.Fatal("fresh nonce rejected")
+	}
+	if n.consume("alice", nonce) {
+		t.Fatal("nonce accepted twice")
+	}
+}
+
+func TestNonceCacheExpires(t *testing.T) {
+	n := newNonceCache()
+
+	nonce, err := n.issue("alice", testIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expireNonces(n)
+
+	if n.consume("alice", nonce) {
+		t.Fatal("expired nonce accepted")
+	}
+}
+
+func TestNonceCacheBounds(t *testing.T) {
+	n := newNonceCache()
+
+	for range maxChallengesPerUser {
+		if _, err := n.issue("alice", testIP); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := n.issue("alice", "192.0.2.2"); !errors.Is(err, errTooManyChallenges) {
+		t.Fatalf("challenge over the user bound: got %v", err)
+	}
+	// others are not locked out by alice
+	if _, err := n.issue("bob", testIP); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := len(n.nonces); i < maxChallengesPerIP; i++ {
+		if _, err := n.issue(fmt.Sprintf("user%d", i), testIP); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := n.issue("carol", testIP); !errors.Is(err, errTooManyChallenges) {
+		t.Fatalf("challenge over the address bound: got %v", err)
+	}
+	if _, err := n.issue("carol", "192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired challenges free their slots
+	expireNonces(n)
+	if _, err := n.issue("alice", testIP); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.nonces) != 1 || len(n.expiry) != 1 || len(n.perUser) != 1 || len(n.perIP) != 1 {
+		t.Fatalf("expired challenges kept: %d nonces, %d users, %d addresses", len(n.nonces), len(n.perUser), len(n.perIP))
+	}
+}
+
+func TestNonceCacheConsumeFrees(t *testing.T) {
+	n := newNonceCache()
+
+	for range 2 * maxChallengesPerUser {
+		nonce, err := n.issue("alice", testIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !n.consume("alice", nonce) {
+			t.Fatal("fresh nonce rejected")
+		}
+	}
+	if len(n.nonces) != 0 || len(n.expiry) != 0 || len(n.perUser) != 0 || len(n.perIP) != 0 {
+		t.Fatal("consumed challenges kept")
+	}
+}
+
+func TestChallengeBound(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+
+	for range maxChallengesPerUser {
+		node.challenge(t, "alice")
+	}
+	resp := node.do(t, http.MethodGet, "/challenge?userID=alice", nil, "")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got %s, want 429", resp.Status)
+	}
+	node.challenge(t, "bob")
+}
+
+const testIP = "192.0.2.1"
+
+// expireNonces moves every outstanding challenge past its expiry.
+func expireNonces(n *nonceCache) {
+	for _, e := range n.nonces {
+		e.expiresAt = time.Now().Add(-time.Second)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	mallory := newTestUser(t, "mallory")
+	node.register(t, alice)
+	node.register(t, mallory)
+
+	tests := []struct {
+		name   string
+		resp   func() *model.AuthResponse
+		status int
+	}{
+		{
+			name:   "valid",
+			resp:   func() *model.AuthResponse { return node.signIn(t, alice) },
+			status: http.StatusOK,
+		},
+		{
+			name: "signed by another key",
+			resp: func() *model.AuthResponse {
+				return auth.SignChallenge(mallory.sigPriv, alice.name, alice.deviceID, node.challenge(t, alice.name), time.Now().Unix())
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "nonce issued to another user",
+			resp: func() *model.AuthResponse {
+				return auth.SignChallenge(alice.sigPriv, alice.name, alice.deviceID, node.challenge(t, mallory.name), time.Now().Unix())
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "nonce never issued",
+			resp: func() *model.AuthResponse {
+				return auth.SignChallenge(alice.sigPriv, alice.name, alice.deviceID, make([]byte, nonceSize), time.Now().Unix())
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "stale timestamp",
+			resp: func() *model.AuthResponse {
+				return auth.SignChallenge(alice.sigPriv, alice.name, alice.deviceID, node.challenge(t, alice.name), time.Now().Add(-2*maxClockSkew).Unix())
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "device swapped after signing",
+			resp: func() *model.AuthResponse {
+				resp := node.signIn(t, alice)
+				resp.DeviceID = "other"
+				return resp
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "unknown user",
+			resp: func() *model.AuthResponse {
+				return auth.SignChallenge(alice.sigPriv, "carol", alice.deviceID, node.challenge(t, "carol"), time.Now().Unix())
+			},
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := node.do(t, http.MethodPost, "/auth/login", tt.resp(), "")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got %s, want %d", resp.Status, tt.status)
+			}
+		})
+	}
+}
+
+func TestLoginReplay(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	node.register(t, alice)
+
+	signed := node.signIn(t, alice)
+	if resp := node.do(t, http.MethodPost, "/auth/login", signed, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first login: %s", resp.Status)
+	}
+	if resp := node.do(t, http.MethodPost, "/auth/login", signed, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("replayed login: got %s, want 401", resp.Status)
+	}
+}
+
+func TestWebsocketLogin(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	mallory := newTestUser(t, "mallory")
+	node.register(t, alice)
+	node.register(t, mallory)
+
+	// mallory claims to be alice with her own key
+	forged := auth.SignChallenge(mallory.sigPriv, alice.name, mallory.deviceID, node.challenge(t, alice.name), time.Now().Unix())
+	if _, status := node.dialAs(t, forged); status != http.StatusUnauthorized {
+		t.Fatalf("forged login: got %d, want 401", status)
+	}
+
+	signed := node.signIn(t, alice)
+	conn, status := node.dialAs(t, signed)
+	if conn == nil {
+		t.Fatalf("login: got %d", status)
+	}
+	node.waitConnected(t, alice.name)
+	conn.Close()
+
+	if _, status := node.dialAs(t, signed); status != http.StatusUnauthorized {
+		t.Fatalf("replayed login: got %d, want 401", status)
+	}
+}
+
+func TestWebsocketLoginMalformed(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+
+	resp := node.do(t, http.MethodGet, "/init?userID=alice", nil, "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %s, want 400", resp.Status)
+	}
+}
+
+func TestQueuedMessagesNeedLogin(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+
+	sender := node.dial(t, alice)
+	writeFrame(t, sender, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, "1")})
+	readFrame(t, sender, model.FrameAccepted)
+
+	// alice cannot read bob's queue by claiming his name
+	forged := auth.SignChallenge(alice.sigPriv, bob.name, alice.deviceID, node.challenge(t, bob.name), time.Now().Unix())
+	if _, status := node.dialAs(t, forged); status != http.StatusUnauthorized {
+		t.Fatalf("forged login: got %d, want 401", status)
+	}
+
+	frame := readFrame(t, node.dial(t, bob), model.FrameMessage)
+	if frame.Message.ClientID != "1" || frame.Message.From != alice.name {
+		t.Fatalf("got %+v", frame.Message)
+	}
+}
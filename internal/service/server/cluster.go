@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/utils/log"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	presenceTTL       = 30 * time.Second
+	heartbeatInterval = presenceTTL / 3
+)
+
+type (
+	// routedFrame is what one node publishes to another that owns the recipient.
+	routedFrame struct {
+		To    string       `json:"to"`
+		Frame *model.Frame `json:"frame"`
+	}
+)
+
+func newNodeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func presenceKey(userID string) string {
+	return fmt.Sprintf("presence: %s", userID)
+}
+
+func nodeChannel(nodeID string) string {
+	return fmt.Sprintf("node: %s", nodeID)
+}
+
+func (s *HttpServer) NodeID() string {
+	return s.nodeID
+}
+
+// claimPresence records that userID is connected to this node.
+func (s *HttpServer) claimPresence(ctx context.Context, userID string) error {
+	return s.state.Set(ctx, presenceKey(userID), []byte(s.nodeID), presenceTTL)
+}
+
+// releasePresence drops the claim unless another node has taken it over.
+func (s *HttpServer) releasePresence(ctx context.Context, userID string) error {
+	return s.state.DelIfEqual(ctx, presenceKey(userID), []byte(s.nodeID))
+}
+
+// ownerOf returns the node currently holding userID's connection, or "" when
+// the user is offline everywhere.
+func (s *HttpServer) ownerOf(ctx context.Context, userID string) (string, error) {
+	nodeID, err := s.state.Get(ctx, presenceKey(userID))
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", nil
+	}
+	return string(nodeID), err
+}
+
+// deliver hands a frame to the recipient wherever it is connected. Messages
+// are already in the recipient's queue, so when no node owns the user there
+// is nothing more to do: they go out on the next login.
+func (s *HttpServer) deliver(ctx context.Context, to string, frame *model.Frame) error {
+	if client, ok := s.conns.Get(to); ok {
+		s.metrics.messagesRouted.Inc(routeLocal)
+		return s.sendFrame(client, frame)
+	}
+
+	nodeID, err := s.ownerOf(ctx, to)
+	if err != nil {
+		return err
+	}
+
+	if nodeID == "" || nodeID == s.nodeID {
+		s.metrics.messagesRouted.Inc(routeOffline)
+		return nil
+	}
+
+	s.metrics.messagesRouted.Inc(routeRemote)
+	data, err := json.Marshal(&routedFrame{
+		To:    to,
+		Frame: frame,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.broker.Publish(ctx, nodeChannel(nodeID), data)
+}
+
+// consumeRouted delivers frames other nodes published for our users.
+func (s *HttpServer) consumeRouted(ctx context.Context) error {
+	ch, err := s.broker.Subscribe(ctx, nodeChannel(s.nodeID))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for payload := range ch {
+			var routed routedFrame
+			if err := json.Unmarshal(payload, &routed); err != nil || routed.Frame == nil {
+				log.Error("Unmarshal routed frame failed", zap.Error(err))
+				continue
+			}
+
+			client, ok := s.conns.Get(routed.To)
+			if !ok {
+				// the user left between lookup and publish; the queue still has it
+				continue
+			}
+
+			if err := s.sendFrame(client, routed.Frame); err != nil {
+				log.Debug("routed delivery failed", zap.String("userID", routed.To), zap.Error(err))
+			}
+		}
+	}()
+	return nil
+}
+
+// heartbeat keeps presence claims for local users alive. A node that dies
+// stops refreshing and its users fall back to the offline queue once the
+// claims expire.
+func (s *HttpServer) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, userID := range s.conns.UserIDs() {
+				if err := s.claimPresence(ctx, userID); err != nil {
+					log.Error("refresh presence failed", zap.String("userID", userID), zap.Error(err))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"e2e_chat/internal/model"
+	"net/http"
+	"testing"
+)
+
+// newTestCluster starts two nodes sharing their stores and token secret,
+// like two relays in front of one Redis.
+func newTestCluster(t *testing.T) (*testNode, *testNode) {
+	t.Helper()
+
+	stores := newTestStores()
+	secret := bytes.Repeat([]byte{1}, 32)
+
+	a := newTestNode(t, stores)
+	b := newTestNode(t, stores)
+	a.SetTokenSecret(secret)
+	b.SetTokenSecret(secret)
+	return a, b
+}
+
+func TestCrossNodeDelivery(t *testing.T) {
+	a, b := newTestCluster(t)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	a.register(t, alice)
+	b.register(t, bob)
+
+	receiver := b.dial(t, bob)
+	b.waitConnected(t, bob.name)
+	if owner, err := a.ownerOf(t.Context(), bob.name); err != nil || owner != b.NodeID() {
+		t.Fatalf("owner of bob: got %q, %v, want %q", owner, err, b.NodeID())
+	}
+
+	sender := a.dial(t, alice)
+	writeFrame(t, sender, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, "1")})
+	accepted := readFrame(t, sender, model.FrameAccepted)
+
+	got := readFrame(t, receiver, model.FrameMessage).Message
+	if got.ID != accepted.Ack.ID || got.From != alice.name {
+		t.Fatalf("got %+v, want the message accepted as %s", got, accepted.Ack.ID)
+	}
+
+	// a token minted by one node is good on the other
+	tokens := a.login(t, alice)
+	if resp := b.do(t, http.MethodGet, "/keys/"+bob.name, nil, tokens.AccessToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf("token from the other node: %s", resp.Status)
+	}
+}
+
+func TestCrossNodeOfflineFallback(t *testing.T) {
+	a, b := newTestCluster(t)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	a.register(t, alice)
+	a.register(t, bob)
+
+	// bob was on b and left
+	b.dial(t, bob).Close()
+	b.waitDisconnected(t, bob.name)
+	if owner, err := a.ownerOf(t.Context(), bob.name); err != nil || owner != "" {
+		t.Fatalf("owner of bob after logout: got %q, %v", owner, err)
+	}
+
+	sender := a.dial(t, alice)
+	writeFrame(t, sender, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, "1")})
+	readFrame(t, sender, model.FrameAccepted)
+
+	got := readFrame(t, b.dial(t, bob), model.FrameMessage).Message
+	if got.ClientID != "1" {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestCrossNodeDuplicateLogin(t *testing.T) {
+	a, b := newTestCluster(t)
+	bob := newTestUser(t, "bob")
+	a.register(t, bob)
+
+	a.dial(t, bob)
+	a.waitConnected(t, bob.name)
+
+	if _, status := b.dialAs(t, b.signIn(t, bob)); status != http.StatusBadRequest {
+		t.Fatalf("second login on the other node: got %d, want 400", status)
+	}
+}
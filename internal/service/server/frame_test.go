@@ -0,0 +1,156 @@
+package server
+
+import (
+	"e2e_chat/internal/model"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckMessage(t *testing.T) {
+	sender := &Client{userID: "alice"}
+
+	tests := []struct {
+		name   string
+		modify func(m *model.Message)
+		want   model.ErrorCode // empty when accepted
+	}{
+		{"valid", func(m *model.Message) {}, ""},
+		{"no recipient", func(m *model.Message) { m.To = "" }, model.ErrorInvalid},
+		{"no sender", func(m *model.Message) { m.From = "" }, model.ErrorInvalid},
+		{"no header", func(m *model.Message) { m.Header = nil }, model.ErrorInvalid},
+		{"no ciphertext", func(m *model.Message) { m.Ciphertext = nil }, model.ErrorInvalid},
+		{"long recipient", func(m *model.Message) { m.To = strings.Repeat("b", 65) }, model.ErrorInvalid},
+		{"long client ID", func(m *model.Message) { m.ClientID = strings.Repeat("1", 65) }, model.ErrorInvalid},
+		{"negative TTL", func(m *model.Message) { m.TTL = -1 }, model.ErrorInvalid},
+		{"short ephemeral key", func(m *model.Message) { m.X3DHHandShake = &model.X3DHHandshake{EKPub: make([]byte, 31)} }, model.ErrorInvalid},
+		{"sealed", func(m *model.Message) { m.Sealed = &model.Sealed{} }, model.ErrorInvalid},
+		{"someone else", func(m *model.Message) { m.From = "mallory" }, model.ErrorForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testMessage("alice", "bob", "1")
+			tt.modify(m)
+
+			got := checkMessage(sender, m)
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("rejected: %v", got)
+				}
+				return
+			}
+			if got == nil || got.Code != tt.want {
+				t.Fatalf("got %v, want %s", got, tt.want)
+			}
+			if got.ClientID != m.ClientID {
+				t.Fatalf("error names client ID %q, want %q", got.ClientID, m.ClientID)
+			}
+		})
+	}
+
+	if got := checkMessage(sender, nil); got == nil || got.Code != model.ErrorInvalid {
+		t.Fatalf("message frame without a message: got %v", got)
+	}
+}
+
+// TestFrameErrors checks that bad frames are answered with an error frame,
+// are not relayed and leave the connection usable.
+func TestFrameErrors(t *testing.T) {
+	stores := newTestStores()
+	node := newTestNode(t, stores)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+	conn := node.dial(t, alice)
+
+	noRecipient := testMessage(alice.name, "", "no-recipient")
+	spoofed := testMessage(bob.name, alice.name, "spoofed")
+
+	tests := []struct {
+		name     string
+		frame    string
+		code     model.ErrorCode
+		clientID string
+	}{
+		{"not JSON", "{", model.ErrorMalformed, ""},
+		{"unknown type", `{"type":"typing"}`, model.ErrorMalformed, ""},
+		{"message missing", `{"type":"message"}`, model.ErrorInvalid, ""},
+		{"no recipient", frameJSON(t, &model.Frame{Type: model.FrameMessage, Message: noRecipient}), model.ErrorInvalid, noRecipient.ClientID},
+		{"spoofed sender", frameJSON(t, &model.Frame{Type: model.FrameMessage, Message: spoofed}), model.ErrorForbidden, spoofed.ClientID},
+		{"ack without ID", `{"type":"ack","ack":{}}`, model.ErrorInvalid, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.frame)); err != nil {
+				t.Fatal(err)
+			}
+			got := readFrame(t, conn, model.FrameError).Error
+			if got == nil || got.Code != tt.code || got.ClientID != tt.clientID {
+				t.Fatalf("got %+v, want code %s for client ID %q", got, tt.code, tt.clientID)
+			}
+		})
+	}
+
+	writeFrame(t, conn, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, "valid")})
+	readFrame(t, conn, model.FrameAccepted)
+
+	for _, to := range []string{alice.name, bob.name} {
+		pending, err := stores.queue.Pending(t.Context(), to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range pending {
+			if m.ClientID != "valid" {
+				t.Fatalf("relayed the rejected %q to %s", m.ClientID, to)
+			}
+		}
+	}
+
+	m := node.scrape(t)
+	if m[`e2e_frames_rejected_total{code="malformed"}`] != 2 || m[`e2e_frames_rejected_total{code="invalid"}`] != 3 || m[`e2e_frames_rejected_total{code="forbidden"}`] != 1 {
+		t.Fatalf("rejected frames not counted by code: %v", m)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	stores := newTestStores()
+	node := newTestNode(t, stores, func(s *HttpServer) { s.SetMaxFrameSize(1024) })
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+	conn := node.dial(t, alice)
+
+	big := testMessage(alice.name, bob.name, "big")
+	big.Ciphertext = make([]byte, 2048)
+	writeFrame(t, conn, &model.Frame{Type: model.FrameMessage, Message: big})
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+		t.Fatalf("connection ended with %v, want close code %d", err, websocket.CloseMessageTooBig)
+	}
+
+	node.waitDisconnected(t, alice.name)
+	if pending, err := stores.queue.Pending(t.Context(), bob.name); err != nil || len(pending) != 0 {
+		t.Fatalf("oversized frame queued: %d, %v", len(pending), err)
+	}
+}
+
+func frameJSON(t *testing.T, frame *model.Frame) string {
+	t.Helper()
+
+	data, err := json.Marshal(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	readinessTimeout = 2 * time.Second
+)
+
+type (
+	// check reports whether a dependency, e.g. the database, is usable.
+	check struct {
+		name string
+		fn   func(ctx context.Context) error
+	}
+
+	readiness struct {
+		Ready  bool              `json:"ready"`
+		Checks map[string]string `json:"checks"`
+	}
+
+	nodeStats struct {
+		NodeID      string    `json:"node_id"`
+		Addr        string    `json:"addr"`
+		StartedAt   time.Time `json:"started_at"`
+		Uptime      string    `json:"uptime"`
+		Listening   bool      `json:"listening"`
+		Draining    bool      `json:"draining"`
+		Connections int       `json:"connections"`
+		Goroutines  int       `json:"goroutines"`
+	}
+
+	adminStats struct {
+		Node    nodeStats `json:"node"`
+		Users   []string  `json:"connected_users"`
+		Storage readiness `json:"storage"`
+	}
+)
+
+// AddReadinessCheck makes /readyz fail while fn returns an error.
+func (s *HttpServer) AddReadinessCheck(name string, fn func(ctx context.Context) error) {
+	s.checks = append(s.checks, check{name: name, fn: fn})
+}
+
+// HandleHealthz reports that the process is alive and serving requests.
+func (s *HttpServer) HandleHealthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// HandleReadyz reports whether the node should receive traffic: the listener
+// is up, it is not draining and every dependency answers.
+func (s *HttpServer) HandleReadyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready := s.runChecks(r.Context())
+
+		if !s.listening.Load() {
+			ready.Ready = false
+			ready.Checks["listener"] = "not listening"
+		}
+
+		if s.isDraining() {
+			ready.Ready = false
+			ready.Checks["listener"] = "draining"
+		}
+
+		status := http.StatusOK
+		if !ready.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, ready)
+	}
+}
+
+// HandleAdminStats describes this node, its users and its storage.
+func (s *HttpServer) HandleAdminStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users := s.conns.UserIDs()
+		sort.Strings(users)
+
+		writeJSON(w, http.StatusOK, &adminStats{
+			Node: nodeStats{
+				NodeID:      s.nodeID,
+				Addr:        s.addr,
+				StartedAt:   s.startedAt,
+				Uptime:      time.Since(s.startedAt).Round(time.Second).String(),
+				Listening:   s.listening.Load(),
+				Draining:    s.isDraining(),
+				Connections: len(users),
+				Goroutines:  runtime.NumGoroutine(),
+			},
+			Users:   users,
+			Storage: s.runChecks(r.Context()),
+		})
+	}
+}
+
+// runChecks runs every readiness check concurrently, each with its own timeout.
+func (s *HttpServer) runChecks(ctx context.Context) readiness {
+	result := readiness{
+		Ready:  true,
+		Checks: make(map[string]string, len(s.checks)),
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, c := range s.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+			defer cancel()
+
+			status := "ok"
+			err := c.fn(ctx)
+			if err != nil {
+				status = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			result.Checks[c.name] = status
+			if err != nil {
+				result.Ready = false
+			}
+		}()
+	}
+	wg.Wait()
+
+	return result
+}
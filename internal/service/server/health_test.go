@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func (n *testNode) readyz(t testing.TB) (int, readiness) {
+	t.Helper()
+
+	resp := n.do(t, http.MethodGet, "/readyz", nil, "")
+	var ready readiness
+	if err := json.NewDecoder(resp.Body).Decode(&ready); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, ready
+}
+
+func TestHealthz(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+
+	resp := node.do(t, http.MethodGet, "/healthz", nil, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("healthz: %s", resp.Status)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	node := startTestNode(t, newTestStores())
+	t.Cleanup(func() { node.Shutdown(context.Background()) })
+
+	if status, ready := node.readyz(t); status != http.StatusOK || !ready.Ready {
+		t.Fatalf("readyz: %d %+v", status, ready)
+	}
+}
+
+func TestReadyzFailingCheck(t *testing.T) {
+	node := startTestNode(t, newTestStores(), func(s *HttpServer) {
+		s.AddReadinessCheck("redis", func(ctx context.Context) error { return nil })
+		s.AddReadinessCheck("mongo", func(ctx context.Context) error { return errors.New("connection refused") })
+	})
+	t.Cleanup(func() { node.Shutdown(context.Background()) })
+
+	status, ready := node.readyz(t)
+	if status != http.StatusServiceUnavailable || ready.Ready {
+		t.Fatalf("readyz with mongo down: %d %+v", status, ready)
+	}
+	if ready.Checks["mongo"] != "connection refused" || ready.Checks["redis"] != "ok" {
+		t.Fatalf("checks %+v", ready.Checks)
+	}
+}
+
+func TestReadyzListener(t *testing.T) {
+	// served by the test, never through Start
+	node := newTestNode(t, newTestStores())
+
+	status, ready := node.readyz(t)
+	if status != http.StatusServiceUnavailable || ready.Checks["listener"] != "not listening" {
+		t.Fatalf("readyz before Start: %d %+v", status, ready)
+	}
+
+	if err := node.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	status, ready = node.readyz(t)
+	if status != http.StatusServiceUnavailable || ready.Checks["listener"] != "draining" {
+		t.Fatalf("readyz while draining: %d %+v", status, ready)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	node.SetAdmins("root")
+
+	root := newTestUser(t, "root")
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	for _, u := range []*testUser{root, alice, bob} {
+		node.register(t, u)
+	}
+	node.dial(t, bob)
+	node.dial(t, alice)
+	node.waitConnected(t, alice.name)
+	node.waitConnected(t, bob.name)
+
+	if resp := node.do(t, http.MethodGet, "/admin/stats", nil, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without a token: %s", resp.Status)
+	}
+	if resp := node.do(t, http.MethodGet, "/admin/stats", nil, node.login(t, alice).AccessToken); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("without the admin scope: %s", resp.Status)
+	}
+
+	resp := node.do(t, http.MethodGet, "/admin/stats", nil, node.login(t, root).AccessToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("as admin: %s", resp.Status)
+	}
+	var stats adminStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(stats.Users, []string{"alice", "bob"}) || stats.Node.Connections != 2 {
+		t.Fatalf("connected users %q, connections %d", stats.Users, stats.Node.Connections)
+	}
+	if stats.Node.Draining || stats.Node.Goroutines == 0 || !stats.Storage.Ready {
+		t.Fatalf("stats %+v", stats)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownWithoutStart(t *testing.T) {
+	stores := newTestStores()
+	s := NewHttpServer(stores.users, stores.queue, stores.state, stores.broker)
+
+	if err := s.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownAfterFailedStart(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	stores := newTestStores()
+	s := NewHttpServer(stores.users, stores.queue, stores.state, stores.broker)
+	s.SetAddr(ln.Addr().String())
+
+	if err := s.Start(t.Context()); err == nil {
+		t.Fatal("started on a port in use")
+	}
+	if err := s.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestShutdownDrains checks that messages a client sent right before the
+// shutdown are queued, and that the client is told the server is going away.
+func TestShutdownDrains(t *testing.T) {
+	const n = 20
+
+	stores := newTestStores()
+	node := startTestNode(t, stores)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+
+	aliceConn := node.dial(t, alice)
+	bobConn := node.dial(t, bob)
+	node.waitConnected(t, alice.name)
+	node.waitConnected(t, bob.name)
+
+	for i := range n {
+		writeFrame(t, aliceConn, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, fmt.Sprint(i))})
+	}
+
+	// both keep reading, so they answer the close frame
+	closed := readUntilClosed(aliceConn)
+	readUntilClosed(bobConn)
+
+	// signed before the shutdown, the challenge endpoint goes away with it
+	late := node.signIn(t, alice)
+
+	ctx, cancel := context.WithTimeout(t.Context(), testTimeout)
+	defer cancel()
+	if err := node.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	select {
+	case err := <-closed:
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Fatalf("alice's connection ended with %v, want going away", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("alice was not disconnected")
+	}
+
+	pending, err := stores.queue.Pending(t.Context(), bob.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != n {
+		t.Fatalf("%d messages queued for bob, want %d", len(pending), n)
+	}
+
+	if conn, status := node.dialAs(t, late); conn != nil || status != 0 {
+		t.Fatalf("connected after shutdown: status %d", status)
+	}
+}
+
+// readUntilClosed discards what conn receives and reports why it ended.
+func readUntilClosed(conn *websocket.Conn) <-chan error {
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+	return closed
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	node := startTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	node.register(t, alice)
+
+	// never reads, so it never answers the close frame
+	node.dial(t, alice)
+	node.waitConnected(t, alice.name)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	if err := node.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	node.waitDisconnected(t, alice.name)
+}
+
+// TestReadTimeouts checks that a client too slow to send its request is
+// dropped, while an upgraded websocket stays open past the timeouts.
+func TestReadTimeouts(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	node := startTestNode(t, newTestStores(), func(s *HttpServer) {
+		s.readHeaderTimeout = timeout
+		s.readTimeout = timeout
+	})
+	t.Cleanup(func() { node.Shutdown(context.Background()) })
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(node.url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET /healthz HTTP/1.1\r\nHost: localhost\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("slow request not dropped: %v", err)
+	}
+
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+
+	ws := node.dial(t, alice)
+	time.Sleep(3 * timeout)
+	writeFrame(t, ws, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, "1")})
+	readFrame(t, ws, model.FrameAccepted)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/utils/log"
+	"e2e_chat/internal/utils/validate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// acceptedTTL is how long a client ID is remembered, so a message resent
+// from the sender's outbox after a lost confirmation is not queued twice.
+const acceptedTTL = 24 * time.Hour
+
+func acceptedKey(userID, clientID string) string {
+	return fmt.Sprintf("accepted: %s/%s", userID, clientID)
+}
+
+// relayMessage persists the message for its recipient, confirms the stored ID
+// to the sender and then attempts live delivery. The message stays queued
+// until the recipient acks it.
+func (s *HttpServer) relayMessage(ctx context.Context, sender *Client, message *model.Message) error {
+	id, stored, err := s.storeMessage(ctx, sender.userID, message)
+	if err != nil {
+		return err
+	}
+
+	s.confirmMessage(sender, id, message.ClientID)
+	if stored {
+		s.deliverLive(ctx, message)
+	}
+	return nil
+}
+
+// storeMessage queues message for its recipient and returns its ID. Client
+// IDs are remembered per scope: a resend of a message already queued, e.g.
+// after a lost confirmation, is not queued again and gets the first ID back
+// with stored false.
+func (s *HttpServer) storeMessage(ctx context.Context, scope string, message *model.Message) (id string, stored bool, err error) {
+	if message.ClientID != "" {
+		id, err := s.state.Get(ctx, acceptedKey(scope, message.ClientID))
+		if err == nil {
+			return string(id), false, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return "", false, err
+		}
+	}
+
+	message.ID = ""
+	message.Timestamp = time.Now().UnixMilli()
+
+	if err := s.queue.Enqueue(ctx, message.To, message); err != nil {
+		return "", false, err
+	}
+
+	if message.ClientID != "" {
+		if err := s.state.Set(ctx, acceptedKey(scope, message.ClientID), []byte(message.ID), acceptedTTL); err != nil {
+			log.Error("remember client ID failed", zap.Error(err))
+		}
+	}
+	return message.ID, true, nil
+}
+
+// deliverLive pushes a queued message to its recipient if it is online.
+func (s *HttpServer) deliverLive(ctx context.Context, message *model.Message) {
+	err := s.deliver(ctx, message.To, &model.Frame{
+		Type:    model.FrameMessage,
+		Message: message,
+	})
+	if err != nil && !errors.Is(err, errConnClosed) {
+		log.Debug("live delivery failed", zap.String("userID", message.To), zap.Error(err))
+	}
+}
+
+// checkMessage rejects a message that breaks its schema or claims to come
+// from someone other than the authenticated user.
+func checkMessage(sender *Client, message *model.Message) *model.Error {
+	if message == nil {
+		return &model.Error{Code: model.ErrorInvalid, Message: "message: required"}
+	}
+
+	if err := validate.Struct(message); err != nil {
+		return &model.Error{Code: model.ErrorInvalid, Message: err.Error(), ClientID: message.ClientID}
+	}
+
+	if message.Sealed != nil {
+		// sent over a logged-in connection it would not hide the sender
+		return &model.Error{Code: model.ErrorInvalid, Message: "sealed: submit to /sealed", ClientID: message.ClientID}
+	}
+
+	if message.From != sender.userID {
+		return &model.Error{Code: model.ErrorForbidden, Message: "from: not the authenticated user", ClientID: message.ClientID}
+	}
+	return nil
+}
+
+// rejectFrame tells the sender why its frame was dropped.
+func (s *HttpServer) rejectFrame(client *Client, rejected *model.Error) {
+	log.Debug("frame rejected", zap.String("userID", client.userID), zap.String("code", string(rejected.Code)), zap.String("reason", rejected.Message))
+	s.metrics.framesRejected.Inc(string(rejected.Code))
+
+	if err := s.sendFrame(client, &model.Frame{Type: model.FrameError, Error: rejected}); err != nil {
+		log.Debug("send error frame failed", zap.String("userID", client.userID), zap.Error(err))
+	}
+}
+
+func (s *HttpServer) confirmMessage(sender *Client, id, clientID string) {
+	err := s.sendFrame(sender, &model.Frame{
+		Type: model.FrameAccepted,
+		Ack: &model.Ack{
+			ID:       id,
+			ClientID: clientID,
+		},
+	})
+	if err != nil {
+		log.Debug("confirm message to sender failed", zap.String("userID", sender.userID), zap.Error(err))
+	}
+}
+
+func (s *HttpServer) sendFrame(client *Client, frame *model.Frame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	if frame.Type == model.FrameMessage && frame.Message != nil {
+		return client.SendMessage(frame.Message.ID, data)
+	}
+	return client.Send(data)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"e2e_chat/internal/model"
+	"fmt"
+	"testing"
+)
+
+func TestForwardLargeBacklog(t *testing.T) {
+	const backlog = 4 * outboundBufferSize
+
+	stores := newTestStores()
+	node := newTestNode(t, stores)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+
+	for i := range backlog {
+		if err := stores.queue.Enqueue(t.Context(), bob.name, testMessage(alice.name, bob.name, fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn := node.dial(t, bob)
+	node.waitConnected(t, bob.name)
+
+	// live traffic while the backlog is replayed
+	sender := node.dial(t, alice)
+	writeFrame(t, sender, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, "live")})
+
+	// in order, live traffic last, and nothing twice
+	writeFrame(t, sender, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, "last")})
+	want := make([]string, 0, backlog+2)
+	for i := range backlog {
+		want = append(want, fmt.Sprint(i))
+	}
+	want = append(want, "live", "last")
+	for _, id := range want {
+		frame := readFrame(t, conn, model.FrameMessage)
+		if frame.Message.ClientID != id {
+			t.Fatalf("got message %s, want %s", frame.Message.ClientID, id)
+		}
+	}
+	if !node.conns.Has(bob.name) {
+		t.Fatal("bob was disconnected during the replay")
+	}
+}
+
+func TestRedeliverUntilAcked(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+
+	sender := node.dial(t, alice)
+	for _, id := range []string{"1", "2"} {
+		writeFrame(t, sender, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, id)})
+		readFrame(t, sender, model.FrameAccepted)
+	}
+
+	conn := node.dial(t, bob)
+	first := readFrame(t, conn, model.FrameMessage).Message
+	second := readFrame(t, conn, model.FrameMessage).Message
+	if first.ID == "" || first.Timestamp == 0 {
+		t.Fatalf("message without server ID or timestamp: %+v", first)
+	}
+	writeFrame(t, conn, &model.Frame{Type: model.FrameAck, Ack: &model.Ack{ID: first.ID}})
+	conn.Close()
+
+	// acks are read before the connection is released
+	node.waitDisconnected(t, bob.name)
+
+	conn = node.dial(t, bob)
+	got := readFrame(t, conn, model.FrameMessage).Message
+	if got.ID != second.ID {
+		t.Fatalf("redelivered %s, want only the unacked %s", got.ClientID, second.ClientID)
+	}
+}
+
+func TestResendNotQueuedTwice(t *testing.T) {
+	stores := newTestStores()
+	node := newTestNode(t, stores)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+
+	sender := node.dial(t, alice)
+	var ids []string
+	for range 2 {
+		writeFrame(t, sender, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, "same")})
+		ids = append(ids, readFrame(t, sender, model.FrameAccepted).Ack.ID)
+	}
+	if ids[0] != ids[1] {
+		t.Fatalf("resend got a new ID: %v", ids)
+	}
+
+	pending, err := stores.queue.Pending(t.Context(), bob.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("%d messages queued, want 1", len(pending))
+	}
+}
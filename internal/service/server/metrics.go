@@ -0,0 +1,80 @@
+package server
+
+import (
+	"e2e_chat/internal/metrics"
+)
+
+// delivery routes of a relayed message
+const (
+	routeLocal   = "local"   // recipient connected to this node
+	routeRemote  = "remote"  // published to the node holding the recipient
+	routeOffline = "offline" // left in the queue until the recipient logs in
+)
+
+var (
+	// queueDepthBuckets group users by how many messages wait for them on login.
+	queueDepthBuckets = []float64{0, 1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+)
+
+type (
+	serverMetrics struct {
+		registry *metrics.Registry
+
+		messagesReceived  *metrics.Counter
+		messagesRouted    *metrics.CounterVec
+		messagesAcked     *metrics.Counter
+		messagesForwarded *metrics.Counter
+		handshakes        *metrics.Counter
+		queueDepth        *metrics.Histogram
+		keyFetches        *metrics.CounterVec
+		keyFetchLatency   *metrics.Histogram
+		rateLimited       *metrics.CounterVec
+		framesRejected    *metrics.CounterVec
+
+		attachmentsUploaded *metrics.Counter
+		attachmentBytes     *metrics.Counter
+	}
+)
+
+func newServerMetrics(conns *ConnRegistry) *serverMetrics {
+	r := metrics.NewRegistry()
+
+	r.NewGaugeFunc("e2e_websocket_connections",
+		"Websocket connections currently open on this node.",
+		func() float64 { return float64(conns.Len()) })
+
+	return &serverMetrics{
+		registry: r,
+
+		messagesReceived: r.NewCounter("e2e_messages_received_total",
+			"Messages received from senders."),
+		messagesRouted: r.NewCounterVec("e2e_messages_routed_total",
+			"Accepted messages by how they reached the recipient: delivered live on this node (local), handed to another node (remote) or queued for an offline recipient (offline).",
+			"route"),
+		messagesAcked: r.NewCounter("e2e_messages_acked_total",
+			"Messages acknowledged by their recipient and removed from the queue."),
+		messagesForwarded: r.NewCounter("e2e_messages_forwarded_total",
+			"Queued messages sent to a recipient when it connected."),
+		handshakes: r.NewCounter("e2e_x3dh_handshakes_total",
+			"Messages that initiate a session with an X3DH handshake."),
+		queueDepth: r.NewHistogram("e2e_queue_depth_on_connect",
+			"Messages waiting in a user's queue when it connects.",
+			queueDepthBuckets),
+		keyFetches: r.NewCounterVec("e2e_key_fetches_total",
+			"Prekey bundle fetches by result.",
+			"result"),
+		keyFetchLatency: r.NewHistogram("e2e_key_fetch_duration_seconds",
+			"Time to serve a prekey bundle fetch.",
+			metrics.LatencyBuckets),
+		rateLimited: r.NewCounterVec("e2e_rate_limited_total",
+			"Requests refused for exceeding a rate limit, by budget.",
+			"budget"),
+		framesRejected: r.NewCounterVec("e2e_frames_rejected_total",
+			"Websocket frames refused with an error frame, by error code.",
+			"code"),
+		attachmentsUploaded: r.NewCounter("e2e_attachments_uploaded_total",
+			"Attachment uploads completed."),
+		attachmentBytes: r.NewCounter("e2e_attachment_bytes_received_total",
+			"Encrypted attachment bytes received in upload chunks."),
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bufio"
+	"e2e_chat/internal/model"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape reads /metrics into series name, labels included, to value.
+func (n *testNode) scrape(t testing.TB) map[string]float64 {
+	t.Helper()
+
+	resp := n.do(t, http.MethodGet, "/metrics", nil, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("metrics: %s", resp.Status)
+	}
+
+	series := make(map[string]float64)
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("metrics line %q: %v", line, err)
+		}
+		series[line[:i]] = v
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return series
+}
+
+// waitMetric waits until the series reaches want, as counters move after
+// the frame that caused them was answered.
+func (n *testNode) waitMetric(t testing.TB, name string, want float64) {
+	t.Helper()
+
+	waitFor(t, func() bool { return n.scrape(t)[name] == want }, name)
+}
+
+func TestMetrics(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+
+	sender := node.dial(t, alice)
+	node.waitMetric(t, "e2e_websocket_connections", 1)
+
+	// bob is offline, the first message opens the session
+	first := testMessage(alice.name, bob.name, "1")
+	first.X3DHHandShake = &model.X3DHHandshake{EKPub: make([]byte, 32)}
+	writeFrame(t, sender, &model.Frame{Type: model.FrameMessage, Message: first})
+	readFrame(t, sender, model.FrameAccepted)
+
+	m := node.scrape(t)
+	for name, want := range map[string]float64{
+		"e2e_messages_received_total":                1,
+		"e2e_x3dh_handshakes_total":                  1,
+		`e2e_messages_routed_total{route="offline"}`: 1,
+	} {
+		if m[name] != want {
+			t.Errorf("%s = %v, want %v", name, m[name], want)
+		}
+	}
+
+	conn := node.dial(t, bob)
+	queued := readFrame(t, conn, model.FrameMessage).Message
+	writeFrame(t, conn, &model.Frame{Type: model.FrameAck, Ack: &model.Ack{ID: queued.ID}})
+	node.waitMetric(t, "e2e_messages_acked_total", 1)
+
+	m = node.scrape(t)
+	for name, want := range map[string]float64{
+		"e2e_websocket_connections":                  2,
+		"e2e_messages_forwarded_total":               1,
+		`e2e_queue_depth_on_connect_bucket{le="0"}`:  1, // alice, nothing queued
+		`e2e_queue_depth_on_connect_bucket{le="1"}`:  2,
+		"e2e_queue_depth_on_connect_count":           2,
+		`e2e_messages_routed_total{route="local"}`:   0,
+		`e2e_messages_routed_total{route="offline"}`: 1,
+	} {
+		if m[name] != want {
+			t.Errorf("%s = %v, want %v", name, m[name], want)
+		}
+	}
+
+	writeFrame(t, sender, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, "2")})
+	readFrame(t, conn, model.FrameMessage)
+	node.waitMetric(t, `e2e_messages_routed_total{route="local"}`, 1)
+	if m := node.scrape(t); m["e2e_x3dh_handshakes_total"] != 1 || m["e2e_messages_received_total"] != 2 {
+		t.Errorf("handshakes %v, received %v after a plain message", m["e2e_x3dh_handshakes_total"], m["e2e_messages_received_total"])
+	}
+
+	tokens := node.login(t, bob)
+	for path, want := range map[string]int{
+		"/keys/" + alice.name: http.StatusOK,
+		"/keys/nobody":        http.StatusBadRequest,
+	} {
+		if resp := node.do(t, http.MethodGet, path, nil, tokens.AccessToken); resp.StatusCode != want {
+			t.Fatalf("GET %s: %s", path, resp.Status)
+		}
+	}
+
+	m = node.scrape(t)
+	if m[`e2e_key_fetches_total{result="ok"}`] != 1 || m[`e2e_key_fetches_total{result="not_found"}`] != 1 {
+		t.Errorf("key fetches ok %v, not found %v", m[`e2e_key_fetches_total{result="ok"}`], m[`e2e_key_fetches_total{result="not_found"}`])
+	}
+	if m["e2e_key_fetch_duration_seconds_count"] != 2 {
+		t.Errorf("key fetch latency count %v, want 2", m["e2e_key_fetch_duration_seconds_count"])
+	}
+}
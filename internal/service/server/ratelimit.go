@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/utils/log"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// budgets, also used as metric labels
+const (
+	budgetMessages    = "messages"
+	budgetKeyFetches  = "key_fetches"
+	budgetConnections = "connections"
+)
+
+type (
+	// Limit is a token bucket budget: Rate tokens per second, up to Burst at
+	// once. A zero Rate disables it.
+	Limit struct {
+		Rate  float64
+		Burst int
+	}
+
+	// RateLimits are the budgets enforced by the server. Messages are counted
+	// per user, key fetches per user and per IP, and connection attempts
+	// (challenges, logins, registrations and websockets) per IP.
+	RateLimits struct {
+		Messages    Limit
+		KeyFetches  Limit
+		Connections Limit
+	}
+)
+
+// SetRateLimits enables rate limiting with buckets kept in limiter. Use a
+// shared limiter when running several nodes.
+func (s *HttpServer) SetRateLimits(limiter storage.RateLimiter, limits RateLimits) {
+	s.limiter = limiter
+	s.limits = limits
+}
+
+func rateLimitKey(budget, subject string) string {
+	return fmt.Sprintf("ratelimit: %s: %s", budget, subject)
+}
+
+// allow takes a token from the budget for subject. When the limiter itself
+// fails the request is let through: an outage of the limiter must not take
+// the whole service down.
+func (s *HttpServer) allow(ctx context.Context, budget string, limit Limit, subject string) (bool, time.Duration) {
+	if s.limiter == nil || limit.Rate <= 0 {
+		return true, 0
+	}
+
+	ok, wait, err := s.limiter.Take(ctx, rateLimitKey(budget, subject), limit.Rate, limit.Burst)
+	if err != nil {
+		log.Error("rate limiter failed", zap.String("budget", budget), zap.Error(err))
+		return true, 0
+	}
+
+	if !ok {
+		s.metrics.rateLimited.Inc(budget)
+	}
+	return ok, wait
+}
+
+// LimitConnections applies the connection budget to next, per remote IP.
+func (s *HttpServer) LimitConnections(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := s.allow(r.Context(), budgetConnections, s.limits.Connections, "ip: "+clientIP(r)); !ok {
+			writeRateLimited(w, wait)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// LimitKeyFetches applies the key fetch budget to next, both per remote IP
+// and per authenticated user, so neither rotating accounts nor rotating
+// addresses allows enumerating users. It must run after AuthMiddleware.
+func (s *HttpServer) LimitKeyFetches(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := s.allow(r.Context(), budgetKeyFetches, s.limits.KeyFetches, "ip: "+clientIP(r))
+		if ok {
+			if claims := claimsFromContext(r.Context()); claims != nil {
+				ok, wait = s.allow(r.Context(), budgetKeyFetches, s.limits.KeyFetches, "user: "+claims.Subject)
+			}
+		}
+
+		if !ok {
+			writeRateLimited(w, wait)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowMessage takes a token from the sender's message budget. A sender over
+// budget is disconnected with a close code carrying when to come back;
+// messages it sent meanwhile are not accepted, so they stay in its outbox.
+func (s *HttpServer) allowMessage(client *Client) bool {
+	ok, wait := s.allow(context.TODO(), budgetMessages, s.limits.Messages, "user: "+client.userID)
+	if ok {
+		return true
+	}
+
+	log.Warn("message rate exceeded", zap.String("userID", client.userID))
+	client.closeGracefully(model.CloseRateLimited, model.RetryAfterReason(retryAfterSeconds(wait)))
+	return false
+}
+
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+	http.Error(w, "rate limited", http.StatusTooManyRequests)
+}
+
+func retryAfterSeconds(wait time.Duration) int {
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/memory"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type (
+	failingLimiter struct{}
+
+	// countingQueue counts the acks that reach storage.
+	countingQueue struct {
+		storage.MessageQueue
+		acks atomic.Int64
+	}
+)
+
+func (q *countingQueue) Ack(ctx context.Context, to, id string) error {
+	q.acks.Add(1)
+	return q.MessageQueue.Ack(ctx, to, id)
+}
+
+func (failingLimiter) Take(context.Context, string, float64, int) (bool, time.Duration, error) {
+	return false, 0, errors.New("limiter down")
+}
+
+func withRateLimits(limits RateLimits) func(*HttpServer) {
+	return func(s *HttpServer) { s.SetRateLimits(memory.NewRateLimiter(), limits) }
+}
+
+func checkRateLimited(t *testing.T, resp *http.Response) {
+	t.Helper()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got %s, want %d", resp.Status, http.StatusTooManyRequests)
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || secs < 1 {
+		t.Fatalf("Retry-After %q", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	node := newTestNode(t, newTestStores(), withRateLimits(RateLimits{
+		Connections: Limit{Rate: 0.01, Burst: 2},
+	}))
+
+	for range 2 {
+		node.challenge(t, "alice")
+	}
+	checkRateLimited(t, node.do(t, http.MethodGet, "/challenge?userID=alice", nil, ""))
+	checkRateLimited(t, node.do(t, http.MethodPost, "/register", newTestUser(t, "bob").registration(), ""))
+
+	if got := node.scrape(t)[`e2e_rate_limited_total{budget="connections"}`]; got != 2 {
+		t.Fatalf("rate limited connections %v, want 2", got)
+	}
+}
+
+func TestKeyFetchLimit(t *testing.T) {
+	node := newTestNode(t, newTestStores(), withRateLimits(RateLimits{
+		KeyFetches: Limit{Rate: 0.01, Burst: 2},
+	}))
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+	token := node.login(t, bob).AccessToken
+
+	for range 2 {
+		if resp := node.do(t, http.MethodGet, "/keys/alice", nil, token); resp.StatusCode != http.StatusOK {
+			t.Fatalf("fetch within budget: %s", resp.Status)
+		}
+	}
+	checkRateLimited(t, node.do(t, http.MethodGet, "/keys/alice", nil, token))
+}
+
+// TestKeyFetchLimitPerUser checks that a user keeps its budget across
+// addresses, and an address across users.
+func TestKeyFetchLimitPerUser(t *testing.T) {
+	node := newTestNode(t, newTestStores(), withRateLimits(RateLimits{
+		KeyFetches: Limit{Rate: 0.01, Burst: 1},
+	}))
+	handler := node.LimitKeyFetches(func(w http.ResponseWriter, r *http.Request) {})
+
+	fetch := func(user, ip string) int {
+		r := httptest.NewRequest(http.MethodGet, "/keys/alice", nil)
+		r.RemoteAddr = ip + ":1234"
+		r = r.WithContext(context.WithValue(r.Context(), claimsKey{}, &tokenClaims{Subject: user}))
+
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec.Code
+	}
+
+	tests := []struct {
+		user, ip string
+		want     int
+	}{
+		{"bob", "10.0.0.1", http.StatusOK},
+		{"bob", "10.0.0.2", http.StatusTooManyRequests},   // same user, new address
+		{"carol", "10.0.0.1", http.StatusTooManyRequests}, // same address, new user
+		{"carol", "10.0.0.3", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := fetch(tt.user, tt.ip); got != tt.want {
+			t.Fatalf("%s from %s: got %d, want %d", tt.user, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestMessageLimit(t *testing.T) {
+	stores := newTestStores()
+	node := newTestNode(t, stores, withRateLimits(RateLimits{
+		Messages: Limit{Rate: 0.01, Burst: 2},
+	}))
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+
+	conn := node.dial(t, alice)
+	for i := range 3 {
+		writeFrame(t, conn, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, fmt.Sprint(i))})
+	}
+
+	accepted := 0
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		var frame model.Frame
+		err := conn.ReadJSON(&frame)
+		if err == nil {
+			if frame.Type == model.FrameAccepted {
+				accepted++
+			}
+			continue
+		}
+
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != model.CloseRateLimited {
+			t.Fatalf("connection ended with %v, want close code %d", err, model.CloseRateLimited)
+		}
+		if wait, ok := model.ParseRetryAfterReason(closeErr.Text); !ok || wait < time.Second {
+			t.Fatalf("close reason %q", closeErr.Text)
+		}
+		break
+	}
+
+	if accepted != 2 {
+		t.Fatalf("%d messages accepted, want 2", accepted)
+	}
+	pending, err := stores.queue.Pending(t.Context(), bob.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("%d messages queued, want 2", len(pending))
+	}
+}
+
+func TestLimiterFailureAllows(t *testing.T) {
+	node := newTestNode(t, newTestStores(), func(s *HttpServer) {
+		s.SetRateLimits(failingLimiter{}, RateLimits{Connections: Limit{Rate: 0.01, Burst: 1}})
+	})
+
+	for range 3 {
+		node.challenge(t, "alice")
+	}
+}
+
+func TestAckUnknownDropped(t *testing.T) {
+	stores := newTestStores()
+	queue := &countingQueue{MessageQueue: stores.queue}
+	stores.queue = queue
+	node := newTestNode(t, stores)
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+
+	sender := node.dial(t, alice)
+	writeFrame(t, sender, &model.Frame{Type: model.FrameMessage, Message: testMessage(alice.name, bob.name, "1")})
+	id := readFrame(t, sender, model.FrameAccepted).Ack.ID
+
+	conn := node.dial(t, bob)
+	readFrame(t, conn, model.FrameMessage)
+
+	// made up, twice, and someone else's
+	for i := range 100 {
+		writeFrame(t, conn, &model.Frame{Type: model.FrameAck, Ack: &model.Ack{ID: fmt.Sprint(i)}})
+	}
+	writeFrame(t, conn, &model.Frame{Type: model.FrameAck, Ack: &model.Ack{ID: id}})
+	writeFrame(t, conn, &model.Frame{Type: model.FrameAck, Ack: &model.Ack{ID: id}})
+	writeFrame(t, sender, &model.Frame{Type: model.FrameAck, Ack: &model.Ack{ID: id}})
+
+	waitFor(t, func() bool {
+		pending, err := stores.queue.Pending(t.Context(), bob.name)
+		return err == nil && len(pending) == 0
+	}, "the message to be acked")
+	conn.Close()
+	sender.Close()
+	node.waitDisconnected(t, bob.name)
+	node.waitDisconnected(t, alice.name)
+
+	if n := queue.acks.Load(); n != 1 {
+		t.Fatalf("%d acks reached storage, want 1", n)
+	}
+}
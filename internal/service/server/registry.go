@@ -0,0 +1,371 @@
+package server
+
+import (
+	"e2e_chat/internal/utils/log"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	outboundBufferSize = 256
+	replayBufferSize   = 16
+	writeWait          = 10 * time.Second
+)
+
+var (
+	errDuplicateConn = errors.New("duplicated userID")
+	errConnNotFound  = errors.New("connection not found")
+	errConnClosed    = errors.New("connection closed")
+	errOutboundFull  = errors.New("outbound queue full")
+)
+
+type (
+	// Client owns a single websocket. All writes go through its outbound
+	// channels and are performed by one writer goroutine, since
+	// gorilla/websocket allows at most one concurrent writer per connection.
+	Client struct {
+		userID   string
+		conn     *websocket.Conn
+		send     chan []byte // frames other than messages
+		messages chan []byte // live messages, written after the backlog
+		replay   chan []byte // backlog
+		done     chan struct{}
+		once     sync.Once
+
+		goAway     chan struct{}
+		goAwayOnce sync.Once
+		closeMsg   []byte // written once goAway is closed
+
+		mu        sync.Mutex
+		replaying bool // live messages are held until the backlog is queued
+		held      []heldMessage
+		delivered map[string]bool // IDs of messages queued here, true once acked
+	}
+
+	heldMessage struct {
+		id   string
+		data []byte
+	}
+
+	// ConnRegistry maps user IDs to their live connection.
+	ConnRegistry struct {
+		mu    sync.RWMutex
+		conns map[string]*Client
+	}
+)
+
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{
+		conns: make(map[string]*Client),
+	}
+}
+
+// Register binds conn to userID and starts its writer goroutine. It fails if
+// the user already has a live connection. Live messages are held back until
+// the caller replays the backlog and calls EndReplay.
+func (r *ConnRegistry) Register(userID string, conn *websocket.Conn) (*Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.conns[userID]; ok {
+		return nil, errDuplicateConn
+	}
+
+	client := &Client{
+		userID:    userID,
+		conn:      conn,
+		send:      make(chan []byte, outboundBufferSize),
+		messages:  make(chan []byte, outboundBufferSize),
+		replay:    make(chan []byte, replayBufferSize),
+		done:      make(chan struct{}),
+		goAway:    make(chan struct{}),
+		replaying: true,
+		delivered: make(map[string]bool),
+	}
+	r.conns[userID] = client
+
+	go client.writePump()
+	return client, nil
+}
+
+// Unregister removes client and closes its connection. It is a no-op if the
+// user has since been bound to a different connection.
+func (r *ConnRegistry) Unregister(client *Client) {
+	r.mu.Lock()
+	if cur, ok := r.conns[client.userID]; ok && cur == client {
+		delete(r.conns, client.userID)
+	}
+	r.mu.Unlock()
+
+	client.Close()
+}
+
+func (r *ConnRegistry) Get(userID string) (*Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	client, ok := r.conns[userID]
+	return client, ok
+}
+
+func (r *ConnRegistry) Has(userID string) bool {
+	_, ok := r.Get(userID)
+	return ok
+}
+
+func (r *ConnRegistry) UserIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.conns))
+	for id := range r.conns {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Clients returns a snapshot of the live connections.
+func (r *ConnRegistry) Clients() []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(r.conns))
+	for _, client := range r.conns {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+func (r *ConnRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.conns)
+}
+
+// Send queues data for userID's connection.
+func (r *ConnRegistry) Send(userID string, data []byte) error {
+	client, ok := r.Get(userID)
+	if !ok {
+		return errConnNotFound
+	}
+	return client.Send(data)
+}
+
+// Send queues a frame other than a message without blocking. A client whose
+// buffer is full is too slow to keep up and gets disconnected.
+func (c *Client) Send(data []byte) error {
+	return c.push(c.send, data)
+}
+
+// SendMessage queues a live message frame. While the backlog is replayed it
+// is held back, so that messages are written in the order they were queued;
+// a message the backlog already carried is not written again.
+func (c *Client) SendMessage(id string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.replaying {
+		c.held = append(c.held, heldMessage{id: id, data: data})
+		return nil
+	}
+	if !c.claim(id) {
+		return nil
+	}
+	return c.push(c.messages, data)
+}
+
+// Replay queues a message from the backlog, waiting up to timeout for the
+// writer to make room. The backlog has its own small buffer, so it is read
+// at the client's pace and a long replay neither drops the client nor
+// crowds out other frames.
+func (c *Client) Replay(id string, data []byte, timeout time.Duration) error {
+	c.mu.Lock()
+	claimed := c.claim(id)
+	c.mu.Unlock()
+
+	if !claimed {
+		return nil
+	}
+	return c.pushWait(data, timeout)
+}
+
+// EndReplay queues the live messages held back during the replay, then
+// lets live messages through.
+func (c *Client) EndReplay(timeout time.Duration) error {
+	for {
+		c.mu.Lock()
+		held := c.held
+		c.held = nil
+		if len(held) == 0 {
+			c.replaying = false
+			c.mu.Unlock()
+			return nil
+		}
+		c.mu.Unlock()
+
+		for _, m := range held {
+			if err := c.Replay(m.id, m.data, timeout); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Acked records the ack of a message queued on this connection. It is false
+// for an ID never delivered here or already acked.
+func (c *Client) Acked(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	acked, ok := c.delivered[id]
+	if !ok || acked {
+		return false
+	}
+	c.delivered[id] = true
+	return true
+}
+
+// claim reports whether the message is new to this connection. The caller
+// holds c.mu.
+func (c *Client) claim(id string) bool {
+	if _, ok := c.delivered[id]; ok {
+		return false
+	}
+	c.delivered[id] = false
+	return true
+}
+
+func (c *Client) push(ch chan []byte, data []byte) error {
+	select {
+	case <-c.done:
+		return errConnClosed
+	case <-c.goAway:
+		return errConnClosed
+	default:
+	}
+
+	select {
+	case ch <- data:
+		return nil
+	case <-c.done:
+		return errConnClosed
+	default:
+		log.Warn("outbound queue full, dropping connection", zap.String("userID", c.userID))
+		c.Close()
+		return errOutboundFull
+	}
+}
+
+func (c *Client) pushWait(data []byte, timeout time.Duration) error {
+	select {
+	case <-c.done:
+		return errConnClosed
+	case <-c.goAway:
+		return errConnClosed
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case c.replay <- data:
+		return nil
+	case <-c.done:
+		return errConnClosed
+	case <-c.goAway:
+		return errConnClosed
+	case <-timer.C:
+		log.Warn("backlog not drained in time, dropping connection", zap.String("userID", c.userID))
+		c.Close()
+		return errOutboundFull
+	}
+}
+
+// Close stops the writer and closes the underlying connection. Safe to call
+// more than once and from any goroutine.
+func (c *Client) Close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// GoAway writes out the frames already queued, then sends a close frame
+// telling the client the server is going away. The connection stays open
+// until the client answers the close or Close is called.
+func (c *Client) GoAway() {
+	c.closeGracefully(websocket.CloseGoingAway, "server going away")
+}
+
+// closeGracefully is GoAway with a custom close code and reason. Only the
+// first call has an effect.
+func (c *Client) closeGracefully(code int, reason string) {
+	c.goAwayOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		close(c.goAway)
+	})
+}
+
+func (c *Client) writePump() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.goAway:
+			c.flush()
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.CloseMessage, c.closeMsg); err != nil {
+				c.Close()
+			}
+			return
+		case data := <-c.send:
+			if !c.write(data) {
+				return
+			}
+		case data := <-c.replay:
+			if !c.write(data) {
+				return
+			}
+		case data := <-c.messages:
+			// live messages are only let through once the backlog is
+			// queued, so whatever is left of it goes first
+			if !c.drain(c.replay) || !c.write(data) {
+				return
+			}
+		}
+	}
+}
+
+// flush writes whatever is buffered without waiting for more.
+func (c *Client) flush() bool {
+	return c.drain(c.send) && c.drain(c.replay) && c.drain(c.messages)
+}
+
+func (c *Client) drain(ch chan []byte) bool {
+	for {
+		select {
+		case data := <-ch:
+			if !c.write(data) {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+func (c *Client) write(data []byte) bool {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Debug("write to web socket failed", zap.String("userID", c.userID), zap.Error(err))
+		c.Close()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"e2e_chat/internal/model"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPeer hands out the server side of websockets whose client side reads
+// and discards everything until closed.
+type wsPeer struct {
+	ts    *httptest.Server
+	conns chan *websocket.Conn
+}
+
+func newWSPeer(t testing.TB) *wsPeer {
+	t.Helper()
+
+	p := &wsPeer{conns: make(chan *websocket.Conn)}
+	var upgrader websocket.Upgrader
+	p.ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		p.conns <- conn
+	}))
+	t.Cleanup(p.ts.Close)
+	return p
+}
+
+func (p *wsPeer) conn(t testing.TB) *websocket.Conn {
+	t.Helper()
+
+	conn, client := p.pair(t)
+	go func() {
+		defer client.Close()
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+// pair returns the server side of a new websocket and its client side.
+func (p *wsPeer) pair(t testing.TB) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(p.ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	conn := <-p.conns
+	t.Cleanup(func() { conn.Close() })
+	return conn, client
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	peer := newWSPeer(t)
+	r := NewConnRegistry()
+
+	first, err := r.Register("alice", peer.conn(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Register("alice", peer.conn(t)); !errors.Is(err, errDuplicateConn) {
+		t.Fatalf("second register: got %v, want %v", err, errDuplicateConn)
+	}
+
+	r.Unregister(first)
+	if r.Has("alice") {
+		t.Fatal("alice still registered")
+	}
+	if err := first.Send([]byte("late")); !errors.Is(err, errConnClosed) {
+		t.Fatalf("send after unregister: got %v, want %v", err, errConnClosed)
+	}
+
+	second, err := r.Register("alice", peer.conn(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stale handler unregistering must not drop the new connection
+	r.Unregister(first)
+	if cur, ok := r.Get("alice"); !ok || cur != second {
+		t.Fatal("stale unregister dropped the new connection")
+	}
+}
+
+// TestReplayOrder checks that live messages are written after the backlog,
+// and that each message is written once.
+func TestReplayOrder(t *testing.T) {
+	peer := newWSPeer(t)
+	r := NewConnRegistry()
+
+	conn, reader := peer.pair(t)
+	client, err := r.Register("bob", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queued while the backlog is read from storage, one of them is in it
+	for _, id := range []string{"2", "3"} {
+		if err := client.SendMessage(id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"1", "2"} {
+		if err := client.Replay(id, []byte(id), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.EndReplay(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"3", "4"} {
+		if err := client.SendMessage(id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader.SetReadDeadline(time.Now().Add(testTimeout))
+	for _, want := range []string{"1", "2", "3", "4"} {
+		_, data, err := reader.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("got message %s, want %s", data, want)
+		}
+	}
+}
+
+// TestRegistryConcurrent hammers the registry with connects, disconnects,
+// sends and lookups at once. Run it with -race.
+func TestRegistryConcurrent(t *testing.T) {
+	const (
+		users   = 8
+		workers = 4
+		rounds  = 50
+	)
+
+	peer := newWSPeer(t)
+	r := NewConnRegistry()
+
+	// enough connections for every round, dialed up front
+	conns := make(chan *websocket.Conn, users*workers*rounds)
+	for range cap(conns) {
+		conns <- peer.conn(t)
+	}
+
+	var wg sync.WaitGroup
+	for u := range users {
+		userID := fmt.Sprintf("user-%d", u)
+
+		for range workers {
+			wg.Add(2)
+
+			// connect and disconnect
+			go func() {
+				defer wg.Done()
+				for range rounds {
+					client, err := r.Register(userID, <-conns)
+					if errors.Is(err, errDuplicateConn) {
+						continue
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if rand.IntN(4) == 0 {
+						client.GoAway()
+					}
+					r.Unregister(client)
+				}
+			}()
+
+			// send to whoever is connected
+			go func() {
+				defer wg.Done()
+				for i := range rounds {
+					err := r.Send(fmt.Sprintf("user-%d", rand.IntN(users)), []byte(fmt.Sprintf(`{"n":%d}`, i)))
+					if err != nil && !errors.Is(err, errConnNotFound) && !errors.Is(err, errConnClosed) && !errors.Is(err, errOutboundFull) {
+						t.Error(err)
+					}
+
+					r.Has(userID)
+					r.UserIDs()
+					r.Len()
+					for _, client := range r.Clients() {
+						client.Send([]byte(`{}`))
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	for _, client := range r.Clients() {
+		r.Unregister(client)
+	}
+	if n := r.Len(); n != 0 {
+		t.Fatalf("%d connections left", n)
+	}
+}
+
+// TestServerConcurrentConnections logs users in and out while others send to
+// them, through the whole server. Run it with -race.
+func TestServerConcurrentConnections(t *testing.T) {
+	const (
+		users  = 6
+		rounds = 5
+	)
+
+	node := newTestNode(t, newTestStores())
+	accounts := make([]*testUser, users)
+	for i := range accounts {
+		accounts[i] = newTestUser(t, fmt.Sprintf("user-%d", i))
+		node.register(t, accounts[i])
+	}
+
+	// challenges are fetched up front, helpers must not fail off the test goroutine
+	type login struct {
+		user *testUser
+		resp *model.AuthResponse
+	}
+	logins := make(chan login, users*rounds)
+	for range rounds {
+		for _, u := range accounts {
+			logins <- login{u, node.signIn(t, u)}
+		}
+	}
+	close(logins)
+
+	var wg sync.WaitGroup
+	for w := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range logins {
+				conn, status := node.dialAs(t, l.resp)
+				if conn == nil {
+					// the same user may still be connected from another worker
+					if status != http.StatusBadRequest {
+						t.Errorf("dial %s: %d", l.user.name, status)
+					}
+					continue
+				}
+
+				for i := range 10 {
+					to := accounts[rand.IntN(users)].name
+					frame := &model.Frame{Type: model.FrameMessage, Message: testMessage(l.user.name, to, fmt.Sprintf("%d-%d", w, i))}
+					if err := conn.WriteJSON(frame); err != nil {
+						break
+					}
+				}
+
+				conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+				for {
+					var frame model.Frame
+					if err := conn.ReadJSON(&frame); err != nil {
+						break
+					}
+				}
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, func() bool { return node.conns.Len() == 0 }, "every connection to close")
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/sealed"
+	"e2e_chat/internal/utils/log"
+	"e2e_chat/internal/utils/validate"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// senderCertificateTTL keeps certificates short-lived: once a user replaces
+// its identity key or device, the old one stops being vouched for within the
+// hour. Clients fetch a new certificate before theirs runs out.
+const senderCertificateTTL = time.Hour
+
+func newCertificateKey() ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("generate certificate key: %v", err))
+	}
+	return priv
+}
+
+// SetCertificateKey replaces the random key that signs sender certificates,
+// e.g. with one persisted across restarts. Clients pin its public half.
+func (s *HttpServer) SetCertificateKey(priv ed25519.PrivateKey) {
+	s.certKey = priv
+}
+
+// CertificateTrustRoot is the public certificate key in the form clients
+// are configured with.
+func (s *HttpServer) CertificateTrustRoot() string {
+	return sealed.FormatTrustRoot(s.certKey.Public().(ed25519.PublicKey))
+}
+
+// sealedScope is where client IDs of sealed messages are remembered. The
+// sender is unknown, so they are kept per recipient.
+func sealedScope(to string) string {
+	return "sealed: " + to
+}
+
+// HandleCertificateKey publishes the key that signs sender certificates.
+func (s *HttpServer) HandleCertificateKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, &model.CertificateKey{
+			PublicKey: s.certKey.Public().(ed25519.PublicKey),
+		})
+	}
+}
+
+// HandleSenderCertificate vouches for the caller's registered identity key
+// on the device it logged in from. Recipients of its sealed messages check
+// the certificate to learn who sent them.
+func (s *HttpServer) HandleSenderCertificate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		claims := claimsFromContext(ctx)
+
+		user, err := s.users.GetByName(ctx, claims.Subject)
+		if err != nil || user == nil {
+			log.Error("Issue sender certificate failed", zap.Error(err))
+			http.Error(w, "Issue sender certificate failed", http.StatusInternalServerError)
+			return
+		}
+
+		ikPub, _, err := publicKeys(user)
+		if err != nil {
+			log.Error("Issue sender certificate failed", zap.Error(err))
+			http.Error(w, "Issue sender certificate failed", http.StatusInternalServerError)
+			return
+		}
+
+		cert := sealed.SignCertificate(s.certKey, user.Name, claims.DeviceID, ikPub, time.Now().Add(senderCertificateTTL))
+		writeJSON(w, http.StatusOK, cert)
+	}
+}
+
+// HandleSealed accepts a sealed message without a login, so the server never
+// links it to a sender. The delivery token must match the one the recipient
+// registered; unknown recipients are refused the same way, so the endpoint
+// does not reveal who exists. The budget is kept per IP.
+func (s *HttpServer) HandleSealed() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if ok, wait := s.allow(ctx, budgetMessages, s.limits.Messages, "ip: "+clientIP(r)); !ok {
+			writeRateLimited(w, wait)
+			return
+		}
+
+		var envelope model.SealedEnvelope
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxFrameSize)
+		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+			http.Error(w, "malformed envelope", http.StatusBadRequest)
+			return
+		}
+
+		if err := validate.Struct(&envelope); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.metrics.messagesReceived.Inc()
+
+		user, err := s.users.GetByName(ctx, envelope.To)
+		if err != nil {
+			log.Error("Deliver sealed message failed", zap.Error(err))
+			http.Error(w, "Deliver sealed message failed", http.StatusInternalServerError)
+			return
+		}
+
+		if user == nil || len(user.DeliveryToken) == 0 || subtle.ConstantTimeCompare(user.DeliveryToken, envelope.DeliveryToken) != 1 {
+			http.Error(w, "delivery not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		message := &model.Message{
+			ClientID: envelope.ClientID,
+			To:       envelope.To,
+			Sealed:   envelope.Sealed,
+			TTL:      envelope.TTL,
+		}
+
+		id, stored, err := s.storeMessage(ctx, sealedScope(envelope.To), message)
+		if err != nil {
+			log.Error("Deliver sealed message failed", zap.Error(err))
+			http.Error(w, "Deliver sealed message failed", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &model.Ack{ID: id, ClientID: envelope.ClientID})
+		if stored {
+			s.deliverLive(ctx, message)
+		}
+	}
+}
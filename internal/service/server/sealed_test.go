@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/sealed"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func sealedEnvelope(to string, token []byte, clientID string) *model.SealedEnvelope {
+	return &model.SealedEnvelope{
+		To:            to,
+		ClientID:      clientID,
+		DeliveryToken: token,
+		Sealed: &model.Sealed{
+			EphemeralPub: make([]byte, 32),
+			Ciphertext:   []byte("sealed " + clientID),
+		},
+	}
+}
+
+func TestSealedDelivery(t *testing.T) {
+	stores := newTestStores()
+	node := newTestNode(t, stores)
+	bob := newTestUser(t, "bob")
+	node.register(t, bob)
+	conn := node.dial(t, bob)
+	node.waitConnected(t, bob.name)
+
+	var acks []model.Ack
+	for range 2 {
+		resp := node.do(t, http.MethodPost, "/sealed", sealedEnvelope(bob.name, bob.deliveryToken, "1"), "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("sealed: %s", resp.Status)
+		}
+		var ack model.Ack
+		if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+			t.Fatal(err)
+		}
+		acks = append(acks, ack)
+	}
+	if acks[0].ID == "" || acks[0] != acks[1] {
+		t.Fatalf("acks %+v, want the same ID for a resend", acks)
+	}
+
+	got := readFrame(t, conn, model.FrameMessage).Message
+	if got.Sealed == nil || got.From != "" || got.Header != nil || got.ID != acks[0].ID {
+		t.Fatalf("delivered %+v", got)
+	}
+
+	pending, err := stores.queue.Pending(t.Context(), bob.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("%d messages queued, want 1", len(pending))
+	}
+}
+
+// TestSealedRefused checks that a wrong token and an unknown recipient get
+// the same answer, so the endpoint does not reveal who is registered.
+func TestSealedRefused(t *testing.T) {
+	stores := newTestStores()
+	node := newTestNode(t, stores)
+	bob := newTestUser(t, "bob")
+	mallory := newTestUser(t, "mallory")
+	node.register(t, bob)
+
+	body := func(resp *http.Response) string {
+		data, _ := io.ReadAll(resp.Body)
+		return string(data)
+	}
+
+	wrong := node.do(t, http.MethodPost, "/sealed", sealedEnvelope(bob.name, mallory.deliveryToken, "1"), "")
+	unknown := node.do(t, http.MethodPost, "/sealed", sealedEnvelope("nobody", mallory.deliveryToken, "2"), "")
+	if wrong.StatusCode != http.StatusUnauthorized || unknown.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong token %s, unknown recipient %s", wrong.Status, unknown.Status)
+	}
+	if body(wrong) != body(unknown) {
+		t.Fatal("a wrong token and an unknown recipient are told apart")
+	}
+
+	invalid := sealedEnvelope(bob.name, bob.deliveryToken[:8], "3")
+	if resp := node.do(t, http.MethodPost, "/sealed", invalid, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("short token: %s", resp.Status)
+	}
+
+	if pending, err := stores.queue.Pending(t.Context(), bob.name); err != nil || len(pending) != 0 {
+		t.Fatalf("refused messages queued: %d, %v", len(pending), err)
+	}
+}
+
+func TestSenderCertificate(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	node.register(t, alice)
+
+	if resp := node.do(t, http.MethodGet, "/certificate", nil, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without a login: %s", resp.Status)
+	}
+
+	var key model.CertificateKey
+	if err := json.NewDecoder(node.do(t, http.MethodGet, "/certificate/key", nil, "").Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	if root, err := sealed.ParseTrustRoot(node.CertificateTrustRoot()); err != nil || !bytes.Equal(root, key.PublicKey) {
+		t.Fatalf("trust root %q does not match the published key: %v", node.CertificateTrustRoot(), err)
+	}
+
+	resp := node.do(t, http.MethodGet, "/certificate", nil, node.login(t, alice).AccessToken)
+	var cert model.SenderCertificate
+	if err := json.NewDecoder(resp.Body).Decode(&cert); err != nil {
+		t.Fatal(err)
+	}
+	if err := sealed.VerifyCertificate(key.PublicKey, &cert, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if cert.Sender != alice.name || cert.DeviceID != alice.deviceID || !bytes.Equal(cert.IdentityKey, alice.ikPub) {
+		t.Fatalf("certificate %+v", cert)
+	}
+	if err := sealed.VerifyCertificate(key.PublicKey, &cert, time.Now().Add(senderCertificateTTL)); err == nil {
+		t.Fatal("certificate outlives its TTL")
+	}
+}
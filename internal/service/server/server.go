@@ -2,42 +2,267 @@ package server
 
 import (
 	"context"
-	"e2e_chat/internal/cryptographic/dh"
+	"crypto/ed25519"
+	"crypto/tls"
 	"e2e_chat/internal/model"
-	userRepo "e2e_chat/internal/repository/user"
-	"e2e_chat/internal/service/redis"
+	"e2e_chat/internal/storage"
 	"e2e_chat/internal/utils/log"
+	"e2e_chat/internal/utils/validate"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
+const (
+	// a client has this long to send the request headers, and the whole
+	// request including an attachment chunk; websockets are not affected
+	// once upgraded
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = time.Minute
+)
+
 type (
 	HttpServer struct {
-		mapper       map[string]*websocket.Conn
-		userRepo     *userRepo.UserRepo
-		redisService *redis.RedisService
+		addr      string
+		tlsConfig *tls.Config
+		nodeID    string
+		conns     *ConnRegistry
+		users     storage.UserStore
+		queue     storage.MessageQueue
+		state     storage.StateStore
+		broker    storage.Broker
+
+		nonces      *nonceCache
+		tokenSecret []byte
+		admins      map[string]bool
+		certKey     ed25519.PrivateKey // signs sender certificates
+
+		srv               *http.Server
+		cancel            context.CancelFunc
+		readHeaderTimeout time.Duration
+		readTimeout       time.Duration
+
+		lifecycleMu sync.Mutex
+		draining    bool
+		handlers    sync.WaitGroup // running websocket handlers
+
+		metrics *serverMetrics
+
+		maxFrameSize int64
+
+		limiter storage.RateLimiter
+		limits  RateLimits
+
+		blobs               storage.BlobStore // nil when attachments are off
+		maxAttachmentSize   int64
+		attachmentRetention time.Duration
+
+		checks    []check
+		startedAt time.Time
+		listening atomic.Bool
 	}
 )
 
-func NewHttpServer(userRepo *userRepo.UserRepo, redisSvc *redis.RedisService) *HttpServer {
+func NewHttpServer(users storage.UserStore, queue storage.MessageQueue, state storage.StateStore, broker storage.Broker) *HttpServer {
+	conns := NewConnRegistry()
+
 	return &HttpServer{
-		mapper:       make(map[string]*websocket.Conn),
-		userRepo:     userRepo,
-		redisService: redisSvc,
+		addr:   "localhost:9090",
+		nodeID: newNodeID(),
+		conns:  conns,
+		users:  users,
+		queue:  queue,
+		state:  state,
+		broker: broker,
+
+		nonces:      newNonceCache(),
+		tokenSecret: newTokenSecret(),
+		admins:      make(map[string]bool),
+		certKey:     newCertificateKey(),
+
+		readHeaderTimeout: readHeaderTimeout,
+		readTimeout:       readTimeout,
+
+		metrics:      newServerMetrics(conns),
+		maxFrameSize: model.DefaultMaxFrameSize,
+		startedAt:    time.Now(),
+	}
+}
+
+// SetAddr sets the host:port the server listens on.
+func (s *HttpServer) SetAddr(addr string) {
+	s.addr = addr
+}
+
+// SetTLSConfig makes Run serve HTTPS and WSS. The config must carry the
+// server certificate.
+func (s *HttpServer) SetTLSConfig(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+// SetMaxFrameSize limits the size in bytes of a websocket frame read from a
+// client. A larger frame closes the connection.
+func (s *HttpServer) SetMaxFrameSize(n int64) {
+	s.maxFrameSize = n
+}
+
+// SetNodeID overrides the random node ID, e.g. to keep it stable across restarts.
+func (s *HttpServer) SetNodeID(nodeID string) {
+	s.nodeID = nodeID
+}
+
+// SetAdmins grants the admin scope to the given users on their next login.
+func (s *HttpServer) SetAdmins(names ...string) {
+	for _, name := range names {
+		s.admins[name] = true
+	}
+}
+
+// Start binds the listener and serves in the background, together with the
+// routing and presence workers. Stop it with Shutdown.
+func (s *HttpServer) Start(ctx context.Context) error {
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	if err := s.consumeRouted(ctx); err != nil {
+		s.cancel()
+		return fmt.Errorf("subscribe to node channel: %w", err)
+	}
+	go s.heartbeat(ctx)
+	if s.blobs != nil {
+		go s.purgeAttachments(ctx)
+	}
+
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		s.cancel()
+		return err
+	}
+
+	s.srv = &http.Server{
+		Handler:           s.routes(),
+		TLSConfig:         s.tlsConfig,
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		ReadTimeout:       s.readTimeout,
 	}
+	s.listening.Store(true)
+
+	go func() {
+		var err error
+		if s.tlsConfig != nil {
+			err = s.srv.ServeTLS(ln, "", "")
+		} else {
+			log.Warn("serving plain HTTP, key fetches and metadata are not protected in transit")
+			err = s.srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("serve failed", zap.Error(err))
+		}
+	}()
+	return nil
 }
 
-func (s *HttpServer) Run() {
+// Shutdown stops accepting connections and tells every websocket client the
+// server is going away, after flushing the frames already queued for it. It
+// then waits for the connection handlers to exit, so every message read from
+// a client has been stored in the offline queue. Connections still open when
+// ctx expires are dropped. It is safe to call when Start failed or was never
+// called.
+func (s *HttpServer) Shutdown(ctx context.Context) error {
+	s.lifecycleMu.Lock()
+	s.draining = true
+	s.lifecycleMu.Unlock()
+
+	// hijacked websockets are not tracked by http.Server, only plain requests
+	var err error
+	if s.srv != nil {
+		err = s.srv.Shutdown(ctx)
+	}
+	s.listening.Store(false)
+
+	for _, client := range s.conns.Clients() {
+		client.GoAway()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("shutdown deadline exceeded, dropping connections", zap.Int("connections", s.conns.Len()))
+		for _, client := range s.conns.Clients() {
+			client.Close()
+		}
+		err = ctx.Err()
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return err
+}
+
+func (s *HttpServer) routes() http.Handler {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/init", s.HandleInitWS()).Methods(http.MethodGet)
-	r.HandleFunc("/keys/{name}", s.GetSharedKeysOfUser()).Methods(http.MethodGet)
-	http.ListenAndServe("localhost:9090", r)
+	r.Handle("/metrics", s.metrics.registry.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/healthz", s.HandleHealthz()).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", s.HandleReadyz()).Methods(http.MethodGet)
+	r.HandleFunc("/register", s.LimitConnections(s.HandleRegister())).Methods(http.MethodPost)
+	r.HandleFunc("/challenge", s.LimitConnections(s.HandleChallenge())).Methods(http.MethodGet)
+	r.HandleFunc("/init", s.LimitConnections(s.HandleInitWS())).Methods(http.MethodGet)
+	r.HandleFunc("/auth/login", s.LimitConnections(s.HandleLogin())).Methods(http.MethodPost)
+	r.HandleFunc("/auth/refresh", s.LimitConnections(s.HandleRefresh())).Methods(http.MethodPost)
+	r.HandleFunc("/certificate/key", s.HandleCertificateKey()).Methods(http.MethodGet)
+	r.HandleFunc("/sealed", s.HandleSealed()).Methods(http.MethodPost)
+
+	api := r.NewRoute().Subrouter()
+	api.Use(s.AuthMiddleware)
+	api.HandleFunc("/auth/revoke", s.HandleRevoke()).Methods(http.MethodPost)
+	api.HandleFunc("/certificate", s.HandleSenderCertificate()).Methods(http.MethodGet)
+	api.HandleFunc("/keys", s.RequireScope(ScopeUploadPrekeys, s.UploadSignedPrekey())).Methods(http.MethodPut)
+	api.HandleFunc("/keys/{name}", s.RequireScope(ScopeFetchKeys, s.LimitKeyFetches(s.GetSharedKeysOfUser()))).Methods(http.MethodGet)
+	api.HandleFunc("/admin/stats", s.RequireScope(ScopeAdmin, s.HandleAdminStats())).Methods(http.MethodGet)
+
+	if s.blobs != nil {
+		api.HandleFunc("/attachments", s.HandleCreateUpload()).Methods(http.MethodPost)
+		api.HandleFunc("/attachments/{id:[0-9a-f]{32}}", s.HandleUploadOffset()).Methods(http.MethodHead)
+		api.HandleFunc("/attachments/{id:[0-9a-f]{32}}", s.HandleUploadChunk()).Methods(http.MethodPatch)
+		api.HandleFunc("/attachments/{id:[0-9a-f]{32}}", s.HandleDownload()).Methods(http.MethodGet)
+	}
+	return r
+}
+
+// beginConn accounts for a new websocket handler, unless the server is
+// draining. Every successful call must be paired with s.handlers.Done.
+func (s *HttpServer) beginConn() bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+
+	if s.draining {
+		return false
+	}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *HttpServer) isDraining() bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+
+	return s.draining
 }
 
 func (s *HttpServer) HandleInitWS() http.HandlerFunc {
@@ -48,54 +273,167 @@ func (s *HttpServer) HandleInitWS() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := r.URL.Query().Get("userID")
+		resp, err := parseAuthResponse(r.URL.Query())
+		if err != nil {
+			http.Error(w, "malformed auth response", http.StatusBadRequest)
+			return
+		}
+
+		userID := resp.UserID
 		if userID == "" {
 			http.Error(w, "userID cannot be empty", http.StatusBadRequest)
 			return
 		}
 
-		if _, ok := s.mapper[userID]; ok {
+		err = s.authenticate(r.Context(), resp)
+		if errors.Is(err, errUnauthorized) {
+			log.Warn("websocket login rejected", zap.String("userID", userID))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err != nil {
+			log.Error("websocket login failed", zap.Error(err))
+			http.Error(w, "login failed", http.StatusInternalServerError)
+			return
+		}
+
+		if s.conns.Has(userID) {
 			http.Error(w, "duplicated userID", http.StatusBadRequest)
 			return
 		}
 
+		owner, err := s.ownerOf(r.Context(), userID)
+		if err != nil {
+			log.Error("lookup presence failed", zap.Error(err))
+			http.Error(w, "login failed", http.StatusInternalServerError)
+			return
+		}
+
+		if owner != "" && owner != s.nodeID {
+			http.Error(w, "duplicated userID", http.StatusBadRequest)
+			return
+		}
+
+		if !s.beginConn() {
+			http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
+			s.handlers.Done()
 			http.Error(w, "Failed to upgrade", http.StatusInternalServerError)
 			return
 		}
+		conn.SetReadLimit(s.maxFrameSize)
 
-		s.mapper[userID] = conn
-		go s.processWSMessage(userID, conn)
-		err = s.ForwardUnsentMessages(userID)
+		// another login for the same user may have won the race since the check above
+		client, err := s.conns.Register(userID, conn)
 		if err != nil {
+			s.handlers.Done()
+			msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			conn.Close()
+			return
+		}
+
+		// Shutdown may have listed the clients before this one registered
+		if s.isDraining() {
+			client.GoAway()
+		}
+
+		if err := s.claimPresence(r.Context(), userID); err != nil {
+			log.Error("claim presence failed", zap.Error(err))
+		}
+
+		go s.processWSMessage(client)
+		err = s.ForwardUnsentMessages(client)
+		if err != nil && !errors.Is(err, errConnClosed) {
 			log.Error("forward msg failed", zap.Error(err))
 		}
 	}
 }
 
-func (s *HttpServer) processWSMessage(userID string, conn *websocket.Conn) {
+func (s *HttpServer) processWSMessage(client *Client) {
+	defer s.handlers.Done()
+	defer func() {
+		s.conns.Unregister(client)
+		if err := s.releasePresence(context.TODO(), client.userID); err != nil {
+			log.Error("release presence failed", zap.Error(err))
+		}
+	}()
+
+	throttled := false
 	for {
-		_, data, err := conn.ReadMessage()
+		_, data, err := client.conn.ReadMessage()
 		if err != nil {
+			// a frame over the read limit also ends here, closed with 1009
 			log.Debug("worker web socket closed", zap.Error(err))
-			delete(s.mapper, userID)
-			conn.Close()
 			break
 		}
 
-		var message model.Message
-		err = json.Unmarshal(data, &message)
+		var frame model.Frame
+		err = json.Unmarshal(data, &frame)
 		if err != nil {
-			log.Error("Unmarshal message failed", zap.Error(err))
+			s.rejectFrame(client, &model.Error{Code: model.ErrorMalformed, Message: "frame is not valid JSON"})
+			continue
 		}
 
-		if conn, ok := s.mapper[message.To]; ok {
-			conn.WriteMessage(websocket.TextMessage, data)
-		} else {
-			if err := s.PutMessagesToCache(context.TODO(), message.To, []*model.Message{&message}); err != nil {
-				log.Error("PutMessagesToCache failed", zap.Error(err))
+		switch frame.Type {
+		case model.FrameMessage:
+			if throttled {
+				continue
+			}
+
+			s.metrics.messagesReceived.Inc()
+			if !s.allowMessage(client) {
+				// ignore what arrives until the client answers the close
+				throttled = true
+				continue
+			}
+
+			if rejected := checkMessage(client, frame.Message); rejected != nil {
+				s.rejectFrame(client, rejected)
+				continue
+			}
+
+			if frame.Message.X3DHHandShake != nil {
+				s.metrics.handshakes.Inc()
+			}
+
+			if err := s.relayMessage(context.TODO(), client, frame.Message); err != nil {
+				log.Error("relay message failed", zap.Error(err))
+				s.rejectFrame(client, &model.Error{
+					Code:     model.ErrorInternal,
+					Message:  "message not stored",
+					ClientID: frame.Message.ClientID,
+				})
+			}
+		case model.FrameAck:
+			if frame.Ack == nil || validate.Struct(frame.Ack) != nil {
+				s.rejectFrame(client, &model.Error{Code: model.ErrorInvalid, Message: "ack: id required"})
+				continue
+			}
+
+			// acks cost a storage write, so only those for messages written
+			// to this connection get that far
+			if !client.Acked(frame.Ack.ID) {
+				log.Debug("ack for a message not delivered here dropped", zap.String("userID", client.userID))
+				s.metrics.framesRejected.Inc(string(model.ErrorInvalid))
+				continue
 			}
+
+			if err := s.queue.Ack(context.TODO(), client.userID, frame.Ack.ID); err != nil {
+				log.Error("ack message failed", zap.Error(err))
+				continue
+			}
+			s.metrics.messagesAcked.Inc()
+		default:
+			s.rejectFrame(client, &model.Error{
+				Code:    model.ErrorMalformed,
+				Message: fmt.Sprintf("unknown frame type %q", frame.Type),
+			})
 		}
 	}
 }
@@ -104,11 +442,18 @@ func (s *HttpServer) GetSharedKeysOfUser() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
+		start := time.Now()
+		result := "error"
+		defer func() {
+			s.metrics.keyFetches.Inc(result)
+			s.metrics.keyFetchLatency.ObserveSince(start)
+		}()
+
 		vars := mux.Vars(r)
 		name := vars["name"]
 		log.Info("GetSharedKeysOfUser: ", zap.String("name", name))
 
-		user, err := s.userRepo.GetByName(ctx, name)
+		user, err := s.users.GetByName(ctx, name)
 		if err != nil {
 			log.Error("Get shared keys failed", zap.Error(err))
 			http.Error(w, "Get shared keys failed", http.StatusInternalServerError)
@@ -116,32 +461,24 @@ func (s *HttpServer) GetSharedKeysOfUser() http.HandlerFunc {
 		}
 
 		if user == nil {
+			result = "not_found"
 			log.Error("Get shared keys failed", zap.Error(fmt.Errorf("user not found")))
 			http.Error(w, "user does not exist", http.StatusBadRequest)
 			return
 		}
 
-		ikPriv, err := dh.ConvertToECDHFormat(user.IKPriv)
+		ikPub, spkPub, err := publicKeys(user)
 		if err != nil {
 			log.Error("Get shared keys failed", zap.Error(err))
 			http.Error(w, "Get shared keys failed", http.StatusInternalServerError)
 			return
 		}
 
-		spkPriv, err := dh.ConvertToECDHFormat(user.SPKPriv)
-		if err != nil {
-			log.Error("Get shared keys failed", zap.Error(err))
-			http.Error(w, "Get shared keys failed", http.StatusInternalServerError)
-			return
-		}
-		// spkPubBytes := spkPriv.PublicKey().Bytes()
-
-		// signature := signature.ED25519Sign(user.IKPriv, spkPubBytes)
-
 		sharedKeys := &model.SharedKey{
-			IKPub:  ikPriv.PublicKey().Bytes(),
-			SPKPub: spkPriv.PublicKey().Bytes(),
-			// Signature: signature,
+			IKPub:     ikPub,
+			SPKPub:    spkPub,
+			Signature: user.SPKSig,
+			SigPub:    user.SigPub,
 		}
 
 		data, err := json.Marshal(sharedKeys)
@@ -151,20 +488,42 @@ func (s *HttpServer) GetSharedKeysOfUser() http.HandlerFunc {
 			return
 		}
 
+		result = "ok"
 		w.WriteHeader(http.StatusOK)
 		w.Write(data)
 	}
 }
 
-func (s *HttpServer) ForwardUnsentMessages(userId string) error {
-	messages, err := s.GetMessagesFromCache(context.TODO(), userId)
+// ForwardUnsentMessages redelivers everything the user has not acked yet,
+// at the pace the client reads it, followed by the live messages held back
+// meanwhile. Messages stay queued until acked, so a failed send only needs
+// to stop here.
+func (s *HttpServer) ForwardUnsentMessages(client *Client) (err error) {
+	defer func() {
+		if endErr := client.EndReplay(writeWait); err == nil {
+			err = endErr
+		}
+	}()
+
+	messages, err := s.queue.Pending(context.TODO(), client.userID)
 	if err != nil {
 		log.Error("ForwardUnsentMessages failed: ", zap.Error(err))
 		return err
 	}
+	s.metrics.queueDepth.Observe(float64(len(messages)))
 
 	for _, message := range messages {
-		s.mapper[userId].WriteJSON(&message)
+		data, err := json.Marshal(&model.Frame{
+			Type:    model.FrameMessage,
+			Message: message,
+		})
+		if err != nil {
+			return err
+		}
+		if err := client.Replay(message.ID, data, writeWait); err != nil {
+			return err
+		}
+		s.metrics.messagesForwarded.Inc()
 	}
 	return nil
 }
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"e2e_chat/internal/cryptographic/dh"
+	"e2e_chat/internal/cryptographic/signature"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/auth"
+	"e2e_chat/internal/protocol/sealed"
+	"e2e_chat/internal/protocol/x3dh"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/memory"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testTimeout = 5 * time.Second
+
+type (
+	// testStores are the backends of one test cluster. Nodes sharing them
+	// behave like nodes sharing Mongo and Redis.
+	testStores struct {
+		users  storage.UserStore
+		queue  storage.MessageQueue
+		state  storage.StateStore
+		broker storage.Broker
+	}
+
+	testNode struct {
+		*HttpServer
+		url string // http://host:port
+	}
+
+	testUser struct {
+		name          string
+		deviceID      string
+		ikPub         []byte
+		spkPub        []byte
+		sigPub        []byte
+		sigPriv       []byte
+		deliveryToken []byte
+	}
+)
+
+func newTestStores() *testStores {
+	return &testStores{
+		users:  memory.NewUserStore(),
+		queue:  memory.NewMessageQueue(storage.DefaultQueueMaxLen, storage.DefaultQueueRetention),
+		state:  memory.NewStateStore(),
+		broker: memory.NewBroker(),
+	}
+}
+
+// newTestNode serves a server on stores over plain HTTP until the test ends,
+// after applying configure.
+func newTestNode(t testing.TB, stores *testStores, configure ...func(*HttpServer)) *testNode {
+	t.Helper()
+
+	s := NewHttpServer(stores.users, stores.queue, stores.state, stores.broker)
+	for _, fn := range configure {
+		fn(s)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.consumeRouted(ctx); err != nil {
+		t.Fatalf("consumeRouted: %v", err)
+	}
+
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(func() {
+		cancel()
+		ts.Close()
+	})
+	return &testNode{HttpServer: s, url: ts.URL}
+}
+
+// startTestNode runs a server on stores through Start, on a free local port,
+// after applying configure. The caller shuts it down.
+func startTestNode(t testing.TB, stores *testStores, configure ...func(*HttpServer)) *testNode {
+	t.Helper()
+
+	s := NewHttpServer(stores.users, stores.queue, stores.state, stores.broker)
+	for _, fn := range configure {
+		fn(s)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s.SetAddr(addr)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	return &testNode{HttpServer: s, url: "http://" + addr}
+}
+
+func newTestUser(t testing.TB, name string) *testUser {
+	t.Helper()
+
+	ikPriv, _, err := dh.NewX25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spkPriv, _, err := dh.NewX25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigPub, sigPriv, err := signature.NewEd25519Keypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	profileKey, err := sealed.NewProfileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveryToken, err := sealed.DeliveryToken(profileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ik, err := dh.ConvertToECDHFormat(ikPriv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, err := dh.ConvertToECDHFormat(spkPriv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testUser{
+		name:          name,
+		deviceID:      "device-" + name,
+		ikPub:         ik.PublicKey().Bytes(),
+		spkPub:        spk.PublicKey().Bytes(),
+		sigPub:        sigPub,
+		sigPriv:       sigPriv,
+		deliveryToken: deliveryToken,
+	}
+}
+
+// registration returns a signed registration of u's keys, made now.
+func (u *testUser) registration() *model.Registration {
+	reg := &model.Registration{
+		Name:   u.name,
+		IKPub:  u.ikPub,
+		SPKPub: u.spkPub,
+		SPKSig: signature.ED25519Sign(u.sigPriv, x3dh.SignedPrekeyPayload(u.ikPub, u.spkPub)),
+		SigPub: u.sigPub,
+
+		DeliveryToken: u.deliveryToken,
+		Timestamp:     time.Now().UnixMilli(),
+	}
+	auth.SignRegistration(u.sigPriv, reg)
+	return reg
+}
+
+// do sends a request with an optional JSON body and bearer token.
+func (n *testNode) do(t testing.TB, method, path string, body any, token string) *http.Response {
+	t.Helper()
+
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, n.url+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func (n *testNode) register(t testing.TB, u *testUser) {
+	t.Helper()
+
+	resp := n.do(t, http.MethodPost, "/register", u.registration(), "")
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("register %s: %s", u.name, resp.Status)
+	}
+}
+
+func (n *testNode) challenge(t testing.TB, name string) []byte {
+	t.Helper()
+
+	resp := n.do(t, http.MethodGet, "/challenge?userID="+url.QueryEscape(name), nil, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("challenge %s: %s", name, resp.Status)
+	}
+
+	var challenge model.AuthChallenge
+	if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	return challenge.Nonce
+}
+
+// signIn answers a fresh challenge for u.
+func (n *testNode) signIn(t testing.TB, u *testUser) *model.AuthResponse {
+	t.Helper()
+	return auth.SignChallenge(u.sigPriv, u.name, u.deviceID, n.challenge(t, u.name), time.Now().Unix())
+}
+
+func (n *testNode) login(t testing.TB, u *testUser) *model.TokenPair {
+	t.Helper()
+
+	resp := n.do(t, http.MethodPost, "/auth/login", n.signIn(t, u), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login %s: %s", u.name, resp.Status)
+	}
+
+	var tokens model.TokenPair
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	return &tokens
+}
+
+// dialAs opens the websocket with a signed response and returns the
+// handshake status, 0 when the server could not be reached, and the
+// connection when it succeeded. It is safe to call off the test goroutine.
+func (n *testNode) dialAs(t testing.TB, resp *model.AuthResponse) (*websocket.Conn, int) {
+	params := url.Values{
+		"userID":    []string{resp.UserID},
+		"deviceID":  []string{resp.DeviceID},
+		"nonce":     []string{base64.RawURLEncoding.EncodeToString(resp.Nonce)},
+		"timestamp": []string{strconv.FormatInt(resp.Timestamp, 10)},
+		"signature": []string{base64.RawURLEncoding.EncodeToString(resp.Signature)},
+	}
+	u := "ws" + strings.TrimPrefix(n.url, "http") + "/init?" + params.Encode()
+
+	conn, hresp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		if hresp == nil {
+			return nil, 0
+		}
+		return nil, hresp.StatusCode
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, http.StatusSwitchingProtocols
+}
+
+func (n *testNode) dial(t testing.TB, u *testUser) *websocket.Conn {
+	t.Helper()
+
+	conn, status := n.dialAs(t, n.signIn(t, u))
+	if conn == nil {
+		t.Fatalf("dial %s: %d", u.name, status)
+	}
+	return conn
+}
+
+// waitConnected waits until the node has registered name's connection,
+// which happens after the websocket handshake completes.
+func (n *testNode) waitConnected(t testing.TB, name string) {
+	t.Helper()
+	waitFor(t, func() bool { return n.conns.Has(name) }, name+" connected")
+}
+
+// waitDisconnected waits until the node has released name's connection,
+// after reading everything the client sent.
+func (n *testNode) waitDisconnected(t testing.TB, name string) {
+	t.Helper()
+	waitFor(t, func() bool { return !n.conns.Has(name) }, name+" disconnected")
+}
+
+func waitFor(t testing.TB, cond func() bool, what string) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testMessage(from, to, clientID string) *model.Message {
+	return &model.Message{
+		ClientID:   clientID,
+		From:       from,
+		To:         to,
+		Header:     &model.Header{},
+		Ciphertext: []byte("ciphertext " + clientID),
+	}
+}
+
+func writeFrame(t testing.TB, conn *websocket.Conn, frame *model.Frame) {
+	t.Helper()
+
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+}
+
+// readFrame returns the next frame of the given type, skipping others.
+func readFrame(t testing.TB, conn *websocket.Conn, typ model.FrameType) *model.Frame {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		var frame model.Frame
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("read %s frame: %v", typ, err)
+		}
+		if frame.Type == typ {
+			return &frame
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/utils/log"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ScopeFetchKeys     = "keys:fetch"
+	ScopeUploadPrekeys = "prekeys:upload"
+	ScopeAdmin         = "admin"
+
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+type (
+	tokenClaims struct {
+		ID        string   `json:"jti"`
+		Subject   string   `json:"sub"`
+		DeviceID  string   `json:"dev"`
+		Scopes    []string `json:"scp"`
+		IssuedAt  int64    `json:"iat"`
+		ExpiresAt int64    `json:"exp"`
+	}
+
+	refreshSession struct {
+		Subject  string `json:"sub"`
+		DeviceID string `json:"dev"`
+	}
+
+	claimsKey struct{}
+)
+
+func (c *tokenClaims) hasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func refreshKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("refresh: %s", hex.EncodeToString(sum[:]))
+}
+
+func revokedKey(jti string) string {
+	return fmt.Sprintf("revoked: %s", jti)
+}
+
+func (s *HttpServer) signToken(claims *tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, s.tokenSecret)
+	mac.Write([]byte(body))
+	return body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (s *HttpServer) parseToken(ctx context.Context, token string) (*tokenClaims, error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errUnauthorized
+	}
+
+	gotMac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+
+	mac := hmac.New(sha256.New, s.tokenSecret)
+	mac.Write([]byte(body))
+	if !hmac.Equal(gotMac, mac.Sum(nil)) {
+		return nil, errUnauthorized
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errUnauthorized
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errUnauthorized
+	}
+
+	_, err = s.state.Get(ctx, revokedKey(claims.ID))
+	if err == nil {
+		return nil, errUnauthorized
+	}
+
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+func (s *HttpServer) scopesFor(userID string) []string {
+	scopes := []string{ScopeFetchKeys, ScopeUploadPrekeys}
+	if s.admins[userID] {
+		scopes = append(scopes, ScopeAdmin)
+	}
+	return scopes
+}
+
+// issueTokens mints a new access token and stores a fresh refresh token.
+func (s *HttpServer) issueTokens(ctx context.Context, userID, deviceID string, scopes []string) (*model.TokenPair, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claims := &tokenClaims{
+		ID:        jti,
+		Subject:   userID,
+		DeviceID:  deviceID,
+		Scopes:    scopes,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(accessTokenTTL).Unix(),
+	}
+
+	access, err := s.signToken(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := json.Marshal(&refreshSession{
+		Subject:  userID,
+		DeviceID: deviceID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.state.Set(ctx, refreshKey(refresh), session, refreshTokenTTL); err != nil {
+		return nil, err
+	}
+
+	return &model.TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresAt:    claims.ExpiresAt,
+		Scopes:       scopes,
+	}, nil
+}
+
+func (s *HttpServer) HandleLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var resp model.AuthResponse
+		if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+			http.Error(w, "malformed auth response", http.StatusBadRequest)
+			return
+		}
+
+		err := s.authenticate(ctx, &resp)
+		if errors.Is(err, errUnauthorized) {
+			log.Warn("login rejected", zap.String("userID", resp.UserID))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err != nil {
+			log.Error("login failed", zap.Error(err))
+			http.Error(w, "login failed", http.StatusInternalServerError)
+			return
+		}
+
+		tokens, err := s.issueTokens(ctx, resp.UserID, resp.DeviceID, s.scopesFor(resp.UserID))
+		if err != nil {
+			log.Error("login failed", zap.Error(err))
+			http.Error(w, "login failed", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, tokens)
+	}
+}
+
+// HandleRefresh rotates a refresh token: the old one is atomically deleted and
+// a new pair is returned, so a leaked refresh token can be used at most once.
+// Scopes are granted anew, so a revoked admin loses the scope on refresh.
+func (s *HttpServer) HandleRefresh() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var req model.RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "malformed refresh request", http.StatusBadRequest)
+			return
+		}
+
+		v, err := s.state.GetDel(ctx, refreshKey(req.RefreshToken))
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err != nil {
+			log.Error("refresh failed", zap.Error(err))
+			http.Error(w, "refresh failed", http.StatusInternalServerError)
+			return
+		}
+
+		var session refreshSession
+		if err := json.Unmarshal(v, &session); err != nil {
+			log.Error("refresh failed", zap.Error(err))
+			http.Error(w, "refresh failed", http.StatusInternalServerError)
+			return
+		}
+
+		tokens, err := s.issueTokens(ctx, session.Subject, session.DeviceID, s.scopesFor(session.Subject))
+		if err != nil {
+			log.Error("refresh failed", zap.Error(err))
+			http.Error(w, "refresh failed", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, tokens)
+	}
+}
+
+// HandleRevoke invalidates the calling access token and, if given, the
+// matching refresh token, which must belong to the same user and device.
+func (s *HttpServer) HandleRevoke() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		claims := claimsFromContext(ctx)
+
+		var req model.RevokeRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "malformed revoke request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if req.RefreshToken != "" {
+			v, err := s.state.Get(ctx, refreshKey(req.RefreshToken))
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, "refresh token not found", http.StatusNotFound)
+				return
+			}
+
+			if err != nil {
+				log.Error("revoke failed", zap.Error(err))
+				http.Error(w, "revoke failed", http.StatusInternalServerError)
+				return
+			}
+
+			var session refreshSession
+			if err := json.Unmarshal(v, &session); err != nil {
+				log.Error("revoke failed", zap.Error(err))
+				http.Error(w, "revoke failed", http.StatusInternalServerError)
+				return
+			}
+
+			if session.Subject != claims.Subject || session.DeviceID != claims.DeviceID {
+				log.Warn("revoke of another session rejected", zap.String("userID", claims.Subject))
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		ttl := time.Until(time.Unix(claims.ExpiresAt, 0))
+		if err := s.state.Set(ctx, revokedKey(claims.ID), []byte("1"), ttl); err != nil {
+			log.Error("revoke failed", zap.Error(err))
+			http.Error(w, "revoke failed", http.StatusInternalServerError)
+			return
+		}
+
+		if req.RefreshToken != "" {
+			if err := s.state.Del(ctx, refreshKey(req.RefreshToken)); err != nil {
+				log.Error("revoke failed", zap.Error(err))
+				http.Error(w, "revoke failed", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AuthMiddleware rejects requests without a valid bearer access token and
+// stores the token claims in the request context.
+func (s *HttpServer) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := s.parseToken(r.Context(), token)
+		if errors.Is(err, errUnauthorized) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err != nil {
+			log.Error("verify token failed", zap.Error(err))
+			http.Error(w, "verify token failed", http.StatusInternalServerError)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsKey{}, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireScope wraps a handler mounted behind AuthMiddleware.
+func (s *HttpServer) RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r.Context())
+		if claims == nil || !claims.hasScope(scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func claimsFromContext(ctx context.Context) *tokenClaims {
+	claims, _ := ctx.Value(claimsKey{}).(*tokenClaims)
+	return claims
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Error("marshal response failed", zap.Error(err))
+		http.Error(w, "marshal response failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// SetTokenSecret replaces the random key that signs access tokens. Nodes
+// behind one address must share it, or a token minted by one is refused by
+// the others; keeping it also keeps tokens valid across restarts.
+func (s *HttpServer) SetTokenSecret(secret []byte) {
+	s.tokenSecret = secret
+}
+
+func newTokenSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
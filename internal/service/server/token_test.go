@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"e2e_chat/internal/model"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAccessToken(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	bob := newTestUser(t, "bob")
+	node.register(t, alice)
+	node.register(t, bob)
+
+	tokens := node.login(t, alice)
+
+	expired, err := node.signToken(&tokenClaims{
+		ID:        "expired",
+		Subject:   alice.name,
+		Scopes:    []string{ScopeFetchKeys},
+		IssuedAt:  time.Now().Add(-2 * accessTokenTTL).Unix(),
+		ExpiresAt: time.Now().Add(-accessTokenTTL).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"valid", tokens.AccessToken, http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"tampered", tokens.AccessToken + "x", http.StatusUnauthorized},
+		{"refresh token", tokens.RefreshToken, http.StatusUnauthorized},
+		{"expired", expired, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := node.do(t, http.MethodGet, "/keys/"+bob.name, nil, tt.token)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got %s, want %d", resp.Status, tt.status)
+			}
+		})
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	node.SetAdmins("root")
+	alice := newTestUser(t, "alice")
+	root := newTestUser(t, "root")
+	node.register(t, alice)
+	node.register(t, root)
+
+	if resp := node.do(t, http.MethodGet, "/admin/stats", nil, node.login(t, alice).AccessToken); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("user: got %s, want 403", resp.Status)
+	}
+	if resp := node.do(t, http.MethodGet, "/admin/stats", nil, node.login(t, root).AccessToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin: got %s, want 200", resp.Status)
+	}
+
+	// a token without the scope, e.g. minted before a downgrade
+	limited, err := node.issueTokens(t.Context(), alice.name, alice.deviceID, []string{ScopeUploadPrekeys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := node.do(t, http.MethodGet, "/keys/"+root.name, nil, limited.AccessToken); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("missing scope: got %s, want 403", resp.Status)
+	}
+}
+
+func TestRefreshRotates(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	node.register(t, alice)
+
+	tokens := node.login(t, alice)
+
+	resp := node.do(t, http.MethodPost, "/auth/refresh", &model.RefreshRequest{RefreshToken: tokens.RefreshToken}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("refresh: %s", resp.Status)
+	}
+
+	var rotated model.TokenPair
+	if err := json.NewDecoder(resp.Body).Decode(&rotated); err != nil {
+		t.Fatal(err)
+	}
+	if rotated.RefreshToken == tokens.RefreshToken || rotated.AccessToken == tokens.AccessToken {
+		t.Fatal("refresh returned the old tokens")
+	}
+	if resp := node.do(t, http.MethodGet, "/keys/"+alice.name, nil, rotated.AccessToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf("rotated access token: %s", resp.Status)
+	}
+
+	if resp := node.do(t, http.MethodPost, "/auth/refresh", &model.RefreshRequest{RefreshToken: tokens.RefreshToken}, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: got %s, want 401", resp.Status)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	node.register(t, alice)
+
+	tokens := node.login(t, alice)
+
+	resp := node.do(t, http.MethodPost, "/auth/revoke", &model.RevokeRequest{RefreshToken: tokens.RefreshToken}, tokens.AccessToken)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke: %s", resp.Status)
+	}
+
+	if resp := node.do(t, http.MethodGet, "/keys/"+alice.name, nil, tokens.AccessToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked access token: got %s, want 401", resp.Status)
+	}
+	if resp := node.do(t, http.MethodPost, "/auth/refresh", &model.RefreshRequest{RefreshToken: tokens.RefreshToken}, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked refresh token: got %s, want 401", resp.Status)
+	}
+}
+
+func TestRefreshRecomputesScopes(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	node.SetAdmins("root")
+	root := newTestUser(t, "root")
+	node.register(t, root)
+
+	tokens := node.login(t, root)
+	delete(node.admins, root.name)
+
+	resp := node.do(t, http.MethodPost, "/auth/refresh", &model.RefreshRequest{RefreshToken: tokens.RefreshToken}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("refresh: %s", resp.Status)
+	}
+
+	var rotated model.TokenPair
+	if err := json.NewDecoder(resp.Body).Decode(&rotated); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(rotated.Scopes, ScopeAdmin) {
+		t.Fatalf("scopes %q kept the admin scope", rotated.Scopes)
+	}
+	if resp := node.do(t, http.MethodGet, "/admin/stats", nil, rotated.AccessToken); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("demoted admin: got %s, want 403", resp.Status)
+	}
+}
+
+func TestRevokeOtherSession(t *testing.T) {
+	node := newTestNode(t, newTestStores())
+	alice := newTestUser(t, "alice")
+	mallory := newTestUser(t, "mallory")
+	node.register(t, alice)
+	node.register(t, mallory)
+
+	victim := node.login(t, alice)
+	attacker := node.login(t, mallory)
+
+	resp := node.do(t, http.MethodPost, "/auth/revoke", &model.RevokeRequest{RefreshToken: victim.RefreshToken}, attacker.AccessToken)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("revoke of another user's token: got %s, want 403", resp.Status)
+	}
+
+	// the same user on another device
+	other := *alice
+	other.deviceID = "other"
+	resp = node.do(t, http.MethodPost, "/auth/revoke", &model.RevokeRequest{RefreshToken: victim.RefreshToken}, node.login(t, &other).AccessToken)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("revoke of another device's token: got %s, want 403", resp.Status)
+	}
+
+	resp = node.do(t, http.MethodPost, "/auth/revoke", &model.RevokeRequest{RefreshToken: "unknown"}, attacker.AccessToken)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("revoke of an unknown token: got %s, want 404", resp.Status)
+	}
+
+	if resp := node.do(t, http.MethodPost, "/auth/refresh", &model.RefreshRequest{RefreshToken: victim.RefreshToken}, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("victim's refresh token: got %s, want 200", resp.Status)
+	}
+}
+
+func TestTokenSecretShared(t *testing.T) {
+	stores := newTestStores()
+	secret := bytes.Repeat([]byte{7}, 32)
+
+	a := newTestNode(t, stores)
+	b := newTestNode(t, stores)
+	c := newTestNode(t, stores)
+	a.SetTokenSecret(secret)
+	b.SetTokenSecret(secret)
+
+	alice := newTestUser(t, "alice")
+	a.register(t, alice)
+	tokens := a.login(t, alice)
+
+	if resp := b.do(t, http.MethodGet, "/keys/"+alice.name, nil, tokens.AccessToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf("node sharing the secret: got %s, want 200", resp.Status)
+	}
+	if resp := c.do(t, http.MethodGet, "/keys/"+alice.name, nil, tokens.AccessToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("node with its own secret: got %s, want 401", resp.Status)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"e2e_chat/internal/cryptographic/dh"
+	"e2e_chat/internal/cryptographic/signature"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/auth"
+	"e2e_chat/internal/protocol/sealed"
+	"e2e_chat/internal/protocol/x3dh"
+	"e2e_chat/internal/utils/log"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const maxNameLength = 64
+
+// publicKeys returns the user's identity and signed prekey public keys.
+// Records created before registration existed only hold the private keys.
+func publicKeys(user *model.User) (ikPub, spkPub []byte, err error) {
+	ikPub, spkPub = user.IKPub, user.SPKPub
+
+	if ikPub == nil {
+		ikPriv, err := dh.ConvertToECDHFormat(user.IKPriv)
+		if err != nil {
+			return nil, nil, err
+		}
+		ikPub = ikPriv.PublicKey().Bytes()
+	}
+
+	if spkPub == nil {
+		spkPriv, err := dh.ConvertToECDHFormat(user.SPKPriv)
+		if err != nil {
+			return nil, nil, err
+		}
+		spkPub = spkPriv.PublicKey().Bytes()
+	}
+
+	return ikPub, spkPub, nil
+}
+
+// HandleRegister publishes a user's public keys. Names are first come, first
+// served: registering again is only allowed with the same signing key, which
+// lets a client re-publish its keys on every start. The registration must be
+// signed with that key and newer than the last one accepted, so a captured
+// request can neither be forged nor replayed to roll the keys back.
+func (s *HttpServer) HandleRegister() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var reg model.Registration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, "malformed registration", http.StatusBadRequest)
+			return
+		}
+
+		if reg.Name == "" || len(reg.Name) > maxNameLength || len(reg.IKPub) != 32 || len(reg.SPKPub) != 32 || len(reg.SigPub) != ed25519.PublicKeySize {
+			http.Error(w, "invalid registration", http.StatusBadRequest)
+			return
+		}
+
+		if len(reg.DeliveryToken) != sealed.DeliveryTokenSize {
+			http.Error(w, "invalid delivery token", http.StatusBadRequest)
+			return
+		}
+
+		if !signature.ED25519Verify(reg.SigPub, x3dh.SignedPrekeyPayload(reg.IKPub, reg.SPKPub), reg.SPKSig) {
+			http.Error(w, "invalid prekey signature", http.StatusBadRequest)
+			return
+		}
+
+		skew := time.Since(time.UnixMilli(reg.Timestamp))
+		if skew > maxClockSkew || skew < -maxClockSkew {
+			http.Error(w, "registration expired", http.StatusBadRequest)
+			return
+		}
+
+		// for a known name, SigPub is checked against the stored key below
+		if !auth.VerifyRegistration(reg.SigPub, &reg) {
+			http.Error(w, "invalid registration signature", http.StatusBadRequest)
+			return
+		}
+
+		user, err := s.users.GetByName(ctx, reg.Name)
+		if err != nil {
+			log.Error("Register user failed", zap.Error(err))
+			http.Error(w, "Register user failed", http.StatusInternalServerError)
+			return
+		}
+
+		if user == nil {
+			err = s.users.Create(ctx, &model.User{
+				Name:   reg.Name,
+				IKPub:  reg.IKPub,
+				SPKPub: reg.SPKPub,
+				SPKSig: reg.SPKSig,
+				SigPub: reg.SigPub,
+
+				DeliveryToken: reg.DeliveryToken,
+				RegisteredAt:  reg.Timestamp,
+			})
+			if err != nil {
+				log.Error("Register user failed", zap.Error(err))
+				http.Error(w, "Register user failed", http.StatusInternalServerError)
+				return
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		if !bytes.Equal(user.SigPub, reg.SigPub) {
+			http.Error(w, "name already taken", http.StatusConflict)
+			return
+		}
+
+		if reg.Timestamp <= user.RegisteredAt {
+			http.Error(w, "registration replayed", http.StatusConflict)
+			return
+		}
+
+		user.IKPub = reg.IKPub
+		user.SPKPub = reg.SPKPub
+		user.SPKSig = reg.SPKSig
+		user.DeliveryToken = reg.DeliveryToken
+		user.RegisteredAt = reg.Timestamp
+		if err := s.users.Update(ctx, user); err != nil {
+			log.Error("Register user failed", zap.Error(err))
+			http.Error(w, "Register user failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// UploadSignedPrekey rotates the caller's signed prekey. The signature must
+// bind the new prekey to the caller's identity key.
+func (s *HttpServer) UploadSignedPrekey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		claims := claimsFromContext(ctx)
+
+		var upload model.PrekeyUpload
+		if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+			http.Error(w, "malformed prekey upload", http.StatusBadRequest)
+			return
+		}
+
+		if len(upload.SPKPub) != 32 {
+			http.Error(w, "invalid signed prekey", http.StatusBadRequest)
+			return
+		}
+
+		user, err := s.users.GetByName(ctx, claims.Subject)
+		if err != nil || user == nil {
+			log.Error("Upload signed prekey failed", zap.Error(err))
+			http.Error(w, "Upload signed prekey failed", http.StatusInternalServerError)
+			return
+		}
+
+		ikPub, _, err := publicKeys(user)
+		if err != nil {
+			log.Error("Upload signed prekey failed", zap.Error(err))
+			http.Error(w, "Upload signed prekey failed", http.StatusInternalServerError)
+			return
+		}
+
+		payload := x3dh.SignedPrekeyPayload(ikPub, upload.SPKPub)
+		if !signature.ED25519Verify(user.SigPub, payload, upload.Signature) {
+			http.Error(w, "invalid prekey signature", http.StatusBadRequest)
+			return
+		}
+
+		user.SPKPub = upload.SPKPub
+		user.SPKSig = upload.Signature
+		if err := s.users.Update(ctx, user); err != nil {
+			log.Error("Upload signed prekey failed", zap.Error(err))
+			http.Error(w, "Upload signed prekey failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
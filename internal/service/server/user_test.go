@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/protocol/auth"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	stores := newTestStores()
+	node := newTestNode(t, stores)
+	alice := newTestUser(t, "alice")
+
+	first := alice.registration()
+	if resp := node.do(t, http.MethodPost, "/register", first, ""); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %s", resp.Status)
+	}
+
+	// a restarted client re-publishes a rotated prekey
+	rotated := newTestUser(t, "alice")
+	alice.spkPub = rotated.spkPub
+	second := alice.registration()
+	second.Timestamp = first.Timestamp + 1
+	auth.SignRegistration(alice.sigPriv, second)
+	if resp := node.do(t, http.MethodPost, "/register", second, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("register again: %s", resp.Status)
+	}
+
+	user, err := stores.users.GetByName(t.Context(), alice.name)
+	if err != nil || user == nil {
+		t.Fatalf("stored user: %v", err)
+	}
+	if !bytes.Equal(user.SPKPub, rotated.spkPub) || user.RegisteredAt != second.Timestamp {
+		t.Fatal("second registration not stored")
+	}
+}
+
+func TestRegisterRejected(t *testing.T) {
+	alice := newTestUser(t, "alice")
+	mallory := newTestUser(t, "mallory")
+
+	// resign applies fn to a fresh registration and signs it again
+	resign := func(fn func(reg *model.Registration)) func(reg *model.Registration) {
+		return func(reg *model.Registration) {
+			fn(reg)
+			auth.SignRegistration(alice.sigPriv, reg)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(reg *model.Registration)
+		want   int
+	}{
+		{"no signature", func(reg *model.Registration) { reg.Signature = nil }, http.StatusBadRequest},
+		{"signed by another key", func(reg *model.Registration) { auth.SignRegistration(mallory.sigPriv, reg) }, http.StatusBadRequest},
+		{"token changed after signing", func(reg *model.Registration) { reg.DeliveryToken = mallory.deliveryToken }, http.StatusBadRequest},
+		{"prekey changed after signing", func(reg *model.Registration) { reg.SPKPub[0] ^= 1 }, http.StatusBadRequest},
+		{"no delivery token", resign(func(reg *model.Registration) { reg.DeliveryToken = nil }), http.StatusBadRequest},
+		{"short delivery token", resign(func(reg *model.Registration) { reg.DeliveryToken = reg.DeliveryToken[:8] }), http.StatusBadRequest},
+		{"stale", resign(func(reg *model.Registration) { reg.Timestamp -= (maxClockSkew + time.Minute).Milliseconds() }), http.StatusBadRequest},
+		{"from the future", resign(func(reg *model.Registration) { reg.Timestamp += (maxClockSkew + time.Minute).Milliseconds() }), http.StatusBadRequest},
+		{"no timestamp", resign(func(reg *model.Registration) { reg.Timestamp = 0 }), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stores := newTestStores()
+			node := newTestNode(t, stores)
+
+			reg := alice.registration()
+			tt.modify(reg)
+			if resp := node.do(t, http.MethodPost, "/register", reg, ""); resp.StatusCode != tt.want {
+				t.Fatalf("got %s, want %d", resp.Status, tt.want)
+			}
+			if user, _ := stores.users.GetByName(t.Context(), alice.name); user != nil {
+				t.Fatal("user stored")
+			}
+		})
+	}
+}
+
+func TestRegisterReplay(t *testing.T) {
+	stores := newTestStores()
+	node := newTestNode(t, stores)
+	alice := newTestUser(t, "alice")
+
+	old := alice.registration()
+	node.do(t, http.MethodPost, "/register", old, "")
+
+	// alice moves to a new prekey
+	alice.spkPub = newTestUser(t, "alice").spkPub
+	current := alice.registration()
+	current.Timestamp = old.Timestamp + 1
+	auth.SignRegistration(alice.sigPriv, current)
+	if resp := node.do(t, http.MethodPost, "/register", current, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("register: %s", resp.Status)
+	}
+
+	for name, reg := range map[string]*model.Registration{"older": old, "same": current} {
+		if resp := node.do(t, http.MethodPost, "/register", reg, ""); resp.StatusCode != http.StatusConflict {
+			t.Fatalf("replaying the %s registration: %s", name, resp.Status)
+		}
+	}
+
+	user, _ := stores.users.GetByName(t.Context(), alice.name)
+	if !bytes.Equal(user.SPKPub, current.SPKPub) {
+		t.Fatal("replay rolled the prekey back")
+	}
+}
+
+func TestRegisterNameTaken(t *testing.T) {
+	stores := newTestStores()
+	node := newTestNode(t, stores)
+	alice := newTestUser(t, "alice")
+	node.register(t, alice)
+
+	// a validly signed registration, but by another key
+	impostor := newTestUser(t, "alice")
+	if resp := node.do(t, http.MethodPost, "/register", impostor.registration(), ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("got %s, want %d", resp.Status, http.StatusConflict)
+	}
+
+	resp := node.do(t, http.MethodGet, "/keys/alice", nil, node.login(t, alice).AccessToken)
+	var keys model.SharedKey
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys.SigPub, alice.sigPub) {
+		t.Fatal("impostor replaced alice's keys")
+	}
+}
@@ -0,0 +1,248 @@
+package file
+
+import (
+	"context"
+	"e2e_chat/internal/storage"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	blobDataExt = ".blob"
+	blobInfoExt = ".json"
+)
+
+type (
+	// BlobStore keeps each attachment blob as a file in a directory, next to
+	// a small JSON file with its owner and declared size. Chunks are appended
+	// to the data file, so its length is the upload offset.
+	BlobStore struct {
+		dir   string
+		mu    sync.Mutex // guards locks and serializes Create and Purge
+		locks map[string]*blobLock
+	}
+
+	// blobLock serializes appends to one blob, so that a slow upload only
+	// holds up itself. Purge skips blobs while they are locked.
+	blobLock struct {
+		mu   sync.Mutex
+		refs int
+	}
+)
+
+// NewBlobStore stores blobs in dir, creating it if needed.
+func NewBlobStore(dir string) (*BlobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &BlobStore{
+		dir:   dir,
+		locks: make(map[string]*blobLock),
+	}, nil
+}
+
+// path returns the file of blob id with ext. IDs are generated by the
+// server, anything that could leave the directory is unknown.
+func (s *BlobStore) path(id, ext string) (string, bool) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", false
+	}
+	return filepath.Join(s.dir, id+ext), true
+}
+
+func (s *BlobStore) Create(ctx context.Context, id string, owner string, size int64) error {
+	infoPath, ok := s.path(id, blobInfoExt)
+	if !ok {
+		return storage.ErrNotFound
+	}
+	dataPath, _ := s.path(id, blobDataExt)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(&storage.BlobInfo{
+		Owner:   owner,
+		Size:    size,
+		Created: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(dataPath, nil, 0o600); err != nil {
+		return err
+	}
+	return writeFileSync(infoPath, data)
+}
+
+// lock takes the lock of blob id.
+func (s *BlobStore) lock(id string) *blobLock {
+	s.mu.Lock()
+	l, ok := s.locks[id]
+	if !ok {
+		l = &blobLock{}
+		s.locks[id] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.mu.Lock()
+	return l
+}
+
+func (s *BlobStore) unlock(id string, l *blobLock) {
+	l.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(s.locks, id)
+	}
+}
+
+func (s *BlobStore) Append(ctx context.Context, id string, offset int64, chunk io.Reader) (int64, error) {
+	if _, ok := s.path(id, blobDataExt); !ok {
+		return 0, storage.ErrNotFound
+	}
+
+	l := s.lock(id)
+	defer s.unlock(id, l)
+
+	info, err := s.Stat(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if offset != info.Offset {
+		return info.Offset, storage.ErrOffsetMismatch
+	}
+
+	dataPath, _ := s.path(id, blobDataExt)
+	f, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return info.Offset, err
+	}
+	defer f.Close()
+
+	// one byte past the declared size tells an oversized chunk apart
+	n, copyErr := io.Copy(f, io.LimitReader(chunk, info.Size-offset+1))
+	if offset+n > info.Size {
+		if err := f.Truncate(offset); err != nil {
+			return offset, err
+		}
+		return offset, storage.ErrBlobTooLarge
+	}
+
+	// what arrived of an interrupted chunk is kept for the resume
+	if err := f.Sync(); err != nil {
+		return offset, err
+	}
+	return offset + n, copyErr
+}
+
+func (s *BlobStore) Stat(ctx context.Context, id string) (*storage.BlobInfo, error) {
+	infoPath, ok := s.path(id, blobInfoExt)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	dataPath, _ := s.path(id, blobDataExt)
+
+	data, err := os.ReadFile(infoPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var info storage.BlobInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(dataPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Offset = fi.Size()
+	return &info, nil
+}
+
+func (s *BlobStore) Open(ctx context.Context, id string) (io.ReadSeekCloser, error) {
+	info, err := s.Stat(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if info.Offset < info.Size {
+		return nil, storage.ErrBlobIncomplete
+	}
+
+	dataPath, _ := s.path(id, blobDataExt)
+	return os.Open(dataPath)
+}
+
+func (s *BlobStore) Purge(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), blobDataExt)
+		if !ok {
+			continue
+		}
+		if _, busy := s.locks[id]; busy {
+			// being written, so not idle for long; the next purge gets it
+			continue
+		}
+
+		info, err := s.Stat(ctx, id)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return n, err
+		}
+		if info != nil && !info.Created.Before(before) {
+			continue
+		}
+
+		infoPath, _ := s.path(id, blobInfoExt)
+		dataPath, _ := s.path(id, blobDataExt)
+		if err := os.Remove(infoPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return n, err
+		}
+		if err := os.Remove(dataPath); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
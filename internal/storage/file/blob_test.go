@@ -0,0 +1,68 @@
+package file
+
+import (
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/storagetest"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBlobStore(t *testing.T) {
+	storagetest.TestBlobStore(t, func(t *testing.T) storage.BlobStore {
+		s, err := NewBlobStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestBlobStoreRejectsPaths(t *testing.T) {
+	s, err := NewBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"", "../owned", `..\owned`, "a/b", ".hidden"} {
+		if err := s.Create(t.Context(), id, "alice", 1); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("create %q: got %v", id, err)
+		}
+		if _, err := s.Stat(t.Context(), id); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("stat %q: got %v", id, err)
+		}
+	}
+}
+
+func TestBlobStorePurgeSkipsUpload(t *testing.T) {
+	s, err := NewBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const id = "0123456789abcdef0123456789abcdef"
+	if err := s.Create(t.Context(), id, "alice", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Append(t.Context(), id, 0, pr)
+		done <- err
+	}()
+	pw.Write([]byte("ab"))
+
+	if n, err := s.Purge(t.Context(), time.Now().Add(time.Hour)); err != nil || n != 0 {
+		t.Fatalf("purge during the upload: got %d, %v", n, err)
+	}
+
+	pw.Write([]byte("cd"))
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Purge(t.Context(), time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Fatalf("purge after the upload: got %d, %v", n, err)
+	}
+}
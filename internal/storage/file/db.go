@@ -0,0 +1,489 @@
+package file
+
+import (
+	"bufio"
+	"e2e_chat/internal/utils/log"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	headerSize = 8 // payload length + CRC32 of the payload
+
+	// compaction kicks in once the log holds this much garbage and the
+	// garbage outweighs the live data
+	compactMinGarbage = 4 << 20
+
+	// expired keys are swept at most this often, and a failed compaction is
+	// retried after compactRetry
+	sweepInterval = time.Second
+	compactRetry  = time.Minute
+
+	maxRecordSize = 64 << 20
+)
+
+var (
+	ErrClosed = errors.New("database closed")
+)
+
+type (
+	// Op is a single change inside a commit.
+	Op struct {
+		Delete    bool   `json:"del,omitempty"`
+		Bucket    string `json:"b"`
+		Key       string `json:"k"`
+		Value     []byte `json:"v,omitempty"`
+		ExpiresAt int64  `json:"exp,omitempty"` // unix nanos, 0 means never
+	}
+
+	// ref locates the latest value of a key inside the log.
+	ref struct {
+		offset    int64 // of the commit record
+		index     int   // of the op inside the commit
+		size      int64 // of the commit record, header included
+		expiresAt int64
+	}
+
+	// DB is an append-only log of commits with an in-memory index of the
+	// latest op for every live key. Each commit is written as one checksummed
+	// record and fsynced before it becomes visible, so a crash loses at most
+	// the commit in flight; a torn tail is cut off when the log is reopened.
+	DB struct {
+		mu      sync.RWMutex
+		path    string
+		f       *os.File
+		size    int64
+		garbage int64
+		index   map[string]map[string]ref
+		live    map[int64]int // live ops per commit offset
+
+		nextSweep   int64 // unix nanos of the earliest expiry, roughly
+		nextCompact int64 // unix nanos before which compaction is not retried
+	}
+)
+
+// Open opens or creates the log at path and rebuilds the index from it.
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		path:  path,
+		f:     f,
+		index: make(map[string]map[string]ref),
+		live:  make(map[int64]int),
+
+		nextSweep: math.MaxInt64,
+	}
+
+	if err := db.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// recover replays the log. Everything after the first record that is short
+// or fails its checksum was never acknowledged and is truncated away.
+func (db *DB) recover() error {
+	r := bufio.NewReader(db.f)
+
+	var offset int64
+	for {
+		ops, size, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			if err := db.f.Truncate(offset); err != nil {
+				return err
+			}
+			if err := db.f.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+
+		db.apply(offset, size, ops)
+		offset += size
+	}
+
+	db.size = offset
+	db.sweep(time.Now().UnixNano())
+
+	if db.garbage > db.size-db.garbage {
+		return db.compact()
+	}
+	return nil
+}
+
+func readRecord(r io.Reader) ([]Op, int64, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, fmt.Errorf("torn header: %w", err)
+		}
+		return nil, 0, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n > maxRecordSize {
+		return nil, 0, fmt.Errorf("record too large: %d", n)
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, fmt.Errorf("torn record: %w", err)
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+
+	var ops []Op
+	if err := json.Unmarshal(payload, &ops); err != nil {
+		return nil, 0, err
+	}
+	return ops, int64(headerSize + n), nil
+}
+
+func encodeRecord(ops []Op) ([]byte, error) {
+	payload, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:headerSize], crc32.ChecksumIEEE(payload))
+	copy(buf[headerSize:], payload)
+	return buf, nil
+}
+
+// apply updates the index for a commit stored at offset. Callers must hold mu
+// for writing.
+func (db *DB) apply(offset, size int64, ops []Op) {
+	live := 0
+	for i, op := range ops {
+		bucket := db.index[op.Bucket]
+		if old, ok := bucket[op.Key]; ok {
+			if old.offset == offset {
+				live-- // written twice in this commit
+			} else {
+				db.release(old)
+			}
+		}
+
+		if op.Delete {
+			delete(bucket, op.Key)
+			continue
+		}
+
+		if bucket == nil {
+			bucket = make(map[string]ref)
+			db.index[op.Bucket] = bucket
+		}
+		bucket[op.Key] = ref{
+			offset:    offset,
+			index:     i,
+			size:      size,
+			expiresAt: op.ExpiresAt,
+		}
+		if op.ExpiresAt != 0 {
+			db.nextSweep = min(db.nextSweep, op.ExpiresAt)
+		}
+		live++
+	}
+
+	if live == 0 {
+		db.garbage += size
+		return
+	}
+	db.live[offset] = live
+}
+
+// release marks a superseded op. A commit becomes garbage once none of its
+// ops is the latest for its key.
+func (db *DB) release(r ref) {
+	db.live[r.offset]--
+	if db.live[r.offset] <= 0 {
+		delete(db.live, r.offset)
+		db.garbage += r.size
+	}
+}
+
+// sweep drops expired keys from the index, so that their commits count as
+// garbage. Callers must hold mu for writing.
+func (db *DB) sweep(now int64) {
+	if now < db.nextSweep {
+		return
+	}
+
+	next := int64(math.MaxInt64)
+	for _, bucket := range db.index {
+		for key, r := range bucket {
+			switch {
+			case r.expiresAt == 0:
+			case r.expiresAt <= now:
+				delete(bucket, key)
+				db.release(r)
+			default:
+				next = min(next, r.expiresAt)
+			}
+		}
+	}
+	db.nextSweep = max(next, now+int64(sweepInterval))
+}
+
+// Commit atomically appends ops and fsyncs them. Once they are durable,
+// Commit succeeds; a failed compaction afterwards is only logged.
+func (db *DB) Commit(ops ...Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	buf, err := encodeRecord(ops)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.f == nil {
+		return ErrClosed
+	}
+
+	if _, err := db.f.WriteAt(buf, db.size); err != nil {
+		return err
+	}
+
+	if err := db.f.Sync(); err != nil {
+		return err
+	}
+
+	offset := db.size
+	db.size += int64(len(buf))
+	db.apply(offset, int64(len(buf)), ops)
+
+	now := time.Now().UnixNano()
+	db.sweep(now)
+
+	if db.garbage > compactMinGarbage && db.garbage > db.size-db.garbage && now >= db.nextCompact {
+		if err := db.compact(); err != nil {
+			log.Error("compact database failed", zap.String("path", db.path), zap.Error(err))
+			db.nextCompact = now + int64(compactRetry)
+		}
+	}
+	return nil
+}
+
+// Get returns the value of key, or ok=false if it is missing or expired.
+func (db *DB) Get(bucket, key string) ([]byte, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.f == nil {
+		return nil, false, ErrClosed
+	}
+
+	r, ok := db.index[bucket][key]
+	if !ok || expired(r.expiresAt) {
+		return nil, false, nil
+	}
+
+	op, err := db.read(r)
+	if err != nil {
+		return nil, false, err
+	}
+	return op.Value, true, nil
+}
+
+// Keys returns the live keys of bucket with the given prefix, sorted.
+func (db *DB) Keys(bucket, prefix string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var keys []string
+	for k, r := range db.index[bucket] {
+		if strings.HasPrefix(k, prefix) && !expired(r.expiresAt) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func (db *DB) read(r ref) (*Op, error) {
+	buf := make([]byte, r.size)
+	if _, err := db.f.ReadAt(buf, r.offset); err != nil {
+		return nil, err
+	}
+
+	var ops []Op
+	if err := json.Unmarshal(buf[headerSize:], &ops); err != nil {
+		return nil, err
+	}
+
+	if r.index >= len(ops) {
+		return nil, errors.New("corrupt index")
+	}
+	return &ops[r.index], nil
+}
+
+// Compact rewrites the log with only the live, unexpired keys.
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.f == nil {
+		return ErrClosed
+	}
+	return db.compact()
+}
+
+// compact writes the live data to a temporary file, fsyncs it and renames it
+// over the log. A crash before the rename leaves the old log untouched.
+func (db *DB) compact() error {
+	tmpPath := db.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]map[string]ref)
+	live := make(map[int64]int)
+	nextSweep := int64(math.MaxInt64)
+	var offset int64
+
+	for name, bucket := range db.index {
+		for key, r := range bucket {
+			if expired(r.expiresAt) {
+				continue
+			}
+
+			op, err := db.read(r)
+			if err != nil {
+				tmp.Close()
+				os.Remove(tmpPath)
+				return err
+			}
+
+			buf, err := encodeRecord([]Op{*op})
+			if err != nil {
+				tmp.Close()
+				os.Remove(tmpPath)
+				return err
+			}
+
+			if _, err := tmp.WriteAt(buf, offset); err != nil {
+				tmp.Close()
+				os.Remove(tmpPath)
+				return err
+			}
+
+			if index[name] == nil {
+				index[name] = make(map[string]ref)
+			}
+			index[name][key] = ref{
+				offset:    offset,
+				size:      int64(len(buf)),
+				expiresAt: r.expiresAt,
+			}
+			live[offset] = 1
+			offset += int64(len(buf))
+			if r.expiresAt != 0 {
+				nextSweep = min(nextSweep, r.expiresAt)
+			}
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, db.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(db.path))
+
+	db.f.Close()
+	db.f = tmp
+	db.size = offset
+	db.garbage = 0
+	db.index = index
+	db.live = live
+	db.nextSweep = nextSweep
+	return nil
+}
+
+// Ping reports whether the log is open and still on disk.
+func (db *DB) Ping() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.f == nil {
+		return ErrClosed
+	}
+
+	_, err := os.Stat(db.path)
+	return err
+}
+
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.f == nil {
+		return nil
+	}
+
+	err := db.f.Close()
+	db.f = nil
+	return err
+}
+
+func expired(expiresAt int64) bool {
+	return expiresAt != 0 && time.Now().UnixNano() >= expiresAt
+}
+
+func expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,253 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, db *DB, bucket, key string) (string, bool) {
+	t.Helper()
+
+	v, ok, err := db.Get(bucket, key)
+	if err != nil {
+		t.Fatalf("get %s/%s: %v", bucket, key, err)
+	}
+	return string(v), ok
+}
+
+func commit(t *testing.T, db *DB, ops ...Op) {
+	t.Helper()
+
+	if err := db.Commit(ops...); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+}
+
+func TestDBCommit(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "e2e.db"))
+
+	commit(t, db,
+		Op{Bucket: "a", Key: "k1", Value: []byte("v1")},
+		Op{Bucket: "a", Key: "k2", Value: []byte("v2")},
+		Op{Bucket: "b", Key: "k1", Value: []byte("other bucket")},
+	)
+	commit(t, db,
+		Op{Bucket: "a", Key: "k1", Value: []byte("v1 again")},
+		Op{Bucket: "a", Key: "k2", Delete: true},
+	)
+
+	if v, ok := get(t, db, "a", "k1"); !ok || v != "v1 again" {
+		t.Fatalf("a/k1 = %q, %v", v, ok)
+	}
+	if _, ok := get(t, db, "a", "k2"); ok {
+		t.Fatal("a/k2 still there after delete")
+	}
+	if v, ok := get(t, db, "b", "k1"); !ok || v != "other bucket" {
+		t.Fatalf("b/k1 = %q, %v", v, ok)
+	}
+	if keys := db.Keys("a", ""); len(keys) != 1 || keys[0] != "k1" {
+		t.Fatalf("keys %q", keys)
+	}
+}
+
+func TestDBRecover(t *testing.T) {
+	tests := []struct {
+		name      string
+		dropsLast bool // the damage hits the last commit, not a write after it
+		corrupt   func(t *testing.T, path string, size int64)
+	}{
+		{"torn header", false, func(t *testing.T, path string, size int64) {
+			appendBytes(t, path, []byte{0, 0, 0})
+		}},
+		{"torn record", false, func(t *testing.T, path string, size int64) {
+			// a header announcing more than was written
+			appendBytes(t, path, []byte{0, 0, 1, 0, 1, 2, 3, 4, '['})
+		}},
+		{"checksum mismatch", true, func(t *testing.T, path string, size int64) {
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			// flip a byte inside the last commit
+			var b [1]byte
+			f.ReadAt(b[:], size-2)
+			b[0] ^= 0xff
+			if _, err := f.WriteAt(b[:], size-2); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "e2e.db")
+
+			db, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			commit(t, db, Op{Bucket: "a", Key: "kept", Value: []byte("v")})
+			good := db.size
+			commit(t, db, Op{Bucket: "a", Key: "last", Value: []byte("v")})
+			size := db.size
+			db.Close()
+
+			tt.corrupt(t, path, size)
+
+			db = openTestDB(t, path)
+			if _, ok := get(t, db, "a", "kept"); !ok {
+				t.Fatal("lost an intact commit")
+			}
+
+			wantSize := size
+			if tt.dropsLast {
+				wantSize = good
+				if _, ok := get(t, db, "a", "last"); ok {
+					t.Fatal("kept a corrupt commit")
+				}
+			}
+			if fi, err := os.Stat(path); err != nil || fi.Size() != wantSize {
+				t.Fatalf("log not truncated to %d: %v, %v", wantSize, fi.Size(), err)
+			}
+
+			// the log keeps working after the cut
+			commit(t, db, Op{Bucket: "a", Key: "after", Value: []byte("v")})
+			db.Close()
+			db = openTestDB(t, path)
+			if _, ok := get(t, db, "a", "after"); !ok {
+				t.Fatal("lost a commit made after recovery")
+			}
+		})
+	}
+}
+
+func appendBytes(t *testing.T, path string, b []byte) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "e2e.db")
+	db := openTestDB(t, path)
+
+	for i := range 100 {
+		commit(t, db,
+			Op{Bucket: "a", Key: "hot", Value: fmt.Appendf(nil, "v%d", i)},
+			Op{Bucket: "a", Key: fmt.Sprintf("cold-%d", i), Value: []byte("v")},
+		)
+	}
+	for i := range 50 {
+		commit(t, db, Op{Bucket: "a", Key: fmt.Sprintf("cold-%d", i), Delete: true})
+	}
+	commit(t, db, Op{Bucket: "a", Key: "gone", Value: []byte("v"), ExpiresAt: time.Now().Add(-time.Second).UnixNano()})
+
+	before := db.size
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if db.size >= before || db.garbage != 0 {
+		t.Fatalf("size %d -> %d, garbage %d", before, db.size, db.garbage)
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+
+		if v, ok := get(t, db, "a", "hot"); !ok || v != "v99" {
+			t.Fatalf("hot = %q, %v", v, ok)
+		}
+		if keys := db.Keys("a", "cold-"); len(keys) != 50 {
+			t.Fatalf("%d cold keys, want 50", len(keys))
+		}
+		if _, ok := get(t, db, "a", "gone"); ok {
+			t.Fatal("expired key survived compaction")
+		}
+	}
+	check(db)
+
+	db.Close()
+	check(openTestDB(t, path))
+}
+
+func TestDBExpiredIsGarbage(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "e2e.db"))
+
+	commit(t, db, Op{Bucket: "a", Key: "short", Value: []byte("v"), ExpiresAt: time.Now().Add(50 * time.Millisecond).UnixNano()})
+	expiring := db.size
+	commit(t, db, Op{Bucket: "a", Key: "long", Value: []byte("v")})
+
+	time.Sleep(100 * time.Millisecond)
+	commit(t, db, Op{Bucket: "a", Key: "other", Value: []byte("v")})
+	if db.garbage != expiring {
+		t.Fatalf("garbage %d after expiry, want %d", db.garbage, expiring)
+	}
+
+	// overwriting the expired key must not count it again
+	commit(t, db, Op{Bucket: "a", Key: "short", Value: []byte("new")})
+	if db.garbage != expiring {
+		t.Fatalf("garbage %d after overwrite, want %d", db.garbage, expiring)
+	}
+	if v, ok := get(t, db, "a", "short"); !ok || v != "new" {
+		t.Fatalf("short = %q, %v", v, ok)
+	}
+}
+
+func TestDBReopenCountsExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "e2e.db")
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		commit(t, db, Op{Bucket: "a", Key: fmt.Sprintf("k%d", i), Value: []byte("v")})
+	}
+	commit(t, db, Op{Bucket: "a", Key: "short", Value: []byte("v"), ExpiresAt: time.Now().Add(50 * time.Millisecond).UnixNano()})
+	db.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	db = openTestDB(t, path)
+	if db.garbage == 0 {
+		t.Fatal("expired commit not counted as garbage after reopening")
+	}
+	if _, ok := get(t, db, "a", "short"); ok {
+		t.Fatal("expired key visible after reopening")
+	}
+}
+
+func TestDBCommitSurvivesFailedCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "e2e.db")
+	db := openTestDB(t, path)
+
+	// the temporary log cannot be created
+	if err := os.Mkdir(path+".compact", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	db.garbage = compactMinGarbage + 1
+
+	commit(t, db, Op{Bucket: "a", Key: "k", Value: []byte("v")})
+	if v, ok := get(t, db, "a", "k"); !ok || v != "v" {
+		t.Fatalf("k = %q, %v", v, ok)
+	}
+	if db.nextCompact == 0 {
+		t.Fatal("failed compaction will be retried on every commit")
+	}
+
+	db.Close()
+	if v, ok := get(t, openTestDB(t, path), "a", "k"); !ok || v != "v" {
+		t.Fatalf("k after reopening = %q, %v", v, ok)
+	}
+}
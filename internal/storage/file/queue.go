@@ -0,0 +1,148 @@
+package file
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const queueBucket = "queue"
+
+type (
+	// MessageQueue stores each message under "<escaped recipient>/<id>". IDs have the
+	// same "<unix millis>-<seq>" shape as stream entry IDs, zero-padded so that
+	// key order is arrival order.
+	MessageQueue struct {
+		db        *DB
+		mu        sync.Mutex
+		lastMs    int64
+		seq       int64
+		maxLen    int
+		retention time.Duration
+	}
+)
+
+func NewMessageQueue(db *DB, maxLen int, retention time.Duration) *MessageQueue {
+	q := &MessageQueue{
+		db:        db,
+		maxLen:    maxLen,
+		retention: retention,
+	}
+	q.restoreSequence()
+	return q
+}
+
+func queuePrefix(to string) string {
+	return url.PathEscape(to) + "/"
+}
+
+// nextID returns a strictly increasing ID. Callers must hold mu.
+func (q *MessageQueue) nextID() string {
+	ms := time.Now().UnixMilli()
+	if ms > q.lastMs {
+		q.lastMs = ms
+		q.seq = 0
+	} else {
+		q.seq++
+	}
+	return fmt.Sprintf("%013d-%06d", q.lastMs, q.seq)
+}
+
+func (q *MessageQueue) Enqueue(ctx context.Context, to string, message *model.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	message.ID = q.nextID()
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	// a disappearing message leaves the queue with its timer
+	expiresAt := expiry(q.retention)
+	if message.TTL > 0 {
+		ttl := expiry(time.Duration(message.TTL) * time.Second)
+		if expiresAt == 0 || ttl < expiresAt {
+			expiresAt = ttl
+		}
+	}
+
+	ops := []Op{{
+		Bucket:    queueBucket,
+		Key:       queuePrefix(to) + message.ID,
+		Value:     data,
+		ExpiresAt: expiresAt,
+	}}
+
+	// drop the oldest entries beyond maxLen in the same commit
+	if q.maxLen > 0 {
+		keys := q.db.Keys(queueBucket, queuePrefix(to))
+		for i := 0; i < len(keys)+1-q.maxLen; i++ {
+			ops = append(ops, Op{
+				Delete: true,
+				Bucket: queueBucket,
+				Key:    keys[i],
+			})
+		}
+	}
+
+	return q.db.Commit(ops...)
+}
+
+func (q *MessageQueue) Pending(ctx context.Context, to string) ([]*model.Message, error) {
+	var res []*model.Message
+	for _, key := range q.db.Keys(queueBucket, queuePrefix(to)) {
+		v, ok, err := q.db.Get(queueBucket, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		var m model.Message
+		if err := json.Unmarshal(v, &m); err != nil {
+			return nil, err
+		}
+		res = append(res, &m)
+	}
+	return res, nil
+}
+
+func (q *MessageQueue) Ack(ctx context.Context, to string, id string) error {
+	return q.db.Commit(Op{
+		Delete: true,
+		Bucket: queueBucket,
+		Key:    queuePrefix(to) + id,
+	})
+}
+
+// restoreSequence continues IDs after the newest one on disk, so that a clock
+// that went backwards across a restart cannot reorder a queue.
+func (q *MessageQueue) restoreSequence() {
+	for _, key := range q.db.Keys(queueBucket, "") {
+		id := key[strings.LastIndex(key, "/")+1:]
+
+		msPart, seqPart, ok := strings.Cut(id, "-")
+		if !ok {
+			continue
+		}
+
+		ms, err1 := strconv.ParseInt(msPart, 10, 64)
+		seq, err2 := strconv.ParseInt(seqPart, 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		if ms > q.lastMs || (ms == q.lastMs && seq > q.seq) {
+			q.lastMs, q.seq = ms, seq
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package file
+
+import (
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/storagetest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMessageQueue(t *testing.T) {
+	storagetest.TestMessageQueue(t, func(t *testing.T, maxLen int, retention time.Duration) storage.MessageQueue {
+		return NewMessageQueue(openTestDB(t, filepath.Join(t.TempDir(), "e2e.db")), maxLen, retention)
+	}, false)
+}
+
+func TestMessageQueueSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "e2e.db")
+
+	db := openTestDB(t, path)
+	q := NewMessageQueue(db, storage.DefaultQueueMaxLen, storage.DefaultQueueRetention)
+	first := &model.Message{From: "alice", To: "bob"}
+	if err := q.Enqueue(t.Context(), "bob", first); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	q = NewMessageQueue(openTestDB(t, path), storage.DefaultQueueMaxLen, storage.DefaultQueueRetention)
+	second := &model.Message{From: "alice", To: "bob"}
+	if err := q.Enqueue(t.Context(), "bob", second); err != nil {
+		t.Fatal(err)
+	}
+	if second.ID <= first.ID {
+		t.Fatalf("ID %s after restart does not follow %s", second.ID, first.ID)
+	}
+
+	messages, err := q.Pending(t.Context(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].ID != first.ID || messages[1].ID != second.ID {
+		t.Fatalf("pending after restart: %+v", messages)
+	}
+}
+
+func openTestDB(t *testing.T, path string) *DB {
+	t.Helper()
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
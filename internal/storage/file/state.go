@@ -0,0 +1,75 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"e2e_chat/internal/storage"
+	"sync"
+	"time"
+)
+
+const stateBucket = "state"
+
+type (
+	StateStore struct {
+		db *DB
+		mu sync.Mutex // makes read-modify-write operations atomic
+	}
+)
+
+func NewStateStore(db *DB) *StateStore {
+	return &StateStore{
+		db: db,
+	}
+}
+
+func (s *StateStore) Get(ctx context.Context, key string) ([]byte, error) {
+	v, ok, err := s.db.Get(stateBucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *StateStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.db.Commit(Op{
+		Bucket:    stateBucket,
+		Key:       key,
+		Value:     value,
+		ExpiresAt: expiry(ttl),
+	})
+}
+
+func (s *StateStore) GetDel(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return v, s.Del(ctx, key)
+}
+
+func (s *StateStore) Del(ctx context.Context, key string) error {
+	return s.db.Commit(Op{
+		Delete: true,
+		Bucket: stateBucket,
+		Key:    key,
+	})
+}
+
+func (s *StateStore) DelIfEqual(ctx context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok, err := s.db.Get(stateBucket, key)
+	if err != nil || !ok || !bytes.Equal(v, value) {
+		return err
+	}
+	return s.Del(ctx, key)
+}
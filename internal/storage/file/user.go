@@ -0,0 +1,88 @@
+package file
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const usersBucket = "users"
+
+type (
+	UserStore struct {
+		db *DB
+		mu sync.Mutex // makes Create's check-and-insert atomic
+	}
+)
+
+func NewUserStore(db *DB) *UserStore {
+	return &UserStore{
+		db: db,
+	}
+}
+
+func (s *UserStore) GetByName(ctx context.Context, name string) (*model.User, error) {
+	v, ok, err := s.db.Get(usersBucket, name)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var user model.User
+	if err := json.Unmarshal(v, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *UserStore) Create(ctx context.Context, user *model.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok, err := s.db.Get(usersBucket, user.Name)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return errors.New("user already exists")
+	}
+
+	user.ID = primitive.NewObjectID()
+	if err := s.put(user); err != nil {
+		user.ID = primitive.NilObjectID
+		return err
+	}
+	return nil
+}
+
+func (s *UserStore) Update(ctx context.Context, user *model.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur, err := s.GetByName(ctx, user.Name)
+	if err != nil {
+		return err
+	}
+
+	if cur == nil || cur.ID != user.ID {
+		return errors.New("user not found")
+	}
+	return s.put(user)
+}
+
+func (s *UserStore) put(user *model.User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Commit(Op{
+		Bucket: usersBucket,
+		Key:    user.Name,
+		Value:  data,
+	})
+}
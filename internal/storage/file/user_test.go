@@ -0,0 +1,14 @@
+package file
+
+import (
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserStore(t *testing.T) {
+	storagetest.TestUserStore(t, func(t *testing.T) storage.UserStore {
+		return NewUserStore(openTestDB(t, filepath.Join(t.TempDir(), "e2e.db")))
+	})
+}
@@ -0,0 +1,13 @@
+package memory
+
+import (
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/storagetest"
+	"testing"
+)
+
+func TestBlobStore(t *testing.T) {
+	storagetest.TestBlobStore(t, func(t *testing.T) storage.BlobStore {
+		return NewBlobStore()
+	})
+}
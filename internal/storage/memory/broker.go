@@ -0,0 +1,63 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+const subscriberBufferSize = 256
+
+type (
+	// Broker is an in-process pub/sub. Several servers sharing one Broker
+	// behave like nodes sharing a Redis instance.
+	Broker struct {
+		mu   sync.RWMutex
+		subs map[string]map[chan []byte]struct{}
+	}
+)
+
+func NewBroker() *Broker {
+	return &Broker{
+		subs: make(map[string]map[chan []byte]struct{}),
+	}
+}
+
+// Publish never blocks: like Redis pub/sub, a subscriber that falls behind
+// loses messages.
+func (b *Broker) Publish(ctx context.Context, channel string, data []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subs[channel] {
+		select {
+		case ch <- bytes.Clone(data):
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *Broker) Subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	ch := make(chan []byte, subscriberBufferSize)
+
+	b.mu.Lock()
+	if b.subs[channel] == nil {
+		b.subs[channel] = make(map[chan []byte]struct{})
+	}
+	b.subs[channel][ch] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.mu.Lock()
+		delete(b.subs[channel], ch)
+		if len(b.subs[channel]) == 0 {
+			delete(b.subs, channel)
+		}
+		b.mu.Unlock()
+		close(ch)
+	}()
+	return ch, nil
+}
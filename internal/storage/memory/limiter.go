@@ -0,0 +1,76 @@
+package memory
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxBuckets triggers a sweep of buckets that have refilled completely, which
+// are indistinguishable from absent ones.
+const maxBuckets = 100000
+
+type (
+	bucket struct {
+		tokens float64
+		rate   float64
+		burst  float64
+		ts     time.Time
+	}
+
+	// RateLimiter keeps token buckets in process memory, so limits only hold
+	// per node.
+	RateLimiter struct {
+		mu      sync.Mutex
+		buckets map[string]*bucket
+	}
+)
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *RateLimiter) Take(_ context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: float64(burst), ts: now}
+		l.buckets[key] = b
+	}
+
+	b.rate, b.burst = rate, float64(burst)
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+
+	wait := time.Duration(math.Ceil((1 - b.tokens) / rate * float64(time.Second)))
+	return false, wait, nil
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.ts).Seconds()*b.rate)
+	b.ts = now
+}
+
+// sweep drops full buckets. Callers must hold mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
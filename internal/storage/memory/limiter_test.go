@@ -0,0 +1,10 @@
+package memory
+
+import (
+	"e2e_chat/internal/storage/storagetest"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	storagetest.TestRateLimiter(t, NewRateLimiter())
+}
@@ -0,0 +1,106 @@
+package memory
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type (
+	queuedMessage struct {
+		message  model.Message
+		queuedAt time.Time
+	}
+
+	// MessageQueue keeps each recipient's unacked messages in arrival order,
+	// bounded by count and age like the Redis Streams queue.
+	MessageQueue struct {
+		mu        sync.Mutex
+		queues    map[string][]queuedMessage
+		seq       uint64
+		maxLen    int
+		retention time.Duration
+	}
+)
+
+func NewMessageQueue(maxLen int, retention time.Duration) *MessageQueue {
+	return &MessageQueue{
+		queues:    make(map[string][]queuedMessage),
+		maxLen:    maxLen,
+		retention: retention,
+	}
+}
+
+func (q *MessageQueue) Enqueue(ctx context.Context, to string, message *model.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	q.seq++
+	// same shape as a stream entry ID, padded so that IDs sort by time as
+	// strings too
+	message.ID = fmt.Sprintf("%013d-%010d", now.UnixMilli(), q.seq)
+
+	queue := append(q.queues[to], queuedMessage{
+		message:  *message,
+		queuedAt: now,
+	})
+	if q.maxLen > 0 && len(queue) > q.maxLen {
+		queue = queue[len(queue)-q.maxLen:]
+	}
+	q.queues[to] = queue
+	return nil
+}
+
+func (q *MessageQueue) Pending(ctx context.Context, to string) ([]*model.Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	queue := q.queues[to]
+	if q.retention > 0 {
+		cutoff := now.Add(-q.retention)
+		for len(queue) > 0 && queue[0].queuedAt.Before(cutoff) {
+			queue = queue[1:]
+		}
+	}
+
+	// disappearing messages expire on their own timer, in any order
+	kept := queue[:0:0]
+	res := make([]*model.Message, 0, len(queue))
+	for _, m := range queue {
+		if m.message.Expired(now) {
+			continue
+		}
+		kept = append(kept, m)
+		cpy := m.message
+		res = append(res, &cpy)
+	}
+
+	if len(kept) == 0 {
+		delete(q.queues, to)
+	} else {
+		q.queues[to] = kept
+	}
+	return res, nil
+}
+
+func (q *MessageQueue) Ack(ctx context.Context, to string, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue := q.queues[to]
+	for i, m := range queue {
+		if m.message.ID == id {
+			q.queues[to] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+
+	if len(q.queues[to]) == 0 {
+		delete(q.queues, to)
+	}
+	return nil
+}
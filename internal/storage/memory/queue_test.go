@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/storagetest"
+	"testing"
+	"time"
+)
+
+func TestMessageQueue(t *testing.T) {
+	storagetest.TestMessageQueue(t, func(t *testing.T, maxLen int, retention time.Duration) storage.MessageQueue {
+		return NewMessageQueue(maxLen, retention)
+	}, false)
+}
@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"e2e_chat/internal/storage"
+	"sync"
+	"time"
+)
+
+type (
+	stateEntry struct {
+		value     []byte
+		expiresAt time.Time // zero means no expiry
+	}
+
+	StateStore struct {
+		mu      sync.Mutex
+		entries map[string]stateEntry
+	}
+)
+
+func NewStateStore() *StateStore {
+	return &StateStore{
+		entries: make(map[string]stateEntry),
+	}
+}
+
+// lookup returns the live entry for key, dropping it if expired. Callers
+// must hold mu.
+func (s *StateStore) lookup(key string) (stateEntry, bool) {
+	e, ok := s.entries[key]
+	if !ok {
+		return e, false
+	}
+
+	if !e.expiresAt.IsZero() && time.Now().After(e.expiresAt) {
+		delete(s.entries, key)
+		return e, false
+	}
+	return e, true
+}
+
+func (s *StateStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.lookup(key)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return bytes.Clone(e.value), nil
+}
+
+func (s *StateStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	e := stateEntry{
+		value: bytes.Clone(value),
+	}
+	if ttl > 0 {
+		e.expiresAt = time.Now().Add(ttl)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = e
+	return nil
+}
+
+func (s *StateStore) GetDel(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.lookup(key)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	delete(s.entries, key)
+	return e.value, nil
+}
+
+func (s *StateStore) Del(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *StateStore) DelIfEqual(ctx context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.lookup(key); ok && bytes.Equal(e.value, value) {
+		delete(s.entries, key)
+	}
+	return nil
+}
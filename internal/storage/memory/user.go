@@ -0,0 +1,64 @@
+package memory
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"errors"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	UserStore struct {
+		mu    sync.RWMutex
+		users map[string]*model.User
+	}
+)
+
+func NewUserStore() *UserStore {
+	return &UserStore{
+		users: make(map[string]*model.User),
+	}
+}
+
+func (s *UserStore) GetByName(ctx context.Context, name string) (*model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[name]
+	if !ok {
+		return nil, nil
+	}
+
+	cpy := *user
+	return &cpy, nil
+}
+
+func (s *UserStore) Create(ctx context.Context, user *model.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user.Name]; ok {
+		return errors.New("user already exists")
+	}
+
+	user.ID = primitive.NewObjectID()
+	cpy := *user
+	s.users[user.Name] = &cpy
+	return nil
+}
+
+func (s *UserStore) Update(ctx context.Context, user *model.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur, ok := s.users[user.Name]
+	if !ok || cur.ID != user.ID {
+		return errors.New("user not found")
+	}
+
+	cpy := *user
+	s.users[user.Name] = &cpy
+	return nil
+}
@@ -0,0 +1,36 @@
+package memory
+
+import (
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"e2e_chat/internal/storage/storagetest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUserStore(t *testing.T) {
+	storagetest.TestUserStore(t, func(t *testing.T) storage.UserStore {
+		return NewUserStore()
+	})
+}
+
+func TestUserStoreCopies(t *testing.T) {
+	s := NewUserStore()
+	user := &model.User{Name: "alice", SPKPub: []byte("spk")}
+	if err := s.Create(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	user.Name = "mallory"
+
+	got, err := s.GetByName(t.Context(), "alice")
+	if err != nil || got == nil {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	got.ID = primitive.NilObjectID
+
+	again, _ := s.GetByName(t.Context(), "alice")
+	if again.Name != "alice" || again.ID == primitive.NilObjectID {
+		t.Fatalf("the store shares its records: %+v", again)
+	}
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"e2e_chat/internal/model"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	DefaultQueueMaxLen    = 10000
+	DefaultQueueRetention = 30 * 24 * time.Hour
+
+	DefaultAttachmentMaxSize = 100 << 20
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+
+	ErrOffsetMismatch = errors.New("upload offset does not match the bytes received")
+	ErrBlobTooLarge   = errors.New("upload exceeds the declared size")
+	ErrBlobIncomplete = errors.New("upload not complete")
+)
+
+type (
+	// UserStore persists user records. GetByName returns nil, nil for an
+	// unknown user. Create sets user.ID.
+	UserStore interface {
+		GetByName(ctx context.Context, name string) (*model.User, error)
+		Create(ctx context.Context, user *model.User) error
+		Update(ctx context.Context, user *model.User) error
+	}
+
+	// MessageQueue holds messages for a recipient until they are acked.
+	// Enqueue assigns message.ID.
+	MessageQueue interface {
+		Enqueue(ctx context.Context, to string, message *model.Message) error
+		Pending(ctx context.Context, to string) ([]*model.Message, error)
+		Ack(ctx context.Context, to string, id string) error
+	}
+
+	// StateStore is a key/value store with optional expiry. A zero ttl means
+	// the key never expires. Get and GetDel return ErrNotFound for a missing key.
+	StateStore interface {
+		Get(ctx context.Context, key string) ([]byte, error)
+		Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+		GetDel(ctx context.Context, key string) ([]byte, error)
+		Del(ctx context.Context, key string) error
+		DelIfEqual(ctx context.Context, key string, value []byte) error
+	}
+
+	// RateLimiter keeps token buckets, shared by all nodes. Take removes one
+	// token from the bucket at key, which refills at rate tokens per second up
+	// to burst. When the bucket is empty it returns false and the time until
+	// the next token.
+	RateLimiter interface {
+		Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error)
+	}
+
+	// BlobInfo describes an uploaded or uploading blob.
+	BlobInfo struct {
+		Owner   string    `json:"owner"`
+		Size    int64     `json:"size"`   // declared when the upload was created
+		Offset  int64     `json:"offset"` // bytes received so far
+		Created time.Time `json:"created"`
+	}
+
+	// BlobStore keeps attachment blobs, which the server only ever sees
+	// encrypted. Create reserves a blob of a fixed size; Append writes a chunk
+	// at offset, which must equal the bytes received so far, and returns the
+	// new offset, so an interrupted upload resumes from Stat. Open returns
+	// ErrBlobIncomplete until every byte arrived. Purge removes blobs created
+	// before the given time.
+	BlobStore interface {
+		Create(ctx context.Context, id string, owner string, size int64) error
+		Append(ctx context.Context, id string, offset int64, chunk io.Reader) (int64, error)
+		Stat(ctx context.Context, id string) (*BlobInfo, error)
+		Open(ctx context.Context, id string) (io.ReadSeekCloser, error)
+		Purge(ctx context.Context, before time.Time) (int, error)
+	}
+
+	// Broker carries payloads between relay nodes.
+	Broker interface {
+		Publish(ctx context.Context, channel string, data []byte) error
+		Subscribe(ctx context.Context, channel string) (<-chan []byte, error)
+	}
+)
@@ -0,0 +1,222 @@
+package storagetest
+
+import (
+	"bytes"
+	"e2e_chat/internal/storage"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBlobID = "0123456789abcdef0123456789abcdef"
+
+type (
+	// brokenReader yields data and then fails, like a dropped connection.
+	brokenReader struct {
+		data []byte
+	}
+)
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// TestBlobStore runs the blob store conformance tests on stores made by
+// newStore.
+func TestBlobStore(t *testing.T, newStore func(t *testing.T) storage.BlobStore) {
+	t.Run("Upload", func(t *testing.T) {
+		s := newStore(t)
+		createBlob(t, s, 10)
+
+		if _, err := s.Open(t.Context(), testBlobID); !errors.Is(err, storage.ErrBlobIncomplete) {
+			t.Fatalf("open empty: got %v, want %v", err, storage.ErrBlobIncomplete)
+		}
+		appendBlob(t, s, 0, "01234", 5)
+		checkOffset(t, s, 5)
+		if _, err := s.Open(t.Context(), testBlobID); !errors.Is(err, storage.ErrBlobIncomplete) {
+			t.Fatalf("open half: got %v, want %v", err, storage.ErrBlobIncomplete)
+		}
+		appendBlob(t, s, 5, "56789", 10)
+		checkContent(t, s, "0123456789")
+
+		info, err := s.Stat(t.Context(), testBlobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Owner != "alice" || info.Size != 10 || info.Created.IsZero() {
+			t.Fatalf("got %+v", info)
+		}
+	})
+
+	t.Run("OffsetMismatch", func(t *testing.T) {
+		s := newStore(t)
+		createBlob(t, s, 10)
+		appendBlob(t, s, 0, "01234", 5)
+
+		for _, offset := range []int64{0, 3, 7} {
+			next, err := s.Append(t.Context(), testBlobID, offset, strings.NewReader("xx"))
+			if !errors.Is(err, storage.ErrOffsetMismatch) || next != 5 {
+				t.Fatalf("append at %d: got %d, %v, want 5, %v", offset, next, err, storage.ErrOffsetMismatch)
+			}
+		}
+		appendBlob(t, s, 5, "56789", 10)
+		checkContent(t, s, "0123456789")
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		s := newStore(t)
+		createBlob(t, s, 10)
+		appendBlob(t, s, 0, "01234", 5)
+
+		next, err := s.Append(t.Context(), testBlobID, 5, strings.NewReader("56789X"))
+		if !errors.Is(err, storage.ErrBlobTooLarge) || next != 5 {
+			t.Fatalf("got %d, %v, want 5, %v", next, err, storage.ErrBlobTooLarge)
+		}
+		checkOffset(t, s, 5)
+	})
+
+	t.Run("Interrupted", func(t *testing.T) {
+		s := newStore(t)
+		createBlob(t, s, 10)
+
+		next, err := s.Append(t.Context(), testBlobID, 0, &brokenReader{data: []byte("0123")})
+		if err == nil || next != 4 {
+			t.Fatalf("got %d, %v, want 4 and an error", next, err)
+		}
+		checkOffset(t, s, 4)
+		appendBlob(t, s, 4, "456789", 10)
+		checkContent(t, s, "0123456789")
+	})
+
+	t.Run("SlowUpload", func(t *testing.T) {
+		s := newStore(t)
+		const other = "fedcba9876543210fedcba9876543210"
+		if err := s.Create(t.Context(), other, "bob", 4); err != nil {
+			t.Fatal(err)
+		}
+		createBlob(t, s, 10)
+
+		// a chunk that trickles in must not hold up other blobs
+		pr, pw := io.Pipe()
+		slow := make(chan error, 1)
+		go func() {
+			_, err := s.Append(t.Context(), other, 0, pr)
+			slow <- err
+		}()
+		pw.Write([]byte("ab"))
+
+		fast := make(chan error, 1)
+		go func() {
+			_, err := s.Append(t.Context(), testBlobID, 0, strings.NewReader("0123456789"))
+			fast <- err
+		}()
+		select {
+		case err := <-fast:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("append blocked by a slow upload of another blob")
+		}
+		checkContent(t, s, "0123456789")
+
+		pw.Write([]byte("cd"))
+		pw.Close()
+		if err := <-slow; err != nil {
+			t.Fatal(err)
+		}
+		info, err := s.Stat(t.Context(), other)
+		if err != nil || info.Offset != 4 {
+			t.Fatalf("slow upload: got %+v, %v", info, err)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		s := newStore(t)
+		ctx := t.Context()
+
+		if _, err := s.Stat(ctx, testBlobID); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("stat: got %v", err)
+		}
+		if _, err := s.Append(ctx, testBlobID, 0, strings.NewReader("x")); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("append: got %v", err)
+		}
+		if _, err := s.Open(ctx, testBlobID); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("open: got %v", err)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		s := newStore(t)
+		createBlob(t, s, 1)
+
+		if n, err := s.Purge(t.Context(), time.Now().Add(-time.Hour)); err != nil || n != 0 {
+			t.Fatalf("purge before creation: got %d, %v", n, err)
+		}
+		checkOffset(t, s, 0)
+
+		if n, err := s.Purge(t.Context(), time.Now().Add(time.Second)); err != nil || n != 1 {
+			t.Fatalf("purge after creation: got %d, %v", n, err)
+		}
+		if _, err := s.Stat(t.Context(), testBlobID); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("stat purged: got %v", err)
+		}
+	})
+}
+
+func createBlob(t *testing.T, s storage.BlobStore, size int64) {
+	t.Helper()
+
+	if err := s.Create(t.Context(), testBlobID, "alice", size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendBlob(t *testing.T, s storage.BlobStore, offset int64, chunk string, want int64) {
+	t.Helper()
+
+	next, err := s.Append(t.Context(), testBlobID, offset, strings.NewReader(chunk))
+	if err != nil {
+		t.Fatalf("append at %d: %v", offset, err)
+	}
+	if next != want {
+		t.Fatalf("append at %d: offset %d, want %d", offset, next, want)
+	}
+}
+
+func checkOffset(t *testing.T, s storage.BlobStore, want int64) {
+	t.Helper()
+
+	info, err := s.Stat(t.Context(), testBlobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Offset != want {
+		t.Fatalf("offset %d, want %d", info.Offset, want)
+	}
+}
+
+func checkContent(t *testing.T, s storage.BlobStore, want string) {
+	t.Helper()
+
+	r, err := s.Open(t.Context(), testBlobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte(want)) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
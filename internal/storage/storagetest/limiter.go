@@ -0,0 +1,104 @@
+package storagetest
+
+import (
+	"e2e_chat/internal/storage"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRateLimiter runs the rate limiter conformance tests on l.
+func TestRateLimiter(t *testing.T, l storage.RateLimiter) {
+	run := rand.Uint32()
+	key := func(t *testing.T, name string) string {
+		return fmt.Sprintf("%s-%s-%d", t.Name(), name, run)
+	}
+
+	t.Run("Burst", func(t *testing.T) {
+		k := key(t, "alice")
+
+		for i := range 3 {
+			if ok, _ := take(t, l, k, 1, 3); !ok {
+				t.Fatalf("take %d of a burst of 3 refused", i+1)
+			}
+		}
+		ok, wait := take(t, l, k, 1, 3)
+		if ok {
+			t.Fatal("took more than the burst")
+		}
+		if wait <= 0 || wait > time.Second {
+			t.Fatalf("wait %v at 1 token per second", wait)
+		}
+	})
+
+	t.Run("Refill", func(t *testing.T) {
+		k := key(t, "alice")
+
+		take(t, l, k, 20, 1)
+		if ok, _ := take(t, l, k, 20, 1); ok {
+			t.Fatal("empty bucket allowed a take")
+		}
+
+		// two tokens worth, capped at the burst
+		time.Sleep(100 * time.Millisecond)
+		if ok, _ := take(t, l, k, 20, 1); !ok {
+			t.Fatal("bucket did not refill")
+		}
+		if ok, _ := take(t, l, k, 20, 1); ok {
+			t.Fatal("bucket refilled beyond the burst")
+		}
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		alice, bob := key(t, "alice"), key(t, "bob")
+
+		take(t, l, alice, 0.001, 1)
+		if ok, _ := take(t, l, bob, 0.001, 1); !ok {
+			t.Fatal("one key drained another")
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const burst = 50
+		k := key(t, "alice")
+
+		var (
+			allowed atomic.Int32
+			wg      sync.WaitGroup
+		)
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 20 {
+					ok, _, err := l.Take(t.Context(), k, 0.001, burst)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ok {
+						allowed.Add(1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := allowed.Load(); n != burst {
+			t.Fatalf("%d takes allowed, want %d", n, burst)
+		}
+	})
+}
+
+func take(t *testing.T, l storage.RateLimiter, key string, rate float64, burst int) (bool, time.Duration) {
+	t.Helper()
+
+	ok, wait, err := l.Take(t.Context(), key, rate, burst)
+	if err != nil {
+		t.Fatalf("take %s: %v", key, err)
+	}
+	return ok, wait
+}
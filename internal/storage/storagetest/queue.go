@@ -0,0 +1,177 @@
+// Package storagetest checks storage implementations against the behaviour
+// the server relies on.
+package storagetest
+
+import (
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+// QueueFactory returns an empty queue bounded by maxLen and retention.
+type QueueFactory func(t *testing.T, maxLen int, retention time.Duration) storage.MessageQueue
+
+const queueRetention = time.Hour
+
+// TestMessageQueue runs the queue conformance tests. approxMaxLen is set for
+// queues that may keep more than maxLen messages for a while, like a Redis
+// stream trimmed with MAXLEN ~.
+func TestMessageQueue(t *testing.T, newQueue QueueFactory, approxMaxLen bool) {
+	// unique recipients, so that a shared server can be reused across runs
+	run := rand.Uint32()
+	recipient := func(t *testing.T, name string) string {
+		return fmt.Sprintf("%s-%s-%d", t.Name(), name, run)
+	}
+
+	t.Run("Order", func(t *testing.T) {
+		q := newQueue(t, storage.DefaultQueueMaxLen, queueRetention)
+		to := recipient(t, "bob")
+
+		sent := enqueue(t, q, to, 5)
+		for i := 1; i < len(sent); i++ {
+			if sent[i] == "" || sent[i] == sent[i-1] {
+				t.Fatalf("enqueue assigned IDs %q", sent)
+			}
+		}
+		if got := pending(t, q, to); !slices.Equal(got, sent) {
+			t.Fatalf("pending %q, want %q", got, sent)
+		}
+	})
+
+	t.Run("RedeliverUntilAck", func(t *testing.T) {
+		q := newQueue(t, storage.DefaultQueueMaxLen, queueRetention)
+		to := recipient(t, "bob")
+
+		sent := enqueue(t, q, to, 3)
+		pending(t, q, to)
+		if got := pending(t, q, to); !slices.Equal(got, sent) {
+			t.Fatalf("second read %q, want %q", got, sent)
+		}
+
+		if err := q.Ack(t.Context(), to, sent[1]); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Ack(t.Context(), to, sent[1]); err != nil {
+			t.Fatalf("second ack: %v", err)
+		}
+		if got, want := pending(t, q, to), []string{sent[0], sent[2]}; !slices.Equal(got, want) {
+			t.Fatalf("after ack %q, want %q", got, want)
+		}
+
+		more := enqueue(t, q, to, 1)
+		if got, want := pending(t, q, to), []string{sent[0], sent[2], more[0]}; !slices.Equal(got, want) {
+			t.Fatalf("after enqueue %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Recipients", func(t *testing.T) {
+		q := newQueue(t, storage.DefaultQueueMaxLen, queueRetention)
+		bob, carol := recipient(t, "bob"), recipient(t, "carol")
+
+		toBob := enqueue(t, q, bob, 2)
+		toCarol := enqueue(t, q, carol, 1)
+
+		if err := q.Ack(t.Context(), carol, toBob[0]); err != nil {
+			t.Fatal(err)
+		}
+		if got := pending(t, q, bob); !slices.Equal(got, toBob) {
+			t.Fatalf("bob %q, want %q", got, toBob)
+		}
+		if got := pending(t, q, carol); !slices.Equal(got, toCarol) {
+			t.Fatalf("carol %q, want %q", got, toCarol)
+		}
+		if got := pending(t, q, recipient(t, "dave")); len(got) != 0 {
+			t.Fatalf("unknown recipient %q", got)
+		}
+	})
+
+	t.Run("MaxLen", func(t *testing.T) {
+		const maxLen = 3
+		q := newQueue(t, maxLen, queueRetention)
+		to := recipient(t, "bob")
+
+		sent := enqueue(t, q, to, 10)
+		got := pending(t, q, to)
+		if !approxMaxLen && len(got) != maxLen {
+			t.Fatalf("kept %d messages, want %d", len(got), maxLen)
+		}
+		if len(got) < maxLen || !slices.Equal(got, sent[len(sent)-len(got):]) {
+			t.Fatalf("kept %q, want the newest of %q", got, sent)
+		}
+	})
+
+	t.Run("Retention", func(t *testing.T) {
+		q := newQueue(t, storage.DefaultQueueMaxLen, 100*time.Millisecond)
+		to := recipient(t, "bob")
+
+		enqueue(t, q, to, 2)
+		time.Sleep(200 * time.Millisecond)
+		fresh := enqueue(t, q, to, 1)
+
+		if got := pending(t, q, to); !slices.Equal(got, fresh) {
+			t.Fatalf("pending %q, want only %q", got, fresh)
+		}
+	})
+
+	t.Run("DisappearingMessages", func(t *testing.T) {
+		q := newQueue(t, storage.DefaultQueueMaxLen, queueRetention)
+		to := recipient(t, "bob")
+
+		short := &model.Message{From: "alice", To: to, TTL: 1, Timestamp: time.Now().UnixMilli()}
+		if err := q.Enqueue(t.Context(), to, short); err != nil {
+			t.Fatal(err)
+		}
+		kept := enqueue(t, q, to, 1)
+
+		if got, want := pending(t, q, to), []string{short.ID, kept[0]}; !slices.Equal(got, want) {
+			t.Fatalf("before the timer %q, want %q", got, want)
+		}
+		time.Sleep(1100 * time.Millisecond)
+		if got := pending(t, q, to); !slices.Equal(got, kept) {
+			t.Fatalf("after the timer %q, want %q", got, kept)
+		}
+	})
+}
+
+// enqueue queues n messages for to and returns the IDs they were given.
+func enqueue(t *testing.T, q storage.MessageQueue, to string, n int) []string {
+	t.Helper()
+
+	ids := make([]string, n)
+	for i := range ids {
+		m := &model.Message{
+			ClientID:   fmt.Sprintf("c%d", i),
+			From:       "alice",
+			To:         to,
+			Ciphertext: []byte{byte(i)},
+			Timestamp:  time.Now().UnixMilli(),
+		}
+		if err := q.Enqueue(t.Context(), to, m); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+func pending(t *testing.T, q storage.MessageQueue, to string) []string {
+	t.Helper()
+
+	messages, err := q.Pending(t.Context(), to)
+	if err != nil {
+		t.Fatalf("pending: %v", err)
+	}
+
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		if m.To != to || m.From != "alice" {
+			t.Fatalf("message %s: from %q to %q", m.ID, m.From, m.To)
+		}
+		ids[i] = m.ID
+	}
+	return ids
+}
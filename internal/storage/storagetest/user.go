@@ -0,0 +1,83 @@
+package storagetest
+
+import (
+	"bytes"
+	"e2e_chat/internal/model"
+	"e2e_chat/internal/storage"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestUserStore runs the user store conformance tests against empty stores.
+func TestUserStore(t *testing.T, newStore func(t *testing.T) storage.UserStore) {
+	run := rand.Uint32()
+	name := func(t *testing.T) string {
+		return fmt.Sprintf("%s-%d", t.Name(), run)
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		s := newStore(t)
+		user := &model.User{Name: name(t), IKPub: []byte("ik"), SigPub: []byte("sig")}
+
+		if got, err := s.GetByName(t.Context(), user.Name); got != nil || err != nil {
+			t.Fatalf("unknown user: got %v, %v", got, err)
+		}
+
+		if err := s.Create(t.Context(), user); err != nil {
+			t.Fatal(err)
+		}
+		if user.ID == primitive.NilObjectID {
+			t.Fatal("create did not set the ID")
+		}
+
+		got, err := s.GetByName(t.Context(), user.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.ID != user.ID || !bytes.Equal(got.IKPub, user.IKPub) || !bytes.Equal(got.SigPub, user.SigPub) {
+			t.Fatalf("got %+v, want %+v", got, user)
+		}
+
+		if err := s.Create(t.Context(), &model.User{Name: user.Name}); err == nil {
+			t.Fatal("created the same name twice")
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		s := newStore(t)
+		user := &model.User{Name: name(t), SPKPub: []byte("old")}
+		if err := s.Create(t.Context(), user); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.GetByName(t.Context(), user.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.SPKPub = []byte("new")
+		if err := s.Update(t.Context(), got); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err = s.GetByName(t.Context(), user.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.SPKPub) != "new" {
+			t.Fatalf("SPKPub %q after update", got.SPKPub)
+		}
+	})
+
+	t.Run("UpdateUnknown", func(t *testing.T) {
+		s := newStore(t)
+		user := &model.User{ID: primitive.NewObjectID(), Name: name(t)}
+
+		s.Update(t.Context(), user)
+		if got, err := s.GetByName(t.Context(), user.Name); got != nil || err != nil {
+			t.Fatalf("update created %v, %v", got, err)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	pinPrefix = "sha256/"
+
+	selfSignedValidity = 365 * 24 * time.Hour
+)
+
+var (
+	ErrPinMismatch = errors.New("server certificate does not match any pinned key")
+)
+
+// Pin returns the SPKI pin of cert: "sha256/" followed by the base64 SHA-256
+// of its DER encoded public key, as used by HPKP and curl --pinnedpubkey.
+func Pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ParsePin checks that pin is in the form produced by Pin.
+func ParsePin(pin string) ([]byte, error) {
+	b64, ok := strings.CutPrefix(pin, pinPrefix)
+	if !ok {
+		return nil, fmt.Errorf("pin must start with %q", pinPrefix)
+	}
+
+	sum, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.New("pin must be a base64 SHA-256 digest")
+	}
+	return sum, nil
+}
+
+// LeafPin returns the SPKI pin of the first certificate in cert.
+func LeafPin(cert *tls.Certificate) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("empty certificate chain")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return Pin(leaf), nil
+}
+
+// SelfSigned creates an ECDSA P-256 certificate for hosts that is its own CA,
+// so clients can trust it directly as a root.
+func SelfSigned(hosts []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "e2e_chat dev"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// LoadOrCreateSelfSigned loads the key pair at certFile and keyFile, creating
+// a self-signed one for hosts first if either is missing. Empty paths keep
+// the generated pair in memory only, so its pin changes on every start.
+func LoadOrCreateSelfSigned(certFile, keyFile string, hosts []string) (tls.Certificate, error) {
+	if certFile != "" && keyFile != "" && exists(certFile) && exists(keyFile) {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+
+	certPEM, keyPEM, err := SelfSigned(hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if certFile != "" && keyFile != "" {
+		if err := writeFile(keyFile, keyPEM, 0o600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := writeFile(certFile, certPEM, 0o644); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// ClientConfig returns a TLS config that trusts the system roots plus the
+// PEM certificates in caFile, if any, and on top of normal verification
+// requires one certificate of the verified chain to match one of pins.
+func ClientConfig(caFile string, pins []string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(pins) > 0 {
+		allowed := make(map[string]bool, len(pins))
+		for _, pin := range pins {
+			if _, err := ParsePin(pin); err != nil {
+				return nil, fmt.Errorf("pin %q: %w", pin, err)
+			}
+			allowed[pin] = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, allowed)
+		}
+	}
+
+	return cfg, nil
+}
+
+// LoadOrCreateEd25519 loads the PEM (PKCS #8) Ed25519 private key at path,
+// generating and writing one first if the file is missing.
+func LoadOrCreateEd25519(path string) (ed25519.PrivateKey, error) {
+	if exists(path) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("%s: no PEM private key found", path)
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+		}
+		return priv, nil
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+func verifyPins(cs tls.ConnectionState, allowed map[string]bool) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if allowed[Pin(cert)] {
+				return nil
+			}
+		}
+	}
+	return ErrPinMismatch
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, perm)
+}
@@ -0,0 +1,198 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testCert struct {
+	cert   tls.Certificate
+	pin    string
+	caFile string
+}
+
+func newTestCert(t *testing.T) *testCert {
+	t.Helper()
+
+	certPEM, keyPEM, err := SelfSigned([]string{"127.0.0.1", "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin, err := LeafPin(&cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, pin: pin, caFile: caFile}
+}
+
+func newTLSServer(t *testing.T, cert tls.Certificate) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestClientConfigPins(t *testing.T) {
+	server := newTestCert(t)
+	rogue := newTestCert(t)
+	ts := newTLSServer(t, server.cert)
+
+	// a bundle trusting both, as if a rogue CA were installed
+	both := filepath.Join(t.TempDir(), "both.pem")
+	serverPEM, _ := os.ReadFile(server.caFile)
+	roguePEM, _ := os.ReadFile(rogue.caFile)
+	if err := os.WriteFile(both, append(serverPEM, roguePEM...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		caFile  string
+		pins    []string
+		wantErr error // checked with errors.Is when set
+		fails   bool
+	}{
+		{"trusted, no pins", server.caFile, nil, nil, false},
+		{"trusted and pinned", server.caFile, []string{server.pin}, nil, false},
+		{"one of several pins", server.caFile, []string{rogue.pin, server.pin}, nil, false},
+		{"trusted, wrong pin", both, []string{rogue.pin}, ErrPinMismatch, true},
+		{"untrusted but pinned", rogue.caFile, []string{server.pin}, nil, true},
+		{"no CA", "", nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ClientConfig(tt.caFile, tt.pins)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+			resp, err := client.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			if tt.fails != (err != nil) {
+				t.Fatalf("got %v, want failure %v", err, tt.fails)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientConfigBadInput(t *testing.T) {
+	if _, err := ClientConfig("", []string{"md5/abc"}); err == nil {
+		t.Fatal("accepted a bad pin")
+	}
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientConfig(notPEM, nil); err == nil {
+		t.Fatal("accepted a CA file without certificates")
+	}
+	if _, err := ClientConfig(filepath.Join(t.TempDir(), "missing.pem"), nil); err == nil {
+		t.Fatal("accepted a missing CA file")
+	}
+}
+
+func TestParsePin(t *testing.T) {
+	cert := newTestCert(t)
+
+	valid := []string{cert.pin}
+	invalid := []string{
+		"",
+		cert.pin[len(pinPrefix):],
+		"sha1/" + cert.pin[len(pinPrefix):],
+		pinPrefix + "not base64!",
+		pinPrefix + "AAAA",
+	}
+
+	for _, pin := range valid {
+		if _, err := ParsePin(pin); err != nil {
+			t.Errorf("ParsePin(%q): %v", pin, err)
+		}
+	}
+	for _, pin := range invalid {
+		if _, err := ParsePin(pin); err == nil {
+			t.Errorf("ParsePin(%q) accepted", pin)
+		}
+	}
+}
+
+func TestLoadOrCreateSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls", "cert.pem"), filepath.Join(dir, "tls", "key.pem")
+
+	first, err := LoadOrCreateSelfSigned(certFile, keyFile, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadOrCreateSelfSigned(certFile, keyFile, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pin1, _ := LeafPin(&first)
+	pin2, _ := LeafPin(&second)
+	if pin1 != pin2 {
+		t.Fatal("the saved pair was not reused, the pin changed")
+	}
+
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("key file mode: %v, %v", fi, err)
+	}
+
+	// in memory only, a fresh pair every time
+	a, _ := LoadOrCreateSelfSigned("", "", []string{"localhost"})
+	b, _ := LoadOrCreateSelfSigned("", "", []string{"localhost"})
+	pinA, _ := LeafPin(&a)
+	pinB, _ := LeafPin(&b)
+	if pinA == pinB {
+		t.Fatal("in-memory pairs are reused")
+	}
+}
+
+func TestLoadOrCreateEd25519(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "certificate_key.pem")
+
+	first, err := LoadOrCreateEd25519(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadOrCreateEd25519(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Equal(second) {
+		t.Fatal("the saved key was not reused")
+	}
+
+	if err := os.WriteFile(path, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateEd25519(path); err == nil {
+		t.Fatal("accepted a corrupt key file")
+	}
+}
@@ -0,0 +1,128 @@
+// Package validate checks structs against their `validate` tags.
+//
+// Supported rules, comma separated:
+//
+//	required  the field is not its zero value
+//	len=N     a string, slice or map has exactly N elements
+//	min=N     a number is at least N, a string, slice or map has at least N elements
+//	max=N     a number is at most N, a string, slice or map has at most N elements
+//
+// Nested structs and non-nil pointers to structs are checked too. Fields are
+// named in errors by their json name, since that is what clients send.
+package validate
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type (
+	// FieldError reports the first field of a struct that broke a rule.
+	FieldError struct {
+		Field string
+		Rule  string
+	}
+)
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: failed %s", e.Field, e.Rule)
+}
+
+// Struct validates v, a struct or a pointer to one.
+func Struct(v any) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return &FieldError{Field: "(root)", Rule: "required"}
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("validate: %s is not a struct", rv.Type())
+	}
+	return checkStruct(rv, "")
+}
+
+func checkStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		name := prefix + fieldName(sf)
+		fv := v.Field(i)
+
+		for _, rule := range strings.Split(sf.Tag.Get("validate"), ",") {
+			if rule == "" {
+				continue
+			}
+			ok, err := apply(fv, rule)
+			if err != nil {
+				return fmt.Errorf("validate: field %s: %w", name, err)
+			}
+			if !ok {
+				return &FieldError{Field: name, Rule: rule}
+			}
+		}
+
+		if fv.Kind() == reflect.Pointer && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct {
+			if err := checkStruct(fv, name+"."); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func apply(v reflect.Value, rule string) (bool, error) {
+	name, arg, _ := strings.Cut(rule, "=")
+
+	switch name {
+	case "required":
+		return !v.IsZero(), nil
+	case "len", "min", "max":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("bad rule %q", rule)
+		}
+
+		var size int64
+		switch v.Kind() {
+		case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+			size = int64(v.Len())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if name == "len" {
+				return false, fmt.Errorf("rule %q on %s", rule, v.Type())
+			}
+			size = v.Int()
+		default:
+			return false, fmt.Errorf("rule %q on %s", rule, v.Type())
+		}
+
+		switch name {
+		case "len":
+			return size == n, nil
+		case "min":
+			return size >= n, nil
+		default:
+			return size <= n, nil
+		}
+	default:
+		return false, fmt.Errorf("unknown rule %q", rule)
+	}
+}
+
+func fieldName(sf reflect.StructField) string {
+	name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return sf.Name
+	}
+	return name
+}